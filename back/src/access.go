@@ -0,0 +1,194 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/AndrewBurian/powermux"
+	"github.com/palantir/stacktrace"
+)
+
+// Works councils want to know who looked at whose time records, so every successful read on /a is
+// logged in access_log with the reader, the user whose records it was if the route has a /users/:id,
+// and the route. Only that is kept, not what was read, and only for accessLogDays, after which
+// the nightly prune deletes it. Auditors can search the log, users see who read their records.
+
+const defaultAccessLogDays = 365
+
+var accessLogDays = defaultAccessLogDays
+
+// accessLogDaysFromEnv reads WMS2_ACCESS_LOG_DAYS, how many days reads are logged for
+func accessLogDaysFromEnv() int {
+	s := os.Getenv("WMS2_ACCESS_LOG_DAYS")
+	if s == "" {
+		return defaultAccessLogDays
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n <= 0 {
+		logWarning(stacktrace.NewError("invalid WMS2_ACCESS_LOG_DAYS %q, using %d", s, defaultAccessLogDays))
+		return defaultAccessLogDays
+	}
+	return n
+}
+
+type accessEvent struct {
+	ACID  int    `json:"acid"`
+	At    int64  `json:"at"`
+	By    uidT   `json:"by"`
+	UID   uidT   `json:"uid"`   // 0 for reads across users, like a report for a site
+	Route string `json:"route"` // like GET /a/users/:id/reports/month
+	Path  string `json:"path"`  // like /a/users/3/reports/month
+
+	BreakGlass int `json:"breakGlass,omitempty"` // the grant the request was made under, see breakglass.go
+}
+
+func logAccess(db *sql.DB, ev accessEvent) (err error) {
+	var uid interface{}
+	if ev.UID != 0 {
+		uid = ev.UID
+	}
+	var bgid interface{}
+	if ev.BreakGlass != 0 {
+		bgid = ev.BreakGlass
+	}
+	_, err = db.Exec("INSERT INTO access_log (at_unix_s, by_uid, uid, route, path, break_glass) VALUES (?1, ?2, ?3, ?4, ?5, ?6)",
+		ev.At, ev.By, uid, ev.Route, ev.Path, bgid)
+	return stacktrace.Propagate(err, "failed to log access")
+}
+
+// accessFilter narrows down listAccess, zero values don't filter
+type accessFilter struct {
+	UID        uidT
+	By         uidT
+	BreakGlass int
+	From, To   int64 // unix times, To is exclusive
+}
+
+// listAccess returns up to limit reads matching the filter after skipping offset of them, newest first.
+// more is set if there are more after them.
+func listAccess(db *sql.DB, filter accessFilter, offset, limit int) (evs []accessEvent, more bool, err error) {
+	query := `SELECT acid, at_unix_s, by_uid, IFNULL(uid, 0), route, path, IFNULL(break_glass, 0) FROM access_log
+		WHERE at_unix_s >= ? AND at_unix_s < ?`
+	args := []interface{}{filter.From, filter.To}
+	if filter.UID != 0 {
+		query += " AND uid = ?"
+		args = append(args, filter.UID)
+	}
+	if filter.By != 0 {
+		query += " AND by_uid = ?"
+		args = append(args, filter.By)
+	}
+	if filter.BreakGlass != 0 {
+		query += " AND break_glass = ?"
+		args = append(args, filter.BreakGlass)
+	}
+	query += " ORDER BY acid DESC LIMIT ? OFFSET ?"
+	args = append(args, limit+1, offset)
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, false, stacktrace.Propagate(err, "failed to list access log")
+	}
+	defer rows.Close()
+
+	evs = []accessEvent{}
+	for rows.Next() {
+		var ev accessEvent
+		err = rows.Scan(&ev.ACID, &ev.At, &ev.By, &ev.UID, &ev.Route, &ev.Path, &ev.BreakGlass)
+		if err != nil {
+			return nil, false, stacktrace.Propagate(err, "failed to scan row")
+		}
+		evs = append(evs, ev)
+	}
+	if len(evs) > limit {
+		return evs[:limit], true, nil
+	}
+	return evs, false, nil
+}
+
+// pruneAccessLog deletes the reads older than accessLogDays, affected is how many
+func pruneAccessLog(db *sql.DB, now time.Time) (affected int, err error) {
+	res, err := db.Exec("DELETE FROM access_log WHERE at_unix_s < ?", now.AddDate(0, 0, -accessLogDays).Unix())
+	if err != nil {
+		return 0, stacktrace.Propagate(err, "failed to prune access log")
+	}
+	n, err := res.RowsAffected()
+	return int(n), stacktrace.Propagate(err, "failed to get rows affected")
+}
+
+// accessLogPruner prunes the access log every night
+func accessLogPruner(db *sql.DB) {
+	for {
+		now := time.Now()
+		next := time.Date(now.Year(), now.Month(), now.Day(), 3, 0, 0, 0, now.Location())
+		if !next.After(now) {
+			next = next.AddDate(0, 0, 1)
+		}
+		if !jobSleep(time.Until(next)) {
+			return
+		}
+		err := runJob(db, jobAccessLog, func() (int, error) { return pruneAccessLog(db, time.Now()) })
+		if err != nil {
+			logError(err, "job", jobAccessLog)
+		}
+	}
+}
+
+// statusWriter remembers the status of the response
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sw *statusWriter) WriteHeader(status int) {
+	sw.status = status
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+// logAccessMiddleware logs successful reads of other users' records, see access.go.
+// It goes after requireSession, which logs everything break-glass sessions do.
+func (env *env) logAccessMiddleware(w http.ResponseWriter, r *http.Request, n func(http.ResponseWriter, *http.Request)) {
+	if bgid, _ := r.Context().Value(breakGlassKey).(int); bgid != 0 || (r.Method != http.MethodGet && r.Method != http.MethodHead) {
+		n(w, r)
+		return
+	}
+	sw := &statusWriter{w, http.StatusOK}
+	n(sw, r)
+	if sw.status >= 400 {
+		return
+	}
+
+	by, ok := r.Context().Value(uidKey).(uidT)
+	if !ok {
+		logRequestError(r, stacktrace.NewError("malformed context, use requireSession first"))
+		return
+	}
+	ev := accessEvent{
+		At: clk.Now().Unix(), By: by, UID: routeUser(r), Route: r.Method + " " + powermux.RequestPath(r), Path: r.URL.Path,
+	}
+	if ev.UID == by {
+		return
+	}
+
+	if err := logAccess(env.db, ev); err != nil {
+		logRequestError(r, err)
+	}
+}
+
+// logBreakGlass serves the request and logs it in access_log under the grant, whatever it was
+func (env *env) logBreakGlass(w http.ResponseWriter, r *http.Request, n func(http.ResponseWriter, *http.Request), bgid int) {
+	sw := &statusWriter{w, http.StatusOK}
+	n(sw, r)
+
+	by, _ := r.Context().Value(uidKey).(uidT)
+	ev := accessEvent{
+		At: clk.Now().Unix(), By: by, UID: routeUser(r), Route: r.Method + " " + powermux.RequestPath(r), Path: r.URL.Path,
+		BreakGlass: bgid,
+	}
+	if err := logAccess(env.db, ev); err != nil {
+		logRequestError(r, err)
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/palantir/stacktrace"
+)
+
+// The first kiosk punch of a user at a device is held until an admin approves the combination,
+// so that a cloned badge can't be used unnoticed. Once approved, the held punches are applied
+// as of when they happened and later punches there go through right away.
+
+const (
+	holdPending  = "pending"
+	holdApproved = "approved"
+	holdRejected = "rejected"
+)
+
+type heldPunch struct {
+	HPID  int       `json:"hpid"`
+	UID   uidT      `json:"uid"`
+	Email string    `json:"email"`
+	DID   didT      `json:"did"`
+	Kind  userState `json:"kind"` // the state the user would move to
+	At    int       `json:"at"`
+}
+
+func deviceApproved(db *sql.DB, uid uidT, did didT) (approved bool, err error) {
+	err = db.QueryRow("SELECT 1 FROM device_users WHERE did = ?1 AND uid = ?2", did, uid).Scan(new(int))
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, stacktrace.Propagate(err, "failed to check device approval")
+}
+
+// holdPunch holds a punch to the state after state, or after the user's latest pending held punch
+func holdPunch(db *sql.DB, uid uidT, did didT, state userState) (err error) {
+	var last userState
+	err = db.QueryRow(
+		`SELECT kind FROM held_punches WHERE uid = ?1 AND status = ?2
+			ORDER BY hpid DESC LIMIT 1`, uid, holdPending).Scan(&last)
+	if err != nil && err != sql.ErrNoRows {
+		return stacktrace.Propagate(err, "failed to get last held punch")
+	}
+	if err == nil {
+		state = last
+	}
+
+	kind := stateIn
+	if state == stateIn {
+		kind = stateOut
+	}
+	_, err = db.Exec(
+		`INSERT INTO held_punches (uid, did, kind, at_unix_s)
+			VALUES (?1, ?2, ?3, ?4)`, uid, did, kind, clk.Now().Unix())
+	return stacktrace.Propagate(err, "failed to hold punch")
+}
+
+func listHeldPunches(db *sql.DB) (hps []heldPunch, err error) {
+	rows, err := db.Query(
+		`SELECT hpid, uid, email, did, kind, at_unix_s FROM held_punches JOIN users USING (uid)
+			WHERE status = ? ORDER BY at_unix_s`, holdPending)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed to list held punches")
+	}
+	defer rows.Close()
+
+	hps = []heldPunch{}
+	for rows.Next() {
+		var hp heldPunch
+		err = rows.Scan(&hp.HPID, &hp.UID, &hp.Email, &hp.DID, &hp.Kind, &hp.At)
+		if err != nil {
+			return nil, stacktrace.Propagate(err, "failed to scan row")
+		}
+		hps = append(hps, hp)
+	}
+	return hps, nil
+}
+
+func rejectHeldPunch(db *sql.DB, hpid int) (found bool, err error) {
+	res, err := db.Exec(
+		"UPDATE held_punches SET status = ?1 WHERE hpid = ?2 AND status = ?3", holdRejected, hpid, holdPending)
+	if err != nil {
+		return false, stacktrace.Propagate(err, "failed to reject held punch")
+	}
+	n, err := res.RowsAffected()
+	return n == 1, stacktrace.Propagate(err, "failed to reject held punch")
+}
+
+// approveHeldPunch approves the user and device of the held punch and applies their pending
+// held punches in order. Ones the user has punched past in the meantime are rejected.
+func approveHeldPunch(ctx context.Context, db *sql.DB, hpid int) (found bool, err error) {
+	var uid uidT
+	var did didT
+	err = db.QueryRowContext(ctx,
+		"SELECT uid, did FROM held_punches WHERE hpid = ?1 AND status = ?2", hpid, holdPending).Scan(&uid, &did)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, stacktrace.Propagate(err, "failed to get held punch")
+	}
+
+	_, err = db.ExecContext(ctx, "INSERT OR IGNORE INTO device_users (did, uid) VALUES (?1, ?2)", did, uid)
+	if err != nil {
+		return false, stacktrace.Propagate(err, "failed to approve device")
+	}
+
+	rows, err := db.QueryContext(ctx,
+		`SELECT hpid, kind, at_unix_s FROM held_punches
+			WHERE uid = ?1 AND did = ?2 AND status = ?3 ORDER BY at_unix_s`, uid, did, holdPending)
+	if err != nil {
+		return false, stacktrace.Propagate(err, "failed to list held punches")
+	}
+	hps := []heldPunch{}
+	for rows.Next() {
+		var hp heldPunch
+		err = rows.Scan(&hp.HPID, &hp.Kind, &hp.At)
+		if err != nil {
+			rows.Close()
+			return false, stacktrace.Propagate(err, "failed to scan row")
+		}
+		hps = append(hps, hp)
+	}
+	rows.Close()
+
+	for _, hp := range hps {
+		var state userState
+		var since int
+		err = db.QueryRowContext(ctx, "SELECT state, since_unix_s FROM user_states WHERE uid = ?", uid).Scan(&state, &since)
+		if err != nil {
+			return false, stacktrace.Propagate(err, "failed to get user state")
+		}
+
+		status := holdRejected
+		if state != hp.Kind && since <= hp.At {
+			if hp.Kind == stateIn {
+				err = clockInAt(ctx, db, uid, did, 0, int64(hp.At))
+			} else {
+				err = clockOutAt(ctx, db, uid, did, int64(hp.At))
+			}
+			if err != nil {
+				return false, err
+			}
+			status = holdApproved
+		}
+
+		_, err = db.ExecContext(ctx, "UPDATE held_punches SET status = ?1 WHERE hpid = ?2", status, hp.HPID)
+		if err != nil {
+			return false, stacktrace.Propagate(err, "failed to resolve held punch")
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/palantir/stacktrace"
+)
+
+// audit actions, see audit_log.action
+const (
+	auditClockIn    = "clock-in"
+	auditClockOut   = "clock-out"
+	auditBreakStart = "break-start"
+	auditBreakEnd   = "break-end"
+	auditDisqualify = "disqualify"
+	auditCreate     = "create"
+	auditEdit       = "edit"
+	auditDelete     = "delete"
+	auditRestore    = "restore"
+	auditSubmit     = "submit"
+	auditApprove    = "approve"
+	auditReject     = "reject"
+	auditIdle       = "idle"       // an idle period was taken out of worked time
+	auditConfirm    = "confirm"    // the user confirmed or corrected an auto-closed entry
+	auditAttribute  = "attribute"  // an entry was attributed to another contract, see contracts.go
+	auditCategorize = "categorize" // an entry was put in another category, see categories.go
+	auditMerge      = "merge"      // another user's records were moved to the user, see merge.go
+	auditRepair     = "repair"     // wms2 repair closed an orphaned open state, see repair.go
+)
+
+// auditSystem is who did what the server does by itself, like disqualify
+const auditSystem uidT = 0
+
+// auditState is the before and after of state changes
+type auditState struct {
+	State userState `json:"state"`
+	At    int64     `json:"at,omitempty"`
+	DID   didT      `json:"did,omitempty"`
+}
+
+// transitionAction is what a change of state is audited as
+func transitionAction(from, to userState) string {
+	switch {
+	case to == stateBreak:
+		return auditBreakStart
+	case from == stateBreak && to == stateIn:
+		return auditBreakEnd
+	case to == stateIn:
+		return auditClockIn
+	}
+	return auditClockOut
+}
+
+// audit records that by (auditSystem for the server itself) did action to the user's data.
+// eid is the entry it was done to, 0 for none. before and after are marshalled to JSON, nil for none.
+// It should be called in the transaction making the change.
+func audit(ex queryExecer, by, uid uidT, action string, eid eidT, before, after interface{}) (err error) {
+	if db, ok := ex.(*sql.DB); ok && auditChain {
+		// reading the last hash and appending has to be atomic
+		tx, err := db.Begin()
+		if err != nil {
+			return stacktrace.Propagate(err, "failed to begin transaction")
+		}
+		defer tx.Rollback()
+		err = audit(tx, by, uid, action, eid, before, after)
+		if err != nil {
+			return err
+		}
+		return stacktrace.Propagate(tx.Commit(), "failed to commit audit log")
+	}
+
+	var jsBefore, jsAfter []byte
+	if before != nil {
+		jsBefore, err = json.Marshal(before)
+		if err != nil {
+			return stacktrace.Propagate(err, "failed to marshal audit before")
+		}
+	}
+	if after != nil {
+		jsAfter, err = json.Marshal(after)
+		if err != nil {
+			return stacktrace.Propagate(err, "failed to marshal audit after")
+		}
+	}
+
+	at := clk.Now().Unix()
+	var hash sql.NullString
+	if auditChain {
+		prev, err := lastAuditHash(ex)
+		if err != nil {
+			return err
+		}
+		r := auditRecord{prev, at, by, uid, action, eid,
+			nullStringPtr(nullJSON(jsBefore)), nullStringPtr(nullJSON(jsAfter))}
+		hash = sql.NullString{String: r.hash(), Valid: true}
+	}
+
+	_, err = ex.Exec(
+		`INSERT INTO audit_log (at_unix_s, by_uid, uid, action, eid, before, after, hash)
+			VALUES (?1, NULLIF(?2, 0), ?3, ?4, NULLIF(?5, 0), ?6, ?7, ?8)`,
+		at, by, uid, action, eid, nullJSON(jsBefore), nullJSON(jsAfter), hash)
+	if err != nil {
+		return stacktrace.Propagate(err, "failed to write audit log")
+	}
+
+	if event := webhookEvent(action); event != "" {
+		return enqueueWebhooks(ex, webhookBody{event, action, at, by, uid, eid, jsBefore, jsAfter})
+	}
+	return nil
+}
+
+func nullJSON(js []byte) sql.NullString {
+	return sql.NullString{String: string(js), Valid: js != nil}
+}
+
+type auditEvent struct {
+	ALID   int             `json:"alid"`
+	At     int64           `json:"at"`
+	By     uidT            `json:"by"` // 0 for the server itself
+	UID    uidT            `json:"uid"`
+	Action string          `json:"action"`
+	EID    eidT            `json:"eid,omitempty"`
+	Before json.RawMessage `json:"before,omitempty"`
+	After  json.RawMessage `json:"after,omitempty"`
+}
+
+// auditFilter narrows down listAudit, zero values don't filter
+type auditFilter struct {
+	UID      uidT
+	By       uidT
+	Action   string
+	EID      eidT
+	From, To int64 // unix times, To is exclusive
+	After    int64 // only events with a greater alid, to page through with a cursor
+}
+
+// listAudit returns up to limit events matching the filter after skipping offset of them, oldest first.
+// more is set if there are more after them.
+func listAudit(db *sql.DB, filter auditFilter, offset, limit int) (evs []auditEvent, more bool, err error) {
+	query := `SELECT alid, at_unix_s, IFNULL(by_uid, 0), uid, action, IFNULL(eid, 0), before, after
+		FROM audit_log WHERE at_unix_s >= ? AND at_unix_s < ?`
+	args := []interface{}{filter.From, filter.To}
+	if filter.UID != 0 {
+		query += " AND uid = ?"
+		args = append(args, filter.UID)
+	}
+	if filter.By != 0 {
+		query += " AND by_uid = ?"
+		args = append(args, filter.By)
+	}
+	if filter.Action != "" {
+		query += " AND action = ?"
+		args = append(args, filter.Action)
+	}
+	if filter.EID != 0 {
+		query += " AND eid = ?"
+		args = append(args, filter.EID)
+	}
+	if filter.After != 0 {
+		query += " AND alid > ?"
+		args = append(args, filter.After)
+	}
+	query += " ORDER BY alid LIMIT ? OFFSET ?"
+	args = append(args, limit+1, offset)
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, false, stacktrace.Propagate(err, "failed to list audit log")
+	}
+	defer rows.Close()
+
+	evs = []auditEvent{}
+	for rows.Next() {
+		var ev auditEvent
+		var before, after sql.NullString
+		err = rows.Scan(&ev.ALID, &ev.At, &ev.By, &ev.UID, &ev.Action, &ev.EID, &before, &after)
+		if err != nil {
+			return nil, false, stacktrace.Propagate(err, "failed to scan row")
+		}
+		if before.Valid {
+			ev.Before = json.RawMessage(before.String)
+		}
+		if after.Valid {
+			ev.After = json.RawMessage(after.String)
+		}
+		evs = append(evs, ev)
+	}
+	if len(evs) > limit {
+		evs, more = evs[:limit], true
+	}
+	return evs, more, nil
+}
+
+// writeAuditCSV writes the events with a header row, before and after stay JSON
+func writeAuditCSV(w io.Writer, evs []auditEvent) (err error) {
+	cw := csv.NewWriter(w)
+	err = cw.Write([]string{"alid", "at", "by", "uid", "action", "eid", "before", "after"})
+	if err != nil {
+		return stacktrace.Propagate(err, "failed to write header")
+	}
+	for _, ev := range evs {
+		by, eid := "", ""
+		if ev.By != auditSystem {
+			by = strconv.Itoa(int(ev.By))
+		}
+		if ev.EID != 0 {
+			eid = strconv.Itoa(int(ev.EID))
+		}
+		err = cw.Write([]string{
+			strconv.Itoa(ev.ALID), time.Unix(ev.At, 0).Format(time.RFC3339), by, strconv.Itoa(int(ev.UID)),
+			ev.Action, eid, string(ev.Before), string(ev.After),
+		})
+		if err != nil {
+			return stacktrace.Propagate(err, "failed to write row")
+		}
+	}
+	cw.Flush()
+	return stacktrace.Propagate(cw.Error(), "failed to flush")
+}
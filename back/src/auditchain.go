@@ -0,0 +1,134 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/palantir/stacktrace"
+)
+
+// With WMS2_AUDIT_CHAIN set, each audit record gets a hash over its fields and the hash of the record
+// before it. Changing, inserting or deleting a record afterwards breaks the chain from there on, which
+// verifyAuditChain finds. Every change to entries made through wms2 is audited, so this is what shows
+// time records were tampered with. Deleting the newest records can only be told by comparing the last
+// hash with one noted down before, so verify-audit prints it.
+
+// auditChain is whether audit records are hash chained, see auditChainFromEnv
+var auditChain = false
+
+// auditChainFromEnv reads WMS2_AUDIT_CHAIN, "true" to hash chain the audit log. Records from before
+// it was turned on stay unchained, the chain starts with the first record after.
+func auditChainFromEnv() bool {
+	return os.Getenv("WMS2_AUDIT_CHAIN") == "true"
+}
+
+// queryExecer is satisfied by both *sql.DB and *sql.Tx
+type queryExecer interface {
+	execer
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// auditRecord is what an audit record's hash is over, as stored
+type auditRecord struct {
+	Prev   string  `json:"prev"` // the hash of the record before, empty for the first
+	At     int64   `json:"at"`
+	By     uidT    `json:"by"`
+	UID    uidT    `json:"uid"`
+	Action string  `json:"action"`
+	EID    eidT    `json:"eid"`
+	Before *string `json:"before"`
+	After  *string `json:"after"`
+}
+
+func (r auditRecord) hash() string {
+	js, _ := json.Marshal(r) // can't fail, it's only strings and numbers
+	sum := sha256.Sum256(js)
+	return hex.EncodeToString(sum[:])
+}
+
+func nullStringPtr(s sql.NullString) *string {
+	if !s.Valid {
+		return nil
+	}
+	return &s.String
+}
+
+// lastAuditHash returns the hash of the newest audit record, empty if there's none or it isn't chained
+func lastAuditHash(q queryExecer) (hash string, err error) {
+	var h sql.NullString
+	err = q.QueryRow("SELECT hash FROM audit_log ORDER BY alid DESC LIMIT 1").Scan(&h)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return h.String, stacktrace.Propagate(err, "failed to get last audit hash")
+}
+
+// auditChainBreak is a record where the chain doesn't hold
+type auditChainBreak struct {
+	ALID   int
+	Reason string
+}
+
+// verifyAuditChain checks the chain from its first record, chained is how many records are in it
+// and last is the hash of the newest one
+func verifyAuditChain(db *sql.DB) (chained int, last string, breaks []auditChainBreak, err error) {
+	rows, err := db.Query(
+		`SELECT alid, at_unix_s, IFNULL(by_uid, 0), uid, action, IFNULL(eid, 0), before, after, hash
+			FROM audit_log ORDER BY alid`)
+	if err != nil {
+		return 0, "", nil, stacktrace.Propagate(err, "failed to list audit log")
+	}
+	defer rows.Close()
+
+	prev := ""
+	for rows.Next() {
+		var alid int
+		var r auditRecord
+		var before, after, hash sql.NullString
+		err = rows.Scan(&alid, &r.At, &r.By, &r.UID, &r.Action, &r.EID, &before, &after, &hash)
+		if err != nil {
+			return 0, "", nil, stacktrace.Propagate(err, "failed to scan row")
+		}
+		if !hash.Valid {
+			if chained > 0 {
+				breaks = append(breaks, auditChainBreak{alid, "not chained"})
+			}
+			continue
+		}
+
+		r.Prev, r.Before, r.After = prev, nullStringPtr(before), nullStringPtr(after)
+		if r.hash() != hash.String {
+			breaks = append(breaks, auditChainBreak{alid, "hash doesn't match"})
+		}
+		// go on from the stored hash so that one changed record is one break
+		prev = hash.String
+		chained++
+	}
+	return chained, prev, breaks, stacktrace.Propagate(rows.Err(), "failed to list audit log")
+}
+
+// printAuditChain prints the result of verifyAuditChain
+func printAuditChain(db *sql.DB) (err error) {
+	chained, last, breaks, err := verifyAuditChain(db)
+	if err != nil {
+		return err
+	}
+	if chained == 0 {
+		fmt.Println("the audit log isn't chained, see WMS2_AUDIT_CHAIN")
+		return nil
+	}
+	for _, b := range breaks {
+		fmt.Printf("record %d: %s\n", b.ALID, b.Reason)
+	}
+	if len(breaks) == 0 {
+		fmt.Println(chained, "records chained, none tampered with")
+	} else {
+		fmt.Println(chained, "records chained,", len(breaks), "tampered with")
+	}
+	fmt.Println("last hash", last)
+	return nil
+}
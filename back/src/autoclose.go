@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"strconv"
+
+	"github.com/palantir/stacktrace"
+)
+
+// Entries disqualify closes for users who forgot to clock out don't count until the user confirms
+// when they actually stopped, which they have confirmDays to do. After that it's up to an admin,
+// the exception digest lists the ones that weren't confirmed in time.
+
+const defaultConfirmDays = 3
+
+var confirmDays = defaultConfirmDays
+
+// confirmDaysFromEnv reads WMS2_CONFIRM_DAYS, how many days users have to confirm auto-closed entries
+func confirmDaysFromEnv() int {
+	s := os.Getenv("WMS2_CONFIRM_DAYS")
+	if s == "" {
+		return defaultConfirmDays
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n <= 0 {
+		logWarning(stacktrace.NewError("invalid WMS2_CONFIRM_DAYS %q, using %d", s, defaultConfirmDays))
+		return defaultConfirmDays
+	}
+	return n
+}
+
+// confirmPeriod is how many seconds users have to confirm an entry after it was auto-closed
+func confirmPeriod() int64 {
+	return int64(confirmDays) * 24 * 60 * 60
+}
+
+// unconfirmedEntry is an auto-closed entry waiting for the user to confirm it
+type unconfirmedEntry struct {
+	entry
+	Deadline int64 `json:"deadline"` // unix time
+}
+
+// listUnconfirmed returns the user's auto-closed entries that can still be confirmed
+func listUnconfirmed(db *sql.DB, uid uidT) (ues []unconfirmedEntry, err error) {
+	rows, err := entryStore.query(context.TODO(), db,
+		`SELECT `+entryColumns+` FROM entries
+			WHERE uid = ?1 AND source = 'auto-close' AND valid = 0 AND confirmed_unix_s IS NULL
+			AND deleted_unix_s IS NULL AND to_unix_s > ?2 ORDER BY from_unix_s`,
+		uid, clk.Now().Unix()-confirmPeriod())
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed to list unconfirmed entries")
+	}
+	defer rows.Close()
+
+	ues = []unconfirmedEntry{}
+	for rows.Next() {
+		en, err := scanEntry(rows)
+		if err != nil {
+			return nil, err
+		}
+		ues = append(ues, unconfirmedEntry{en, int64(en.To) + confirmPeriod()})
+	}
+	return ues, nil
+}
+
+// confirmError is a correction confirmAutoClosed won't take, the message is safe to show to clients
+type confirmError string
+
+func (e confirmError) Error() string {
+	return string(e)
+}
+
+// confirmAutoClosed confirms the user's auto-closed entry, correcting when it ended to to unless that's 0.
+// The entry counts as worked from then on. found is false if there's no such entry or it's too late
+// to confirm it. A correction that overlaps other entries returns an *overlapError,
+// one that ends before the entry started a confirmError.
+func confirmAutoClosed(db *sql.DB, uid uidT, eid eidT, to int) (found bool, err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, stacktrace.Propagate(err, "failed to begin transaction")
+	}
+	defer tx.Rollback()
+
+	old := entryRange{EID: eid}
+	err = entryStore.queryRow(context.TODO(), tx,
+		`SELECT from_unix_s, to_unix_s FROM entries
+			WHERE eid = ?1 AND uid = ?2 AND source = 'auto-close' AND valid = 0 AND confirmed_unix_s IS NULL
+			AND deleted_unix_s IS NULL AND to_unix_s > ?3`,
+		eid, uid, clk.Now().Unix()-confirmPeriod()).Scan(&old.From, &old.To)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, stacktrace.Propagate(err, "failed to get entry")
+	}
+
+	if to == 0 {
+		to = old.To
+	}
+	if to < old.From {
+		return true, confirmError("the entry can't end before it started")
+	}
+	_, _, err = fitEntry(tx, uid, eid, old.From, to, false)
+	if err != nil {
+		return true, err
+	}
+
+	_, err = entryStore.exec(context.TODO(), tx,
+		"UPDATE entries SET to_unix_s = ?1, valid = 1, confirmed_unix_s = ?2 WHERE eid = ?3", to, clk.Now().Unix(), eid)
+	if err != nil {
+		return true, stacktrace.Propagate(err, "failed to confirm entry")
+	}
+	err = audit(tx, uid, uid, auditConfirm, eid, old, entryRange{eid, old.From, to})
+	if err != nil {
+		return true, err
+	}
+	return true, stacktrace.Propagate(tx.Commit(), "failed to commit transaction")
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/palantir/stacktrace"
+)
+
+// minBenchmarkGroup is the fewest users a group needs for its averages to be shown,
+// so that nobody's hours can be read off a small group's
+const minBenchmarkGroup = 5
+
+// benchmarkGroup averages a site's users over a quarter, there are no teams so sites stand in for them
+type benchmarkGroup struct {
+	Site       stidT  `json:"site"`
+	Name       string `json:"name"`
+	Suppressed bool   `json:"suppressed"`         // the group is too small, the averages are left out
+	Worked     int    `json:"worked,omitempty"`   // average seconds per user
+	Overtime   int    `json:"overtime,omitempty"` // average seconds beyond what was expected per user, see monthTotals
+}
+
+// getBenchmark averages hours and overtime of each site's users during the quarter (1 to 4) of the year
+func getBenchmark(db *sql.DB, year, quarter int, loc *time.Location) (bgs []benchmarkGroup, err error) {
+	from := time.Date(year, time.Month(3*(quarter-1)+1), 1, 0, 0, 0, 0, loc)
+	days := int(from.AddDate(0, 3, 0).Sub(from).Hours()/24 + 0.5)
+
+	sites, err := listSites(db)
+	if err != nil {
+		return nil, err
+	}
+
+	bgs = []benchmarkGroup{}
+	for _, s := range sites {
+		uids, err := listSiteUsers(db, s.STID)
+		if err != nil {
+			return nil, err
+		}
+
+		bg := benchmarkGroup{Site: s.STID, Name: s.Name, Suppressed: len(uids) < minBenchmarkGroup}
+		if !bg.Suppressed {
+			for _, uid := range uids {
+				drs, err := getDayReports(db, uid, from, days)
+				if err != nil {
+					return nil, err
+				}
+				for _, dr := range drs {
+					bg.Worked += dr.Worked
+					if dr.Delta > 0 {
+						bg.Overtime += dr.Delta
+					}
+				}
+			}
+			bg.Worked /= len(uids)
+			bg.Overtime /= len(uids)
+		}
+		bgs = append(bgs, bg)
+	}
+
+	return bgs, nil
+}
+
+// listSiteUsers lists the users whose default site is stid
+func listSiteUsers(db *sql.DB, stid stidT) (uids []uidT, err error) {
+	rows, err := db.Query("SELECT uid FROM users WHERE stid = ?", stid)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed to list site users")
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var uid uidT
+		err = rows.Scan(&uid)
+		if err != nil {
+			return nil, stacktrace.Propagate(err, "failed to scan row")
+		}
+		uids = append(uids, uid)
+	}
+	return uids, nil
+}
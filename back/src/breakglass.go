@@ -0,0 +1,215 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/palantir/stacktrace"
+	"golang.org/x/crypto/argon2"
+)
+
+// Break-glass is for when admins can't get in, say during payroll cutoff. `wms2 seal-break-glass` makes
+// a secret to keep sealed and WMS2_BREAK_GLASS, the hash of it the server checks. A user who gives their
+// password, the secret and a reason gets a session with admin access for breakGlassMinutes, then it
+// expires. Opening one alerts all admins and the security address (see securityAlert), and every request
+// of the session is logged in access_log with the grant.
+
+const defaultBreakGlassMinutes = 60
+
+var breakGlassMinutes = defaultBreakGlassMinutes
+
+// breakGlassMinutesFromEnv reads WMS2_BREAK_GLASS_MINUTES, how long a break-glass session lasts
+func breakGlassMinutesFromEnv() int {
+	s := os.Getenv("WMS2_BREAK_GLASS_MINUTES")
+	if s == "" {
+		return defaultBreakGlassMinutes
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n <= 0 {
+		logWarning(stacktrace.NewError("invalid WMS2_BREAK_GLASS_MINUTES %q, using %d", s, defaultBreakGlassMinutes))
+		return defaultBreakGlassMinutes
+	}
+	return n
+}
+
+// breakGlassSeal is the salt and hash of the break-glass secret
+type breakGlassSeal struct {
+	salt, hash []byte
+}
+
+// breakGlass is the seal from WMS2_BREAK_GLASS, nil if break-glass is off
+var breakGlass *breakGlassSeal
+
+// breakGlassFromEnv reads WMS2_BREAK_GLASS as made by sealBreakGlass
+func breakGlassFromEnv() *breakGlassSeal {
+	s := os.Getenv("WMS2_BREAK_GLASS")
+	if s == "" {
+		return nil
+	}
+	parts := strings.SplitN(s, ":", 2)
+	if len(parts) == 2 {
+		salt, err1 := base64.StdEncoding.DecodeString(parts[0])
+		hash, err2 := base64.StdEncoding.DecodeString(parts[1])
+		if err1 == nil && err2 == nil && len(salt) > 0 && len(hash) > 0 {
+			return &breakGlassSeal{salt, hash}
+		}
+	}
+	logWarning(stacktrace.NewError("invalid WMS2_BREAK_GLASS, break-glass is off"))
+	return nil
+}
+
+// sealBreakGlass makes a new secret and the WMS2_BREAK_GLASS value for it
+func sealBreakGlass() (secret, sealed string) {
+	secretRaw := make([]byte, 24)
+	rand.Read(secretRaw)
+	secret = base64.RawURLEncoding.EncodeToString(secretRaw)
+
+	salt := make([]byte, 8)
+	rand.Read(salt)
+	hash := argon2.IDKey([]byte(secret), salt, 1, 64*1024, 1, 16)
+	return secret, base64.StdEncoding.EncodeToString(salt) + ":" + base64.StdEncoding.EncodeToString(hash)
+}
+
+// opens reports whether secret is the sealed one
+func (s *breakGlassSeal) opens(secret string) bool {
+	if s == nil {
+		return false
+	}
+	hash := argon2.IDKey([]byte(secret), s.salt, 1, 64*1024, 1, 16)
+	return subtle.ConstantTimeCompare(hash, s.hash) == 1
+}
+
+type breakGlassGrant struct {
+	BGID   int    `json:"bgid"`
+	UID    uidT   `json:"uid"`
+	Email  string `json:"email"`
+	Reason string `json:"reason"`
+	From   int64  `json:"from"`
+	Until  int64  `json:"until"` // when it expires or was closed
+}
+
+// openBreakGlass creates a session for the user with admin access until breakGlassMinutes from now
+// and alerts the admins. Nothing is granted unless all the alerts could be queued.
+func openBreakGlass(db *sql.DB, uid uidT, reason string, now time.Time) (bg breakGlassGrant, sid sidT, err error) {
+	duration := time.Duration(breakGlassMinutes) * time.Minute
+	bg = breakGlassGrant{UID: uid, Reason: reason, From: now.Unix(), Until: now.Add(duration).Unix()}
+	bg.Email, err = uidToEmail(db, uid)
+	if err != nil {
+		return bg, "", stacktrace.Propagate(err, "failed to get email")
+	}
+	emails, err := listAdminEmails(db)
+	if err != nil {
+		return bg, "", err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return bg, "", stacktrace.Propagate(err, "failed to begin transaction")
+	}
+	rollback := func() {
+		if err := tx.Rollback(); err != nil {
+			logError(stacktrace.Propagate(err, "failed to roll back break-glass grant"))
+		}
+	}
+	sid, err = createSession(tx, uid, duration)
+	if err != nil {
+		rollback()
+		return bg, "", stacktrace.Propagate(err, "failed to create a session")
+	}
+	res, err := tx.Exec("INSERT INTO break_glass (uid, sid, reason, from_unix_s, until_unix_s) VALUES (?1, ?2, ?3, ?4, ?5)",
+		uid, sid, reason, bg.From, bg.Until)
+	if err != nil {
+		rollback()
+		return bg, "", stacktrace.Propagate(err, "failed to insert break-glass grant")
+	}
+	bgid, err := res.LastInsertId()
+	if err != nil {
+		rollback()
+		return bg, "", stacktrace.Propagate(err, "failed to get bgid")
+	}
+	bg.BGID = int(bgid)
+
+	subject := "break-glass admin access by " + bg.Email
+	body := fmt.Sprintf("%s broke the glass for admin access until %s, giving the reason:\n\n%s\n\n"+
+		"Everything they do in that session is in the access log under break-glass grant %d.",
+		bg.Email, time.Unix(bg.Until, 0).Format(time.RFC1123), reason, bg.BGID)
+	if err = queueSecurityAlert(tx, subject, body); err != nil {
+		rollback()
+		return bg, "", err
+	}
+	for _, email := range emails {
+		err = enqueueEmail(tx, email, "[wms2] "+subject, body)
+		if err != nil {
+			rollback()
+			return bg, "", stacktrace.Propagate(err, "failed to queue break-glass alert")
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		return bg, "", stacktrace.Propagate(err, "failed to commit transaction")
+	}
+	return bg, sid, nil
+}
+
+// activeBreakGlass returns the grant of the session if it hasn't expired, 0 if there's none
+func activeBreakGlass(db *sql.DB, sid sidT, now time.Time) (bgid int, err error) {
+	err = db.QueryRow("SELECT bgid FROM break_glass WHERE sid = ?1 AND until_unix_s > ?2", sid, now.Unix()).Scan(&bgid)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return bgid, stacktrace.Propagate(err, "failed to get break-glass grant")
+}
+
+// closeBreakGlass ends the grant and its session before they expire
+func closeBreakGlass(db *sql.DB, bgid int, now time.Time) (err error) {
+	var sid sidT
+	err = db.QueryRow("SELECT sid FROM break_glass WHERE bgid = ?", bgid).Scan(&sid)
+	if err != nil {
+		return stacktrace.Propagate(err, "failed to get break-glass session")
+	}
+	_, err = db.Exec("UPDATE break_glass SET until_unix_s = ?1 WHERE bgid = ?2 AND until_unix_s > ?1", now.Unix(), bgid)
+	if err != nil {
+		return stacktrace.Propagate(err, "failed to close break-glass grant")
+	}
+	_, err = db.Exec("DELETE FROM sessions WHERE sid = ?", sid)
+	return stacktrace.Propagate(err, "failed to delete break-glass session")
+}
+
+// listBreakGlass returns all grants, newest first
+func listBreakGlass(db *sql.DB) (bgs []breakGlassGrant, err error) {
+	rows, err := db.Query(`SELECT bgid, break_glass.uid, email, reason, from_unix_s, until_unix_s
+		FROM break_glass JOIN users ON users.uid = break_glass.uid ORDER BY bgid DESC`)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed to list break-glass grants")
+	}
+	defer rows.Close()
+
+	bgs = []breakGlassGrant{}
+	for rows.Next() {
+		var bg breakGlassGrant
+		err = rows.Scan(&bg.BGID, &bg.UID, &bg.Email, &bg.Reason, &bg.From, &bg.Until)
+		if err != nil {
+			return nil, stacktrace.Propagate(err, "failed to scan row")
+		}
+		bgs = append(bgs, bg)
+	}
+	return bgs, nil
+}
+
+// breakGlassAllows reports whether admins meet any of the requirements, relationships to the
+// route's user aren't granted by breaking the glass
+func breakGlassAllows(reqs []string) bool {
+	for _, req := range reqs {
+		if policyRoles[req] {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// sealTestBreakGlass turns break-glass on with a new secret, callers defer the returned function
+func sealTestBreakGlass(t *testing.T) (secret string, done func()) {
+	t.Helper()
+	secret, sealed := sealBreakGlass()
+	saved := breakGlass
+	os.Setenv("WMS2_BREAK_GLASS", sealed)
+	breakGlass = breakGlassFromEnv()
+	os.Unsetenv("WMS2_BREAK_GLASS")
+	if breakGlass == nil {
+		t.Fatal("the new seal didn't read")
+	}
+	return secret, func() { breakGlass = saved }
+}
+
+// setTestPassword gives the user the password
+func setTestPassword(t *testing.T, db *sql.DB, uid uidT, password string) {
+	t.Helper()
+	salt := []byte("saltsalt")
+	hash := argon2.IDKey([]byte(password), salt, 1, 64*1024, 1, 16)
+	if _, err := db.Exec("UPDATE users SET password_hash = ?, password_salt = ? WHERE uid = ?", hash, salt, uid); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// breakGlassRequest tries to break the glass from the address and returns the status
+func breakGlassRequest(h http.Handler, addr, email, password, secret string) int {
+	body := fmt.Sprintf(`{"email": %q, "password": %q, "secret": %q, "reason": "payroll cutoff"}`, email, password, secret)
+	r := httptest.NewRequest("POST", "/break-glass", strings.NewReader(body))
+	r.RemoteAddr = addr
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w.Code
+}
+
+// attempts are limited per address, not for everyone at once or for the user named
+func TestBreakGlassLimit(t *testing.T) {
+	db, done := newTestDB(t, time.Unix(1570000000, 0))
+	defer done()
+	secret, unseal := sealTestBreakGlass(t)
+	defer unseal()
+	h := newTestServer(db)
+	a := seedUser(t, db, "a@example.com", false)
+	setTestPassword(t, db, a, "pw")
+
+	// the test server allows 5 attempts an hour
+	for i := 0; i < 5; i++ {
+		if code := breakGlassRequest(h, "192.0.2.1:1000", "a@example.com", "wrong", secret); code != 401 {
+			t.Fatalf("attempt %d got %d, want 401", i, code)
+		}
+	}
+	if code := breakGlassRequest(h, "192.0.2.1:1001", "a@example.com", "pw", secret); code != 429 {
+		t.Errorf("the same address got %d, want 429", code)
+	}
+	if code := breakGlassRequest(h, "192.0.2.2:1000", "a@example.com", "pw", secret); code != 200 {
+		t.Errorf("the user from another address got %d, want 200", code)
+	}
+
+	r := httptest.NewRequest("POST", "/break-glass", strings.NewReader(`{"email": `))
+	r.RemoteAddr = "192.0.2.3:1000"
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != 400 {
+		t.Errorf("malformed JSON got %d, want 400", w.Code)
+	}
+}
+
+func TestOpenBreakGlass(t *testing.T) {
+	now := time.Unix(1570000000, 0)
+	db, done := newTestDB(t, now)
+	defer done()
+	seedUser(t, db, "admin@example.com", true)
+	uid := seedUser(t, db, "a@example.com", false)
+
+	bg, sid, err := openBreakGlass(db, uid, "payroll cutoff", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sid == "" || bg.BGID == 0 || !checkSession(db, sid) {
+		t.Errorf("got grant %d and session %q, want both", bg.BGID, sid)
+	}
+	if active, err := activeBreakGlass(db, sid, now); err != nil || active != bg.BGID {
+		t.Errorf("active grant of the session is %d, %v, want %d", active, err, bg.BGID)
+	}
+	if n := countRows(t, db, "SELECT COUNT(*) FROM outbox"); n != 1 {
+		t.Errorf("%d alerts queued, want 1 for the admin", n)
+	}
+
+	// without the alerts, neither the session nor the grant are kept
+	if _, err = db.Exec(`CREATE TRIGGER no_outbox BEFORE INSERT ON outbox BEGIN SELECT RAISE(FAIL, 'outbox is down'); END`); err != nil {
+		t.Fatal(err)
+	}
+	sessions := countRows(t, db, "SELECT COUNT(*) FROM sessions")
+	_, sid, err = openBreakGlass(db, uid, "payroll cutoff", now)
+	if err == nil || sid != "" {
+		t.Errorf("got session %q, %v, want an error", sid, err)
+	}
+	if n := countRows(t, db, "SELECT COUNT(*) FROM sessions"); n != sessions {
+		t.Errorf("%d sessions, want %d", n, sessions)
+	}
+	if n := countRows(t, db, "SELECT COUNT(*) FROM break_glass"); n != 1 {
+		t.Errorf("%d grants, want the first one only", n)
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"regexp"
+
+	"github.com/palantir/stacktrace"
+)
+
+// Categories, like on-call or travel, sort work entries for the calendar, which shows them in their
+// color, and for exports. They're the same for everyone and an entry has at most one.
+
+type catidT int
+
+type category struct {
+	CATID catidT `json:"catid"`
+	Name  string `json:"name"`  // what exports use, like on-call
+	Label string `json:"label"` // what the calendar shows, like On call
+	Color string `json:"color"` // like #e67e22
+}
+
+var categoryNameRegexp = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+var categoryColorRegexp = regexp.MustCompile(`^#[0-9a-fA-F]{6}$`)
+
+func (c category) validate() error {
+	if len(c.Name) > maxNameLength || !categoryNameRegexp.MatchString(c.Name) {
+		return stacktrace.NewError("name has to be lowercase letters, digits and dashes, like on-call")
+	}
+	if c.Label == "" {
+		return stacktrace.NewError("category needs a label")
+	}
+	if err := checkText("label", c.Label, maxNameLength); err != nil {
+		return err
+	}
+	if !categoryColorRegexp.MatchString(c.Color) {
+		return stacktrace.NewError("color has to be like #e67e22")
+	}
+	return nil
+}
+
+// nullCategory is catid for the database, 0 is NULL
+func nullCategory(catid catidT) interface{} {
+	if catid == 0 {
+		return nil
+	}
+	return catid
+}
+
+func listCategories(db *sql.DB) (cs []category, err error) {
+	rows, err := db.Query("SELECT catid, name, label, color FROM categories ORDER BY catid")
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed to list categories")
+	}
+	defer rows.Close()
+
+	cs = []category{}
+	for rows.Next() {
+		var c category
+		err = rows.Scan(&c.CATID, &c.Name, &c.Label, &c.Color)
+		if err != nil {
+			return nil, stacktrace.Propagate(err, "failed to scan row")
+		}
+		cs = append(cs, c)
+	}
+	return cs, nil
+}
+
+// categoryNames maps the categories' ids to their names
+func categoryNames(db *sql.DB) (names map[catidT]string, err error) {
+	cs, err := listCategories(db)
+	if err != nil {
+		return nil, err
+	}
+	names = map[catidT]string{}
+	for _, c := range cs {
+		names[c.CATID] = c.Name
+	}
+	return names, nil
+}
+
+// createCategory adds the category, taken is true if there's one with the name already
+func createCategory(db *sql.DB, c category) (catid catidT, taken bool, err error) {
+	res, err := db.Exec("INSERT OR IGNORE INTO categories (name, label, color) VALUES (?1, ?2, ?3)", c.Name, c.Label, c.Color)
+	if err != nil {
+		return 0, false, stacktrace.Propagate(err, "failed to insert category")
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return 0, err == nil, stacktrace.Propagate(err, "failed to get rows affected")
+	}
+	id, err := res.LastInsertId()
+	return catidT(id), false, stacktrace.Propagate(err, "failed to get category id")
+}
+
+// updateCategory changes the category, found is false if there's none with the id
+// or another one has the name
+func updateCategory(db *sql.DB, c category) (found bool, err error) {
+	res, err := db.Exec("UPDATE OR IGNORE categories SET name = ?1, label = ?2, color = ?3 WHERE catid = ?4",
+		c.Name, c.Label, c.Color, c.CATID)
+	if err != nil {
+		return false, stacktrace.Propagate(err, "failed to update category")
+	}
+	n, err := res.RowsAffected()
+	return n == 1, stacktrace.Propagate(err, "failed to get rows affected")
+}
+
+// deleteCategory deletes the category, its entries are left without one
+func deleteCategory(db *sql.DB, catid catidT) (found bool, err error) {
+	res, err := db.Exec("DELETE FROM categories WHERE catid = ?", catid)
+	if err != nil {
+		return false, stacktrace.Propagate(err, "failed to delete category")
+	}
+	n, err := res.RowsAffected()
+	return n == 1, stacktrace.Propagate(err, "failed to get rows affected")
+}
+
+// entryCategory is the before and after of categorizing an entry
+type entryCategory struct {
+	Category catidT `json:"category"`
+}
+
+// setEntryCategory puts the entry in the category, 0 for none. If owner isn't 0 the entry has to be theirs.
+// found is false if there's no such entry or category.
+func setEntryCategory(db *sql.DB, eid eidT, catid catidT, owner, by uidT) (found bool, err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, stacktrace.Propagate(err, "failed to begin transaction")
+	}
+	defer tx.Rollback()
+
+	var uid uidT
+	var old catidT
+	err = entryStore.queryRow(context.TODO(), tx, "SELECT uid, IFNULL(catid, 0) FROM entries WHERE eid = ? AND deleted_unix_s IS NULL", eid).
+		Scan(&uid, &old)
+	if err == sql.ErrNoRows || (err == nil && owner != 0 && uid != owner) {
+		return false, nil
+	}
+	if err != nil {
+		return false, stacktrace.Propagate(err, "failed to get entry")
+	}
+	if catid != 0 {
+		err = tx.QueryRow("SELECT 1 FROM categories WHERE catid = ?", catid).Scan(new(int))
+		if err == sql.ErrNoRows {
+			return false, nil
+		}
+		if err != nil {
+			return false, stacktrace.Propagate(err, "failed to get category")
+		}
+	}
+
+	_, err = entryStore.exec(context.TODO(), tx, "UPDATE entries SET catid = ?1 WHERE eid = ?2", nullCategory(catid), eid)
+	if err != nil {
+		return false, stacktrace.Propagate(err, "failed to set category")
+	}
+	err = audit(tx, by, uid, auditCategorize, eid, entryCategory{old}, entryCategory{catid})
+	if err != nil {
+		return false, err
+	}
+	return true, stacktrace.Propagate(tx.Commit(), "failed to commit transaction")
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/palantir/stacktrace"
+)
+
+// entryChange is a change to an entry as of the feed, Entry is nil if it was deleted
+type entryChange struct {
+	EID     eidT   `json:"eid"`
+	Deleted bool   `json:"deleted"`
+	Entry   *entry `json:"entry"`
+}
+
+// changeFeed is the entries that changed after a cursor, with the cursor to ask for the next ones.
+// More is set if there were more changes than fit.
+type changeFeed struct {
+	Cursor  int64         `json:"cursor"`
+	More    bool          `json:"more"`
+	Changes []entryChange `json:"changes"`
+}
+
+// listChanges returns the user's entries that changed after cursor, in their current state.
+// entry_changes is filled by triggers on entries, so every way of changing them counts.
+func listChanges(db *sql.DB, uid uidT, cursor int64, limit int) (cf changeFeed, err error) {
+	rows, err := db.Query(
+		`SELECT cid, eid, deleted FROM entry_changes
+			WHERE uid = ?1 AND cid > ?2 ORDER BY cid LIMIT ?3`, uid, cursor, limit+1)
+	if err != nil {
+		return cf, stacktrace.Propagate(err, "failed to list entry changes")
+	}
+	defer rows.Close()
+
+	cf = changeFeed{Cursor: cursor, Changes: []entryChange{}}
+	latest := make(map[eidT]int) // index into cf.Changes, an entry that changed twice is only listed once
+	n := 0
+	for rows.Next() {
+		if n++; n > limit {
+			cf.More = true
+			break
+		}
+
+		var ec entryChange
+		err = rows.Scan(&cf.Cursor, &ec.EID, &ec.Deleted)
+		if err != nil {
+			return cf, stacktrace.Propagate(err, "failed to scan row")
+		}
+		if i, ok := latest[ec.EID]; ok {
+			cf.Changes[i] = ec
+		} else {
+			latest[ec.EID] = len(cf.Changes)
+			cf.Changes = append(cf.Changes, ec)
+		}
+	}
+	rows.Close()
+
+	for i, ec := range cf.Changes {
+		if ec.Deleted {
+			continue
+		}
+		en, found, err := getEntry(db, ec.EID)
+		if err != nil {
+			return cf, err
+		}
+		if !found { // deleted after the last change in this page
+			cf.Changes[i].Deleted = true
+			continue
+		}
+		cf.Changes[i].Entry = &en
+	}
+
+	return cf, nil
+}
+
+func getEntry(db *sql.DB, eid eidT) (en entry, found bool, err error) {
+	rows, err := entryStore.query(context.TODO(), db, "SELECT "+entryColumns+" FROM entries WHERE eid = ? AND deleted_unix_s IS NULL", eid)
+	if err != nil {
+		return en, false, stacktrace.Propagate(err, "failed to get entry")
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		return en, false, stacktrace.Propagate(rows.Err(), "failed to get entry")
+	}
+	en, err = scanEntry(rows)
+	return en, err == nil, err
+}
+
+// changedEntry is an entry with who it belongs to, for listRecentlyChanged
+type changedEntry struct {
+	entry
+	UID   uidT   `json:"uid"`
+	Email string `json:"email"`
+}
+
+// defaultRecentPeriod is how far back listRecentlyChanged looks if it's not told
+const defaultRecentPeriod = 7 * 24 * time.Hour
+
+// listRecentlyChanged returns up to limit of everyone's entries changed at or after the unix time since,
+// skipping the first offset of them, the last changed first. Entries in the trash aren't listed.
+func listRecentlyChanged(db *sql.DB, since int64, offset, limit int) (ces []changedEntry, more bool, err error) {
+	rows, err := entryStore.query(context.TODO(), db,
+		`SELECT `+entryColumns+`, uid, (SELECT email FROM users WHERE users.uid = entries.uid) FROM entries
+			WHERE updated_unix_s >= ?1 AND deleted_unix_s IS NULL
+			ORDER BY updated_unix_s DESC, eid DESC LIMIT ?2 OFFSET ?3`, since, limit+1, offset)
+	if err != nil {
+		return nil, false, stacktrace.Propagate(err, "failed to list recently changed entries")
+	}
+	defer rows.Close()
+
+	ces = []changedEntry{}
+	for rows.Next() {
+		var ce changedEntry
+		en := &ce.entry
+		err = rows.Scan(&en.EID, &en.From, &en.To, &en.Valid, &en.Source, &en.Kind, &en.Site, &en.Contract, &en.Category,
+			&en.MissedHeartbeat, &en.OverCap, &en.AfterBreak, &en.Pending, &en.Created, &en.Updated,
+			&ce.UID, &ce.Email)
+		if err != nil {
+			return nil, false, stacktrace.Propagate(err, "failed to scan row")
+		}
+		ces = append(ces, ce)
+	}
+	if len(ces) > limit {
+		ces, more = ces[:limit], true
+	}
+	return ces, more, nil
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/palantir/stacktrace"
+)
+
+const usage = `usage:
+	wms2                          run the server
+	wms2 repair                   repair inconsistent user states
+	wms2 report EMAIL [YYYY-MM]   print a user's month, the current one by default
+	wms2 rotate-keys              protect badges and training details with the current WMS2_DATA_KEYS key
+	wms2 seal-break-glass         make a new break-glass secret and its WMS2_BREAK_GLASS
+	wms2 verify-audit             check the audit log's hash chain for tampering`
+
+// runCommand runs the command given on the command line, if any,
+// ran is false if the server should be started instead
+func runCommand(db *sql.DB, args []string) (ran bool) {
+	if len(args) == 0 {
+		return false
+	}
+
+	var err error
+	switch args[0] {
+	case "repair":
+		err = stacktrace.Propagate(repairStates(db), "failed to repair user states")
+	case "rotate-keys":
+		var rotated int
+		rotated, err = rotateBadges(db, fieldKeys)
+		if err == nil {
+			fmt.Println("rotated", rotated, "badges")
+			rotated, err = rotateTraining(db, fieldKeys)
+		}
+		if err == nil {
+			fmt.Println("rotated", rotated, "training details")
+		}
+	case "seal-break-glass":
+		secret, sealed := sealBreakGlass()
+		fmt.Println("secret, keep it sealed:", secret)
+		fmt.Println("WMS2_BREAK_GLASS=" + sealed)
+	case "verify-audit":
+		err = printAuditChain(db)
+	case "report":
+		if len(args) < 2 || len(args) > 3 {
+			fmt.Println(usage)
+			return true
+		}
+		month := clk.Now()
+		if len(args) == 3 {
+			month, err = time.ParseInLocation("2006-01", args[2], time.Local)
+			if err != nil {
+				fmt.Println(usage)
+				return true
+			}
+		}
+		err = printMonthReport(db, args[1], month)
+	default:
+		fmt.Println(usage)
+	}
+
+	if err != nil {
+		logError(err)
+	}
+	return true
+}
+
+func printMonthReport(db *sql.DB, email string, month time.Time) (err error) {
+	uid, err := emailToUID(db, email)
+	if err != nil {
+		return stacktrace.Propagate(err, "no user with email "+email)
+	}
+
+	mr, err := getMonthReport(db, uid, month.Year(), month.Month(), month.Location())
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%s, %s %d\n\n", email, mr.Month, mr.Year)
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	header := "Day\tPunches\tWorked\tDelta\t"
+	for _, b := range overtimeBuckets {
+		header += strings.Title(b.Name) + "\t"
+	}
+	fmt.Fprintln(tw, header+"Holiday\tFlags\t")
+	for _, dr := range mr.Days {
+		punches := []string{}
+		flags := 0
+		for _, en := range dr.Entries {
+			punches = append(punches, clockTime(en.From)+"-"+clockTime(en.To))
+			if !en.Valid {
+				flags++
+			}
+		}
+		flagged := ""
+		if flags > 0 {
+			flagged = fmt.Sprintf("%d not clocked out", flags)
+		}
+		holiday := ""
+		if dr.Holiday {
+			holiday = formatSeconds(dr.HolidayWorked)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s%s\t%s\t\n",
+			time.Unix(dr.Date, 0).Format("Mon Jan 2"), strings.Join(punches, " "),
+			formatSeconds(dr.Worked), formatSeconds(dr.Delta), overtimeColumns(dr.OvertimeBuckets), holiday, flagged)
+	}
+	fmt.Fprintf(tw, "Total\t\t%s\t%s\t%s%s\t\t\n",
+		formatSeconds(mr.Worked), formatSeconds(mr.Delta), overtimeColumns(mr.OvertimeBuckets), formatSeconds(mr.HolidayWorked))
+	return tw.Flush()
+}
+
+// overtimeColumns formats the overtime buckets as tab terminated columns
+func overtimeColumns(split map[string]int) string {
+	columns := ""
+	for _, b := range overtimeBuckets {
+		columns += formatSeconds(split[b.Name]) + "\t"
+	}
+	return columns
+}
+
+func clockTime(unix int) string {
+	return time.Unix(int64(unix), 0).Format("15:04")
+}
@@ -0,0 +1,21 @@
+package main
+
+import "time"
+
+// clock tells the time, so that an operation can read it once and use it throughout
+// and so that the entries and report code can run against a fixed time
+type clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+// fixedClock always returns the same time, e.g. for recalculating as of a past moment
+type fixedClock time.Time
+
+func (c fixedClock) Now() time.Time { return time.Time(c) }
+
+// clk is the clock the entries and report code use
+var clk clock = systemClock{}
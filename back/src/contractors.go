@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/palantir/stacktrace"
+)
+
+// Contractors are users with a cap on the hours they may bill per month. Time beyond the cap
+// is still recorded, but the entries that go over it are flagged (entries.over_cap), and
+// the contractor and their sponsor are mailed when the month reaches capWarnPercent and the cap.
+
+const capWarnPercent = 80
+
+// setContract makes the user a contractor with the monthly cap in seconds and the sponsoring
+// user, a cap of 0 makes them a regular user again. sponsor may be 0 for none.
+func setContract(db *sql.DB, uid uidT, capS int, sponsor uidT) (err error) {
+	var c, s interface{}
+	if capS > 0 {
+		c = capS
+		if sponsor != 0 {
+			s = sponsor
+		}
+	}
+	_, err = db.Exec("UPDATE users SET monthly_cap_s = ?1, sponsor = ?2 WHERE uid = ?3", c, s, uid)
+	return stacktrace.Propagate(err, "failed to set contract")
+}
+
+// workedInMonth sums the valid work entries that started in the month of t
+func workedInMonth(db *sql.DB, uid uidT, t time.Time) (worked int, err error) {
+	som := time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, t.Location())
+	err = entryStore.queryRow(context.TODO(), db,
+		`SELECT IFNULL(SUM(to_unix_s - from_unix_s
+				- CASE WHEN ?4 > 0 AND to_unix_s - from_unix_s > ?4 THEN ?5 ELSE 0 END), 0) FROM entries
+			WHERE uid = ?1 AND valid = 1 AND approved = 1 AND deleted_unix_s IS NULL AND kind = 'work'
+				AND from_unix_s >= ?2 AND from_unix_s < ?3`,
+		uid, som.Unix(), som.AddDate(0, 1, 0).Unix(), lunchDeduction.After, lunchDeduction.Deduct).Scan(&worked)
+	return worked, stacktrace.Propagate(err, "failed to sum up month")
+}
+
+// checkCap is run after a contractor clocks out at the unix time at, it flags the entry
+// that ended then if the month is over the cap and sends the notices that are due
+func checkCap(db *sql.DB, uid uidT, at int64) (err error) {
+	var capS sql.NullInt64
+	var sponsor sql.NullInt64
+	err = db.QueryRow("SELECT monthly_cap_s, sponsor FROM users WHERE uid = ?", uid).Scan(&capS, &sponsor)
+	if err != nil {
+		return stacktrace.Propagate(err, "failed to get contract")
+	}
+	if !capS.Valid {
+		return nil
+	}
+
+	// the entry counts towards the month it started in
+	var from int64
+	err = entryStore.queryRow(context.TODO(), db, "SELECT from_unix_s FROM entries WHERE uid = ?1 AND to_unix_s = ?2 AND deleted_unix_s IS NULL", uid, at).Scan(&from)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return stacktrace.Propagate(err, "failed to get entry")
+	}
+	month := time.Unix(from, 0)
+
+	worked, err := workedInMonth(db, uid, month)
+	if err != nil {
+		return err
+	}
+
+	if worked > int(capS.Int64) {
+		_, err = entryStore.exec(context.TODO(), db, "UPDATE entries SET over_cap = 1 WHERE uid = ?1 AND to_unix_s = ?2", uid, at)
+		if err != nil {
+			return stacktrace.Propagate(err, "failed to flag entry")
+		}
+	}
+
+	level := 0
+	if worked >= int(capS.Int64) {
+		level = 100
+	} else if worked*100 >= int(capS.Int64)*capWarnPercent {
+		level = capWarnPercent
+	}
+	if level == 0 {
+		return nil
+	}
+
+	// each notice goes out once per month
+	res, err := db.Exec(
+		"INSERT OR IGNORE INTO cap_notices (uid, month, level) VALUES (?1, ?2, ?3)",
+		uid, month.Format("2006-01"), level)
+	if err != nil {
+		return stacktrace.Propagate(err, "failed to record cap notice")
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return nil
+	}
+
+	email, err := uidToEmail(db, uid)
+	if err != nil {
+		return stacktrace.Propagate(err, "failed to get email")
+	}
+	subject := fmt.Sprintf("%s reached %d%% of the monthly cap", email, level)
+	body := fmt.Sprintf("%s worked %s of the %s cap for %s.",
+		email, formatSeconds(worked), formatSeconds(int(capS.Int64)), month.Format("January 2006"))
+	if level == 100 {
+		body += " Further time will be recorded but flagged as over the cap."
+	}
+
+	to := []string{email}
+	if sponsor.Valid {
+		sponsorEmail, err := uidToEmail(db, uidT(sponsor.Int64))
+		if err != nil {
+			return stacktrace.Propagate(err, "failed to get sponsor email")
+		}
+		to = append(to, sponsorEmail)
+	}
+	for _, t := range to {
+		err = enqueueEmail(db, t, subject, body)
+		if err != nil {
+			return stacktrace.Propagate(err, "failed to queue cap notice")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/palantir/stacktrace"
+)
+
+// Contracts let a user hold several part-time jobs at once, each with its own cost center and daily target.
+// While any are in effect, the user is expected to work the sum of their targets instead of users.daily_target_s.
+// Punches are attributed to a contract (entries.ctid): the one chosen when clocking in, or else the user's
+// first contract in effect. Absences aren't split between contracts.
+
+type ctidT int
+
+type contract struct {
+	CTID       ctidT  `json:"ctid"`
+	UID        uidT   `json:"uid"`
+	Name       string `json:"name"`
+	CostCenter string `json:"costCenter"`
+	Target     int    `json:"target"` // seconds per working day
+	From       string `json:"from"`   // like holiday.Date
+	To         string `json:"to"`     // inclusive, empty if it's open-ended
+}
+
+func (c contract) validate() error {
+	if c.Name == "" {
+		return stacktrace.NewError("contract needs a name")
+	}
+	if err := checkText("name", c.Name, maxNameLength); err != nil {
+		return err
+	}
+	if err := checkText("cost center", c.CostCenter, maxNameLength); err != nil {
+		return err
+	}
+	if c.Target < 0 || c.Target > 24*60*60 {
+		return stacktrace.NewError("hours has to be between 0 and 24")
+	}
+	from, err := time.Parse(holidayDate, c.From)
+	if err != nil {
+		return stacktrace.NewError("from has to be like 2019-10-03")
+	}
+	if c.To == "" {
+		return nil
+	}
+	to, err := time.Parse(holidayDate, c.To)
+	if err != nil {
+		return stacktrace.NewError("to has to be like 2019-10-03")
+	}
+	if to.Before(from) {
+		return stacktrace.NewError("to can't be before from")
+	}
+	return nil
+}
+
+// inEffect is whether the contract covers the day of date
+func (c contract) inEffect(date time.Time) bool {
+	d := date.Format(holidayDate)
+	return c.From <= d && (c.To == "" || c.To >= d)
+}
+
+// nullContract is the ctid column value for c, null for none
+func nullContract(c ctidT) interface{} {
+	if c == 0 {
+		return nil
+	}
+	return c
+}
+
+// userContracts are a user's contracts, see getContracts
+type userContracts []contract
+
+// target sums the daily targets of the contracts in effect on the day of date, ok is false if there are none
+func (ucs userContracts) target(date time.Time) (target int, ok bool) {
+	for _, c := range ucs {
+		if c.inEffect(date) {
+			target += c.Target
+			ok = true
+		}
+	}
+	return target, ok
+}
+
+// getContracts returns the user's contracts that are in effect at some point from the day of from
+// up to the day of to, inclusive
+func getContracts(ctx context.Context, db *sql.DB, uid uidT, from, to time.Time) (ucs userContracts, err error) {
+	rows, err := db.QueryContext(ctx,
+		`SELECT ctid, uid, name, cost_center, daily_target_s, from_date, IFNULL(to_date, '') FROM contracts
+			WHERE uid = ?1 AND from_date <= ?3 AND (to_date IS NULL OR to_date >= ?2) ORDER BY ctid`,
+		uid, from.Format(holidayDate), to.Format(holidayDate))
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed to get contracts")
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var c contract
+		err = rows.Scan(&c.CTID, &c.UID, &c.Name, &c.CostCenter, &c.Target, &c.From, &c.To)
+		if err != nil {
+			return nil, stacktrace.Propagate(err, "failed to scan row")
+		}
+		ucs = append(ucs, c)
+	}
+	return ucs, nil
+}
+
+// listContracts returns all of the user's contracts, the oldest first
+func listContracts(db *sql.DB, uid uidT) (cs []contract, err error) {
+	rows, err := db.Query(
+		`SELECT ctid, uid, name, cost_center, daily_target_s, from_date, IFNULL(to_date, '') FROM contracts
+			WHERE uid = ? ORDER BY from_date, ctid`, uid)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed to list contracts")
+	}
+	defer rows.Close()
+
+	cs = []contract{}
+	for rows.Next() {
+		var c contract
+		err = rows.Scan(&c.CTID, &c.UID, &c.Name, &c.CostCenter, &c.Target, &c.From, &c.To)
+		if err != nil {
+			return nil, stacktrace.Propagate(err, "failed to scan row")
+		}
+		cs = append(cs, c)
+	}
+	return cs, nil
+}
+
+// contractInEffect is whether ctid is one of the user's contracts and covers the day of date
+func contractInEffect(db *sql.DB, uid uidT, ctid ctidT, date time.Time) (ok bool, err error) {
+	ucs, err := getContracts(context.TODO(), db, uid, date, date)
+	if err != nil {
+		return false, err
+	}
+	for _, c := range ucs {
+		if c.CTID == ctid {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// hasContract is whether ctid is one of the user's contracts, in effect or not
+func hasContract(db *sql.DB, uid uidT, ctid ctidT) (found bool, err error) {
+	err = db.QueryRow("SELECT 1 FROM contracts WHERE ctid = ?1 AND uid = ?2", ctid, uid).Scan(new(int))
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, stacktrace.Propagate(err, "failed to get contract")
+}
+
+func createContract(db *sql.DB, c contract) (ctid ctidT, err error) {
+	var to interface{}
+	if c.To != "" {
+		to = c.To
+	}
+	res, err := db.Exec(
+		`INSERT INTO contracts (uid, name, cost_center, daily_target_s, from_date, to_date)
+			VALUES (?1, ?2, ?3, ?4, ?5, ?6)`, c.UID, c.Name, c.CostCenter, c.Target, c.From, to)
+	if err != nil {
+		return 0, stacktrace.Propagate(err, "failed to insert contract")
+	}
+	id, err := res.LastInsertId()
+	return ctidT(id), stacktrace.Propagate(err, "failed to get contract id")
+}
+
+// deleteContract deletes the contract, the time attributed to it isn't attributed to any anymore
+func deleteContract(db *sql.DB, ctid ctidT) (found bool, err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, stacktrace.Propagate(err, "failed to begin transaction")
+	}
+	defer tx.Rollback()
+
+	_, err = entryStore.exec(context.TODO(), tx, "UPDATE entries SET ctid = NULL WHERE ctid = ?", ctid)
+	if err != nil {
+		return false, stacktrace.Propagate(err, "failed to detach entries")
+	}
+	_, err = tx.Exec("UPDATE user_states SET ctid = NULL WHERE ctid = ?", ctid)
+	if err != nil {
+		return false, stacktrace.Propagate(err, "failed to detach user states")
+	}
+	res, err := tx.Exec("DELETE FROM contracts WHERE ctid = ?", ctid)
+	if err != nil {
+		return false, stacktrace.Propagate(err, "failed to delete contract")
+	}
+	n, err := res.RowsAffected()
+	if err != nil || n != 1 {
+		return false, stacktrace.Propagate(err, "failed to delete contract")
+	}
+	return true, stacktrace.Propagate(tx.Commit(), "failed to commit transaction")
+}
+
+// entryContract is the before and after of attributing an entry to a contract
+type entryContract struct {
+	Contract ctidT `json:"contract"`
+}
+
+// setEntryContract attributes the entry to ctid, 0 for none. found is false if there's no such entry
+// or the contract isn't one of the entry's user's.
+func setEntryContract(db *sql.DB, eid eidT, ctid ctidT, by uidT) (found bool, err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, stacktrace.Propagate(err, "failed to begin transaction")
+	}
+	defer tx.Rollback()
+
+	var uid uidT
+	var old ctidT
+	err = entryStore.queryRow(context.TODO(), tx, "SELECT uid, IFNULL(ctid, 0) FROM entries WHERE eid = ? AND deleted_unix_s IS NULL", eid).
+		Scan(&uid, &old)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, stacktrace.Propagate(err, "failed to get entry")
+	}
+	if ctid != 0 {
+		err = tx.QueryRow("SELECT 1 FROM contracts WHERE ctid = ?1 AND uid = ?2", ctid, uid).Scan(new(int))
+		if err == sql.ErrNoRows {
+			return false, nil
+		}
+		if err != nil {
+			return false, stacktrace.Propagate(err, "failed to get contract")
+		}
+	}
+
+	_, err = entryStore.exec(context.TODO(), tx, "UPDATE entries SET ctid = ?1 WHERE eid = ?2", nullContract(ctid), eid)
+	if err != nil {
+		return false, stacktrace.Propagate(err, "failed to set contract")
+	}
+	err = audit(tx, by, uid, auditAttribute, eid, entryContract{old}, entryContract{ctid})
+	if err != nil {
+		return false, err
+	}
+	return true, stacktrace.Propagate(tx.Commit(), "failed to commit transaction")
+}
+
+// contractReport sums up a month under one contract
+type contractReport struct {
+	Contract   ctidT  `json:"contract"` // 0 for work that isn't attributed to a contract
+	Name       string `json:"name"`
+	CostCenter string `json:"costCenter"`
+	Worked     int    `json:"worked"`
+	Expected   int    `json:"expected"`
+	Delta      int    `json:"delta"`
+}
+
+// getContractReports reports on the month for each of the user's contracts in effect during it, plus the
+// work that isn't attributed to any if there is some. Days are in loc, see userLocation. On days a schedule
+// profile changes the target, each contract is expected its share of it. Only finished entries count.
+func getContractReports(db *sql.DB, uid uidT, year int, month time.Month, loc *time.Location) (
+	crs []contractReport, err error) {
+	som := time.Date(year, month, 1, 0, 0, 0, 0, loc)
+	eom := som.AddDate(0, 1, 0)
+	sc, err := getSchedule(context.TODO(), db, uid, som, eom.AddDate(0, 0, -1))
+	if err != nil {
+		return nil, err
+	}
+
+	crs = []contractReport{}
+	index := map[ctidT]int{}
+	for _, c := range sc.contracts {
+		cr := contractReport{Contract: c.CTID, Name: c.Name, CostCenter: c.CostCenter}
+		for d := som; d.Before(eom); d = d.AddDate(0, 0, 1) {
+			expected := expectedForDay(d, sc)
+			total, _ := sc.contracts.target(d)
+			if expected > 0 && total > 0 && c.inEffect(d) {
+				cr.Expected += c.Target * expected / total
+			}
+		}
+		index[c.CTID] = len(crs)
+		crs = append(crs, cr)
+	}
+
+	rows, err := entryStore.query(context.TODO(), db,
+		`SELECT IFNULL(ctid, 0), SUM(to_unix_s - from_unix_s
+				- CASE WHEN ?4 > 0 AND to_unix_s - from_unix_s > ?4 THEN ?5 ELSE 0 END) FROM entries
+			WHERE uid = ?1 AND valid = 1 AND approved = 1 AND deleted_unix_s IS NULL AND kind = 'work'
+				AND from_unix_s >= ?2 AND from_unix_s < ?3
+			GROUP BY IFNULL(ctid, 0)`,
+		uid, som.Unix(), eom.Unix(), lunchDeduction.After, lunchDeduction.Deduct)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed to sum up contracts")
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var ctid ctidT
+		var worked int
+		err = rows.Scan(&ctid, &worked)
+		if err != nil {
+			return nil, stacktrace.Propagate(err, "failed to scan row")
+		}
+		i, ok := index[ctid]
+		if !ok {
+			// unattributed, or a contract that isn't in effect this month anymore
+			index[ctid] = len(crs)
+			i = len(crs)
+			crs = append(crs, contractReport{Contract: ctid})
+		}
+		crs[i].Worked = worked
+	}
+	for i := range crs {
+		crs[i].Delta = crs[i].Worked - crs[i].Expected
+	}
+	return crs, nil
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/palantir/stacktrace"
+)
+
+// Sensitive fields are stored as a blind index, a keyed hash that can be looked up but not reversed,
+// next to a sealed (encrypted) copy that lets the key be rotated. Both are prefixed with the id of
+// the key they were made with. Badges are the only such field so far. Sensitive values that are never
+// looked up are only sealed, see sealBytes. The keys are the deployment's, each has its own database.
+// These are all the sensitive columns, `wms2 rotate-keys` rotates each of them:
+//   - users.badge and users.badge_sealed, badge numbers as blind index and sealed
+//   - training_details.course, certificate and certificate_type, the attachments of training entries
+//     and their metadata, sealed
+// There are no notes on entries or leave requests to seal. The reason for editing or deleting someone
+// else's entry is only in the email telling them, see noticeEntryChanged, which outbox.payload keeps
+// in the clear like every message it sends. break_glass.reason stays in the clear for whoever reviews
+// the grants.
+
+// keyring holds the keys for sensitive fields, the one with the highest id is the current one
+type keyring struct {
+	current int
+	keys    map[int][]byte
+}
+
+// fieldKeys is nil if no keys are configured, sensitive fields are stored in the clear then
+var fieldKeys *keyring
+
+// keyringFromEnv reads WMS2_DATA_KEYS, a comma separated list of id:key with the keys being
+// 32 random bytes in base64, e.g. "1:<key>,2:<key>". It returns nil if the variable isn't set.
+func keyringFromEnv() (k *keyring, err error) {
+	s := os.Getenv("WMS2_DATA_KEYS")
+	if s == "" {
+		return nil, nil
+	}
+
+	k = &keyring{keys: make(map[int][]byte)}
+	for _, pair := range strings.Split(s, ",") {
+		parts := strings.SplitN(strings.TrimSpace(pair), ":", 2)
+		if len(parts) != 2 {
+			return nil, stacktrace.NewError("WMS2_DATA_KEYS entries have to look like id:key")
+		}
+		id, err := strconv.Atoi(parts[0])
+		if err != nil || id < 1 {
+			return nil, stacktrace.NewError("WMS2_DATA_KEYS ids have to be positive numbers")
+		}
+		key, err := base64.StdEncoding.DecodeString(parts[1])
+		if err != nil || len(key) != 32 {
+			return nil, stacktrace.NewError("WMS2_DATA_KEYS key %d has to be 32 bytes in base64", id)
+		}
+		k.keys[id] = key
+		if id > k.current {
+			k.current = id
+		}
+	}
+	return k, nil
+}
+
+// subkey derives a key for one purpose, so encryption and the blind index don't share one
+func (k *keyring) subkey(id int, purpose string) []byte {
+	mac := hmac.New(sha256.New, k.keys[id])
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil)
+}
+
+func (k *keyring) index(id int, value string) string {
+	mac := hmac.New(sha256.New, k.subkey(id, "wms2 blind index"))
+	mac.Write([]byte(value))
+	return strconv.Itoa(id) + ":" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (k *keyring) seal(value string) (sealed string, err error) {
+	block, err := aes.NewCipher(k.subkey(k.current, "wms2 encryption"))
+	if err != nil {
+		return "", stacktrace.Propagate(err, "failed to create cipher")
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", stacktrace.Propagate(err, "failed to create cipher")
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return "", stacktrace.Propagate(err, "failed to generate nonce")
+	}
+	ct := gcm.Seal(nonce, nonce, []byte(value), nil)
+	return strconv.Itoa(k.current) + ":" + base64.StdEncoding.EncodeToString(ct), nil
+}
+
+func (k *keyring) open(sealed string) (value string, err error) {
+	parts := strings.SplitN(sealed, ":", 2)
+	id, err := strconv.Atoi(parts[0])
+	if err != nil || len(parts) != 2 || k.keys[id] == nil {
+		return "", stacktrace.NewError("sealed with an unknown key")
+	}
+	ct, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", stacktrace.Propagate(err, "invalid sealed value")
+	}
+
+	block, err := aes.NewCipher(k.subkey(id, "wms2 encryption"))
+	if err != nil {
+		return "", stacktrace.Propagate(err, "failed to create cipher")
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", stacktrace.Propagate(err, "failed to create cipher")
+	}
+	if len(ct) < gcm.NonceSize() {
+		return "", stacktrace.NewError("invalid sealed value")
+	}
+
+	pt, err := gcm.Open(nil, ct[:gcm.NonceSize()], ct[gcm.NonceSize():], nil)
+	return string(pt), stacktrace.Propagate(err, "failed to decrypt")
+}
+
+// protect returns what to store for a sensitive value, the index to look it up by and its sealed copy
+func (k *keyring) protect(value string) (index string, sealed sql.NullString, err error) {
+	if k == nil {
+		return value, sealed, nil
+	}
+	sealed.String, err = k.seal(value)
+	sealed.Valid = err == nil
+	return k.index(k.current, value), sealed, err
+}
+
+// lookups returns what a sensitive value may be stored as: its index under each key,
+// and the value itself for what was stored before keys were configured
+func (k *keyring) lookups(value string) []interface{} {
+	ls := []interface{}{value}
+	if k != nil {
+		for id := range k.keys {
+			ls = append(ls, k.index(id, value))
+		}
+	}
+	return ls
+}
+
+// sealBytes returns what to store for a sensitive value that's never looked up: the value sealed with the
+// current key, or the value itself if no keys are configured. sealed is which one it is.
+func (k *keyring) sealBytes(value []byte) (stored []byte, sealed bool, err error) {
+	if k == nil {
+		return value, false, nil
+	}
+	s, err := k.seal(string(value))
+	return []byte(s), err == nil, err
+}
+
+// openBytes returns the value sealBytes stored
+func (k *keyring) openBytes(stored []byte, sealed bool) (value []byte, err error) {
+	if !sealed {
+		return stored, nil
+	}
+	if k == nil {
+		return nil, stacktrace.NewError("sealed, but no keys configured, set WMS2_DATA_KEYS")
+	}
+	s, err := k.open(string(stored))
+	return []byte(s), err
+}
+
+// rotateBadges protects every badge with the current key, including ones stored in the clear
+func rotateBadges(db *sql.DB, k *keyring) (rotated int, err error) {
+	if k == nil {
+		return 0, stacktrace.NewError("no keys configured, set WMS2_DATA_KEYS")
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, stacktrace.Propagate(err, "failed to begin transaction")
+	}
+	rollback := func() {
+		if err := tx.Rollback(); err != nil {
+			logError(stacktrace.Propagate(err, "failed to roll back transaction"))
+		}
+	}
+
+	rows, err := tx.Query("SELECT uid, badge, badge_sealed FROM users WHERE badge IS NOT NULL")
+	if err != nil {
+		rollback()
+		return 0, stacktrace.Propagate(err, "failed to select badges")
+	}
+	type stored struct {
+		uid    uidT
+		badge  string
+		sealed sql.NullString
+	}
+	all := []stored{}
+	for rows.Next() {
+		var s stored
+		err = rows.Scan(&s.uid, &s.badge, &s.sealed)
+		if err != nil {
+			rows.Close()
+			rollback()
+			return 0, stacktrace.Propagate(err, "failed to scan row")
+		}
+		all = append(all, s)
+	}
+	rows.Close()
+
+	prefix := strconv.Itoa(k.current) + ":"
+	for _, s := range all {
+		badge := s.badge // stored in the clear
+		if s.sealed.Valid {
+			if strings.HasPrefix(s.sealed.String, prefix) {
+				continue // already under the current key
+			}
+			badge, err = k.open(s.sealed.String)
+			if err != nil {
+				rollback()
+				return 0, stacktrace.Propagate(err, "failed to open badge of user %d", s.uid)
+			}
+		}
+
+		index, sealed, err := k.protect(badge)
+		if err != nil {
+			rollback()
+			return 0, err
+		}
+		_, err = tx.Exec("UPDATE users SET badge = ?1, badge_sealed = ?2 WHERE uid = ?3", index, sealed, s.uid)
+		if err != nil {
+			rollback()
+			return 0, stacktrace.Propagate(err, "failed to update badge of user %d", s.uid)
+		}
+		rotated++
+	}
+
+	err = tx.Commit()
+	return rotated, stacktrace.Propagate(err, "failed to commit transaction")
+}
+
+// rotateTraining seals the course and certificate of every training entry with the current key, including
+// ones stored in the clear
+func rotateTraining(db *sql.DB, k *keyring) (rotated int, err error) {
+	if k == nil {
+		return 0, stacktrace.NewError("no keys configured, set WMS2_DATA_KEYS")
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, stacktrace.Propagate(err, "failed to begin transaction")
+	}
+	rollback := func() {
+		if err := tx.Rollback(); err != nil {
+			logError(stacktrace.Propagate(err, "failed to roll back transaction"))
+		}
+	}
+
+	rows, err := tx.Query(
+		"SELECT eid, course, course_sealed, certificate, certificate_type, certificate_sealed FROM training_details")
+	if err != nil {
+		rollback()
+		return 0, stacktrace.Propagate(err, "failed to select training details")
+	}
+	type stored struct {
+		eid                             eidT
+		course, certificate, certType   []byte
+		courseSealed, certificateSealed bool
+	}
+	all := []stored{}
+	for rows.Next() {
+		var s stored
+		err = rows.Scan(&s.eid, &s.course, &s.courseSealed, &s.certificate, &s.certType, &s.certificateSealed)
+		if err != nil {
+			rows.Close()
+			rollback()
+			return 0, stacktrace.Propagate(err, "failed to scan row")
+		}
+		all = append(all, s)
+	}
+	rows.Close()
+
+	prefix := []byte(strconv.Itoa(k.current) + ":")
+	current := func(value []byte, sealed bool) bool {
+		return value == nil || sealed && bytes.HasPrefix(value, prefix)
+	}
+	// reseal seals what's stored with the current key
+	reseal := func(value []byte, sealed bool) (resealed []byte, err error) {
+		if value == nil {
+			return nil, nil
+		}
+		value, err = k.openBytes(value, sealed)
+		if err != nil {
+			return nil, err
+		}
+		resealed, _, err = k.sealBytes(value)
+		return resealed, err
+	}
+	for _, s := range all {
+		if current(s.course, s.courseSealed) && current(s.certificate, s.certificateSealed) {
+			continue
+		}
+		course, err := reseal(s.course, s.courseSealed)
+		if err != nil {
+			rollback()
+			return 0, stacktrace.Propagate(err, "failed to reseal course of entry %d", s.eid)
+		}
+		certificate, err := reseal(s.certificate, s.certificateSealed)
+		if err != nil {
+			rollback()
+			return 0, stacktrace.Propagate(err, "failed to reseal certificate of entry %d", s.eid)
+		}
+		var certType interface{}
+		if s.certType != nil {
+			sealedType, err := reseal(s.certType, s.certificateSealed)
+			if err != nil {
+				rollback()
+				return 0, stacktrace.Propagate(err, "failed to reseal certificate of entry %d", s.eid)
+			}
+			certType = string(sealedType)
+		}
+
+		_, err = tx.Exec(
+			`UPDATE training_details SET course = ?1, course_sealed = 1, certificate = ?2, certificate_type = ?3,
+				certificate_sealed = ?4 WHERE eid = ?5`, string(course), certificate, certType, certificate != nil, s.eid)
+		if err != nil {
+			rollback()
+			return 0, stacktrace.Propagate(err, "failed to update training details of entry %d", s.eid)
+		}
+		rotated++
+	}
+
+	err = tx.Commit()
+	return rotated, stacktrace.Propagate(err, "failed to commit transaction")
+}
@@ -0,0 +1,575 @@
+package main
+
+import (
+	"database/sql"
+	"os"
+	"strconv"
+
+	"github.com/palantir/stacktrace"
+)
+
+// schema creates the tables of a new database
+const schema = `
+CREATE TABLE sites (
+	stid INTEGER PRIMARY KEY AUTOINCREMENT,
+	name TEXT,
+	timezone TEXT, -- IANA name, or Local for the server's
+	clock_out_s INTEGER DEFAULT 0, -- when open states get disqualified, seconds after local midnight
+	UNIQUE(name)
+);
+
+INSERT INTO sites (name, timezone) VALUES ('Main', 'Local');
+
+CREATE TABLE users (
+	uid INTEGER PRIMARY KEY AUTOINCREMENT, -- so that they don't repeat
+	email TEXT,
+	password_hash BLOB,
+	password_salt BLOB,
+	admin INTEGER CHECK(admin IN (0, 1)),
+	auditor INTEGER DEFAULT 0 CHECK(auditor IN (0, 1)), -- read-only access to everything
+	warden INTEGER DEFAULT 0 CHECK(warden IN (0, 1)), -- may run evacuation musters
+	badge TEXT, -- what the user scans at kiosks, can be null, a blind index if keys are configured (see crypt.go)
+	badge_sealed TEXT, -- the badge encrypted, null if it's stored in the clear
+	weekly_summary INTEGER DEFAULT 1 CHECK(weekly_summary IN (0, 1)), -- gets the weekly email, 0 if opted out
+	presence TEXT DEFAULT 'off' CHECK(presence IN ('off', 'suggest', 'punch')), -- what presence events do
+	stid INTEGER DEFAULT 1, -- default site, for punches that don't come from a device
+	daily_target_s INTEGER NOT NULL DEFAULT 28800, -- seconds expected per working day
+	monthly_cap_s INTEGER, -- seconds a contractor may work per month, null for regular users
+	sponsor INTEGER, -- who gets notified about a contractor's cap, can be null
+	timezone TEXT, -- IANA name like Europe/Berlin, null for the server's, see userLocation
+	payroll_id TEXT, -- personnel number at the payroll provider, null to use the uid, see payroll.go
+	display_name TEXT, -- what kiosks greet the user with, null for the start of the email, see greeting.go
+	language TEXT, -- of kiosk greetings, like de, null for English
+	photo BLOB, -- shown by kiosks, can be null
+	photo_type TEXT, -- content type of the photo
+	hired_date TEXT, -- like 2026-04-01, null if unknown, see probation.go
+	FOREIGN KEY (stid) REFERENCES sites(stid),
+	FOREIGN KEY (sponsor) REFERENCES users(uid),
+	UNIQUE(email),
+	UNIQUE(badge)
+);
+
+CREATE TABLE holiday_calendars ( -- iCal feeds holidays are synced from, see holidaycal.go
+	hcid INTEGER PRIMARY KEY AUTOINCREMENT,
+	url TEXT NOT NULL,
+	stid INTEGER, -- like holidays.stid
+	synced_unix_s INTEGER, -- the last successful sync, null if there was none
+	last_error TEXT, -- why the last sync failed, null if it didn't
+	FOREIGN KEY (stid) REFERENCES sites(stid)
+);
+
+CREATE TABLE holidays (
+	hid INTEGER PRIMARY KEY AUTOINCREMENT,
+	date TEXT NOT NULL, -- like 2019-10-03, in whatever timezone the day is looked at
+	name TEXT,
+	stid INTEGER, -- the site it's a holiday at, null for all sites
+	hcid INTEGER, -- the calendar it was synced from, null if it was added by hand
+	FOREIGN KEY (stid) REFERENCES sites(stid),
+	FOREIGN KEY (hcid) REFERENCES holiday_calendars(hcid)
+);
+
+CREATE TABLE schedule_profiles ( -- temporary daily targets for groups of users, see profiles.go
+	spid INTEGER PRIMARY KEY AUTOINCREMENT,
+	name TEXT NOT NULL,
+	from_date TEXT NOT NULL, -- like holidays.date
+	to_date TEXT NOT NULL, -- inclusive
+	daily_target_s INTEGER NOT NULL, -- replaces users.daily_target_s on the days it covers
+	weekdays INTEGER NOT NULL DEFAULT 127, -- the days of the week it covers, bit n is time.Weekday n
+	stid INTEGER, -- covers everyone at the site besides its users, can be null
+	FOREIGN KEY (stid) REFERENCES sites(stid)
+);
+
+CREATE TABLE schedule_profile_users (
+	spid INTEGER NOT NULL,
+	uid INTEGER NOT NULL,
+	UNIQUE (spid, uid),
+	FOREIGN KEY (spid) REFERENCES schedule_profiles(spid),
+	FOREIGN KEY (uid) REFERENCES users(uid)
+);
+
+CREATE TABLE school_days ( -- recurring school days of apprentices, see school.go
+	sdid INTEGER PRIMARY KEY AUTOINCREMENT,
+	uid INTEGER NOT NULL,
+	weekdays INTEGER NOT NULL, -- like schedule_profiles.weekdays
+	from_date TEXT NOT NULL, -- like holidays.date
+	to_date TEXT NOT NULL, -- inclusive
+	FOREIGN KEY (uid) REFERENCES users(uid)
+);
+
+CREATE TABLE contracts ( -- concurrent employment contracts of a user, see contracts.go
+	ctid INTEGER PRIMARY KEY AUTOINCREMENT,
+	uid INTEGER NOT NULL,
+	name TEXT NOT NULL,
+	cost_center TEXT NOT NULL DEFAULT '',
+	daily_target_s INTEGER NOT NULL, -- seconds expected per working day under the contract
+	from_date TEXT NOT NULL, -- like holidays.date
+	to_date TEXT, -- inclusive, null if it's open-ended
+	FOREIGN KEY (uid) REFERENCES users(uid)
+);
+
+CREATE TABLE weekend_approvals ( -- weekend days users may work on, see weekend.go
+	uid INTEGER NOT NULL,
+	date TEXT NOT NULL, -- like holidays.date
+	approved_by INTEGER,
+	approved_unix_s INTEGER NOT NULL,
+	UNIQUE (uid, date),
+	FOREIGN KEY (uid) REFERENCES users(uid),
+	FOREIGN KEY (approved_by) REFERENCES users(uid)
+);
+
+CREATE TABLE user_states (
+	uid INTEGER NOT NULL,
+	state TEXT NOT NULL CHECK(state IN ('I', 'O', 'B')),
+	since_unix_s INTEGER NOT NULL, -- see entries.from_unix_s
+	expected_end_unix_s INTEGER, -- when a clocked in user plans to clock out, can be null
+	stid INTEGER, -- where the user clocked in, null when clocked out
+	ctid INTEGER, -- the contract the user clocked in under, like stid
+	after_break INTEGER DEFAULT 0 CHECK(after_break IN (0, 1)), -- clocked in at the end of a break
+	heartbeat_unix_s INTEGER, -- last ping from a client in heartbeat mode, null if it isn't in that mode
+	missed_heartbeat INTEGER DEFAULT 0 CHECK(missed_heartbeat IN (0, 1)), -- a heartbeat came too late since clocking in
+	FOREIGN KEY (uid) REFERENCES users(uid),
+	FOREIGN KEY (stid) REFERENCES sites(stid),
+	FOREIGN KEY (ctid) REFERENCES contracts(ctid),
+	UNIQUE(uid) -- a user is only ever in one state, so only one activity can be open
+);
+
+CREATE TABLE categories ( -- of entries, see categories.go
+	catid INTEGER PRIMARY KEY AUTOINCREMENT,
+	name TEXT NOT NULL,
+	label TEXT NOT NULL,
+	color TEXT NOT NULL,
+	UNIQUE(name)
+);
+
+INSERT INTO categories (name, label, color) VALUES
+	('regular', 'Regular', '#4a90d9'),
+	('on-call', 'On call', '#e67e22'),
+	('training', 'Training', '#27ae60'),
+	('travel', 'Travel', '#8e44ad');
+
+CREATE TABLE entries (
+	eid INTEGER PRIMARY KEY AUTOINCREMENT, -- so that they don't repeat
+	uid INTEGER,
+	from_unix_s INTEGER, -- "_s" stands for seconds, unlike the JS millisecond unix time
+	to_unix_s INTEGER, -- see above, can be null, signifies disqualifed entry
+	valid INTEGER CHECK(valid IN (0, 1)),
+	source TEXT CHECK(source IN ('clock', 'auto-close', 'manual')), -- what created the entry
+	kind TEXT NOT NULL DEFAULT 'work' CHECK(kind IN ('work', 'sick', 'vacation', 'other')), -- see entryWork
+	after_break INTEGER DEFAULT 0 CHECK(after_break IN (0, 1)), -- the gap before it was a break
+	approved INTEGER NOT NULL DEFAULT 1 CHECK(approved IN (0, 1)), -- 0 while a manual entry waits for approval
+	over_cap INTEGER DEFAULT 0 CHECK(over_cap IN (0, 1)), -- a contractor's month went over the cap with it
+	stid INTEGER, -- site the user clocked in at
+	ctid INTEGER, -- the contract it's attributed to, null for none
+	catid INTEGER, -- its category, null for none, see categories.go
+	missed_heartbeat INTEGER DEFAULT 0 CHECK(missed_heartbeat IN (0, 1)), -- see user_states.missed_heartbeat
+	confirmed_unix_s INTEGER, -- when the user confirmed an auto-close entry, see autoclose.go
+	deleted_unix_s INTEGER, -- set while it's in the trash, null otherwise
+	deleted_by INTEGER,
+	created_unix_s INTEGER NOT NULL DEFAULT (CAST(strftime('%s', 'now') AS INTEGER)),
+	updated_unix_s INTEGER NOT NULL DEFAULT (CAST(strftime('%s', 'now') AS INTEGER)), -- see entries_updated
+	FOREIGN KEY (uid) REFERENCES users(uid),
+	FOREIGN KEY (stid) REFERENCES sites(stid),
+	FOREIGN KEY (ctid) REFERENCES contracts(ctid),
+	FOREIGN KEY (catid) REFERENCES categories(catid) ON DELETE SET NULL,
+	FOREIGN KEY (deleted_by) REFERENCES users(uid),
+	CHECK(from_unix_s <= to_unix_s)
+);
+
+CREATE TABLE training_details ( -- of entries in the training category, see training.go
+	eid INTEGER PRIMARY KEY,
+	course TEXT NOT NULL, -- can be empty
+	certificate BLOB, -- a PDF or an image, can be null
+	certificate_type TEXT, -- its content type
+	course_sealed INTEGER NOT NULL DEFAULT 0 CHECK(course_sealed IN (0, 1)), -- whether course is, see crypt.go
+	certificate_sealed INTEGER NOT NULL DEFAULT 0 CHECK(certificate_sealed IN (0, 1)), -- and the certificate and its type
+	FOREIGN KEY (eid) REFERENCES entries(eid) ON DELETE CASCADE
+);
+
+CREATE TABLE devices (
+	did INTEGER PRIMARY KEY AUTOINCREMENT,
+	name TEXT,
+	kind TEXT CHECK(kind IN ('kiosk', 'display', 'presence')),
+	allowed_ips TEXT, -- comma separated IPs and CIDR ranges the device may connect from, null for any
+	cert_fingerprint TEXT, -- hex SHA-256 of the client certificate the device has to present, null for none
+	token TEXT, -- sent by the device instead of a session id
+	stid INTEGER DEFAULT 1,
+	FOREIGN KEY (stid) REFERENCES sites(stid),
+	UNIQUE(token)
+);
+
+CREATE TABLE punches (
+	pid INTEGER PRIMARY KEY AUTOINCREMENT,
+	uid INTEGER,
+	did INTEGER, -- null unless punched on a device
+	stid INTEGER, -- site of the device, or the user's default site
+	kind TEXT CHECK(kind IN ('I', 'O', 'B')), -- see user_states.state
+	at_unix_s INTEGER, -- see entries.from_unix_s
+	result TEXT CHECK(result IN ('accepted', 'duplicate', 'failed')),
+	FOREIGN KEY (uid) REFERENCES users(uid),
+	FOREIGN KEY (did) REFERENCES devices(did),
+	FOREIGN KEY (stid) REFERENCES sites(stid)
+);
+
+CREATE TABLE musters (
+	mid INTEGER PRIMARY KEY AUTOINCREMENT,
+	started_unix_s INTEGER,
+	started_by INTEGER,
+	stid INTEGER, -- null if the muster covers all sites
+	FOREIGN KEY (started_by) REFERENCES users(uid),
+	FOREIGN KEY (stid) REFERENCES sites(stid)
+);
+
+CREATE TABLE muster_users ( -- who was clocked in when the muster started
+	mid INTEGER,
+	uid INTEGER,
+	stid INTEGER, -- where the user was clocked in
+	accounted_by INTEGER, -- null until a warden accounts for the user
+	accounted_unix_s INTEGER,
+	FOREIGN KEY (mid) REFERENCES musters(mid),
+	FOREIGN KEY (uid) REFERENCES users(uid),
+	FOREIGN KEY (stid) REFERENCES sites(stid),
+	FOREIGN KEY (accounted_by) REFERENCES users(uid),
+	UNIQUE(mid, uid)
+);
+
+CREATE TABLE idle_periods (
+	ipid INTEGER PRIMARY KEY AUTOINCREMENT,
+	uid INTEGER NOT NULL,
+	from_unix_s INTEGER NOT NULL, -- as reported by the user's desktop agent
+	to_unix_s INTEGER NOT NULL,
+	status TEXT NOT NULL DEFAULT 'pending' CHECK(status IN ('pending', 'confirmed', 'dismissed')),
+	FOREIGN KEY (uid) REFERENCES users(uid),
+	CHECK(from_unix_s < to_unix_s)
+);
+
+CREATE TABLE calendar_tokens ( -- see icalfeed.go
+	uid INTEGER NOT NULL,
+	token TEXT NOT NULL,
+	created_unix_s INTEGER,
+	FOREIGN KEY (uid) REFERENCES users(uid),
+	UNIQUE(uid), -- a new token replaces the old one
+	UNIQUE(token)
+);
+
+CREATE TABLE user_identities ( -- ids of users in other systems, see identity.go
+	uid INTEGER NOT NULL,
+	system TEXT NOT NULL CHECK(system IN ('hris', 'ldap')),
+	external_id TEXT NOT NULL,
+	FOREIGN KEY (uid) REFERENCES users(uid),
+	UNIQUE(uid, system),
+	UNIQUE(system, external_id)
+);
+
+CREATE TABLE slack_users ( -- see slack.go
+	slack_id TEXT NOT NULL,
+	uid INTEGER NOT NULL,
+	FOREIGN KEY (uid) REFERENCES users(uid),
+	UNIQUE(slack_id),
+	UNIQUE(uid)
+);
+
+CREATE TABLE telegram_users ( -- see telegram.go
+	telegram_id INTEGER NOT NULL,
+	uid INTEGER NOT NULL,
+	FOREIGN KEY (uid) REFERENCES users(uid),
+	UNIQUE(telegram_id),
+	UNIQUE(uid)
+);
+
+CREATE TABLE extension_tokens (
+	uid INTEGER NOT NULL,
+	token TEXT NOT NULL,
+	created_unix_s INTEGER,
+	FOREIGN KEY (uid) REFERENCES users(uid),
+	UNIQUE(uid), -- a new token replaces the old one
+	UNIQUE(token)
+);
+
+CREATE TABLE punch_suggestions (
+	psid INTEGER PRIMARY KEY AUTOINCREMENT,
+	uid INTEGER NOT NULL,
+	did INTEGER, -- the presence device that saw the user
+	kind TEXT CHECK(kind IN ('I', 'O')), -- see user_states.state
+	at_unix_s INTEGER NOT NULL,
+	status TEXT NOT NULL DEFAULT 'pending' CHECK(status IN ('pending', 'accepted', 'dismissed')),
+	FOREIGN KEY (uid) REFERENCES users(uid),
+	FOREIGN KEY (did) REFERENCES devices(did)
+);
+
+CREATE TABLE device_users ( -- users approved to punch at a kiosk, see approvals.go
+	did INTEGER NOT NULL,
+	uid INTEGER NOT NULL,
+	FOREIGN KEY (did) REFERENCES devices(did),
+	FOREIGN KEY (uid) REFERENCES users(uid),
+	UNIQUE(did, uid)
+);
+
+CREATE TABLE held_punches ( -- kiosk punches waiting for the device to be approved
+	hpid INTEGER PRIMARY KEY AUTOINCREMENT,
+	uid INTEGER NOT NULL,
+	did INTEGER NOT NULL,
+	kind TEXT CHECK(kind IN ('I', 'O')), -- see user_states.state
+	at_unix_s INTEGER NOT NULL,
+	status TEXT NOT NULL DEFAULT 'pending' CHECK(status IN ('pending', 'approved', 'rejected')),
+	FOREIGN KEY (uid) REFERENCES users(uid),
+	FOREIGN KEY (did) REFERENCES devices(did)
+);
+
+CREATE TABLE entry_changes (
+	cid INTEGER PRIMARY KEY AUTOINCREMENT, -- the cursor of the change feed
+	uid INTEGER NOT NULL,
+	eid INTEGER NOT NULL, -- no foreign key, deletions are changes too
+	deleted INTEGER NOT NULL DEFAULT 0 CHECK(deleted IN (0, 1))
+);
+
+CREATE TRIGGER entries_inserted AFTER INSERT ON entries BEGIN
+	INSERT INTO entry_changes (uid, eid) VALUES (NEW.uid, NEW.eid);
+END;
+
+-- setting updated_unix_s doesn't fire the trigger again, recursive triggers are off
+CREATE TRIGGER entries_updated AFTER UPDATE ON entries BEGIN
+	INSERT INTO entry_changes (uid, eid, deleted) VALUES (NEW.uid, NEW.eid, NEW.deleted_unix_s IS NOT NULL);
+	UPDATE entries SET updated_unix_s = CAST(strftime('%s', 'now') AS INTEGER) WHERE eid = NEW.eid;
+END;
+
+-- to the user an entry was moved away from (see merge.go) it's gone
+CREATE TRIGGER entries_moved AFTER UPDATE OF uid ON entries WHEN OLD.uid IS NOT NEW.uid BEGIN
+	INSERT INTO entry_changes (uid, eid, deleted) VALUES (OLD.uid, OLD.eid, 1);
+END;
+
+CREATE TRIGGER entries_deleted AFTER DELETE ON entries BEGIN
+	INSERT INTO entry_changes (uid, eid, deleted) VALUES (OLD.uid, OLD.eid, 1);
+END;
+
+CREATE TABLE outbox (
+	oid INTEGER PRIMARY KEY AUTOINCREMENT,
+	kind TEXT NOT NULL, -- what delivers it, e.g. email
+	payload TEXT NOT NULL, -- JSON, depends on the kind
+	created_unix_s INTEGER NOT NULL,
+	attempts INTEGER NOT NULL DEFAULT 0,
+	next_attempt_unix_s INTEGER NOT NULL,
+	last_error TEXT,
+	status TEXT NOT NULL DEFAULT 'pending' CHECK(status IN ('pending', 'sent', 'dead'))
+);
+
+CREATE TABLE webhooks ( -- see webhooks.go
+	whid INTEGER PRIMARY KEY AUTOINCREMENT,
+	url TEXT NOT NULL,
+	secret TEXT NOT NULL,
+	events TEXT NOT NULL, -- comma separated, empty for all
+	created_unix_s INTEGER NOT NULL
+);
+
+CREATE TABLE approvals ( -- manual entries and edits waiting for an admin, see edits.go
+	apid INTEGER PRIMARY KEY AUTOINCREMENT,
+	kind TEXT NOT NULL CHECK(kind IN ('entry', 'edit')),
+	eid INTEGER NOT NULL,
+	from_unix_s INTEGER NOT NULL, -- what the entry is to be changed to for edits
+	to_unix_s INTEGER NOT NULL,
+	submitted_by INTEGER,
+	submitted_unix_s INTEGER NOT NULL,
+	status TEXT NOT NULL DEFAULT 'pending' CHECK(status IN ('pending', 'approved', 'rejected')),
+	decided_by INTEGER,
+	decided_unix_s INTEGER,
+	FOREIGN KEY (eid) REFERENCES entries(eid) ON DELETE CASCADE,
+	FOREIGN KEY (submitted_by) REFERENCES users(uid),
+	FOREIGN KEY (decided_by) REFERENCES users(uid)
+);
+
+CREATE TABLE audit_log ( -- who changed what, see audit.go
+	alid INTEGER PRIMARY KEY AUTOINCREMENT,
+	at_unix_s INTEGER NOT NULL,
+	by_uid INTEGER, -- null for the server itself
+	uid INTEGER NOT NULL, -- whose data it is
+	action TEXT NOT NULL,
+	eid INTEGER, -- no foreign key, the log outlives entries
+	before TEXT, -- JSON, depends on the action
+	after TEXT,
+	hash TEXT, -- hex SHA-256 chaining it to the record before, null if unchained, see auditchain.go
+	FOREIGN KEY (by_uid) REFERENCES users(uid),
+	FOREIGN KEY (uid) REFERENCES users(uid)
+);
+
+CREATE INDEX audit_log_at ON audit_log (at_unix_s);
+
+CREATE TABLE access_log ( -- who read whose records, see access.go
+	acid INTEGER PRIMARY KEY AUTOINCREMENT,
+	at_unix_s INTEGER NOT NULL,
+	by_uid INTEGER NOT NULL,
+	uid INTEGER, -- whose records they were, null for reads across users
+	route TEXT NOT NULL, -- like GET /a/users/:id/reports/month
+	path TEXT NOT NULL,
+	break_glass INTEGER, -- the grant the request was made under, see breakglass.go
+	FOREIGN KEY (by_uid) REFERENCES users(uid),
+	FOREIGN KEY (uid) REFERENCES users(uid),
+	FOREIGN KEY (break_glass) REFERENCES break_glass(bgid)
+);
+
+CREATE TABLE break_glass ( -- emergency admin sessions, see breakglass.go
+	bgid INTEGER PRIMARY KEY AUTOINCREMENT,
+	uid INTEGER NOT NULL,
+	sid TEXT NOT NULL,
+	reason TEXT NOT NULL,
+	from_unix_s INTEGER NOT NULL,
+	until_unix_s INTEGER NOT NULL, -- when it expires or was closed
+	FOREIGN KEY (uid) REFERENCES users(uid)
+);
+
+CREATE INDEX access_log_at ON access_log (at_unix_s);
+
+CREATE TABLE user_merges ( -- see merge.go
+	mgid INTEGER PRIMARY KEY AUTOINCREMENT,
+	from_uid INTEGER NOT NULL,
+	into_uid INTEGER NOT NULL,
+	by_uid INTEGER NOT NULL,
+	at_unix_s INTEGER NOT NULL,
+	undone_unix_s INTEGER, -- null unless it was undone
+	FOREIGN KEY (from_uid) REFERENCES users(uid),
+	FOREIGN KEY (into_uid) REFERENCES users(uid),
+	FOREIGN KEY (by_uid) REFERENCES users(uid)
+);
+
+CREATE TABLE user_merge_rows ( -- the rows a merge moved, so it can be undone
+	mgid INTEGER NOT NULL,
+	tbl TEXT NOT NULL,
+	row INTEGER NOT NULL, -- rowid in tbl
+	FOREIGN KEY (mgid) REFERENCES user_merges(mgid)
+);
+
+CREATE TABLE leave_requests ( -- see leave.go
+	lrid INTEGER PRIMARY KEY AUTOINCREMENT,
+	uid INTEGER NOT NULL,
+	type TEXT NOT NULL CHECK(type IN ('vacation', 'sick', 'other')),
+	from_date TEXT NOT NULL, -- like holidays.date
+	to_date TEXT NOT NULL, -- inclusive
+	status TEXT NOT NULL DEFAULT 'pending' CHECK(status IN ('pending', 'approved', 'denied')),
+	submitted_unix_s INTEGER NOT NULL,
+	decided_by INTEGER,
+	decided_unix_s INTEGER,
+	FOREIGN KEY (uid) REFERENCES users(uid),
+	FOREIGN KEY (decided_by) REFERENCES users(uid)
+);
+
+CREATE TABLE timesheet_signoffs ( -- months users submitted and admins approved, see signoff.go
+	uid INTEGER NOT NULL,
+	year INTEGER NOT NULL,
+	month INTEGER NOT NULL,
+	snapshot TEXT NOT NULL, -- JSON of the month report as submitted
+	submitted_unix_s INTEGER NOT NULL,
+	approved_by INTEGER,
+	approved_unix_s INTEGER,
+	key_id TEXT, -- of the key that signed it
+	signature TEXT, -- base64 Ed25519
+	PRIMARY KEY (uid, year, month),
+	FOREIGN KEY (uid) REFERENCES users(uid),
+	FOREIGN KEY (approved_by) REFERENCES users(uid)
+);
+
+CREATE TABLE reminder_snoozes ( -- days users don't want clock out reminders on, see reminders.go
+	uid INTEGER NOT NULL,
+	date TEXT NOT NULL, -- like holidays.date
+	UNIQUE (uid, date),
+	FOREIGN KEY (uid) REFERENCES users(uid)
+);
+
+CREATE TABLE snooze_tokens ( -- for the snooze links in reminders
+	token TEXT PRIMARY KEY,
+	uid INTEGER NOT NULL,
+	date TEXT NOT NULL, -- what it snoozes
+	expires_unix_s INTEGER NOT NULL,
+	FOREIGN KEY (uid) REFERENCES users(uid)
+);
+
+CREATE TABLE job_runs ( -- background job runs, see jobs.go
+	jrid INTEGER PRIMARY KEY AUTOINCREMENT,
+	job TEXT NOT NULL,
+	started_unix_s INTEGER NOT NULL,
+	ended_unix_s INTEGER, -- null while running
+	duration_ms INTEGER,
+	status TEXT NOT NULL DEFAULT 'running' CHECK(status IN ('running', 'ok', 'failed')),
+	error TEXT,
+	affected INTEGER NOT NULL DEFAULT 0 -- what the job did, like users disqualified or emails queued
+);
+
+CREATE INDEX job_runs_job ON job_runs (job, started_unix_s);
+
+CREATE TABLE cap_notices ( -- contractor cap notices that were sent
+	uid INTEGER,
+	month TEXT, -- like 2019-10
+	level INTEGER, -- percent of the cap
+	FOREIGN KEY (uid) REFERENCES users(uid),
+	UNIQUE(uid, month, level)
+);
+
+CREATE TABLE sessions (
+	sid TEXT,
+	uid INTEGER,
+	expires_unix_s INTEGER, -- see entries.from_unix_s
+	country TEXT, -- where the session was last used from, see WMS2_COUNTRY_HEADER
+	FOREIGN KEY (uid) REFERENCES users(uid)
+);
+
+CREATE INDEX sessions_id ON sessions (sid);
+CREATE INDEX break_glass_sid ON break_glass (sid);
+CREATE INDEX user_merge_rows_mgid ON user_merge_rows (mgid, tbl);
+CREATE INDEX punches_uid ON punches (uid);
+CREATE INDEX entry_changes_uid ON entry_changes (uid, cid);
+CREATE INDEX outbox_status ON outbox (status, next_attempt_unix_s);
+`
+
+// openDB opens the database at path, creating it if it doesn't exist yet and migrating it if it's older
+func openDB(path string) (db *sql.DB, err error) {
+	_, err = os.Stat(path)
+	create := os.IsNotExist(err)
+
+	mode := "rw"
+	if create {
+		mode = "rwc"
+	}
+	// foreign keys are a setting of each connection, the driver sets them for every one it opens
+	db, err = sql.Open("sqlite3", path+"?mode="+mode+"&_foreign_keys=on")
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed to open the database")
+	}
+
+	if create {
+		err = initDB(db)
+	} else {
+		err = migrate(db)
+	}
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// openMemoryDB opens a fresh, initialised database that only lives in memory,
+// for trying out the SQL paths without touching wms2.db
+func openMemoryDB() (db *sql.DB, err error) {
+	db, err = sql.Open("sqlite3", ":memory:?_foreign_keys=on")
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed to open the database")
+	}
+	// every connection would get its own empty database otherwise
+	db.SetMaxOpenConns(1)
+
+	if err = initDB(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// schemaVersion is the version of schema, stored in the database's user_version. It goes up with every
+// step in migrations, /readyz fails for databases of another version.
+const schemaVersion = len(migrations)
+
+func initDB(db *sql.DB) (err error) {
+	_, err = db.Exec(schema)
+	if err != nil {
+		return stacktrace.Propagate(err, "failed to execute init SQL")
+	}
+	_, err = db.Exec("PRAGMA user_version = " + strconv.Itoa(schemaVersion))
+	return stacktrace.Propagate(err, "failed to set schema version")
+}
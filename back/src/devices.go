@@ -0,0 +1,181 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/palantir/stacktrace"
+)
+
+// didT identifies a device such as a kiosk, 0 means a punch didn't come from a device
+type didT int
+
+// device kinds
+const (
+	deviceKiosk   = "kiosk"   // punches by badge
+	deviceDisplay = "display" // only shows how many people are in
+
+	devicePresence = "presence" // reports people entering and leaving, e.g. Home Assistant
+)
+
+type device struct {
+	DID   didT   `json:"did"`
+	Name  string `json:"name"`
+	Kind  string `json:"kind"`
+	Site  stidT  `json:"site"`
+	Token string `json:"token,omitempty"`
+
+	AllowedIPs      string `json:"allowedIPs,omitempty"`      // see devices.allowed_ips
+	CertFingerprint string `json:"certFingerprint,omitempty"` // see devices.cert_fingerprint
+}
+
+func createDevice(db *sql.DB, name, kind string, stid stidT) (d device, err error) {
+	tokenRaw := make([]byte, 18)
+	rand.Read(tokenRaw)
+	d.Name = name
+	d.Kind = kind
+	d.Site = stid
+	d.Token = base64.URLEncoding.EncodeToString(tokenRaw) // URL safe for display panels
+
+	res, err := db.Exec("INSERT INTO devices (name, kind, stid, token) VALUES (?1, ?2, ?3, ?4)", d.Name, d.Kind, d.Site, d.Token)
+	if err != nil {
+		return d, stacktrace.Propagate(err, "failed to insert device")
+	}
+	did, err := res.LastInsertId()
+	d.DID = didT(did)
+	return d, stacktrace.Propagate(err, "failed to get device id")
+}
+
+func getDeviceByToken(db *sql.DB, token string) (d device, err error) {
+	err = db.QueryRow(
+		`SELECT did, name, kind, stid, IFNULL(allowed_ips, ''), IFNULL(cert_fingerprint, '') FROM devices
+			WHERE token = ?`, token).Scan(&d.DID, &d.Name, &d.Kind, &d.Site, &d.AllowedIPs, &d.CertFingerprint)
+	return d, err
+}
+
+// allows reports whether the device may make the request, given where it comes from and the
+// client certificate it presented, if its restrictions call for either
+func (d device) allows(r *http.Request) bool {
+	if d.AllowedIPs != "" {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		ip := net.ParseIP(host)
+		if err != nil || ip == nil || !ipAllowed(ip, d.AllowedIPs) {
+			return false
+		}
+	}
+
+	if d.CertFingerprint != "" {
+		if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+			return false
+		}
+		sum := sha256.Sum256(r.TLS.PeerCertificates[0].Raw)
+		if !strings.EqualFold(hex.EncodeToString(sum[:]), d.CertFingerprint) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func ipAllowed(ip net.IP, allowed string) bool {
+	for _, a := range strings.Split(allowed, ",") {
+		if _, ipNet, err := net.ParseCIDR(a); err == nil && ipNet.Contains(ip) {
+			return true
+		}
+		if aIP := net.ParseIP(a); aIP != nil && aIP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// setDeviceAllowedIPs restricts where the device may connect from, an empty list lifts the restriction.
+// ok is false if an entry isn't an IP or CIDR range.
+func setDeviceAllowedIPs(db *sql.DB, did didT, ips []string) (ok bool, err error) {
+	var allowed interface{}
+	if len(ips) > 0 {
+		for i, a := range ips {
+			ips[i] = strings.TrimSpace(a)
+			_, _, cidrErr := net.ParseCIDR(ips[i])
+			if cidrErr != nil && net.ParseIP(ips[i]) == nil {
+				return false, nil
+			}
+		}
+		allowed = strings.Join(ips, ",")
+	}
+
+	_, err = db.Exec("UPDATE devices SET allowed_ips = ?1 WHERE did = ?2", allowed, did)
+	return true, stacktrace.Propagate(err, "failed to set allowed IPs of device")
+}
+
+// setDeviceCertFingerprint makes the device present the client certificate with the given
+// hex SHA-256 fingerprint, an empty one lifts the requirement. ok is false if it isn't one.
+func setDeviceCertFingerprint(db *sql.DB, did didT, fingerprint string) (ok bool, err error) {
+	var fp interface{}
+	if fingerprint != "" {
+		fingerprint = strings.ToLower(strings.Replace(fingerprint, ":", "", -1))
+		if b, err := hex.DecodeString(fingerprint); err != nil || len(b) != sha256.Size {
+			return false, nil
+		}
+		fp = fingerprint
+	}
+
+	_, err = db.Exec("UPDATE devices SET cert_fingerprint = ?1 WHERE did = ?2", fp, did)
+	return true, stacktrace.Propagate(err, "failed to set certificate fingerprint of device")
+}
+
+func badgeToUID(db *sql.DB, badge string) (uid uidT, err error) {
+	lookups := fieldKeys.lookups(badge)
+	query := "SELECT uid FROM users WHERE badge IN (?" + strings.Repeat(", ?", len(lookups)-1) + ")"
+	err = db.QueryRow(query, lookups...).Scan(&uid)
+	return uid, err
+}
+
+// setBadge assigns a badge to the user, an empty badge removes it. taken is true if another user has
+// the badge, under any key or in the clear, so that UNIQUE(badge) alone wouldn't catch it.
+func setBadge(db *sql.DB, uid uidT, badge string) (taken bool, err error) {
+	if badge == "" {
+		_, err = db.Exec("UPDATE users SET badge = NULL, badge_sealed = NULL WHERE uid = ?", uid)
+		return false, stacktrace.Propagate(err, "failed to remove badge")
+	}
+
+	index, sealed, err := fieldKeys.protect(badge)
+	if err != nil {
+		return false, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return false, stacktrace.Propagate(err, "failed to begin transaction")
+	}
+	rollback := func() {
+		if err := tx.Rollback(); err != nil {
+			logError(stacktrace.Propagate(err, "failed to roll back transaction"))
+		}
+	}
+
+	lookups := fieldKeys.lookups(badge)
+	err = tx.QueryRow("SELECT 1 FROM users WHERE uid != ? AND badge IN (?"+strings.Repeat(", ?", len(lookups)-1)+")",
+		append([]interface{}{uid}, lookups...)...).Scan(new(int))
+	if err == nil {
+		rollback()
+		return true, nil
+	}
+	if err != sql.ErrNoRows {
+		rollback()
+		return false, stacktrace.Propagate(err, "failed to check for the badge")
+	}
+
+	_, err = tx.Exec("UPDATE users SET badge = ?1, badge_sealed = ?2 WHERE uid = ?3", index, sealed, uid)
+	if err != nil {
+		rollback()
+		return false, stacktrace.Propagate(err, "failed to set badge")
+	}
+	return false, stacktrace.Propagate(tx.Commit(), "failed to commit transaction")
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+// a badge is another user's whether it was stored in the clear, under an old key or the current one
+func TestSetBadgeTaken(t *testing.T) {
+	db, done := newTestDB(t, time.Now())
+	defer done()
+	clear := seedUser(t, db, "clear@example.com", false)
+	old := seedUser(t, db, "old@example.com", false)
+	a := seedUser(t, db, "a@example.com", false)
+	b := seedUser(t, db, "b@example.com", false)
+
+	saved := fieldKeys
+	defer func() { fieldKeys = saved }()
+	set := func(uid uidT, badge string) bool {
+		t.Helper()
+		taken, err := setBadge(db, uid, badge)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return taken
+	}
+
+	fieldKeys = nil
+	if set(clear, "clear") || set(clear, "clear") {
+		t.Error("setting the user's own badge again found it taken")
+	}
+	oldKeys := &keyring{current: 1, keys: map[int][]byte{1: bytes.Repeat([]byte{1}, 32)}}
+	fieldKeys = oldKeys
+	if set(old, "old") {
+		t.Error("a new badge was taken")
+	}
+	fieldKeys = &keyring{current: 2, keys: map[int][]byte{1: oldKeys.keys[1], 2: bytes.Repeat([]byte{2}, 32)}}
+	if set(a, "current") {
+		t.Error("a new badge was taken")
+	}
+
+	for uid, badge := range map[uidT]string{clear: "clear", old: "old"} {
+		if !set(b, badge) {
+			t.Errorf("badge %q of user %d isn't taken", badge, uid)
+		}
+	}
+	if !set(b, "current") {
+		t.Errorf("the current badge of user %d isn't taken", a)
+	}
+	if uid, err := badgeToUID(db, "current"); err != nil || uid != a {
+		t.Errorf("the badge is user %d's (%v), want %d's", uid, err, a)
+	}
+
+	// the badge of the user, once removed, is free again
+	if set(a, "") || set(b, "current") {
+		t.Error("a removed badge was taken")
+	}
+	if uid, err := badgeToUID(db, "current"); err != nil || uid != b {
+		t.Errorf("the badge is user %d's (%v), want %d's", uid, err, b)
+	}
+}
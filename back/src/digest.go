@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"text/template"
+	"time"
+
+	"github.com/palantir/stacktrace"
+)
+
+// exception is something an admin should look at: an entry disqualify flagged, one of those
+// the user didn't confirm in time (see confirmDays), or work on a holiday
+type exception struct {
+	UID         uidT
+	Email       string
+	From        int
+	To          int
+	Holiday     string // the name of the holiday worked on, empty for flagged entries
+	Unconfirmed bool
+}
+
+var exceptionDigestTemplate = template.Must(template.New("digest").Funcs(template.FuncMap{
+	"clock": func(unix int) string { return time.Unix(int64(unix), 0).Format("Jan 2 15:04") },
+	"hours": formatSeconds,
+	"time":  func(s int) string { return fmt.Sprintf("%02d:%02d", s/3600, s/60%60) },
+}).Parse(`{{if .Flagged}}These entries were flagged since {{clock .Since}} because nobody clocked out:
+{{range .Flagged}}
+    {{.Email}}: {{clock .From}} - {{clock .To}}
+{{- end}}
+{{end}}
+{{- if .Unconfirmed}}{{if .Flagged}}
+{{end}}These auto-closed entries weren't confirmed within {{.ConfirmDays}} days and don't count until you fix them:
+{{range .Unconfirmed}}
+    {{.Email}}: {{clock .From}} - {{clock .To}}
+{{- end}}
+{{end}}
+{{- if .Holidays}}{{if or .Flagged .Unconfirmed}}
+{{end}}These people worked on a public holiday since {{clock .Since}}, which is paid at a premium:
+{{range .Holidays}}
+    {{.Email}}: {{clock .From}} - {{clock .To}} ({{.Holiday}})
+{{- end}}
+{{end}}
+{{- if .Probation}}{{if or .Flagged .Unconfirmed .Holidays}}
+{{end}}These people are on probation:
+{{range .Probation}}
+    {{.Email}}, until {{.Ends}}: late on {{.Late}} of {{.WorkingDays}} working days, starting at {{time .AverageStart}} on average,
+        absent on {{.Absent}} days, missed {{.Missed}} days, delta {{hours .Delta}}
+{{- end}}
+{{end}}`))
+
+func listExceptions(db *sql.DB, from, to time.Time) (exs []exception, err error) {
+	rows, err := entryStore.query(context.TODO(), db,
+		`SELECT entries.uid, users.email, from_unix_s, to_unix_s, '', 0 FROM entries
+			JOIN users ON users.uid = entries.uid
+			WHERE valid = 0 AND deleted_unix_s IS NULL AND to_unix_s >= ?1 AND to_unix_s < ?2
+		UNION ALL
+		SELECT entries.uid, users.email, from_unix_s, to_unix_s, '', 1 FROM entries
+			JOIN users ON users.uid = entries.uid
+			WHERE source = 'auto-close' AND valid = 0 AND confirmed_unix_s IS NULL AND deleted_unix_s IS NULL
+				AND to_unix_s + ?3 >= ?1 AND to_unix_s + ?3 < ?2
+		UNION ALL
+		SELECT entries.uid, users.email, from_unix_s, to_unix_s, holidays.name, 0 FROM entries
+			JOIN users ON users.uid = entries.uid
+			JOIN holidays ON holidays.date = date(from_unix_s, 'unixepoch', 'localtime')
+				AND (holidays.stid IS NULL OR holidays.stid = users.stid)
+			WHERE valid = 1 AND approved = 1 AND deleted_unix_s IS NULL AND kind = 'work' AND to_unix_s >= ?1 AND to_unix_s < ?2
+		ORDER BY 2, 3`, from.Unix(), to.Unix(), confirmPeriod())
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed to get exceptions")
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var ex exception
+		err = rows.Scan(&ex.UID, &ex.Email, &ex.From, &ex.To, &ex.Holiday, &ex.Unconfirmed)
+		if err != nil {
+			return nil, stacktrace.Propagate(err, "failed to scan row")
+		}
+		exs = append(exs, ex)
+	}
+
+	return exs, nil
+}
+
+func listAdminEmails(db *sql.DB) (emails []string, err error) {
+	rows, err := db.Query("SELECT email FROM users WHERE admin = 1")
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed to get admins")
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var email string
+		err = rows.Scan(&email)
+		if err != nil {
+			return nil, stacktrace.Propagate(err, "failed to scan row")
+		}
+		emails = append(emails, email)
+	}
+
+	return emails, nil
+}
+
+// sendExceptionDigest mails admins the exceptions between since and until and how the people on
+// probation are doing up to until, if there's anything to tell. affected is how many digests were
+// queued, it returns the first failure to queue one.
+func sendExceptionDigest(db *sql.DB, since, until time.Time) (affected int, err error) {
+	exs, err := listExceptions(db, since, until)
+	if err != nil {
+		return 0, stacktrace.Propagate(err, "failed to list exceptions")
+	}
+	prs, err := listProbationReports(db, until)
+	if err != nil {
+		return 0, stacktrace.Propagate(err, "failed to list probation reports")
+	}
+	if len(exs) == 0 && len(prs) == 0 {
+		return 0, nil
+	}
+
+	var flagged, unconfirmed, holidays []exception
+	for _, ex := range exs {
+		switch {
+		case ex.Unconfirmed:
+			unconfirmed = append(unconfirmed, ex)
+		case ex.Holiday == "":
+			flagged = append(flagged, ex)
+		default:
+			holidays = append(holidays, ex)
+		}
+	}
+
+	var body bytes.Buffer
+	err = exceptionDigestTemplate.Execute(&body, struct {
+		Since       int
+		ConfirmDays int
+		Flagged     []exception
+		Unconfirmed []exception
+		Holidays    []exception
+		Probation   []probationReport
+	}{int(since.Unix()), confirmDays, flagged, unconfirmed, holidays, prs})
+	if err != nil {
+		return 0, stacktrace.Propagate(err, "failed to render exception digest")
+	}
+
+	admins, err := listAdminEmails(db)
+	if err != nil {
+		return 0, stacktrace.Propagate(err, "failed to list admins")
+	}
+	var failed error
+	for _, email := range admins {
+		err = enqueueEmail(db, email, "Exceptions for "+until.Format("Jan 2"), body.String())
+		if err != nil {
+			err = stacktrace.Propagate(err, "failed to queue exception digest")
+			logError(err)
+			if failed == nil {
+				failed = err
+			}
+			continue
+		}
+		affected++
+	}
+	return affected, failed
+}
+
+// exceptionDigester mails the last day's exceptions to admins every morning,
+// which includes whatever the midnight disqualify run flagged
+func exceptionDigester(db *sql.DB) {
+	for {
+		now := time.Now()
+		next := time.Date(now.Year(), now.Month(), now.Day(), 6, 0, 0, 0, now.Location())
+		if !next.After(now) {
+			next = next.AddDate(0, 0, 1)
+		}
+		if !jobSleep(time.Until(next)) {
+			return
+		}
+		err := runJob(db, jobExceptionDigest, func() (int, error) {
+			return sendExceptionDigest(db, next.AddDate(0, 0, -1), next)
+		})
+		if err != nil {
+			logError(err, "job", jobExceptionDigest)
+		}
+	}
+}
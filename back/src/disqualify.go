@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/palantir/stacktrace"
+)
+
+// Whoever is still clocked in at their site's clock out time gets clocked out with an invalid entry,
+// see disqualify. The disqualify policy says when that's checked, how long anyone may be clocked in
+// at all and who's exempt, like night guards whose shifts run past the clock out. WMS2_DISQUALIFY
+// names a JSON file with it, like
+//
+//	{"schedule": "*/5 * * * *", "maxOpen": "12h", "staleOpen": "48h", "exempt": ["guard@example.com"]}
+//
+// The schedule is in crontab syntax (see scheduler.go), by default every minute. maxOpen is off by
+// default. Exempt emails without a user are ignored so the file can name people before they sign up.
+// Clock-ins older than staleOpen, by default a day, are implausible when the server starts: it was
+// likely down for that long. Those go to the admins for review instead, see reviewStale.
+
+type disqualifyPolicy struct {
+	Schedule  cronSpec
+	MaxOpen   time.Duration // 0 for no limit
+	StaleOpen time.Duration
+	Exempt    []string // emails
+}
+
+const (
+	defaultDisqualifySchedule = "* * * * *"
+	defaultStaleOpen          = 24 * time.Hour
+)
+
+var disqualifyRules disqualifyPolicy
+
+// disqualifyRulesFromEnv reads the policy in the file WMS2_DISQUALIFY names, if any
+func disqualifyRulesFromEnv() (p disqualifyPolicy, err error) {
+	var rules struct {
+		Schedule  string   `json:"schedule"`
+		MaxOpen   string   `json:"maxOpen"`
+		StaleOpen string   `json:"staleOpen"`
+		Exempt    []string `json:"exempt"`
+	}
+	if path := os.Getenv("WMS2_DISQUALIFY"); path != "" {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return p, stacktrace.Propagate(err, "failed to read WMS2_DISQUALIFY")
+		}
+		err = json.Unmarshal(b, &rules)
+		if err != nil {
+			return p, stacktrace.Propagate(err, "WMS2_DISQUALIFY has to be a JSON object")
+		}
+	}
+
+	if rules.Schedule == "" {
+		rules.Schedule = defaultDisqualifySchedule
+	}
+	p.Schedule, err = parseCron(rules.Schedule)
+	if err != nil {
+		return p, stacktrace.Propagate(err, "invalid disqualify schedule")
+	}
+	if rules.MaxOpen != "" {
+		p.MaxOpen, err = time.ParseDuration(rules.MaxOpen)
+		if err != nil || p.MaxOpen <= 0 {
+			return p, stacktrace.NewError("disqualify maxOpen has to be a duration like 12h, not %q", rules.MaxOpen)
+		}
+	}
+	p.StaleOpen = defaultStaleOpen
+	if rules.StaleOpen != "" {
+		p.StaleOpen, err = time.ParseDuration(rules.StaleOpen)
+		if err != nil || p.StaleOpen <= 0 {
+			return p, stacktrace.NewError("disqualify staleOpen has to be a duration like 48h, not %q", rules.StaleOpen)
+		}
+	}
+	for _, email := range rules.Exempt {
+		if email = strings.TrimSpace(email); email != "" {
+			p.Exempt = append(p.Exempt, email)
+		}
+	}
+	return p, nil
+}
+
+// exemptUsers returns the users the policy exempts
+func (p disqualifyPolicy) exemptUsers(db *sql.DB) (exempt map[uidT]bool, err error) {
+	exempt = make(map[uidT]bool)
+	for _, email := range p.Exempt {
+		uid, err := emailToUID(db, email)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			return nil, stacktrace.Propagate(err, "failed to get exempt user")
+		}
+		exempt[uid] = true
+	}
+	return exempt, nil
+}
+
+// lastDisqualified is the unix time of the last disqualify run, 0 if it hasn't run yet
+var lastDisqualified int64
+
+// disqualifyDue disqualifies as of now those who were clocked in at their site's last clock out,
+// or for longer than the policy's maxOpen. Clocking out is idempotent so it can run as often as the
+// schedule says. It returns the first failure.
+func disqualifyDue(db *sql.DB, now time.Time) (affected int, err error) {
+	defer func() { atomic.StoreInt64(&lastDisqualified, time.Now().Unix()) }()
+
+	sites, err := listSites(db)
+	if err != nil {
+		return 0, stacktrace.Propagate(err, "failed to list sites")
+	}
+	exempt, err := disqualifyRules.exemptUsers(db)
+	if err != nil {
+		return 0, err
+	}
+
+	var failed error
+	for _, s := range sites {
+		last, err := s.lastClockOut(now)
+		if err == nil {
+			openedBefore := last.Unix()
+			if disqualifyRules.MaxOpen > 0 {
+				if t := now.Add(-disqualifyRules.MaxOpen).Unix(); t > openedBefore {
+					openedBefore = t
+				}
+			}
+			var n int
+			n, err = disqualify(db, s.STID, openedBefore, exempt)
+			affected += n
+		}
+		if err != nil && failed == nil {
+			failed = err
+		}
+	}
+	return affected, failed
+}
+
+// reviewStale clocks out as of now those who clocked in more than the policy's staleOpen ago,
+// it's run on startup before catching up on disqualify. Rather than an invalid entry or days of
+// counted time, a clocked in user gets an entry waiting for an admin's approval (see edits.go),
+// who can approve, correct or reject it. Exempt users are left to disqualify.
+func reviewStale(db *sql.DB, now time.Time) (affected int, err error) {
+	exempt, err := disqualifyRules.exemptUsers(db)
+	if err != nil {
+		return 0, err
+	}
+	staleOpen := disqualifyRules.StaleOpen
+	if staleOpen <= 0 {
+		staleOpen = defaultStaleOpen
+	}
+	rows, err := db.Query(
+		`SELECT uid, state, since_unix_s, IFNULL(stid, 0), IFNULL(ctid, 0), missed_heartbeat, after_break FROM user_states
+			WHERE state IN (?1, ?2) AND since_unix_s < ?3`, stateIn, stateBreak, now.Add(-staleOpen).Unix())
+	if err != nil {
+		return 0, stacktrace.Propagate(err, "failed to select stale states")
+	}
+	type stale struct {
+		disqualified
+		stid stidT
+	}
+	var toReview []stale
+	for rows.Next() {
+		var x stale
+		err = rows.Scan(&x.uid, &x.state, &x.since, &x.stid, &x.ctid, &x.missed, &x.afterBreak)
+		if err != nil {
+			rows.Close()
+			return 0, stacktrace.Propagate(err, "failed to scan row")
+		}
+		if !exempt[x.uid] {
+			toReview = append(toReview, x)
+		}
+	}
+	rows.Close()
+
+	var failed error
+	for _, x := range toReview {
+		done, err := reviewStaleUser(db, x.stid, x.disqualified, now.Unix())
+		if err != nil {
+			logError(stacktrace.Propagate(err, "failed to review stale state of "+strconv.Itoa(int(x.uid))))
+			if failed == nil {
+				failed = err
+			}
+			continue
+		}
+		if done {
+			affected++
+			runTransitionHooks(x.uid, x.state, stateOut, now.Unix())
+		}
+	}
+	return affected, failed
+}
+
+// reviewStaleUser clocks the user out as of now if they're still in the state x, submitting the
+// time they were clocked in for approval. done is false if they aren't in that state anymore.
+func reviewStaleUser(db *sql.DB, stid stidT, x disqualified, now int64) (done bool, err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, stacktrace.Propagate(err, "failed to begin a transaction")
+	}
+	rollback := func() {
+		if err := tx.Rollback(); err != nil {
+			logError(stacktrace.Propagate(err, "failed to roll back transaction"))
+		}
+	}
+
+	res, err := tx.Exec(
+		`UPDATE user_states SET state = ?1, since_unix_s = ?2, expected_end_unix_s = NULL, stid = NULL, ctid = NULL,
+			after_break = 0
+			WHERE uid = ?3 AND state = ?4 AND since_unix_s = ?5`, stateOut, now, x.uid, x.state, x.since)
+	if err != nil {
+		rollback()
+		return false, stacktrace.Propagate(err, "failed to clock out")
+	}
+	n, err := res.RowsAffected()
+	if err != nil || n == 0 {
+		rollback()
+		return false, stacktrace.Propagate(err, "failed to get rows affected")
+	}
+
+	if x.state == stateIn {
+		var site interface{}
+		if stid != 0 {
+			site = stid
+		}
+		eid, err := entryStore.insert(context.TODO(), tx, "eid",
+			`INSERT INTO entries (uid, from_unix_s, to_unix_s, valid, source, stid, ctid, missed_heartbeat, after_break, approved)
+				VALUES (?1, ?2, ?3, 1, 'auto-close', ?4, ?5, ?6, ?7, 0)`,
+			x.uid, x.since, now, site, nullContract(x.ctid), x.missed, x.afterBreak)
+		if err != nil {
+			rollback()
+			return false, stacktrace.Propagate(err, "failed to add entry for review")
+		}
+		ap, err := insertApproval(tx, approvalEntry, eidT(eid), x.since, int(now), auditSystem)
+		if err != nil {
+			rollback()
+			return false, err
+		}
+		err = audit(tx, auditSystem, x.uid, auditSubmit, ap.EID, nil, ap)
+		if err != nil {
+			rollback()
+			return false, err
+		}
+	}
+
+	err = audit(tx, auditSystem, x.uid, auditClockOut, 0, auditState{State: x.state}, auditState{State: stateOut, At: now})
+	if err != nil {
+		rollback()
+		return false, err
+	}
+	return true, stacktrace.Propagate(tx.Commit(), "failed to commit transaction")
+}
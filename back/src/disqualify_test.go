@@ -0,0 +1,73 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// clock-ins from before the server was down for days go to review instead of being disqualified
+func TestReviewStale(t *testing.T) {
+	now := time.Unix(1570000000, 0)
+	db, done := newTestDB(t, now)
+	defer done()
+	saved := disqualifyRules
+	defer func() { disqualifyRules = saved }()
+	disqualifyRules = disqualifyPolicy{StaleOpen: 24 * time.Hour, Exempt: []string{"guard@example.com"}}
+
+	stale := seedUser(t, db, "stale@example.com", false)
+	seedState(t, db, stale, stateIn, now.Add(-72*time.Hour))
+	onBreak := seedUser(t, db, "break@example.com", false)
+	seedState(t, db, onBreak, stateBreak, now.Add(-48*time.Hour))
+	recent := seedUser(t, db, "recent@example.com", false)
+	seedState(t, db, recent, stateIn, now.Add(-3*time.Hour))
+	guard := seedUser(t, db, "guard@example.com", false)
+	seedState(t, db, guard, stateIn, now.Add(-72*time.Hour))
+	_, err := db.Exec("UPDATE user_states SET stid = 1 WHERE state != ?", stateOut)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	affected, err := reviewStale(db, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if affected != 2 {
+		t.Errorf("reviewed %d states, want 2", affected)
+	}
+	for uid, want := range map[uidT]userState{stale: stateOut, onBreak: stateOut, recent: stateIn, guard: stateIn} {
+		if state, _, _, _ := getStateRow(t, db, uid); state != want {
+			t.Errorf("user %d is %s, want %s", uid, state, want)
+		}
+	}
+
+	// the stale clock-in waits for approval as a valid entry, it isn't disqualified and doesn't count yet
+	aps, err := listPendingApprovals(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(aps) != 1 {
+		t.Fatalf("%d pending approvals, want 1: %v", len(aps), aps)
+	}
+	ap := aps[0]
+	if ap.UID != stale || ap.Kind != approvalEntry || ap.From != int(now.Add(-72*time.Hour).Unix()) ||
+		ap.To != int(now.Unix()) || ap.SubmittedBy != auditSystem {
+		t.Errorf("got approval %+v", ap)
+	}
+	if n := countRows(t, db, "SELECT COUNT(*) FROM entries WHERE valid = 0"); n != 0 {
+		t.Errorf("%d invalid entries, want none", n)
+	}
+	if n := countRows(t, db, "SELECT COUNT(*) FROM entries WHERE uid = ? AND approved = 0", stale); n != 1 {
+		t.Errorf("%d unapproved entries of the stale user, want 1", n)
+	}
+	if n := countRows(t, db, "SELECT COUNT(*) FROM entries WHERE uid = ?", onBreak); n != 0 {
+		t.Errorf("the break got %d entries, want none", n)
+	}
+
+	// approving it makes it count like any manual entry
+	if found, err := decideApproval(db, ap.APID, true, guard); err != nil || !found {
+		t.Fatalf("approving got %t, %v", found, err)
+	}
+	if n := countRows(t, db, "SELECT COUNT(*) FROM entries WHERE uid = ? AND approved = 1", stale); n != 1 {
+		t.Errorf("%d approved entries of the stale user, want 1", n)
+	}
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/palantir/stacktrace"
+)
+
+// Manual entries and edits to entries wait for an admin's approval. A manual entry exists right away
+// but doesn't count as worked until it's approved, an edit only changes the entry once it's approved.
+// Users may add up to manualEntryLimit manual work entries a week that count without an admin, those are
+// approved as they're submitted. Manual entries of other kinds always wait for approval. The week is the user's, see startOfWeek.
+
+var manualEntryLimit = 0
+
+// manualEntryLimitFromEnv reads WMS2_MANUAL_ENTRY_LIMIT, how many manual entries a user may add each
+// week without approval, by default none
+func manualEntryLimitFromEnv() int {
+	s := os.Getenv("WMS2_MANUAL_ENTRY_LIMIT")
+	if s == "" {
+		return 0
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		logWarning(stacktrace.NewError("invalid WMS2_MANUAL_ENTRY_LIMIT %q, every manual entry waits for approval", s))
+		return 0
+	}
+	return n
+}
+
+type apidT int
+
+// approval kinds, see approvals.kind
+const (
+	approvalEntry = "entry"
+	approvalEdit  = "edit"
+)
+
+// approval statuses, see approvals.status
+const (
+	approvalPending  = "pending"
+	approvalApproved = "approved"
+	approvalRejected = "rejected"
+)
+
+type approval struct {
+	APID        apidT  `json:"apid"`
+	Kind        string `json:"kind"`
+	EID         eidT   `json:"eid"`
+	UID         uidT   `json:"uid"`
+	Email       string `json:"email"`
+	From        int    `json:"from"` // of the new entry, or what the entry is to be changed to
+	To          int    `json:"to"`
+	SubmittedBy uidT   `json:"submittedBy"` // 0 for the server, see reviewStale
+	Submitted   int    `json:"submitted"`
+	Status      string `json:"status"`
+}
+
+// submitEntry adds a manual entry for the user that counts once it's approved, see fitEntry for clamp.
+// If it's work and the user hasn't used up manualEntryLimit this week it's approved right away.
+func submitEntry(db *sql.DB, uid uidT, from, to int, clamp bool, kind string, by uidT) (ap approval, err error) {
+	return submitContractEntry(db, uid, from, to, clamp, kind, 0, by)
+}
+
+// submitContractEntry is submitEntry with the entry attributed to the user's contract ctid, 0 for none
+func submitContractEntry(db *sql.DB, uid uidT, from, to int, clamp bool, kind string, ctid ctidT, by uidT) (
+	ap approval, err error) {
+	loc, err := userLocation(context.TODO(), db, uid)
+	if err != nil {
+		return ap, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return ap, stacktrace.Propagate(err, "failed to begin transaction")
+	}
+	rollback := func() {
+		if err := tx.Rollback(); err != nil {
+			logError(stacktrace.Propagate(err, "failed to roll back transaction"))
+		}
+	}
+
+	from, to, err = fitEntry(tx, uid, 0, from, to, clamp)
+	if err != nil {
+		rollback()
+		return ap, err
+	}
+
+	// absences go through leave requests, they always wait for an admin
+	approved := false
+	if kind == entryWork {
+		approved, err = withinManualEntryLimit(tx, uid, clk.Now().In(loc))
+		if err != nil {
+			rollback()
+			return ap, err
+		}
+	}
+
+	eid, err := entryStore.insert(context.TODO(), tx, "eid",
+		`INSERT INTO entries (uid, from_unix_s, to_unix_s, valid, source, stid, approved, kind, ctid)
+			SELECT ?1, ?2, ?3, 1, 'manual', stid, ?4, ?5, ?6 FROM users WHERE uid = ?1`,
+		uid, from, to, approved, kind, nullContract(ctid))
+	if err != nil {
+		rollback()
+		return ap, stacktrace.Propagate(err, "failed to insert an entry")
+	}
+
+	ap, err = insertApproval(tx, approvalEntry, eidT(eid), from, to, by)
+	if err != nil {
+		rollback()
+		return ap, err
+	}
+	if approved {
+		// no one decided, so decided_by stays null
+		_, err = tx.Exec("UPDATE approvals SET status = ?1, decided_unix_s = ?2 WHERE apid = ?3",
+			approvalApproved, ap.Submitted, ap.APID)
+		if err != nil {
+			rollback()
+			return ap, stacktrace.Propagate(err, "failed to approve entry")
+		}
+		ap.Status = approvalApproved
+	}
+	err = audit(tx, by, uid, auditSubmit, ap.EID, nil, ap)
+	if err != nil {
+		rollback()
+		return ap, err
+	}
+	return ap, stacktrace.Propagate(tx.Commit(), "failed to commit transaction")
+}
+
+// submitEdit proposes moving the entry to [from, to), replacing an earlier proposal for it.
+// found is false if there's no such entry, or it isn't the user's unless uid is 0.
+func submitEdit(db *sql.DB, uid uidT, eid eidT, from, to int, clamp bool, by uidT) (ap approval, found bool, err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return ap, false, stacktrace.Propagate(err, "failed to begin transaction")
+	}
+	rollback := func() {
+		if err := tx.Rollback(); err != nil {
+			logError(stacktrace.Propagate(err, "failed to roll back transaction"))
+		}
+	}
+
+	var owner uidT
+	old := entryRange{EID: eid}
+	err = entryStore.queryRow(context.TODO(), tx,
+		"SELECT uid, from_unix_s, to_unix_s FROM entries WHERE eid = ? AND deleted_unix_s IS NULL",
+		eid).Scan(&owner, &old.From, &old.To)
+	if err == sql.ErrNoRows || (err == nil && uid != 0 && owner != uid) {
+		rollback()
+		return ap, false, nil
+	}
+	if err != nil {
+		rollback()
+		return ap, false, stacktrace.Propagate(err, "failed to get entry")
+	}
+
+	from, to, err = fitEntry(tx, owner, eid, from, to, clamp)
+	if err != nil {
+		rollback()
+		return ap, true, err
+	}
+
+	_, err = tx.Exec(
+		"UPDATE approvals SET status = ?1 WHERE eid = ?2 AND kind = ?3 AND status = ?4",
+		approvalRejected, eid, approvalEdit, approvalPending)
+	if err != nil {
+		rollback()
+		return ap, true, stacktrace.Propagate(err, "failed to replace earlier edit")
+	}
+
+	ap, err = insertApproval(tx, approvalEdit, eid, from, to, by)
+	if err != nil {
+		rollback()
+		return ap, true, err
+	}
+	err = audit(tx, by, owner, auditSubmit, eid, old, ap)
+	if err != nil {
+		rollback()
+		return ap, true, err
+	}
+	return ap, true, stacktrace.Propagate(tx.Commit(), "failed to commit transaction")
+}
+
+// withinManualEntryLimit reports whether the user added fewer than manualEntryLimit manual work entries
+// in the week of now, whether they were approved or not. Those the server submitted don't count.
+func withinManualEntryLimit(tx *sql.Tx, uid uidT, now time.Time) (within bool, err error) {
+	if manualEntryLimit == 0 {
+		return false, nil
+	}
+	var n int
+	err = entryStore.queryRow(context.TODO(), tx,
+		`SELECT COUNT(*) FROM approvals JOIN entries USING (eid)
+			WHERE approvals.kind = ?1 AND uid = ?2 AND submitted_by = ?2 AND submitted_unix_s >= ?3 AND entries.kind = ?4`,
+		approvalEntry, uid, startOfWeek(now).Unix(), entryWork).Scan(&n)
+	if err != nil {
+		return false, stacktrace.Propagate(err, "failed to count manual entries")
+	}
+	return n < manualEntryLimit, nil
+}
+
+func insertApproval(tx *sql.Tx, kind string, eid eidT, from, to int, by uidT) (ap approval, err error) {
+	now := clk.Now().Unix()
+	res, err := tx.Exec(
+		`INSERT INTO approvals (kind, eid, from_unix_s, to_unix_s, submitted_by, submitted_unix_s)
+			VALUES (?1, ?2, ?3, ?4, NULLIF(?5, 0), ?6)`, kind, eid, from, to, by, now)
+	if err != nil {
+		return ap, stacktrace.Propagate(err, "failed to insert approval")
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return ap, stacktrace.Propagate(err, "failed to get approval id")
+	}
+
+	ap = approval{APID: apidT(id), Kind: kind, EID: eid, From: from, To: to, SubmittedBy: by, Submitted: int(now),
+		Status: approvalPending}
+	err = entryStore.queryRow(context.TODO(), tx,
+		"SELECT uid, email FROM entries JOIN users USING (uid) WHERE eid = ?", eid).Scan(&ap.UID, &ap.Email)
+	return ap, stacktrace.Propagate(err, "failed to get user of entry")
+}
+
+func listPendingApprovals(db *sql.DB) (aps []approval, err error) {
+	rows, err := entryStore.query(context.TODO(), db,
+		`SELECT apid, approvals.kind, eid, uid, email, approvals.from_unix_s, approvals.to_unix_s, IFNULL(submitted_by, 0), submitted_unix_s
+			FROM approvals JOIN entries USING (eid) JOIN users USING (uid)
+			WHERE status = ? AND deleted_unix_s IS NULL ORDER BY submitted_unix_s`, approvalPending)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed to list approvals")
+	}
+	defer rows.Close()
+
+	aps = []approval{}
+	for rows.Next() {
+		var ap approval
+		err = rows.Scan(&ap.APID, &ap.Kind, &ap.EID, &ap.UID, &ap.Email, &ap.From, &ap.To, &ap.SubmittedBy, &ap.Submitted)
+		if err != nil {
+			return nil, stacktrace.Propagate(err, "failed to scan row")
+		}
+		ap.Status = approvalPending
+		aps = append(aps, ap)
+	}
+	return aps, nil
+}
+
+// decideApproval approves or rejects a pending approval. Approving a manual entry makes it count,
+// rejecting one moves it to the trash, where it keeps its rejected approval and still doesn't count
+// if it's restored. Approving an edit applies it, which fails with an *overlapError if the entry no
+// longer fits there. Nothing is decided or audited unless all of it is.
+func decideApproval(db *sql.DB, apid apidT, approve bool, by uidT) (found bool, err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, stacktrace.Propagate(err, "failed to begin transaction")
+	}
+	rollback := func() {
+		if err := tx.Rollback(); err != nil {
+			logError(stacktrace.Propagate(err, "failed to roll back transaction"))
+		}
+	}
+
+	var kind string
+	var eid eidT
+	var uid uidT
+	var from, to int
+	err = entryStore.queryRow(context.TODO(), tx,
+		`SELECT approvals.kind, eid, uid, approvals.from_unix_s, approvals.to_unix_s FROM approvals JOIN entries USING (eid)
+			WHERE apid = ?1 AND status = ?2`, apid, approvalPending).Scan(&kind, &eid, &uid, &from, &to)
+	if err == sql.ErrNoRows {
+		rollback()
+		return false, nil
+	}
+	if err != nil {
+		rollback()
+		return false, stacktrace.Propagate(err, "failed to get approval")
+	}
+
+	switch {
+	case kind == approvalEdit && approve:
+		_, found, err = editEntryTx(tx, eid, from, to, false, by)
+		if err != nil || !found {
+			rollback()
+			return found, err
+		}
+	case kind == approvalEntry && approve:
+		_, err = entryStore.exec(context.TODO(), tx, "UPDATE entries SET approved = 1 WHERE eid = ?", eid)
+		if err != nil {
+			rollback()
+			return true, stacktrace.Propagate(err, "failed to approve entry")
+		}
+	case kind == approvalEntry && !approve:
+		found, err = deleteEntryTx(tx, eid, by)
+		if err != nil || !found {
+			rollback()
+			return found, err
+		}
+	}
+
+	status, action := approvalRejected, auditReject
+	if approve {
+		status, action = approvalApproved, auditApprove
+	}
+	_, err = tx.Exec(
+		"UPDATE approvals SET status = ?1, decided_by = ?2, decided_unix_s = ?3 WHERE apid = ?4",
+		status, by, clk.Now().Unix(), apid)
+	if err != nil {
+		rollback()
+		return true, stacktrace.Propagate(err, "failed to decide approval")
+	}
+	err = audit(tx, by, uid, action, eid, nil, struct {
+		APID apidT  `json:"apid"`
+		Kind string `json:"kind"`
+	}{apid, kind})
+	if err != nil {
+		rollback()
+		return true, err
+	}
+	return true, stacktrace.Propagate(tx.Commit(), "failed to commit transaction")
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSubmitEntryAndEdit(t *testing.T) {
+	loc := testLocation(t)
+	at := func(day, hour int) int { return int(time.Date(2019, time.October, day, hour, 0, 0, 0, loc).Unix()) }
+	db, done := newTestDB(t, time.Unix(int64(at(31, 12)), 0))
+	defer done()
+	a := seedUser(t, db, "a@example.com", false)
+	b := seedUser(t, db, "b@example.com", false)
+	seedEntry(t, db, a, time.Unix(int64(at(1, 8)), 0), time.Unix(int64(at(1, 12)), 0), entryWork)
+
+	ap, err := submitEntry(db, a, at(2, 8), at(2, 12), false, entryWork, a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ap.Kind != approvalEntry || ap.UID != a || ap.From != at(2, 8) || ap.To != at(2, 12) {
+		t.Errorf("got approval %+v", ap)
+	}
+	var approved bool
+	if err = db.QueryRow("SELECT approved FROM entries WHERE eid = ?", ap.EID).Scan(&approved); err != nil || approved {
+		t.Errorf("the submitted entry is approved %t (%v), want it pending", approved, err)
+	}
+
+	// an overlapping entry leaves nothing behind, clamping fits it in
+	if _, err = submitEntry(db, a, at(1, 10), at(1, 14), false, entryWork, a); err == nil {
+		t.Error("an overlapping entry was submitted")
+	} else if _, ok := err.(*overlapError); !ok {
+		t.Errorf("got %v, want an overlapError", err)
+	}
+	if n := countRows(t, db, "SELECT COUNT(*) FROM approvals"); n != 1 {
+		t.Errorf("%d approvals, want 1", n)
+	}
+	clamped, err := submitEntry(db, a, at(1, 10), at(1, 14), true, entryWork, a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if clamped.From != at(1, 12) || clamped.To != at(1, 14) {
+		t.Errorf("clamped to %d-%d, want %d-%d", clamped.From, clamped.To, at(1, 12), at(1, 14))
+	}
+
+	// edits are of the user's own entries, and replace earlier ones
+	if _, found, err := submitEdit(db, b, ap.EID, at(2, 9), at(2, 12), false, b); err != nil || found {
+		t.Errorf("editing another user's entry got found %t, %v", found, err)
+	}
+	first, found, err := submitEdit(db, a, ap.EID, at(2, 9), at(2, 12), false, a)
+	if err != nil || !found {
+		t.Fatalf("got found %t, %v", found, err)
+	}
+	second, found, err := submitEdit(db, 0, ap.EID, at(2, 7), at(2, 12), false, a)
+	if err != nil || !found {
+		t.Fatalf("got found %t, %v", found, err)
+	}
+	var status string
+	if err = db.QueryRow("SELECT status FROM approvals WHERE apid = ?", first.APID).Scan(&status); err != nil {
+		t.Fatal(err)
+	}
+	if status != approvalRejected || second.Kind != approvalEdit {
+		t.Errorf("the first edit is %s and the second a %s, want rejected and an edit", status, second.Kind)
+	}
+	if n := countRows(t, db, "SELECT COUNT(*) FROM audit_log WHERE action = ?", auditSubmit); n != 4 {
+		t.Errorf("%d submissions audited, want 4", n)
+	}
+
+	// the pending ones are the entries and the second edit, deciding takes them off the list
+	aps, err := listPendingApprovals(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(aps) != 3 {
+		t.Fatalf("%d pending approvals, want 3: %v", len(aps), aps)
+	}
+	if found, err := decideApproval(db, second.APID, true, b); err != nil || !found {
+		t.Fatalf("approving the edit got %t, %v", found, err)
+	}
+	if found, err := decideApproval(db, clamped.APID, false, b); err != nil || !found {
+		t.Fatalf("rejecting the entry got %t, %v", found, err)
+	}
+	if found, err := decideApproval(db, second.APID, false, b); err != nil || found {
+		t.Errorf("deciding again got %t, %v", found, err)
+	}
+	var from int
+	if err = db.QueryRow("SELECT from_unix_s FROM entries WHERE eid = ?", ap.EID).Scan(&from); err != nil || from != at(2, 7) {
+		t.Errorf("the edited entry is from %d (%v), want %d", from, err, at(2, 7))
+	}
+	if n := countRows(t, db, "SELECT COUNT(*) FROM entries WHERE eid = ? AND deleted_unix_s IS NULL", clamped.EID); n != 0 {
+		t.Error("the rejected entry isn't in the trash")
+	}
+	n := countRows(t, db, "SELECT COUNT(*) FROM approvals WHERE apid = ?1 AND status = ?2 AND decided_by = ?3",
+		clamped.APID, approvalRejected, b)
+	if n != 1 {
+		t.Error("the rejection of the entry isn't recorded")
+	}
+	if aps, err = listPendingApprovals(db); err != nil || len(aps) != 1 {
+		t.Errorf("%d pending approvals (%v), want 1", len(aps), err)
+	}
+}
+
+// an approval that fails leaves the approval pending and nothing audited
+func TestDecideApprovalAtomic(t *testing.T) {
+	loc := testLocation(t)
+	at := func(day, hour int) int { return int(time.Date(2019, time.October, day, hour, 0, 0, 0, loc).Unix()) }
+	db, done := newTestDB(t, time.Unix(int64(at(31, 12)), 0))
+	defer done()
+	admin := seedUser(t, db, "admin@example.com", true)
+	a := seedUser(t, db, "a@example.com", false)
+	eid := seedEntry(t, db, a, time.Unix(int64(at(1, 8)), 0), time.Unix(int64(at(1, 12)), 0), entryWork)
+
+	ap, _, err := submitEdit(db, a, eid, at(1, 8), at(1, 14), false, a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the edit no longer fits once this is there
+	seedEntry(t, db, a, time.Unix(int64(at(1, 13)), 0), time.Unix(int64(at(1, 15)), 0), entryWork)
+
+	_, err = decideApproval(db, ap.APID, true, admin)
+	if _, ok := err.(*overlapError); !ok {
+		t.Fatalf("got %v, want an overlapError", err)
+	}
+	if n := countRows(t, db, "SELECT COUNT(*) FROM approvals WHERE apid = ? AND status = ?", ap.APID, approvalPending); n != 1 {
+		t.Error("the failed approval isn't pending")
+	}
+	if n := countRows(t, db, "SELECT COUNT(*) FROM audit_log WHERE action IN (?, ?)", auditApprove, auditEdit); n != 0 {
+		t.Errorf("%d records of the failed approval audited", n)
+	}
+}
+
+func TestManualEntryLimit(t *testing.T) {
+	loc := testLocation(t)
+	at := func(day, hour int) int { return int(time.Date(2019, time.October, day, hour, 0, 0, 0, loc).Unix()) }
+	// Thursday, the week started on Monday the 14th
+	db, done := newTestDB(t, time.Unix(int64(at(17, 12)), 0))
+	defer done()
+	a := seedUser(t, db, "a@example.com", false)
+	b := seedUser(t, db, "b@example.com", false)
+	savedLimit, savedStart := manualEntryLimit, weekStart
+	defer func() { manualEntryLimit, weekStart = savedLimit, savedStart }()
+	manualEntryLimit, weekStart = 2, time.Monday
+
+	// last week's entries don't count
+	clk = fixedClock(time.Unix(int64(at(11, 12)), 0))
+	if _, err := submitEntry(db, a, at(10, 8), at(10, 12), false, entryWork, a); err != nil {
+		t.Fatal(err)
+	}
+	clk = fixedClock(time.Unix(int64(at(17, 12)), 0))
+
+	var statuses []string
+	for day := 1; day <= 3; day++ {
+		ap, err := submitEntry(db, a, at(day, 8), at(day, 12), false, entryWork, a)
+		if err != nil {
+			t.Fatal(err)
+		}
+		statuses = append(statuses, ap.Status)
+		var approved bool
+		if err = db.QueryRow("SELECT approved FROM entries WHERE eid = ?", ap.EID).Scan(&approved); err != nil {
+			t.Fatal(err)
+		}
+		if approved != (ap.Status == approvalApproved) {
+			t.Errorf("entry of day %d is approved %t with the approval %s", day, approved, ap.Status)
+		}
+	}
+	if want := []string{approvalApproved, approvalApproved, approvalPending}; !reflect.DeepEqual(statuses, want) {
+		t.Errorf("got %v, want %v", statuses, want)
+	}
+	aps, err := listPendingApprovals(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(aps) != 1 || aps[0].From != at(3, 8) {
+		t.Errorf("pending approvals are %v, want the third entry", aps)
+	}
+
+	// other kinds always wait, and don't use up the limit
+	c := seedUser(t, db, "c@example.com", false)
+	ap, err := submitEntry(db, c, at(1, 8), at(1, 16), false, entryVacation, c)
+	if err != nil || ap.Status != approvalPending {
+		t.Errorf("a vacation entry under the limit got %s, %v", ap.Status, err)
+	}
+	if ap, err = submitEntry(db, c, at(2, 8), at(2, 12), false, entryWork, c); err != nil || ap.Status != approvalApproved {
+		t.Errorf("a work entry after the vacation entry got %s, %v", ap.Status, err)
+	}
+
+	// the limit is per user
+	if ap, err := submitEntry(db, b, at(1, 8), at(1, 12), false, entryWork, b); err != nil || ap.Status != approvalApproved {
+		t.Errorf("another user's first entry got %s, %v", ap.Status, err)
+	}
+
+	// without a limit everything waits for approval
+	manualEntryLimit = 0
+	if ap, err := submitEntry(db, b, at(2, 8), at(2, 12), false, entryWork, b); err != nil || ap.Status != approvalPending {
+		t.Errorf("without a limit got %s, %v", ap.Status, err)
+	}
+}
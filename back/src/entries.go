@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"strconv"
@@ -11,231 +12,989 @@ import (
 
 type eidT int
 
+// entry kinds, see entries.kind. Only work counts as worked, the others are absences that count
+// towards what's expected like leave does. Clocking in and out always records work.
+const (
+	entryWork     = "work"
+	entrySick     = "sick"
+	entryVacation = "vacation"
+	entryOther    = "other"
+)
+
+func validEntryKind(kind string) bool {
+	switch kind {
+	case entryWork, entrySick, entryVacation, entryOther:
+		return true
+	}
+	return false
+}
+
 type entry struct {
-	EID   eidT `json:"eid"`
-	From  int  `json:"from"`
-	To    int  `json:"to"`
-	Valid bool `json:"valid"`
+	EID    eidT   `json:"eid"`
+	From   int    `json:"from"`
+	To     int    `json:"to"`
+	Valid  bool   `json:"valid"`
+	Source string `json:"source"`
+	Kind   string `json:"kind"`
+	Site   stidT  `json:"site"` // where the user clocked in
+
+	Contract ctidT  `json:"contract"` // the contract it's attributed to, 0 for none, see contracts.go
+	Category catidT `json:"category"` // 0 for none, see categories.go
+
+	MissedHeartbeat bool `json:"missedHeartbeat"` // the client stopped sending heartbeats while it ran
+	OverCap         bool `json:"overCap"`         // see checkCap
+	AfterBreak      bool `json:"afterBreak"`      // the time since the entry before was a break
+	Pending         bool `json:"pending"`         // a manual entry waiting for approval, it doesn't count yet
+
+	Created int64 `json:"created"` // unix time, set by the database
+	Updated int64 `json:"updated"` // unix time of the last change, including moving it to the trash and back
 }
 
-func disqualify(db *sql.DB) {
-	rows, err := db.Query("SELECT uid, since_unix_s FROM user_states WHERE state = 'I'")
-	if err != nil {
-		fmt.Println(stacktrace.Propagate(err, "failed to select users to disqualify"))
-		return
+// entryColumns are the columns scanEntry expects
+const entryColumns = "eid, from_unix_s, to_unix_s, valid, source, kind, IFNULL(stid, 0), IFNULL(ctid, 0), " +
+	"IFNULL(catid, 0), missed_heartbeat, over_cap, after_break, 1 - approved, created_unix_s, updated_unix_s"
+
+func scanEntry(rows *sql.Rows) (en entry, err error) {
+	err = rows.Scan(&en.EID, &en.From, &en.To, &en.Valid, &en.Source, &en.Kind, &en.Site, &en.Contract, &en.Category,
+		&en.MissedHeartbeat, &en.OverCap, &en.AfterBreak, &en.Pending, &en.Created, &en.Updated)
+	return en, stacktrace.Propagate(err, "failed to scan row")
+}
+
+// day is what listEntries groups entries by, with what a calendar needs to know about the day
+type day struct {
+	Weekend  bool    `json:"weekend"`
+	Leave    string  `json:"leave,omitempty"` // the type of approved leave on the day
+	Expected int     `json:"expected"`        // seconds, see expectedForDay
+	Entries  []entry `json:"entries"`
+}
+
+func newDay(date time.Time, sc schedule) *day {
+	return &day{
+		Weekend:  isWeekend(date),
+		Leave:    sc.leave.of(date),
+		Expected: expectedForDay(date, sc),
+		Entries:  []entry{},
 	}
+}
 
-	type userSince struct {
-		uid   int
-		since int
+// entryFilter narrows down listEntries, zero values don't filter
+type entryFilter struct {
+	Valid    *bool
+	Source   string
+	Kind     string
+	From, To int64 // unix times the entries start in, To is exclusive
+
+	UpdatedSince int64 // only entries changed at or after the unix time, 0 for all
+}
+
+// disqualify clocks out everyone but the exempt who clocked in at the site before openedBefore, recording invalid entries.
+// Those on a break since before then are clocked out too, the entry before the break stands.
+// Each user is clocked out in a transaction that only goes through if they're still in the state
+// that was selected, so a run that fails part way or a second run for the same time can't record
+// an entry twice. It keeps going past failures for single users and returns the first, affected is
+// how many were clocked out.
+func disqualify(db *sql.DB, stid stidT, openedBefore int64, exempt map[uidT]bool) (affected int, err error) {
+	now := clk.Now().Unix()
+	rows, err := entryStore.query(context.TODO(), db,
+		`SELECT uid, state, since_unix_s, IFNULL(ctid, 0), missed_heartbeat, after_break FROM user_states
+			WHERE state IN (?1, ?2) AND since_unix_s < ?3 AND stid = ?4`, stateIn, stateBreak, openedBefore, stid)
+	if err != nil {
+		return 0, stacktrace.Propagate(err, "failed to select users to disqualify")
+	}
+	var failed error
+	fail := func(err error) {
+		logError(err)
+		if failed == nil {
+			failed = err
+		}
 	}
-	toDisq := []userSince{}
 
+	toDisq := []disqualified{}
 	for rows.Next() {
-		var us userSince
-		err = rows.Scan(&us.uid, &us.since)
+		var x disqualified
+		err = rows.Scan(&x.uid, &x.state, &x.since, &x.ctid, &x.missed, &x.afterBreak)
 		if err != nil {
-			fmt.Print(stacktrace.Propagate(err, "failed to scan row"))
+			fail(stacktrace.Propagate(err, "failed to scan row"))
+			continue
 		}
-		toDisq = append(toDisq, us)
+		if exempt[x.uid] {
+			continue
+		}
+		toDisq = append(toDisq, x)
 	}
+	rows.Close()
 
 	for _, x := range toDisq {
-		_, err = db.Exec("INSERT INTO entries (uid, from_unix_s, to_unix_s, valid) VALUES (?1, ?2, ?3, 0)", x.uid, x.since, time.Now().Unix())
+		done, err := disqualifyUser(db, stid, x, now)
 		if err != nil {
-			fmt.Println(stacktrace.Propagate(err, "failed to add disqualifying entry for "+strconv.Itoa(x.uid)))
+			fail(stacktrace.Propagate(err, "failed to disqualify "+strconv.Itoa(int(x.uid))))
+			continue
+		}
+		if done {
+			affected++
+			runTransitionHooks(x.uid, x.state, stateOut, now)
 		}
 	}
+	return affected, failed
+}
 
-	_, err = db.Exec("UPDATE user_states SET state = 'O', since_unix_s = ? WHERE state = 'I'", time.Now().Unix())
-	if err != nil {
-		fmt.Println(stacktrace.Propagate(err, "failed to clock out disqualified users"))
-	}
+// disqualified is a user disqualify is about to clock out and the state they were in
+type disqualified struct {
+	uid        uidT
+	state      userState
+	since      int
+	ctid       ctidT
+	missed     bool
+	afterBreak bool
 }
 
-func clockIn(db *sql.DB, uid uidT) (err error) {
+// disqualifyUser clocks the user out as of now with an invalid entry if they're still in the state x
+// at the site, done is false if they aren't anymore
+func disqualifyUser(db *sql.DB, stid stidT, x disqualified, now int64) (done bool, err error) {
 	tx, err := db.Begin()
+	if err != nil {
+		return false, stacktrace.Propagate(err, "failed to begin a transaction")
+	}
 	rollback := func() {
-		err = tx.Rollback()
+		if err := tx.Rollback(); err != nil {
+			logError(stacktrace.Propagate(err, "failed to roll back transaction"))
+		}
+	}
+
+	res, err := entryStore.exec(context.TODO(), tx,
+		`UPDATE user_states SET state = ?1, since_unix_s = ?2, expected_end_unix_s = NULL, stid = NULL, ctid = NULL,
+			after_break = 0
+			WHERE uid = ?3 AND state = ?4 AND since_unix_s = ?5 AND stid = ?6`, stateOut, now, x.uid, x.state, x.since, stid)
+	if err != nil {
+		rollback()
+		return false, stacktrace.Propagate(err, "failed to clock out")
+	}
+	n, err := res.RowsAffected()
+	if err != nil || n == 0 {
+		rollback()
+		return false, stacktrace.Propagate(err, "failed to get rows affected")
+	}
+
+	if x.state == stateIn {
+		eid, err := entryStore.insert(context.TODO(), tx, "eid",
+			`INSERT INTO entries (uid, from_unix_s, to_unix_s, valid, source, stid, ctid, missed_heartbeat, after_break)
+				VALUES (?1, ?2, ?3, 0, 'auto-close', ?4, ?5, ?6, ?7)`,
+			x.uid, x.since, now, stid, nullContract(x.ctid), x.missed, x.afterBreak)
+		if err != nil {
+			rollback()
+			return false, stacktrace.Propagate(err, "failed to add disqualifying entry")
+		}
+		err = audit(tx, auditSystem, x.uid, auditDisqualify, eidT(eid), nil, entryRange{eidT(eid), x.since, int(now)})
 		if err != nil {
-			fmt.Println(stacktrace.Propagate(err, "failed to roll back transaction"))
+			rollback()
+			return false, err
+		}
+	}
+
+	err = audit(tx, auditSystem, x.uid, auditClockOut, 0, auditState{State: x.state}, auditState{State: stateOut, At: now})
+	if err != nil {
+		rollback()
+		return false, err
+	}
+	return true, stacktrace.Propagate(tx.Commit(), "failed to commit transaction")
+}
+
+// clockIn clocks the user in, did is the device they used (if any) and
+// expectedEnd is when they plan to clock out, 0 if they didn't say
+func clockIn(ctx context.Context, db *sql.DB, uid uidT, did didT, expectedEnd int64) (err error) {
+	return clockInAt(ctx, db, uid, did, expectedEnd, clk.Now().Unix())
+}
+
+// clockInUnder is clockIn with the time attributed to the user's contract ctid, see contracts.go
+func clockInUnder(ctx context.Context, db *sql.DB, uid uidT, did didT, expectedEnd int64, ctid ctidT) (err error) {
+	return clockInFrom(ctx, db, uid, did, expectedEnd, clk.Now().Unix(), ctid, stateOut, stateBreak)
+}
+
+// clockInAt is clockIn as of the unix time at, which must not be before the user clocked out.
+// Clocking in during a break ends it.
+func clockInAt(ctx context.Context, db *sql.DB, uid uidT, did didT, expectedEnd, at int64) (err error) {
+	return clockInFrom(ctx, db, uid, did, expectedEnd, at, 0, stateOut, stateBreak)
+}
+
+// clockBreakEnd clocks the user back in after a break, it does nothing if they aren't on one
+func clockBreakEnd(ctx context.Context, db *sql.DB, uid uidT, did didT) (err error) {
+	return clockInFrom(ctx, db, uid, did, 0, clk.Now().Unix(), 0, stateBreak)
+}
+
+// clockInFrom clocks the user in if they're in one of the states from, otherwise it's a duplicate punch.
+// The time is attributed to the contract ctid, or if it's 0 to the one from before a break
+// or else the user's first contract that's in effect.
+func clockInFrom(ctx context.Context, db *sql.DB, uid uidT, did didT, expectedEnd, at int64, ctid ctidT, from ...userState) (err error) {
+	result := punchFailed
+	defer func() { logPunch(db, uid, did, stateIn, result) }()
+
+	loc, err := userLocation(ctx, db, uid)
+	if err != nil {
+		return err
+	}
+	date := time.Unix(at, 0).In(loc).Format(holidayDate)
+
+	tx, err := db.BeginTx(ctx, nil)
+	rollback := func() {
+		if err := tx.Rollback(); err != nil {
+			logError(stacktrace.Propagate(err, "failed to roll back transaction"))
 		}
 	}
 	if err != nil {
 		return stacktrace.Propagate(err, "failed to begin transaction")
 	}
 
-	var state string
-	err = db.QueryRow("SELECT state FROM user_states WHERE uid = ?", uid).Scan(&state)
+	state, _, err := getState(ctx, tx, uid)
 	if err != nil {
 		rollback()
-		return stacktrace.Propagate(err, "failed to find a row in user_states for specified user")
+		return err
 	}
 
-	if state == "I" {
+	if !state.in(from) {
 		rollback()
-		return nil // already clocked in
+		result = punchDuplicate
+		return nil // already clocked in, or not on a break
 	}
 
-	_, err = db.Exec("UPDATE user_states SET state = 'I', since_unix_s = ?1 WHERE uid = ?2", time.Now().Unix(), uid)
+	err = setState(ctx, tx, uid, did, state, stateIn, at)
 	if err != nil {
 		rollback()
-		return stacktrace.Propagate(err, "failed to update user state")
+		return err
 	}
 
-	return stacktrace.Propagate(tx.Commit(), "failed to commit transaction")
+	_, err = entryStore.exec(ctx, tx, "UPDATE user_states SET stid = "+punchSiteSQL+" WHERE uid = ?1", uid, did)
+	if err != nil {
+		rollback()
+		return stacktrace.Propagate(err, "failed to set site")
+	}
+
+	_, err = entryStore.exec(ctx, tx,
+		`UPDATE user_states SET ctid = CASE WHEN ?2 != 0 THEN ?2 WHEN ctid IS NOT NULL THEN ctid
+			ELSE (SELECT MIN(ctid) FROM contracts WHERE uid = ?1
+				AND from_date <= ?3 AND (to_date IS NULL OR to_date >= ?3)) END
+			WHERE uid = ?1`, uid, ctid, date)
+	if err != nil {
+		rollback()
+		return stacktrace.Propagate(err, "failed to set contract")
+	}
+
+	if expectedEnd != 0 {
+		_, err = entryStore.exec(ctx, tx, "UPDATE user_states SET expected_end_unix_s = ?1 WHERE uid = ?2", expectedEnd, uid)
+		if err != nil {
+			rollback()
+			return stacktrace.Propagate(err, "failed to set expected end")
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return stacktrace.Propagate(err, "failed to commit transaction")
+	}
+	result = punchAccepted
+	runTransitionHooks(uid, state, stateIn, at)
+	return nil
 }
 
-func clockOut(db *sql.DB, uid uidT) (err error) {
-	tx, err := db.Begin()
+func clockOut(ctx context.Context, db *sql.DB, uid uidT, did didT) (err error) {
+	return clockOutAt(ctx, db, uid, did, clk.Now().Unix())
+}
+
+// clockOutAt is clockOut as of the unix time at, which must not be before the user clocked in.
+// Clocking out during a break ends the day at the start of the break.
+func clockOutAt(ctx context.Context, db *sql.DB, uid uidT, did didT, at int64) (err error) {
+	return clockOutTo(ctx, db, uid, did, at, stateOut)
+}
+
+// clockBreakStart records the time since clocking in as an entry and puts the user on a break,
+// it does nothing if they aren't clocked in
+func clockBreakStart(ctx context.Context, db *sql.DB, uid uidT, did didT) (err error) {
+	return clockOutTo(ctx, db, uid, did, clk.Now().Unix(), stateBreak)
+}
+
+// clockOutTo ends what the user is doing, recording an entry if they were clocked in, and moves them to state to
+func clockOutTo(ctx context.Context, db *sql.DB, uid uidT, did didT, at int64, to userState) (err error) {
+	result := punchFailed
+	defer func() { logPunch(db, uid, did, to, result) }()
+
+	tx, err := db.BeginTx(ctx, nil)
 	rollback := func() {
-		err = tx.Rollback()
-		if err != nil {
-			fmt.Println(stacktrace.Propagate(err, "failed to roll back transaction"))
+		if err := tx.Rollback(); err != nil {
+			logError(stacktrace.Propagate(err, "failed to roll back transaction"))
 		}
 	}
 	if err != nil {
 		return stacktrace.Propagate(err, "failed to begin transaction")
 	}
 
-	var state string
-	var since int
-	err = db.QueryRow("SELECT state, since_unix_s FROM user_states WHERE uid = ?", uid).Scan(&state, &since)
+	state, since, err := getState(ctx, tx, uid)
 	if err != nil {
 		rollback()
-		return stacktrace.Propagate(err, "failed to find a row in user_states for specified user")
+		return err
 	}
 
-	if state == "O" {
+	if state == stateOut || (to == stateBreak && state != stateIn) {
 		rollback()
-		return nil // already clocked out
+		result = punchDuplicate
+		return nil // already clocked out, or not clocked in to take a break
 	}
 
-	now := time.Now().Unix() // so that it doesn't change between the next two SQL statements
-	_, err = db.Exec("INSERT INTO entries (uid, from_unix_s, to_unix_s, valid) VALUES (?1, ?2, ?3, 1)", uid, since, now)
+	if state == stateIn {
+		_, err = entryStore.exec(ctx, tx,
+			`INSERT INTO entries (uid, from_unix_s, to_unix_s, valid, source, stid, ctid, missed_heartbeat, after_break)
+				SELECT ?1, ?2, ?3, 1, 'clock', stid, ctid, missed_heartbeat, after_break FROM user_states WHERE uid = ?1`,
+			uid, since, at)
+		if err != nil {
+			rollback()
+			return stacktrace.Propagate(err, "failed to insert an entry")
+		}
+	}
+	err = setState(ctx, tx, uid, did, state, to, at)
 	if err != nil {
 		rollback()
-		return stacktrace.Propagate(err, "failed to insert an entry")
+		return err
 	}
-	_, err = db.Exec("UPDATE user_states SET state = 'O', since_unix_s = ?1 WHERE uid = ?2", now, uid)
+
+	err = tx.Commit()
 	if err != nil {
-		rollback()
-		return stacktrace.Propagate(err, "failed to update user state")
+		return stacktrace.Propagate(err, "failed to commit transaction")
 	}
+	result = punchAccepted
+	runTransitionHooks(uid, state, to, at)
+	return nil
+}
 
-	return stacktrace.Propagate(tx.Commit(), "failed to commit transaction")
+// entryOverlaps reports whether [from, to] overlaps any of the user's entries or the time since they clocked in
+func entryOverlaps(tx *sql.Tx, uid uidT, from, to int64) (overlaps bool, err error) {
+	err = entryStore.queryRow(context.TODO(), tx,
+		`SELECT 1 FROM entries WHERE uid = ?1 AND from_unix_s < ?3 AND to_unix_s > ?2 AND deleted_unix_s IS NULL
+			UNION ALL
+		SELECT 1 FROM user_states WHERE uid = ?1 AND state = ?4 AND since_unix_s < ?3`,
+		uid, from, to, stateIn).Scan(new(int))
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, stacktrace.Propagate(err, "failed to check for overlapping entries")
 }
 
-func editEntry(db *sql.DB, eid eidT, from, to int) (err error) {
-	_, err = db.Exec("UPDATE entries SET from_unix_s = ?1, to_unix_s = ?2 WHERE eid = ?3", from, to, eid)
-	return stacktrace.Propagate(err, "failed to edit entry")
+// bulkResult is what happened to one date of createEntries or submitEntries, Error is empty if an entry
+// was created. Submitted entries have the approval's id and status.
+type bulkResult struct {
+	Date   string `json:"date"`
+	EID    eidT   `json:"eid,omitempty"`
+	APID   apidT  `json:"apid,omitempty"`
+	Status string `json:"status,omitempty"`
+	Error  string `json:"error,omitempty"`
 }
 
-func deleteEntry(db *sql.DB, eid eidT) (err error) {
-	_, err = db.Exec("DELETE FROM entries WHERE eid = ?", eid)
-	return stacktrace.Propagate(err, "failed to delete entry")
+// bulkRange is the range on the date (like 2006-01-02) from the clock time of from to the clock time of to,
+// problem says why there's none
+func bulkRange(d string, from, to time.Time, loc *time.Location) (start, end int64, problem string) {
+	date, err := time.ParseInLocation("2006-01-02", d, loc)
+	if err != nil {
+		return 0, 0, "invalid date"
+	}
+	s := time.Date(date.Year(), date.Month(), date.Day(), from.Hour(), from.Minute(), 0, 0, loc)
+	e := time.Date(date.Year(), date.Month(), date.Day(), to.Hour(), to.Minute(), 0, 0, loc)
+	// time.Date moves clock times that the time zone skips, like when DST starts
+	if s.Format("2006-01-02 15:04") != d+" "+from.Format("15:04") ||
+		e.Format("2006-01-02 15:04") != d+" "+to.Format("15:04") || !e.After(s) {
+		return 0, 0, "no such time"
+	}
+	return s.Unix(), e.Unix(), ""
 }
 
-func listEntries(db *sql.DB, uid uidT) (days map[int64][]entry, err error) {
-	rows, err := db.Query("SELECT eid, from_unix_s, to_unix_s, valid FROM entries WHERE uid = ?", uid)
+// createEntries creates a manual entry of the kind on each of dates (like 2006-01-02) from the clock time of from
+// to the clock time of to, attributed to the contract ctid unless it's 0, skipping dates where it would
+// overlap an existing entry
+func createEntries(db *sql.DB, uid uidT, dates []string, from, to time.Time, kind string, ctid ctidT, loc *time.Location,
+	by uidT) (results []bulkResult, err error) {
+	tx, err := db.Begin()
 	if err != nil {
-		return nil, stacktrace.Propagate(err, "failed to list entries")
+		return nil, stacktrace.Propagate(err, "failed to begin transaction")
+	}
+	rollback := func() {
+		if err := tx.Rollback(); err != nil {
+			logError(stacktrace.Propagate(err, "failed to roll back transaction"))
+		}
 	}
 
-	ens := []entry{}
-	en := entry{}
+	results = []bulkResult{}
+	for _, d := range dates {
+		res := bulkResult{Date: d}
+		enFrom, enTo, problem := bulkRange(d, from, to, loc)
+		if problem != "" {
+			res.Error = problem
+			results = append(results, res)
+			continue
+		}
+
+		overlaps, err := entryOverlaps(tx, uid, enFrom, enTo)
+		if err != nil {
+			rollback()
+			return nil, err
+		}
+		if overlaps {
+			res.Error = "overlap"
+			results = append(results, res)
+			continue
+		}
+
+		eid, err := entryStore.insert(context.TODO(), tx, "eid",
+			`INSERT INTO entries (uid, from_unix_s, to_unix_s, valid, source, stid, kind, ctid)
+				SELECT ?1, ?2, ?3, 1, 'manual', stid, ?4, ?5 FROM users WHERE uid = ?1`, uid, enFrom, enTo, kind, nullContract(ctid))
+		if err != nil {
+			rollback()
+			return nil, stacktrace.Propagate(err, "failed to insert an entry")
+		}
+		res.EID = eidT(eid)
+		results = append(results, res)
+
+		err = audit(tx, by, uid, auditCreate, res.EID, nil, entryRange{res.EID, int(enFrom), int(enTo)})
+		if err != nil {
+			rollback()
+			return nil, err
+		}
+	}
+
+	err = tx.Commit()
+	return results, stacktrace.Propagate(err, "failed to commit transaction")
+}
+
+// submitEntries is createEntries for users' own entries, each date is submitted like submitEntry does,
+// so that they wait for approval beyond the user's weekly limit
+func submitEntries(db *sql.DB, uid uidT, dates []string, from, to time.Time, kind string, ctid ctidT,
+	loc *time.Location) (results []bulkResult, err error) {
+	results = []bulkResult{}
+	for _, d := range dates {
+		res := bulkResult{Date: d}
+		enFrom, enTo, problem := bulkRange(d, from, to, loc)
+		if problem != "" {
+			res.Error = problem
+			results = append(results, res)
+			continue
+		}
+
+		ap, err := submitContractEntry(db, uid, int(enFrom), int(enTo), false, kind, ctid, uid)
+		if _, ok := err.(*overlapError); ok {
+			res.Error = "overlap"
+			results = append(results, res)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		res.EID, res.APID, res.Status = ap.EID, ap.APID, ap.Status
+		results = append(results, res)
+	}
+	return results, nil
+}
+
+// overlapError is what editEntry returns if the entry would overlap others of the user
+type overlapError struct {
+	Conflicts []entryRange `json:"conflicts"`
+	Running   bool         `json:"running"` // it would overlap the time since the user clocked in
+}
+
+type entryRange struct {
+	EID  eidT `json:"eid"`
+	From int  `json:"from"`
+	To   int  `json:"to"`
+}
+
+func (e *overlapError) Error() string {
+	return fmt.Sprintf("entry would overlap %d other entries (running: %t)", len(e.Conflicts), e.Running)
+}
+
+// findOverlaps returns an overlapError if [from, to) overlaps any of the user's entries but eid
+// or the time since they clocked in, nil if it doesn't
+func findOverlaps(tx *sql.Tx, uid uidT, eid eidT, from, to int) (oe *overlapError, err error) {
+	rows, err := entryStore.query(context.TODO(), tx,
+		`SELECT eid, from_unix_s, to_unix_s FROM entries
+			WHERE uid = ?1 AND eid != ?2 AND from_unix_s < ?4 AND to_unix_s > ?3 AND deleted_unix_s IS NULL
+			ORDER BY from_unix_s`, uid, eid, from, to)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed to find overlapping entries")
+	}
+	defer rows.Close()
+
+	oe = &overlapError{Conflicts: []entryRange{}}
 	for rows.Next() {
-		err = rows.Scan(&en.EID, &en.From, &en.To, &en.Valid)
+		var er entryRange
+		err = rows.Scan(&er.EID, &er.From, &er.To)
 		if err != nil {
 			return nil, stacktrace.Propagate(err, "failed to scan row")
 		}
+		oe.Conflicts = append(oe.Conflicts, er)
+	}
+
+	err = entryStore.queryRow(context.TODO(), tx,
+		"SELECT 1 FROM user_states WHERE uid = ?1 AND state = ?2 AND since_unix_s < ?3", uid, stateIn, to).Scan(new(int))
+	if err != nil && err != sql.ErrNoRows {
+		return nil, stacktrace.Propagate(err, "failed to check the running time")
+	}
+	oe.Running = err == nil
+
+	if len(oe.Conflicts) == 0 && !oe.Running {
+		return nil, nil
+	}
+	return oe, nil
+}
+
+// fitEntry checks that the user's entry eid can be moved to [from, to). If that overlaps other entries
+// of the user, it returns an *overlapError, unless clamp is set and the range can be shortened to fit
+// between them. It returns the range the entry fits in. eid is 0 for a new entry.
+func fitEntry(tx *sql.Tx, uid uidT, eid eidT, from, to int, clamp bool) (fitFrom, fitTo int, err error) {
+	oe, err := findOverlaps(tx, uid, eid, from, to)
+	if err != nil {
+		return from, to, err
+	}
+	if oe != nil && clamp {
+		for _, c := range oe.Conflicts {
+			if c.From <= from && c.To > from {
+				from = c.To
+			}
+			if c.From < to && c.To >= to {
+				to = c.From
+			}
+		}
+		if oe.Running {
+			var since int
+			err = entryStore.queryRow(context.TODO(), tx, "SELECT since_unix_s FROM user_states WHERE uid = ?", uid).Scan(&since)
+			if err != nil {
+				return from, to, stacktrace.Propagate(err, "failed to get user state")
+			}
+			if since < to {
+				to = since
+			}
+		}
+
+		// what's left over lies within the range, or nothing is left of it
+		if from < to {
+			oe, err = findOverlaps(tx, uid, eid, from, to)
+			if err != nil {
+				return from, to, err
+			}
+		}
+	}
+	if oe != nil {
+		return from, to, oe
+	}
+	return from, to, nil
+}
+
+// editEntry moves the entry to [from, to), see fitEntry for clamp. It returns the range that was written.
+func editEntry(db *sql.DB, eid eidT, from, to int, clamp bool, by uidT) (written entryRange, found bool, err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return written, false, stacktrace.Propagate(err, "failed to begin transaction")
+	}
+	defer tx.Rollback()
+
+	written, found, err = editEntryTx(tx, eid, from, to, clamp, by)
+	if err != nil || !found {
+		return written, found, err
+	}
+	return written, true, stacktrace.Propagate(tx.Commit(), "failed to commit transaction")
+}
+
+// editEntryTx is editEntry within tx
+func editEntryTx(tx *sql.Tx, eid eidT, from, to int, clamp bool, by uidT) (written entryRange, found bool, err error) {
+	var uid uidT
+	old := entryRange{EID: eid}
+	err = entryStore.queryRow(context.TODO(), tx,
+		"SELECT uid, from_unix_s, to_unix_s FROM entries WHERE eid = ? AND deleted_unix_s IS NULL",
+		eid).Scan(&uid, &old.From, &old.To)
+	if err == sql.ErrNoRows {
+		return written, false, nil
+	}
+	if err != nil {
+		return written, false, stacktrace.Propagate(err, "failed to get entry")
+	}
+
+	from, to, err = fitEntry(tx, uid, eid, from, to, clamp)
+	if err != nil {
+		return written, true, err
+	}
+
+	_, err = entryStore.exec(context.TODO(), tx, "UPDATE entries SET from_unix_s = ?1, to_unix_s = ?2 WHERE eid = ?3",
+		from, to, eid)
+	if err != nil {
+		return written, true, stacktrace.Propagate(err, "failed to edit entry")
+	}
+	written = entryRange{eid, from, to}
+	return written, true, audit(tx, by, uid, auditEdit, eid, old, written)
+}
+
+// deleteEntry moves the entry to the trash, where it no longer counts but can be restored, see restoreEntry
+func deleteEntry(db *sql.DB, eid eidT, by uidT) (found bool, err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, stacktrace.Propagate(err, "failed to begin transaction")
+	}
+	defer tx.Rollback()
+
+	found, err = deleteEntryTx(tx, eid, by)
+	if err != nil || !found {
+		return found, err
+	}
+	return true, stacktrace.Propagate(tx.Commit(), "failed to commit transaction")
+}
+
+// deleteEntryTx is deleteEntry within tx
+func deleteEntryTx(tx *sql.Tx, eid eidT, by uidT) (found bool, err error) {
+	var uid uidT
+	old := entryRange{EID: eid}
+	err = entryStore.queryRow(context.TODO(), tx,
+		"SELECT uid, from_unix_s, to_unix_s FROM entries WHERE eid = ? AND deleted_unix_s IS NULL",
+		eid).Scan(&uid, &old.From, &old.To)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, stacktrace.Propagate(err, "failed to get entry")
+	}
+
+	_, err = entryStore.exec(context.TODO(), tx,
+		"UPDATE entries SET deleted_unix_s = ?1, deleted_by = ?2 WHERE eid = ?3", clk.Now().Unix(), by, eid)
+	if err != nil {
+		return true, stacktrace.Propagate(err, "failed to delete entry")
+	}
+	return true, audit(tx, by, uid, auditDelete, eid, old, nil)
+}
+
+// deletedEntry is an entry in the trash
+type deletedEntry struct {
+	entry
+	Deleted   int  `json:"deleted"` // unix time
+	DeletedBy uidT `json:"deletedBy"`
+}
+
+// listDeletedEntries returns the user's entries in the trash, the last deleted first
+func listDeletedEntries(db *sql.DB, uid uidT) (des []deletedEntry, err error) {
+	rows, err := entryStore.query(context.TODO(), db,
+		`SELECT `+entryColumns+`, deleted_unix_s, IFNULL(deleted_by, 0) FROM entries
+			WHERE uid = ? AND deleted_unix_s IS NOT NULL ORDER BY deleted_unix_s DESC`, uid)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed to list deleted entries")
+	}
+	defer rows.Close()
+
+	des = []deletedEntry{}
+	for rows.Next() {
+		var de deletedEntry
+		en := &de.entry
+		err = rows.Scan(&en.EID, &en.From, &en.To, &en.Valid, &en.Source, &en.Kind, &en.Site, &en.Contract, &en.Category,
+			&en.MissedHeartbeat, &en.OverCap, &en.AfterBreak, &en.Pending, &en.Created, &en.Updated,
+			&de.Deleted, &de.DeletedBy)
+		if err != nil {
+			return nil, stacktrace.Propagate(err, "failed to scan row")
+		}
+		des = append(des, de)
+	}
+	return des, nil
+}
+
+// restoreEntry takes the entry out of the trash, unless it would overlap the user's entries
+// since then, then it returns an *overlapError
+func restoreEntry(db *sql.DB, eid eidT, by uidT) (found bool, err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, stacktrace.Propagate(err, "failed to begin transaction")
+	}
+	defer tx.Rollback()
+
+	var uid uidT
+	var from, to int
+	err = entryStore.queryRow(context.TODO(), tx,
+		"SELECT uid, from_unix_s, to_unix_s FROM entries WHERE eid = ? AND deleted_unix_s IS NOT NULL",
+		eid).Scan(&uid, &from, &to)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, stacktrace.Propagate(err, "failed to get deleted entry")
+	}
+
+	oe, err := findOverlaps(tx, uid, eid, from, to)
+	if err != nil {
+		return true, err
+	}
+	if oe != nil {
+		return true, oe
+	}
+
+	_, err = entryStore.exec(context.TODO(), tx,
+		"UPDATE entries SET deleted_unix_s = NULL, deleted_by = NULL WHERE eid = ?", eid)
+	if err != nil {
+		return true, stacktrace.Propagate(err, "failed to restore entry")
+	}
+	err = audit(tx, by, uid, auditRestore, eid, nil, entryRange{eid, from, to})
+	if err != nil {
+		return true, err
+	}
+	return true, stacktrace.Propagate(tx.Commit(), "failed to commit transaction")
+}
+
+// listEntries returns up to limit of the user's entries, skipping the first offset of them in order of time,
+// grouped by the unix time of the start of the day they started on in the user's time zone. more is set if
+// there are more after them, a day's entries can be split across pages then.
+func listEntries(ctx context.Context, db *sql.DB, uid uidT, filter entryFilter, offset, limit int) (days map[int64]*day, more bool, err error) {
+	query := "SELECT " + entryColumns + " FROM entries WHERE uid = ? AND deleted_unix_s IS NULL"
+	args := []interface{}{uid}
+	if filter.Valid != nil {
+		query += " AND valid = ?"
+		args = append(args, *filter.Valid)
+	}
+	if filter.Source != "" {
+		query += " AND source = ?"
+		args = append(args, filter.Source)
+	}
+	if filter.Kind != "" {
+		query += " AND kind = ?"
+		args = append(args, filter.Kind)
+	}
+	if filter.From != 0 {
+		query += " AND from_unix_s >= ?"
+		args = append(args, filter.From)
+	}
+	if filter.To != 0 {
+		query += " AND from_unix_s < ?"
+		args = append(args, filter.To)
+	}
+	if filter.UpdatedSince != 0 {
+		query += " AND updated_unix_s >= ?"
+		args = append(args, filter.UpdatedSince)
+	}
+	query += " ORDER BY from_unix_s, eid LIMIT ? OFFSET ?"
+	args = append(args, limit+1, offset)
+
+	rows, err := entryStore.query(ctx, db, query, args...)
+	if err != nil {
+		return nil, false, stacktrace.Propagate(err, "failed to list entries")
+	}
+	defer rows.Close()
+
+	ens := []entry{}
+	for rows.Next() {
+		en, err := scanEntry(rows)
+		if err != nil {
+			return nil, false, err
+		}
 		ens = append(ens, en)
 	}
+	if len(ens) > limit {
+		ens, more = ens[:limit], true
+	}
 
-	days = make(map[int64][]entry)
+	days = make(map[int64]*day)
+	if len(ens) == 0 {
+		return days, more, nil
+	}
+	loc, err := userLocation(ctx, db, uid)
+	if err != nil {
+		return nil, false, err
+	}
+	first, last := time.Unix(int64(ens[0].From), 0).In(loc), time.Unix(int64(ens[0].From), 0).In(loc)
 	for _, x := range ens {
-		date := time.Unix(int64(x.From), 0)
-		key := time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, date.Location()).Unix()
-		days[key] = append(days[key], x)
+		if t := time.Unix(int64(x.From), 0).In(loc); t.Before(first) {
+			first = t
+		} else if t.After(last) {
+			last = t
+		}
+	}
+	sc, err := getSchedule(ctx, db, uid, first, last)
+	if err != nil {
+		return nil, false, err
+	}
+
+	for _, x := range ens {
+		date := time.Unix(int64(x.From), 0).In(loc)
+		sod := time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, date.Location())
+		if days[sod.Unix()] == nil {
+			days[sod.Unix()] = newDay(sod, sc)
+		}
+		days[sod.Unix()].Entries = append(days[sod.Unix()].Entries, x)
 	}
 
-	return days, nil
+	return days, more, nil
 }
 
-func getDeltaForDay(db *sql.DB, uid uidT, date time.Time) (delta int, err error) {
-	// TODO: account for holidays
+// expectedForDay returns how many seconds are supposed to be worked on date,
+// sc is the user's schedule around then. Leave and school days count as if the target had been worked.
+func expectedForDay(date time.Time, sc schedule) int {
+	if isWeekend(date) || sc.holidays.has(date) || sc.leave.of(date) != "" || sc.school.has(date) {
+		return 0
+	}
+	if target, ok := sc.profiles.of(date); ok {
+		return target
+	}
+	if target, ok := sc.contracts.target(date); ok {
+		return target
+	}
+	return sc.target
+}
 
+// getWorkedForDay returns the seconds worked on the day of date in the user's time zone,
+// including the time since clocking in if the user still is. Like in getDayReports,
+// entries count in full towards the day they started on.
+func getWorkedForDay(ctx context.Context, db *sql.DB, uid uidT, date time.Time) (worked int, err error) {
+	loc, err := userLocation(ctx, db, uid)
+	if err != nil {
+		return worked, err
+	}
+	date = date.In(loc)
 	sod := time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, date.Location())
 	eod := time.Date(date.Year(), date.Month(), date.Day()+1, 0, 0, 0, 0, date.Location())
-	rows, err := db.Query(
+	rows, err := entryStore.query(ctx, db,
 		`SELECT from_unix_s, to_unix_s FROM entries
-			WHERE uid = ?1 AND valid = 1
-			AND from_unix_s > ?2 AND to_unix_s < ?3`, uid, sod.Unix(), eod.Unix())
+			WHERE uid = ?1 AND valid = 1 AND approved = 1 AND deleted_unix_s IS NULL AND kind = ?4
+			AND from_unix_s >= ?2 AND from_unix_s < ?3`, uid, sod.Unix(), eod.Unix(), entryWork)
 	if err != nil {
-		return delta, stacktrace.Propagate(err, "failed to get entries in date range")
+		return worked, stacktrace.Propagate(err, "failed to get entries in date range")
 	}
 
 	for rows.Next() {
 		var from, to int
 		rows.Scan(&from, &to)
-		delta += to - from
+		worked += to - from - lunchDeduction.deduction(to-from)
 	}
 
-	if date.Weekday() != time.Saturday && date.Weekday() != time.Sunday {
-		delta -= 8 * 60 * 60
+	r, err := getRunning(ctx, db, uid)
+	if err != nil {
+		return worked, err
 	}
 
-	var state string
-	var since int
-	err = db.QueryRow("SELECT state, since_unix_s FROM user_states WHERE uid = ?", uid).Scan(&state, &since)
+	running := r.in(sod, eod, clk.Now())
+	return worked + running - lunchDeduction.deduction(running), nil
+}
+
+// running is the time since a user clocked in, it isn't an entry yet
+type running struct {
+	Since int64 // 0 if the user is clocked out
+	Site  stidT
+}
+
+func getRunning(ctx context.Context, db *sql.DB, uid uidT) (r running, err error) {
+	var state userState
+	err = entryStore.queryRow(ctx, db,
+		"SELECT state, since_unix_s, IFNULL(stid, 0) FROM user_states WHERE uid = ?", uid).Scan(&state, &r.Since, &r.Site)
 	if err != nil {
-		return delta, stacktrace.Propagate(err, "failed to get user info")
+		return r, stacktrace.Propagate(err, "failed to get user state")
+	}
+	if state != stateIn {
+		r.Since = 0
 	}
+	return r, nil
+}
 
-	if state == "I" {
-		delta += int(time.Now().Unix()) - since
+// in is how many seconds of the running time, as of now, count towards [from, to).
+// Like entries, it counts in full towards the day it started on. Whether anything was
+// expected then doesn't matter, that is up to expectedForDay.
+func (r running) in(from, to, now time.Time) int {
+	if r.Since == 0 || r.Since < from.Unix() || r.Since >= to.Unix() {
+		return 0
 	}
+	return int(now.Unix() - r.Since)
+}
+
+// getDeltaForDay is the delta of the day of date in the user's time zone
+func getDeltaForDay(ctx context.Context, db *sql.DB, uid uidT, date time.Time) (delta int, err error) {
+	loc, err := userLocation(ctx, db, uid)
+	if err != nil {
+		return delta, err
+	}
+	date = date.In(loc)
+
+	worked, err := getWorkedForDay(ctx, db, uid, date)
+	if err != nil {
+		return delta, err
+	}
+
+	sc, err := getSchedule(ctx, db, uid, date, date)
+	if err != nil {
+		return delta, err
+	}
+
+	absent, err := getAbsentForDay(ctx, db, uid, date)
+	if err != nil {
+		return delta, err
+	}
+
+	return worked + absent - expectedForDay(date, sc), nil
+}
 
-	return delta, nil
+// getAbsentForDay sums up the sick, vacation and other entries that started on the day of date
+// in the user's time zone, including those that end on a later day
+func getAbsentForDay(ctx context.Context, db *sql.DB, uid uidT, date time.Time) (absent int, err error) {
+	loc, err := userLocation(ctx, db, uid)
+	if err != nil {
+		return absent, err
+	}
+	date = date.In(loc)
+	sod := time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, date.Location())
+	eod := time.Date(date.Year(), date.Month(), date.Day()+1, 0, 0, 0, 0, date.Location())
+	err = entryStore.queryRow(ctx, db,
+		`SELECT IFNULL(SUM(to_unix_s - from_unix_s), 0) FROM entries
+			WHERE uid = ?1 AND valid = 1 AND approved = 1 AND deleted_unix_s IS NULL AND kind != ?4
+			AND from_unix_s >= ?2 AND from_unix_s < ?3`, uid, sod.Unix(), eod.Unix(), entryWork).Scan(&absent)
+	return absent, stacktrace.Propagate(err, "failed to get absences in date range")
 }
 
-func getDeltaForMonth(db *sql.DB, uid uidT, date time.Time) (delta int, err error) {
-	// TODO: account for holidays
+// deltaMode says up to when getDeltaForMonth subtracts what's expected
+type deltaMode int
 
+const (
+	deltaToDate    deltaMode = iota // up to and including the date
+	deltaProjected                  // up to the end of the month, as if nothing more was worked after the date
+)
+
+// getDeltaForMonth is the delta from the start of the month up to and including the date,
+// with expectations counted as the mode says. Days and months are those of the user's time zone,
+// entries count towards the day they started on.
+func getDeltaForMonth(ctx context.Context, db *sql.DB, uid uidT, date time.Time, mode deltaMode) (delta int, err error) {
+	loc, err := userLocation(ctx, db, uid)
+	if err != nil {
+		return delta, err
+	}
+	date = date.In(loc)
 	som := time.Date(date.Year(), date.Month(), 1, 0, 0, 0, 0, date.Location())
 	eod := time.Date(date.Year(), date.Month(), date.Day()+1, 0, 0, 0, 0, date.Location())
-	rows, err := db.Query(
-		`SELECT from_unix_s, to_unix_s FROM entries
-			WHERE uid = ?1 AND valid = 1
-			AND from_unix_s > ?2 AND to_unix_s < ?3`, uid, som.Unix(), eod.Unix())
+	rows, err := entryStore.query(ctx, db,
+		`SELECT from_unix_s, to_unix_s, kind FROM entries
+			WHERE uid = ?1 AND valid = 1 AND approved = 1 AND deleted_unix_s IS NULL
+			AND from_unix_s >= ?2 AND from_unix_s < ?3`, uid, som.Unix(), eod.Unix())
 	if err != nil {
 		return delta, stacktrace.Propagate(err, "failed to get entries in date range")
 	}
 
 	for rows.Next() {
 		var from, to int
-		rows.Scan(&from, &to)
+		var kind string
+		rows.Scan(&from, &to, &kind)
 		delta += to - from
-	}
-
-	x := som
-	for x.Before(eod) {
-		if x.Weekday() != time.Saturday && x.Weekday() != time.Sunday {
-			delta -= 8 * 60 * 60
+		if kind == entryWork {
+			delta -= lunchDeduction.deduction(to - from)
 		}
-		x = x.Add(time.Hour * 24)
 	}
 
-	var state string
-	var since int
-	err = db.QueryRow("SELECT state, since_unix_s FROM user_states WHERE uid = ?", uid).Scan(&state, &since)
+	end := eod
+	if mode == deltaProjected {
+		end = som.AddDate(0, 1, 0)
+	}
+	sc, err := getSchedule(ctx, db, uid, som, end.AddDate(0, 0, -1))
 	if err != nil {
-		return delta, stacktrace.Propagate(err, "failed to get user info")
+		return delta, err
+	}
+
+	for x := som; x.Before(end); x = x.AddDate(0, 0, 1) {
+		delta -= expectedForDay(x, sc)
 	}
 
-	if state == "I" {
-		delta += int(time.Now().Unix()) - since
+	r, err := getRunning(ctx, db, uid)
+	if err != nil {
+		return delta, err
 	}
 
-	return delta, nil
+	running := r.in(som, eod, clk.Now())
+	return delta + running - lunchDeduction.deduction(running), nil
 }
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// createEntries never writes an entry that ends before it starts or doesn't start on its date,
+// whatever the time zone does on the day
+func FuzzCreateEntries(f *testing.F) {
+	f.Add("2019-10-14", "09:00", "17:00", "Europe/Berlin")
+	f.Add("2019-03-31", "02:30", "03:00", "Europe/Berlin")
+	f.Add("2019-10-27", "02:15", "02:45", "Europe/Berlin")
+	f.Add("2019-11-03", "01:00", "01:30", "America/New_York")
+	f.Add("2011-12-30", "08:00", "09:00", "Pacific/Apia")
+	db, done := newTestDB(f, time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC))
+	defer done()
+	uid := seedUser(f, db, "a@example.com", false)
+
+	f.Fuzz(func(t *testing.T, date, from, to, tz string) {
+		b, err := parseBulkEntries([]byte(fmt.Sprintf(`{"dates": [%q], "from": %q, "to": %q}`, date, from, to)))
+		if err != nil || checkTimezone(tz) != nil || tz == "" {
+			return
+		}
+		loc := timezoneLocation(uid, tz)
+		if _, err = db.Exec("DELETE FROM entries"); err != nil {
+			t.Fatal(err)
+		}
+
+		results, err := createEntries(db, uid, b.Dates, b.from, b.to, b.Kind, b.Contract, loc, uid)
+		if err != nil {
+			t.Fatalf("%s %s-%s in %s: %v", date, from, to, tz, err)
+		}
+		if len(results) != 1 {
+			t.Fatalf("%d results for one date", len(results))
+		}
+		if results[0].Error != "" {
+			return
+		}
+		var enFrom, enTo int64
+		err = db.QueryRow("SELECT from_unix_s, to_unix_s FROM entries WHERE eid = ?", results[0].EID).Scan(&enFrom, &enTo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if enTo <= enFrom {
+			t.Errorf("%s %s-%s in %s: entry from %d to %d", date, from, to, tz, enFrom, enTo)
+		}
+		if got := time.Unix(enFrom, 0).In(loc).Format(holidayDate); got != date {
+			t.Errorf("%s %s-%s in %s: entry starts on %s", date, from, to, tz, got)
+		}
+	})
+}
+
+// users bulk-create their own entries for approval, within the weekly limit they're approved right away
+func TestEntriesBulk(t *testing.T) {
+	loc := testLocation(t)
+	db, done := newTestDB(t, time.Date(2019, time.October, 17, 12, 0, 0, 0, loc))
+	defer done()
+	h := newTestServer(db)
+	a := seedUser(t, db, "a@example.com", false)
+	b := seedUser(t, db, "b@example.com", false)
+	own, err := createContract(db, contract{UID: a, Name: "Lab", From: "2019-01-01"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := createContract(db, contract{UID: b, Name: "Lab", From: "2019-01-01"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	savedLimit, savedStart := manualEntryLimit, weekStart
+	defer func() { manualEntryLimit, weekStart = savedLimit, savedStart }()
+	manualEntryLimit, weekStart = 1, time.Monday
+	seedEntry(t, db, a, time.Date(2019, time.October, 16, 8, 0, 0, 0, loc), time.Date(2019, time.October, 16, 10, 0, 0, 0, loc), entryWork)
+
+	bulk := func(uid uidT, body string) (int, []bulkResult) {
+		w := serve(h, "POST", "/u/entries/bulk", seedSession(t, db, uid), strings.NewReader(body))
+		var results []bulkResult
+		if w.Code == 200 {
+			if err := json.Unmarshal(w.Body.Bytes(), &results); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return w.Code, results
+	}
+
+	code, results := bulk(a, fmt.Sprintf(`{"dates": ["2019-10-14", "2019-10-15", "2019-10-16", "2019-10-32"],
+		"from": "09:00", "to": "17:00", "contract": %d}`, own))
+	if code != 200 {
+		t.Fatalf("got %d", code)
+	}
+	var got []string
+	for _, res := range results {
+		got = append(got, res.Status+res.Error)
+	}
+	if want := []string{approvalApproved, approvalPending, "overlap", "invalid date"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	n := countRows(t, db, `SELECT COUNT(*) FROM entries JOIN approvals USING (eid)
+		WHERE uid = ?1 AND ctid = ?2 AND source = 'manual' AND submitted_by = ?1`, a, own)
+	if n != 2 {
+		t.Errorf("%d submitted entries of the contract, want 2", n)
+	}
+	if n = countRows(t, db, "SELECT COUNT(*) FROM entries WHERE uid = ? AND approved = 0", a); n != 1 {
+		t.Errorf("%d entries wait for approval, want 1", n)
+	}
+
+	// only the user's own contracts
+	code, _ = bulk(a, fmt.Sprintf(`{"dates": ["2019-10-17"], "from": "09:00", "to": "17:00", "contract": %d}`, other))
+	if code != 400 {
+		t.Errorf("another user's contract got %d, want 400", code)
+	}
+	if code, _ = bulk(b, `{"dates": ["2019-10-17"], "from": "09:00", "to": "17:00"}`); code != 200 {
+		t.Errorf("without a contract got %d", code)
+	}
+}
+
+// entries count towards the day they start on, like in reports, even if they start at midnight
+// or end on the next day
+func TestDayAttributionByStart(t *testing.T) {
+	loc := testLocation(t)
+	at := func(day, hour int) time.Time { return time.Date(2019, time.October, day, hour, 0, 0, 0, loc) }
+	db, done := newTestDB(t, at(20, 12))
+	defer done()
+	uid := seedUser(t, db, "a@example.com", false)
+	seedEntry(t, db, uid, at(7, 0), at(7, 2), entryWork)  // starts at midnight
+	seedEntry(t, db, uid, at(7, 22), at(8, 3), entryWork) // ends on the next day
+	seedEntry(t, db, uid, at(8, 23), at(9, 7), entrySick)
+	ctx := context.Background()
+
+	reports, err := getDayReports(db, uid, at(7, 0), 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []struct{ worked, absent int }{{7 * 3600, 0}, {0, 8 * 3600}, {0, 0}} {
+		day := at(7+i, 0)
+		worked, err := getWorkedForDay(ctx, db, uid, day)
+		if err != nil {
+			t.Fatal(err)
+		}
+		absent, err := getAbsentForDay(ctx, db, uid, day)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if worked != want.worked || absent != want.absent {
+			t.Errorf("%s: worked %d and absent %d, want %d and %d", day.Format(holidayDate), worked, absent, want.worked, want.absent)
+		}
+		if worked != reports[i].Worked {
+			t.Errorf("%s: worked %d, but the report says %d", day.Format(holidayDate), worked, reports[i].Worked)
+		}
+	}
+
+	delta, err := getDeltaForMonth(ctx, db, uid, at(9, 0), deltaToDate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mr, err := getMonthReport(db, uid, 2019, time.October, loc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var reported int
+	for _, dr := range mr.Days[:9] {
+		reported += dr.Delta
+	}
+	if delta != reported {
+		t.Errorf("delta up to the 9th is %d, but the report's days sum up to %d", delta, reported)
+	}
+}
+
+// Across random schedules and time zones, the daily deltas of a month sum up to its delta,
+// nothing worked or absent is negative and neither is any entry of the month's report
+func TestDeltaProperties(t *testing.T) {
+	zones := []string{"Europe/Berlin", "America/New_York", "Asia/Kolkata", "Australia/Lord_Howe", "Pacific/Apia", "UTC"}
+	months := []time.Month{time.March, time.October, time.November, time.December}
+	kinds := []string{entryWork, entryWork, entryWork, entrySick, entryVacation, entryOther}
+	r := rand.New(rand.NewSource(230))
+	ctx := context.Background()
+	savedLunch := lunchDeduction
+	defer func() { lunchDeduction = savedLunch }()
+
+	for i := 0; i < 40; i++ {
+		loc, err := time.LoadLocation(zones[r.Intn(len(zones))])
+		if err != nil {
+			t.Fatal(err)
+		}
+		year, month := 2019, months[r.Intn(len(months))]
+		som := time.Date(year, month, 1, 0, 0, 0, 0, loc)
+		eom := som.AddDate(0, 1, 0)
+		lunchDeduction = lunchPolicy{}
+		if r.Intn(2) == 0 {
+			lunchDeduction = lunchPolicy{After: 6 * 3600, Deduct: 30 * 60}
+		}
+
+		db, done := newTestDB(t, eom.Add(time.Duration(r.Intn(48))*time.Hour))
+		uid := seedUser(t, db, "a@example.com", false)
+		_, err = db.Exec("UPDATE users SET timezone = ?, daily_target_s = ? WHERE uid = ?", loc.String(), 3600*(4+r.Intn(6)), uid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for d := 1; d <= 28; d++ {
+			date := time.Date(year, month, d, 0, 0, 0, 0, loc).Format(holidayDate)
+			switch r.Intn(12) {
+			case 0:
+				seedHoliday(t, db, date, "")
+			case 1:
+				_, err = db.Exec(`INSERT INTO leave_requests (uid, type, from_date, to_date, status, submitted_unix_s)
+					VALUES (?1, ?2, ?3, ?3, 'approved', 0)`, uid, leaveVacation, date)
+			case 2:
+				_, err = db.Exec(`INSERT INTO contracts (uid, name, daily_target_s, from_date) VALUES (?, 'part', ?, ?)`,
+					uid, 3600*r.Intn(9), date)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// consecutive entries of random lengths, some over midnight and over the end of the month
+		at := som.Add(time.Duration(r.Intn(12*60)) * time.Minute)
+		for at.Before(eom) {
+			length := time.Duration(1+r.Intn(11*60)) * time.Minute
+			seedEntry(t, db, uid, at, at.Add(length), kinds[r.Intn(len(kinds))])
+			at = at.Add(length + time.Duration(r.Intn(30*60))*time.Minute)
+		}
+		if r.Intn(2) == 0 {
+			seedState(t, db, uid, stateIn, eom.Add(-time.Duration(1+r.Intn(20))*time.Hour))
+		}
+
+		sum := 0
+		for day := som; day.Before(eom); day = day.AddDate(0, 0, 1) {
+			delta, err := getDeltaForDay(ctx, db, uid, day)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sum += delta
+			monthly, err := getDeltaForMonth(ctx, db, uid, day, deltaToDate)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if sum != monthly {
+				t.Errorf("%s in %s: daily deltas sum up to %d, the month's delta is %d", day.Format(holidayDate), loc, sum, monthly)
+			}
+
+			worked, err := getWorkedForDay(ctx, db, uid, day)
+			if err != nil {
+				t.Fatal(err)
+			}
+			absent, err := getAbsentForDay(ctx, db, uid, day)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if worked < 0 || absent < 0 {
+				t.Errorf("%s in %s: worked %d and absent %d", day.Format(holidayDate), loc, worked, absent)
+			}
+		}
+
+		mr, err := getMonthReport(db, uid, year, month, loc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, dr := range mr.Days {
+			if dr.Worked < 0 || dr.Expected < 0 {
+				t.Errorf("%d in %s: worked %d of %d expected", dr.Date, loc, dr.Worked, dr.Expected)
+			}
+			for _, e := range dr.Entries {
+				if e.To < e.From {
+					t.Errorf("entry %d in %s runs from %d to %d", e.EID, loc, e.From, e.To)
+				}
+			}
+		}
+		done()
+	}
+}
+
+func TestRunningIn(t *testing.T) {
+	from, to := time.Unix(1000, 0), time.Unix(2000, 0)
+	now := time.Unix(2500, 0)
+	for _, c := range []struct {
+		since int64
+		want  int
+	}{
+		{0, 0},       // clocked out
+		{999, 0},     // started the day before
+		{1000, 1500}, // at the start of the day
+		{1999, 501},  // just before the end of the day
+		{2000, 0},    // on the next day
+		{2400, 0},    // later on the next day
+		{1500, 1000}, // counts in full, not only up to the end of the day
+	} {
+		if got := (running{Since: c.since}).in(from, to, now); got != c.want {
+			t.Errorf("running since %d counts %d, want %d", c.since, got, c.want)
+		}
+	}
+}
+
+// while the user is clocked in on a holiday or weekend day, nothing is expected, so all of the running time
+// is positive delta, and running time from the day before counts for that day
+func TestDeltaForDayRunning(t *testing.T) {
+	loc := testLocation(t)
+	at := func(day, hour int) time.Time { return time.Date(2019, time.October, day, hour, 0, 0, 0, loc) }
+	const target = 8 * 3600
+	ctx := context.Background()
+
+	for _, c := range []struct {
+		name        string
+		since, now  time.Time
+		day         time.Time
+		wantDelta   int
+		wantRunning int // of the day in its report
+	}{
+		{"holiday", at(3, 8), at(3, 10), at(3, 0), 2 * 3600, 2 * 3600},
+		{"saturday", at(5, 8), at(5, 11), at(5, 0), 3 * 3600, 3 * 3600},
+		{"sunday", at(6, 22), at(7, 1), at(6, 0), 3 * 3600, 3 * 3600},
+		{"weekday", at(1, 8), at(1, 10), at(1, 0), 2*3600 - target, 2 * 3600},
+		{"the weekday after clocking in", at(1, 22), at(2, 2), at(2, 0), -target, 0},
+		{"the weekday of clocking in", at(1, 22), at(2, 2), at(1, 0), 4*3600 - target, 4 * 3600},
+		{"the holiday after clocking in", at(2, 22), at(3, 2), at(3, 0), 0, 0},
+		{"the monday after a weekend", at(6, 22), at(7, 2), at(7, 0), -target, 0},
+	} {
+		db, done := newTestDB(t, c.now)
+		uid := seedUser(t, db, "a@example.com", false)
+		seedHoliday(t, db, "2019-10-03", "Tag der Deutschen Einheit")
+		seedState(t, db, uid, stateIn, c.since)
+
+		delta, err := getDeltaForDay(ctx, db, uid, c.day)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if delta != c.wantDelta {
+			t.Errorf("%s: delta %d, want %d", c.name, delta, c.wantDelta)
+		}
+
+		reports, err := getDayReports(db, uid, c.day, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reports[0].Worked != c.wantRunning || reports[0].Delta != c.wantDelta {
+			t.Errorf("%s: report has worked %d and delta %d, want %d and %d",
+				c.name, reports[0].Worked, reports[0].Delta, c.wantRunning, c.wantDelta)
+		}
+
+		monthly, err := getDeltaForMonth(ctx, db, uid, c.day, deltaToDate)
+		if err != nil {
+			t.Fatal(err)
+		}
+		before := 0
+		if c.day.Day() > 1 {
+			if before, err = getDeltaForMonth(ctx, db, uid, c.day.AddDate(0, 0, -1), deltaToDate); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if monthly-before != c.wantDelta {
+			t.Errorf("%s: the month's delta grew by %d on the day, want %d", c.name, monthly-before, c.wantDelta)
+		}
+		done()
+	}
+}
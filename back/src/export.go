@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/palantir/stacktrace"
+)
+
+// exportedEntry is an entry with who it belongs to, for exports
+type exportedEntry struct {
+	entry
+	UID   uidT
+	Email string
+	loc   *time.Location // the user's, see userLocation
+
+	payrollID, hrisID, ldapDN string // see identity.go
+
+	category string // the name of the entry's category
+}
+
+// exportColumns are the columns entry exports can have. Times are in the user's time zone.
+var exportColumns = map[string]func(ex exportedEntry) string{
+	"eid":     func(ex exportedEntry) string { return strconv.Itoa(int(ex.EID)) },
+	"uid":     func(ex exportedEntry) string { return strconv.Itoa(int(ex.UID)) },
+	"email":   func(ex exportedEntry) string { return ex.Email },
+	"payroll": func(ex exportedEntry) string { return ex.payrollID },
+	"hris":    func(ex exportedEntry) string { return ex.hrisID },
+	"ldap":    func(ex exportedEntry) string { return ex.ldapDN },
+	"date":    func(ex exportedEntry) string { return time.Unix(int64(ex.From), 0).In(ex.loc).Format(holidayDate) },
+	"from":    func(ex exportedEntry) string { return time.Unix(int64(ex.From), 0).In(ex.loc).Format(time.RFC3339) },
+	"to":      func(ex exportedEntry) string { return time.Unix(int64(ex.To), 0).In(ex.loc).Format(time.RFC3339) },
+	"start":   func(ex exportedEntry) string { return time.Unix(int64(ex.From), 0).In(ex.loc).Format("15:04") },
+	"end":     func(ex exportedEntry) string { return time.Unix(int64(ex.To), 0).In(ex.loc).Format("15:04") },
+	"hours": func(ex exportedEntry) string {
+		return strconv.FormatFloat(float64(ex.To-ex.From)/3600, 'f', 2, 64)
+	},
+	"kind":     func(ex exportedEntry) string { return ex.Kind },
+	"source":   func(ex exportedEntry) string { return ex.Source },
+	"site":     func(ex exportedEntry) string { return strconv.Itoa(int(ex.Site)) },
+	"contract": func(ex exportedEntry) string { return strconv.Itoa(int(ex.Contract)) },
+	"category": func(ex exportedEntry) string { return ex.category },
+	"valid":    func(ex exportedEntry) string { return strconv.FormatBool(ex.Valid) },
+	"pending":  func(ex exportedEntry) string { return strconv.FormatBool(ex.Pending) },
+	"created":  func(ex exportedEntry) string { return time.Unix(ex.Created, 0).In(ex.loc).Format(time.RFC3339) },
+	"updated":  func(ex exportedEntry) string { return time.Unix(ex.Updated, 0).In(ex.loc).Format(time.RFC3339) },
+}
+
+var defaultExportColumns = []string{"email", "date", "start", "end", "hours", "kind", "valid"}
+
+// parseExportColumns reads a comma separated list of exportColumns, the defaults if s is empty.
+// The error is meant for clients.
+func parseExportColumns(s string) (columns []string, err error) {
+	if s == "" {
+		return defaultExportColumns, nil
+	}
+	for _, c := range strings.Split(s, ",") {
+		if _, ok := exportColumns[c]; !ok {
+			return nil, fmt.Errorf("unknown column %q", c)
+		}
+		columns = append(columns, c)
+	}
+	return columns, nil
+}
+
+// exportScope is whose entries are exported, the user's if UID is set, everyone at the site
+// (users.stid, sites stand in for teams) if Site is, everyone's otherwise
+type exportScope struct {
+	UID  uidT
+	Site stidT
+}
+
+// writeEntriesCSV writes the entries in scope that match the filter with the columns and a header row,
+// ordered by user and time. Rows are written as they're read so that large exports don't pile up.
+func writeEntriesCSV(db *sql.DB, w io.Writer, scope exportScope, filter entryFilter, columns []string) (err error) {
+	categories, err := categoryNames(db)
+	if err != nil {
+		return err
+	}
+
+	query := `SELECT eid, from_unix_s, to_unix_s, valid, source, kind, IFNULL(entries.stid, 0), IFNULL(ctid, 0),
+			IFNULL(catid, 0), 1 - approved,
+			created_unix_s, updated_unix_s, uid, email, IFNULL(timezone, ''), IFNULL(payroll_id, uid),
+			IFNULL((SELECT external_id FROM user_identities i WHERE i.uid = users.uid AND system = 'hris'), ''),
+			IFNULL((SELECT external_id FROM user_identities i WHERE i.uid = users.uid AND system = 'ldap'), '')
+		FROM entries JOIN users USING (uid)
+		WHERE deleted_unix_s IS NULL AND from_unix_s >= ? AND from_unix_s < ?`
+	args := []interface{}{filter.From, filter.To}
+	if scope.UID != 0 {
+		query += " AND uid = ?"
+		args = append(args, scope.UID)
+	}
+	if scope.Site != 0 {
+		query += " AND users.stid = ?"
+		args = append(args, scope.Site)
+	}
+	if filter.Valid != nil {
+		query += " AND valid = ?"
+		args = append(args, *filter.Valid)
+	}
+	if filter.Source != "" {
+		query += " AND source = ?"
+		args = append(args, filter.Source)
+	}
+	if filter.Kind != "" {
+		query += " AND kind = ?"
+		args = append(args, filter.Kind)
+	}
+	if filter.UpdatedSince != 0 {
+		query += " AND updated_unix_s >= ?"
+		args = append(args, filter.UpdatedSince)
+	}
+	query += " ORDER BY email, from_unix_s, eid"
+
+	rows, err := entryStore.query(context.TODO(), db, query, args...)
+	if err != nil {
+		return stacktrace.Propagate(err, "failed to export entries")
+	}
+	defer rows.Close()
+
+	cw := csv.NewWriter(w)
+	err = cw.Write(columns)
+	if err != nil {
+		return stacktrace.Propagate(err, "failed to write header")
+	}
+
+	locs := map[uidT]*time.Location{}
+	record := make([]string, len(columns))
+	for rows.Next() {
+		var ex exportedEntry
+		var tz string
+		err = rows.Scan(&ex.EID, &ex.From, &ex.To, &ex.Valid, &ex.Source, &ex.Kind, &ex.Site, &ex.Contract, &ex.Category, &ex.Pending,
+			&ex.Created, &ex.Updated, &ex.UID, &ex.Email, &tz, &ex.payrollID, &ex.hrisID, &ex.ldapDN)
+		if err != nil {
+			return stacktrace.Propagate(err, "failed to scan row")
+		}
+		if locs[ex.UID] == nil {
+			locs[ex.UID] = timezoneLocation(ex.UID, tz)
+		}
+		ex.loc = locs[ex.UID]
+		ex.category = categories[ex.Category]
+
+		for i, c := range columns {
+			record[i] = exportColumns[c](ex)
+		}
+		err = cw.Write(record)
+		if err != nil {
+			return stacktrace.Propagate(err, "failed to write row")
+		}
+	}
+	cw.Flush()
+	return stacktrace.Propagate(cw.Error(), "failed to flush")
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestEntriesCSVGolden(t *testing.T) {
+	db, a, _, done := seedOctober(t)
+	defer done()
+	loc := testLocation(t)
+	filter := entryFilter{
+		From: time.Date(2019, time.October, 1, 0, 0, 0, 0, loc).Unix(),
+		To:   time.Date(2019, time.November, 1, 0, 0, 0, 0, loc).Unix(),
+	}
+
+	var b bytes.Buffer
+	if err := writeEntriesCSV(db, &b, exportScope{}, filter, defaultExportColumns); err != nil {
+		t.Fatal(err)
+	}
+	checkGolden(t, "entries.csv", b.Bytes())
+
+	columns, err := parseExportColumns("eid,uid,from,to,hours,source,pending,created")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Reset()
+	if err = writeEntriesCSV(db, &b, exportScope{UID: a}, filter, columns); err != nil {
+		t.Fatal(err)
+	}
+	checkGolden(t, "entries_user.csv", b.Bytes())
+}
+
+func TestPayrollExportGolden(t *testing.T) {
+	db, _, _, done := seedOctober(t)
+	defer done()
+	saved := wageTypes
+	defer func() { wageTypes = saved }()
+	wageTypes = map[string]string{
+		payWorked: "1000", "overtime": "1200", payHolidayWorked: "1300",
+		entrySick: "2000", payLeavePrefix + leaveVacation: "3000",
+	}
+
+	for _, format := range []string{payrollDATEV, payrollFixed} {
+		var b bytes.Buffer
+		if err := writePayrollExport(db, &b, 2019, time.October, 0, format); err != nil {
+			t.Fatal(err)
+		}
+		checkGolden(t, "payroll."+format, b.Bytes())
+	}
+}
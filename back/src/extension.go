@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/palantir/stacktrace"
+)
+
+// Extension tokens let a browser extension popup check and toggle whether the user is clocked in.
+// They don't expire like sessions do, so they're only good for the few /x endpoints,
+// and each user has at most one.
+
+// createExtensionToken gives the user a new extension token, replacing the old one
+func createExtensionToken(db *sql.DB, uid uidT) (token string, err error) {
+	tokenRaw := make([]byte, 18)
+	rand.Read(tokenRaw)
+	token = base64.URLEncoding.EncodeToString(tokenRaw)
+
+	_, err = db.Exec(
+		`INSERT OR REPLACE INTO extension_tokens (uid, token, created_unix_s)
+			VALUES (?1, ?2, ?3)`, uid, token, clk.Now().Unix())
+	return token, stacktrace.Propagate(err, "failed to insert extension token")
+}
+
+func revokeExtensionToken(db *sql.DB, uid uidT) (err error) {
+	_, err = db.Exec("DELETE FROM extension_tokens WHERE uid = ?", uid)
+	return stacktrace.Propagate(err, "failed to revoke extension token")
+}
+
+func getUserByExtensionToken(db *sql.DB, token string) (uid uidT, err error) {
+	err = db.QueryRow("SELECT uid FROM extension_tokens WHERE token = ?", token).Scan(&uid)
+	return uid, err
+}
+
+// extensionStatus is all the popup shows
+type extensionStatus struct {
+	State userState `json:"state"`
+	Since int       `json:"since"`
+	Today int       `json:"today"` // seconds worked today, including since clocking in
+}
+
+func getExtensionStatus(ctx context.Context, db *sql.DB, uid uidT) (s extensionStatus, err error) {
+	err = db.QueryRowContext(ctx, "SELECT state, since_unix_s FROM user_states WHERE uid = ?", uid).Scan(&s.State, &s.Since)
+	if err != nil {
+		return s, stacktrace.Propagate(err, "failed to get user state")
+	}
+
+	s.Today, err = getWorkedForDay(ctx, db, uid, clk.Now())
+	return s, err
+}
+
+// extensionOriginsFromEnv reads WMS2_EXTENSION_ORIGINS, a comma separated list
+// like "chrome-extension://abc,moz-extension://def", empty allows any origin
+func extensionOriginsFromEnv() (origins []string) {
+	for _, o := range strings.Split(os.Getenv("WMS2_EXTENSION_ORIGINS"), ",") {
+		if o = strings.TrimSpace(o); o != "" {
+			origins = append(origins, o)
+		}
+	}
+	return origins
+}
+
+// rateLimiter allows limit requests per key in each window
+type rateLimiter struct {
+	mu     sync.Mutex
+	limit  int
+	window time.Duration
+	start  time.Time
+	counts map[string]int
+}
+
+func newRateLimiter(limit int, window time.Duration) *rateLimiter {
+	return &rateLimiter{limit: limit, window: window, counts: make(map[string]int)}
+}
+
+func (rl *rateLimiter) allow(key string) bool {
+	return rl.hit(key) <= rl.limit
+}
+
+// hit counts a request for key and returns how many there were in the current window
+func (rl *rateLimiter) hit(key string) int {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	if now := time.Now(); now.Sub(rl.start) >= rl.window {
+		rl.start = now
+		rl.counts = make(map[string]int)
+	}
+	rl.counts[key]++
+	return rl.counts[key]
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/palantir/stacktrace"
+)
+
+// After a badge scan kiosks can show a confirmation screen with the user's name and photo, what
+// they worked today and a message in their language. Users set their name, language and photo
+// themselves, or an admin does it for them.
+
+// maxPhotoSize is the largest photo in bytes, kiosks show them small
+const maxPhotoSize = 48 << 10
+
+// greetings are the confirmation messages by language and the state after the punch,
+// %s is the user's name. Languages without one get English.
+var greetings = map[string]map[userState]string{
+	"en": {
+		stateIn:    "Welcome, %s!",
+		stateOut:   "Goodbye, %s, see you soon!",
+		stateBreak: "Enjoy your break, %s!",
+	},
+	"de": {
+		stateIn:    "Willkommen, %s!",
+		stateOut:   "Auf Wiedersehen, %s, bis bald!",
+		stateBreak: "Schöne Pause, %s!",
+	},
+	"fr": {
+		stateIn:    "Bienvenue, %s !",
+		stateOut:   "Au revoir, %s, à bientôt !",
+		stateBreak: "Bonne pause, %s !",
+	},
+	"es": {
+		stateIn:    "¡Bienvenido, %s!",
+		stateOut:   "¡Adiós, %s, hasta pronto!",
+		stateBreak: "¡Buen descanso, %s!",
+	},
+}
+
+const defaultLanguage = "en"
+
+func checkLanguage(language string) error {
+	if _, ok := greetings[language]; language != "" && !ok {
+		return fmt.Errorf("language has to be one of en, de, fr or es")
+	}
+	return nil
+}
+
+// kioskGreeting is the kiosk's confirmation screen
+type kioskGreeting struct {
+	Name     string    `json:"name"`
+	Photo    string    `json:"photo,omitempty"` // a data URL
+	Language string    `json:"language"`
+	State    userState `json:"state"`
+	Today    int       `json:"today"` // seconds worked today
+	Message  string    `json:"message"`
+}
+
+func getKioskGreeting(ctx context.Context, db *sql.DB, uid uidT) (g kioskGreeting, err error) {
+	var email string
+	var name, language, photoType sql.NullString
+	var photo []byte
+	err = db.QueryRowContext(ctx,
+		`SELECT email, display_name, language, photo, photo_type, state FROM users JOIN user_states USING (uid)
+			WHERE uid = ?`, uid).Scan(&email, &name, &language, &photo, &photoType, &g.State)
+	if err != nil {
+		return g, stacktrace.Propagate(err, "failed to get user")
+	}
+
+	g.Name = name.String
+	if g.Name == "" {
+		g.Name = strings.SplitN(email, "@", 2)[0]
+	}
+	g.Language = language.String
+	if g.Language == "" {
+		g.Language = defaultLanguage
+	}
+	if photo != nil {
+		g.Photo = "data:" + photoType.String + ";base64," + base64.StdEncoding.EncodeToString(photo)
+	}
+	g.Message = fmt.Sprintf(greetings[g.Language][g.State], g.Name)
+
+	g.Today, err = getWorkedForDay(ctx, db, uid, clk.Now())
+	return g, err
+}
+
+// setKioskProfile sets the name and language kiosks greet the user with, empty for the defaults
+func setKioskProfile(db *sql.DB, uid uidT, name, language string) (found bool, err error) {
+	var nameValue, languageValue interface{}
+	if name != "" {
+		nameValue = name
+	}
+	if language != "" {
+		languageValue = language
+	}
+	res, err := db.Exec("UPDATE users SET display_name = ?1, language = ?2 WHERE uid = ?3", nameValue, languageValue, uid)
+	if err != nil {
+		return false, stacktrace.Propagate(err, "failed to set kiosk profile")
+	}
+	n, err := res.RowsAffected()
+	return n == 1, stacktrace.Propagate(err, "failed to get rows affected")
+}
+
+// photoType is the content type of a photo, empty if it isn't an image kiosks can show
+func photoType(photo []byte) string {
+	switch t := http.DetectContentType(photo); t {
+	case "image/jpeg", "image/png", "image/gif", "image/webp":
+		return t
+	}
+	return ""
+}
+
+// setPhoto sets the user's photo, nil removes it
+func setPhoto(db *sql.DB, uid uidT, photo []byte) (found bool, err error) {
+	var typeValue interface{}
+	if photo != nil {
+		typeValue = photoType(photo)
+	}
+	res, err := db.Exec("UPDATE users SET photo = ?1, photo_type = ?2 WHERE uid = ?3", photo, typeValue, uid)
+	if err != nil {
+		return false, stacktrace.Propagate(err, "failed to set photo")
+	}
+	n, err := res.RowsAffected()
+	return n == 1, stacktrace.Propagate(err, "failed to get rows affected")
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"flag"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/AndrewBurian/powermux"
+)
+
+// The test harness: newTestDB gives every test its own in-memory database at the current schema version,
+// the seed helpers fill it and checkGolden compares outputs with the files in testdata.
+// Run the tests with -update to rewrite the golden files after an intended change.
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// testLocation is the time zone seeded users are in, so that reports don't depend on the machine's
+func testLocation(t testing.TB) *time.Location {
+	t.Helper()
+	loc, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return loc
+}
+
+// newTestDB opens an in-memory database with all migrations applied and fixes clk at now.
+// Callers defer the returned function, which closes the database and restores the clock.
+func newTestDB(t testing.TB, now time.Time) (db *sql.DB, done func()) {
+	t.Helper()
+	db, err := openMemoryDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = migrate(db); err != nil {
+		t.Fatal(err)
+	}
+	version, err := getSchemaVersion(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != schemaVersion {
+		t.Fatalf("test database is at version %d, want %d", version, schemaVersion)
+	}
+
+	saved := clk
+	clk = fixedClock(now)
+	return db, func() {
+		clk = saved
+		db.Close()
+	}
+}
+
+// seedUser adds a user without a password in testLocation at the main site, out since the epoch
+func seedUser(t testing.TB, db *sql.DB, email string, admin bool) uidT {
+	t.Helper()
+	res, err := db.Exec("INSERT INTO users (email, admin, timezone) VALUES (?, ?, 'Europe/Berlin')", email, admin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uid, err := res.LastInsertId()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec("INSERT INTO user_states (uid, state, since_unix_s) VALUES (?, ?, 0)", uid, stateOut)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return uidT(uid)
+}
+
+// seedEntry adds a valid, approved clock entry of the given kind from from to to,
+// created and updated at to so that exports don't depend on when the test ran
+func seedEntry(t testing.TB, db *sql.DB, uid uidT, from, to time.Time, kind string) eidT {
+	t.Helper()
+	res, err := db.Exec(`INSERT INTO entries (uid, from_unix_s, to_unix_s, valid, source, kind, stid, created_unix_s, updated_unix_s)
+		VALUES (?1, ?2, ?3, 1, 'clock', ?4, 1, ?3, ?3)`, uid, from.Unix(), to.Unix(), kind)
+	if err != nil {
+		t.Fatal(err)
+	}
+	eid, err := res.LastInsertId()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return eidT(eid)
+}
+
+// seedState clocks the user in or out since the time
+func seedState(t testing.TB, db *sql.DB, uid uidT, state userState, since time.Time) {
+	t.Helper()
+	_, err := db.Exec("UPDATE user_states SET state = ?, since_unix_s = ? WHERE uid = ?", state, since.Unix(), uid)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// seedHoliday makes the date, like 2019-10-03, a holiday at all sites
+func seedHoliday(t testing.TB, db *sql.DB, date, name string) {
+	t.Helper()
+	if _, err := db.Exec("INSERT INTO holidays (date, name) VALUES (?, ?)", date, name); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// seedSession signs the user in and returns the Authorization header for the session
+func seedSession(t testing.TB, db *sql.DB, uid uidT) string {
+	t.Helper()
+	sid, err := createSession(db, uid, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return "Bearer " + string(sid)
+}
+
+// newTestServer routes requests like the server does, with the limits main sets up
+func newTestServer(db *sql.DB) http.Handler {
+	mux := powermux.NewServeMux()
+	routes(mux, env{db: db, latencies: newLatencies(), extensionLimiter: newRateLimiter(20, time.Minute),
+		calendarLimiter: newRateLimiter(20, time.Minute), badgeFailures: newRateLimiter(badgeFailureLimit, badgeFailureWindow),
+		breakGlassLimiter: newRateLimiter(5, time.Hour)})
+	return mux
+}
+
+// serve makes a request with the Authorization header auth, none if it's empty
+func serve(h http.Handler, method, path, auth string, body io.Reader) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, body)
+	if auth != "" {
+		r.Header.Set("Authorization", auth)
+	}
+	if body != nil {
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+// checkGolden compares got with testdata/name, or writes it there with -update
+func checkGolden(t testing.TB, name string, got []byte) {
+	t.Helper()
+	path := filepath.Join("testdata", name)
+	if *update {
+		if err := ioutil.WriteFile(path, got, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("%v, run with -update to create it", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("%s differs from the golden file, run with -update if that's intended\ngot:\n%s\nwant:\n%s", name, got, want)
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"time"
+
+	"github.com/palantir/stacktrace"
+)
+
+// /healthz and /readyz are for the liveness and readiness probes of orchestrators like Kubernetes.
+// Both check that the database answers, /readyz also that it has the schema this build expects, so
+// that an instance started on an old database doesn't get traffic.
+
+// healthTimeout is how long the database gets to answer a probe
+const healthTimeout = 2 * time.Second
+
+// checkDB checks that the database answers within healthTimeout
+func checkDB(db *sql.DB) (err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), healthTimeout)
+	defer cancel()
+	err = db.QueryRowContext(ctx, "SELECT 1").Scan(new(int))
+	return stacktrace.Propagate(err, "database didn't answer")
+}
+
+// getSchemaVersion returns the version of the database's schema, see schemaVersion
+func getSchemaVersion(db *sql.DB) (version int, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), healthTimeout)
+	defer cancel()
+	err = db.QueryRowContext(ctx, "PRAGMA user_version").Scan(&version)
+	return version, stacktrace.Propagate(err, "failed to get schema version")
+}
+
+// do503With tells the probe why the server isn't healthy or ready
+func do503With(w http.ResponseWriter, reason string) {
+	w.WriteHeader(503)
+	w.Write([]byte("503 Service Unavailable: " + reason))
+}
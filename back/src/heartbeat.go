@@ -0,0 +1,66 @@
+package main
+
+import (
+	"database/sql"
+	"os"
+	"time"
+
+	"github.com/palantir/stacktrace"
+)
+
+// Heartbeat mode is for remote staff tracking their time on the honor system:
+// a client that pings while its user is clocked in puts the running entry in heartbeat mode,
+// and if the pings stop for longer than the timeout the entry is flagged for an admin to look at.
+// Clients that never ping are unaffected.
+
+const defaultHeartbeatTimeout = 15 * time.Minute
+
+// heartbeatTimeoutFromEnv reads WMS2_HEARTBEAT_TIMEOUT, a duration like "10m"
+func heartbeatTimeoutFromEnv() time.Duration {
+	s := os.Getenv("WMS2_HEARTBEAT_TIMEOUT")
+	if s == "" {
+		return defaultHeartbeatTimeout
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		logWarning(stacktrace.NewError("invalid WMS2_HEARTBEAT_TIMEOUT %q, using %s", s, defaultHeartbeatTimeout))
+		return defaultHeartbeatTimeout
+	}
+	return d
+}
+
+// heartbeat records a ping from the user's client, in is false if they aren't clocked in
+func heartbeat(db *sql.DB, uid uidT) (in bool, err error) {
+	res, err := db.Exec(
+		"UPDATE user_states SET heartbeat_unix_s = ?1 WHERE uid = ?2 AND state = ?3", clk.Now().Unix(), uid, stateIn)
+	if err != nil {
+		return false, stacktrace.Propagate(err, "failed to record heartbeat")
+	}
+	n, err := res.RowsAffected()
+	return n == 1, stacktrace.Propagate(err, "failed to record heartbeat")
+}
+
+// flagMissedHeartbeats flags running entries in heartbeat mode whose last ping is older than timeout,
+// they stay flagged even if the pings resume. affected is how many were newly flagged.
+func flagMissedHeartbeats(db *sql.DB, timeout time.Duration) (affected int, err error) {
+	res, err := db.Exec(
+		`UPDATE user_states SET missed_heartbeat = 1
+			WHERE state = ?1 AND heartbeat_unix_s < ?2 AND missed_heartbeat = 0`, stateIn, clk.Now().Add(-timeout).Unix())
+	if err != nil {
+		return 0, stacktrace.Propagate(err, "failed to flag missed heartbeats")
+	}
+	n, err := res.RowsAffected()
+	return int(n), stacktrace.Propagate(err, "failed to flag missed heartbeats")
+}
+
+func heartbeatWatcher(db *sql.DB, timeout time.Duration) {
+	for {
+		if !jobSleep(time.Minute) {
+			return
+		}
+		err := pollJob(db, jobHeartbeats, func() (int, error) { return flagMissedHeartbeats(db, timeout) })
+		if err != nil {
+			logError(err)
+		}
+	}
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/palantir/stacktrace"
+)
+
+// Holiday calendars are iCal feeds, like a country's public holidays, that are synced into the
+// holidays table every night. Each sync replaces the holidays that came from the calendar.
+
+type hcidT int
+
+type holidayCalendar struct {
+	HCID      hcidT  `json:"hcid"`
+	URL       string `json:"url"`
+	Site      stidT  `json:"site"`                // like holiday.Site
+	Synced    int64  `json:"synced,omitempty"`    // unix time of the last successful sync
+	LastError string `json:"lastError,omitempty"` // why the last sync failed
+}
+
+const (
+	maxCalendarSize   = 1 << 20 // bytes
+	maxHolidaySpan    = 31      // days, longer events are skipped
+	calendarSyncAfter = 3 * time.Hour
+)
+
+var calendarClient = &http.Client{Timeout: 30 * time.Second}
+
+func (hc holidayCalendar) validate() error {
+	if err := checkText("url", hc.URL, maxURLLength); err != nil {
+		return err
+	}
+	u, err := url.Parse(hc.URL)
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "webcal") {
+		return stacktrace.NewError("url has to be an http, https or webcal URL")
+	}
+	return nil
+}
+
+// fetchURL is where the calendar is downloaded from, webcal is https
+func (hc holidayCalendar) fetchURL() string {
+	if strings.HasPrefix(hc.URL, "webcal://") {
+		return "https://" + strings.TrimPrefix(hc.URL, "webcal://")
+	}
+	return hc.URL
+}
+
+// parseICalHolidays reads the events of an iCal feed as holidays, one per day they cover.
+// Only the dates of events count, recurrence rules aren't expanded.
+func parseICalHolidays(r io.Reader) (hs []holiday, err error) {
+	// lines starting with a space or tab continue the one before
+	lines := []string{}
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64<<10), maxCalendarSize)
+	for sc.Scan() {
+		line := strings.TrimRight(sc.Text(), "\r")
+		if (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) && len(lines) > 0 {
+			lines[len(lines)-1] += line[1:]
+			continue
+		}
+		lines = append(lines, line)
+	}
+	if err = sc.Err(); err != nil {
+		return nil, stacktrace.Propagate(err, "failed to read calendar")
+	}
+
+	var inEvent bool
+	var start, end, summary string
+	for _, line := range lines {
+		i := strings.Index(line, ":")
+		if i < 0 {
+			continue
+		}
+		name, value := strings.ToUpper(line[:i]), line[i+1:]
+		if j := strings.Index(name, ";"); j >= 0 {
+			name = name[:j]
+		}
+
+		switch {
+		case name == "BEGIN" && value == "VEVENT":
+			inEvent, start, end, summary = true, "", "", ""
+		case !inEvent:
+		case name == "DTSTART":
+			start = value
+		case name == "DTEND":
+			end = value
+		case name == "SUMMARY":
+			summary = unescapeICalText(value)
+		case name == "END" && value == "VEVENT":
+			inEvent = false
+			hs = append(hs, icalEventHolidays(start, end, summary)...)
+		}
+	}
+	if len(hs) == 0 {
+		return nil, stacktrace.NewError("calendar has no events")
+	}
+	return hs, nil
+}
+
+// icalEventHolidays gives the holidays of an event with the DTSTART, DTEND (exclusive) and SUMMARY values,
+// none if it's malformed or too long. The time of day of events that have one is ignored.
+func icalEventHolidays(start, end, summary string) (hs []holiday) {
+	if len(start) < 8 {
+		return nil
+	}
+	from, err := time.Parse("20060102", start[:8])
+	if err != nil {
+		return nil
+	}
+	to := from.AddDate(0, 0, 1)
+	if len(end) >= 8 {
+		if t, err := time.Parse("20060102", end[:8]); err == nil && t.After(from) {
+			to = t
+		}
+	}
+	if to.Sub(from) > maxHolidaySpan*24*time.Hour {
+		return nil
+	}
+
+	name := strings.TrimSpace(summary)
+	if name == "" {
+		name = "Holiday"
+	}
+	if utf8.RuneCountInString(name) > maxNameLength {
+		name = string([]rune(name)[:maxNameLength])
+	}
+	for d := from; d.Before(to); d = d.AddDate(0, 0, 1) {
+		hs = append(hs, holiday{Date: d.Format(holidayDate), Name: name})
+	}
+	return hs
+}
+
+var icalTextReplacer = strings.NewReplacer(`\n`, " ", `\N`, " ", `\,`, ",", `\;`, ";", `\\`, `\`)
+
+func unescapeICalText(s string) string {
+	return icalTextReplacer.Replace(s)
+}
+
+// fetchICalHolidays downloads and parses the calendar
+func fetchICalHolidays(hc holidayCalendar) (hs []holiday, err error) {
+	resp, err := calendarClient.Get(hc.fetchURL())
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed to download calendar")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, stacktrace.NewError("failed to download calendar: %s", resp.Status)
+	}
+	return parseICalHolidays(io.LimitReader(resp.Body, maxCalendarSize))
+}
+
+func listHolidayCalendars(db *sql.DB) (hcs []holidayCalendar, err error) {
+	rows, err := db.Query(
+		`SELECT hcid, url, IFNULL(stid, 0), IFNULL(synced_unix_s, 0), IFNULL(last_error, '')
+			FROM holiday_calendars ORDER BY hcid`)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed to list holiday calendars")
+	}
+	defer rows.Close()
+
+	hcs = []holidayCalendar{}
+	for rows.Next() {
+		var hc holidayCalendar
+		err = rows.Scan(&hc.HCID, &hc.URL, &hc.Site, &hc.Synced, &hc.LastError)
+		if err != nil {
+			return nil, stacktrace.Propagate(err, "failed to scan row")
+		}
+		hcs = append(hcs, hc)
+	}
+	return hcs, nil
+}
+
+func getHolidayCalendar(db *sql.DB, hcid hcidT) (hc holidayCalendar, found bool, err error) {
+	err = db.QueryRow(
+		`SELECT hcid, url, IFNULL(stid, 0), IFNULL(synced_unix_s, 0), IFNULL(last_error, '')
+			FROM holiday_calendars WHERE hcid = ?`, hcid).Scan(&hc.HCID, &hc.URL, &hc.Site, &hc.Synced, &hc.LastError)
+	if err == sql.ErrNoRows {
+		return hc, false, nil
+	}
+	return hc, err == nil, stacktrace.Propagate(err, "failed to get holiday calendar")
+}
+
+func createHolidayCalendar(db *sql.DB, hc holidayCalendar) (hcid hcidT, err error) {
+	res, err := db.Exec("INSERT INTO holiday_calendars (url, stid) VALUES (?1, ?2)", hc.URL, nullSite(hc.Site))
+	if err != nil {
+		return hcid, stacktrace.Propagate(err, "failed to insert holiday calendar")
+	}
+	id, err := res.LastInsertId()
+	return hcidT(id), stacktrace.Propagate(err, "failed to get holiday calendar id")
+}
+
+// deleteHolidayCalendar deletes the calendar and the holidays synced from it
+func deleteHolidayCalendar(db *sql.DB, hcid hcidT) (found bool, err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, stacktrace.Propagate(err, "failed to begin transaction")
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("DELETE FROM holidays WHERE hcid = ?", hcid)
+	if err != nil {
+		return false, stacktrace.Propagate(err, "failed to delete synced holidays")
+	}
+	res, err := tx.Exec("DELETE FROM holiday_calendars WHERE hcid = ?", hcid)
+	if err != nil {
+		return false, stacktrace.Propagate(err, "failed to delete holiday calendar")
+	}
+	n, err := res.RowsAffected()
+	if err != nil || n != 1 {
+		return false, stacktrace.Propagate(err, "failed to delete holiday calendar")
+	}
+	return true, stacktrace.Propagate(tx.Commit(), "failed to commit transaction")
+}
+
+// syncHolidayCalendar replaces the holidays synced from the calendar with what it has now,
+// affected is how many there are. Failures are recorded on the calendar, which keeps its holidays.
+func syncHolidayCalendar(db *sql.DB, hc holidayCalendar) (affected int, err error) {
+	hs, err := fetchICalHolidays(hc)
+	if err != nil {
+		_, rerr := db.Exec("UPDATE holiday_calendars SET last_error = ?1 WHERE hcid = ?2",
+			stacktrace.RootCause(err).Error(), hc.HCID)
+		if rerr != nil {
+			logError(stacktrace.Propagate(rerr, "failed to record sync error"))
+		}
+		return 0, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, stacktrace.Propagate(err, "failed to begin transaction")
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("DELETE FROM holidays WHERE hcid = ?", hc.HCID)
+	if err != nil {
+		return 0, stacktrace.Propagate(err, "failed to delete synced holidays")
+	}
+	seen := map[string]bool{}
+	for _, h := range hs {
+		if seen[h.Date] {
+			continue
+		}
+		seen[h.Date] = true
+		_, err = tx.Exec("INSERT INTO holidays (date, name, stid, hcid) VALUES (?1, ?2, ?3, ?4)",
+			h.Date, h.Name, nullSite(hc.Site), hc.HCID)
+		if err != nil {
+			return 0, stacktrace.Propagate(err, "failed to insert holiday")
+		}
+	}
+	_, err = tx.Exec("UPDATE holiday_calendars SET synced_unix_s = ?1, last_error = NULL WHERE hcid = ?2",
+		clk.Now().Unix(), hc.HCID)
+	if err != nil {
+		return 0, stacktrace.Propagate(err, "failed to record sync")
+	}
+	return len(seen), stacktrace.Propagate(tx.Commit(), "failed to commit transaction")
+}
+
+// syncHolidayCalendars syncs every calendar, it keeps going past failures and returns the first
+func syncHolidayCalendars(db *sql.DB) (affected int, err error) {
+	hcs, err := listHolidayCalendars(db)
+	if err != nil {
+		return 0, err
+	}
+
+	var failed error
+	for _, hc := range hcs {
+		n, err := syncHolidayCalendar(db, hc)
+		affected += n
+		if err != nil {
+			logError(err)
+			if failed == nil {
+				failed = err
+			}
+		}
+	}
+	return affected, failed
+}
+
+// holidaySyncer syncs the holiday calendars every night at calendarSyncAfter past midnight
+func holidaySyncer(db *sql.DB) {
+	for {
+		now := time.Now()
+		next := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location()).Add(calendarSyncAfter)
+		if !next.After(now) {
+			next = next.AddDate(0, 0, 1)
+		}
+		if !jobSleep(time.Until(next)) {
+			return
+		}
+		if err := runJob(db, jobHolidays, func() (int, error) { return syncHolidayCalendars(db) }); err != nil {
+			logError(err, "job", jobHolidays)
+		}
+	}
+}
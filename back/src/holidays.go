@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/palantir/stacktrace"
+)
+
+type hidT int
+
+// holiday is a public holiday, nothing is expected to be worked on it
+type holiday struct {
+	HID  hidT   `json:"hid"`
+	Date string `json:"date"` // like 2019-10-03
+	Name string `json:"name"`
+	Site stidT  `json:"site"` // 0 if it's a holiday at all sites
+
+	// the calendar it was synced from, 0 if it was added by hand. Changes to synced holidays
+	// last until the next sync.
+	Calendar hcidT `json:"calendar,omitempty"`
+}
+
+const holidayDate = "2006-01-02"
+
+func (h holiday) validate() error {
+	if _, err := time.Parse(holidayDate, h.Date); err != nil {
+		return stacktrace.NewError("date has to be like 2019-10-03")
+	}
+	if h.Name == "" {
+		return stacktrace.NewError("holiday needs a name")
+	}
+	return checkText("name", h.Name, maxNameLength)
+}
+
+// holidaySet holds the dates (see holiday.Date) that are holidays for a user
+type holidaySet map[string]bool
+
+func (hs holidaySet) has(date time.Time) bool {
+	return hs[date.Format(holidayDate)]
+}
+
+// getHolidays returns the holidays from the day of from up to the day of to, inclusive,
+// that apply to the user's site
+func getHolidays(ctx context.Context, db *sql.DB, uid uidT, from, to time.Time) (hs holidaySet, err error) {
+	rows, err := db.QueryContext(ctx,
+		`SELECT date FROM holidays WHERE date >= ?1 AND date <= ?2
+			AND (stid IS NULL OR stid = (SELECT stid FROM users WHERE uid = ?3))`,
+		from.Format(holidayDate), to.Format(holidayDate), uid)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed to get holidays")
+	}
+	defer rows.Close()
+
+	hs = make(holidaySet)
+	for rows.Next() {
+		var date string
+		err = rows.Scan(&date)
+		if err != nil {
+			return nil, stacktrace.Propagate(err, "failed to scan row")
+		}
+		hs[date] = true
+	}
+	return hs, nil
+}
+
+// listHolidays returns the holidays of the year at all sites
+func listHolidays(db *sql.DB, year int) (hs []holiday, err error) {
+	rows, err := db.Query(
+		`SELECT hid, date, name, IFNULL(stid, 0), IFNULL(hcid, 0) FROM holidays
+			WHERE date >= ?1 AND date < ?2 ORDER BY date`,
+		time.Date(year, 1, 1, 0, 0, 0, 0, time.UTC).Format(holidayDate),
+		time.Date(year+1, 1, 1, 0, 0, 0, 0, time.UTC).Format(holidayDate))
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed to list holidays")
+	}
+	defer rows.Close()
+
+	hs = []holiday{}
+	for rows.Next() {
+		var h holiday
+		err = rows.Scan(&h.HID, &h.Date, &h.Name, &h.Site, &h.Calendar)
+		if err != nil {
+			return nil, stacktrace.Propagate(err, "failed to scan row")
+		}
+		hs = append(hs, h)
+	}
+	return hs, nil
+}
+
+// nullSite is the stid column value for s, null for all sites
+func nullSite(s stidT) interface{} {
+	if s == 0 {
+		return nil
+	}
+	return s
+}
+
+func createHoliday(db *sql.DB, h holiday) (hid hidT, err error) {
+	res, err := db.Exec(
+		"INSERT INTO holidays (date, name, stid) VALUES (?1, ?2, ?3)", h.Date, h.Name, nullSite(h.Site))
+	if err != nil {
+		return hid, stacktrace.Propagate(err, "failed to insert holiday")
+	}
+	id, err := res.LastInsertId()
+	return hidT(id), stacktrace.Propagate(err, "failed to get holiday id")
+}
+
+func updateHoliday(db *sql.DB, h holiday) (found bool, err error) {
+	res, err := db.Exec(
+		"UPDATE holidays SET date = ?1, name = ?2, stid = ?3 WHERE hid = ?4", h.Date, h.Name, nullSite(h.Site), h.HID)
+	if err != nil {
+		return false, stacktrace.Propagate(err, "failed to update holiday")
+	}
+	n, err := res.RowsAffected()
+	return n == 1, stacktrace.Propagate(err, "failed to update holiday")
+}
+
+func deleteHoliday(db *sql.DB, hid hidT) (found bool, err error) {
+	res, err := db.Exec("DELETE FROM holidays WHERE hid = ?", hid)
+	if err != nil {
+		return false, stacktrace.Propagate(err, "failed to delete holiday")
+	}
+	n, err := res.RowsAffected()
+	return n == 1, stacktrace.Propagate(err, "failed to delete holiday")
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/palantir/stacktrace"
+)
+
+// Calendar tokens give a user a secret feed URL, /ical/TOKEN, that calendar apps can subscribe to.
+// The feed has the user's entries of the last calendarFeedPeriod as events, and the time since
+// clocking in if they are. Like extension tokens they don't expire, and each user has at most one.
+
+const calendarFeedPeriod = 366 * 24 * time.Hour
+
+// createCalendarToken gives the user a new calendar token, replacing the old one
+func createCalendarToken(db *sql.DB, uid uidT) (token string, err error) {
+	tokenRaw := make([]byte, 18)
+	rand.Read(tokenRaw)
+	token = base64.URLEncoding.EncodeToString(tokenRaw)
+
+	_, err = db.Exec(
+		`INSERT OR REPLACE INTO calendar_tokens (uid, token, created_unix_s)
+			VALUES (?1, ?2, ?3)`, uid, token, clk.Now().Unix())
+	return token, stacktrace.Propagate(err, "failed to insert calendar token")
+}
+
+func revokeCalendarToken(db *sql.DB, uid uidT) (err error) {
+	_, err = db.Exec("DELETE FROM calendar_tokens WHERE uid = ?", uid)
+	return stacktrace.Propagate(err, "failed to revoke calendar token")
+}
+
+// getUserByCalendarToken returns the user with the token, found is false if there's none
+func getUserByCalendarToken(db *sql.DB, token string) (uid uidT, found bool, err error) {
+	err = db.QueryRow("SELECT uid FROM calendar_tokens WHERE token = ?", token).Scan(&uid)
+	if err == sql.ErrNoRows {
+		return 0, false, nil
+	}
+	return uid, err == nil, stacktrace.Propagate(err, "failed to get calendar token")
+}
+
+var icalTextEscaper = strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\n", `\n`)
+
+func icalTime(unix int64) string {
+	return time.Unix(unix, 0).UTC().Format("20060102T150405Z")
+}
+
+// writeICalFeed writes the user's feed, see calendar tokens
+func writeICalFeed(db *sql.DB, w io.Writer, uid uidT) (err error) {
+	now := clk.Now()
+	rows, err := entryStore.query(context.TODO(), db,
+		`SELECT `+entryColumns+` FROM entries
+			WHERE uid = ?1 AND from_unix_s >= ?2 AND deleted_unix_s IS NULL ORDER BY from_unix_s`,
+		uid, now.Add(-calendarFeedPeriod).Unix())
+	if err != nil {
+		return stacktrace.Propagate(err, "failed to list entries")
+	}
+	ens := []entry{}
+	for rows.Next() {
+		en, err := scanEntry(rows)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		ens = append(ens, en)
+	}
+	rows.Close()
+
+	r, err := getRunning(context.TODO(), db, uid)
+	if err != nil {
+		return err
+	}
+
+	var b strings.Builder
+	line := func(format string, a ...interface{}) {
+		fmt.Fprintf(&b, format+"\r\n", a...)
+	}
+	line("BEGIN:VCALENDAR")
+	line("VERSION:2.0")
+	line("PRODID:-//wms2//entries//EN")
+	line("CALSCALE:GREGORIAN")
+	line("X-WR-CALNAME:Worked time")
+	for _, en := range ens {
+		summary := strings.ToUpper(en.Kind[:1]) + en.Kind[1:]
+		if !en.Valid || en.Pending {
+			summary += " (doesn't count)"
+		}
+		line("BEGIN:VEVENT")
+		line("UID:entry-%d@wms2", en.EID)
+		line("DTSTAMP:%s", icalTime(en.Updated))
+		line("DTSTART:%s", icalTime(int64(en.From)))
+		line("DTEND:%s", icalTime(int64(en.To)))
+		line("SUMMARY:%s", icalTextEscaper.Replace(summary))
+		line("DESCRIPTION:%s", icalTextEscaper.Replace("Source: "+en.Source))
+		line("END:VEVENT")
+	}
+	if r.Since != 0 {
+		// it grows until the user clocks out, then the entry takes its place
+		line("BEGIN:VEVENT")
+		line("UID:running-%d-%d@wms2", uid, r.Since)
+		line("DTSTAMP:%s", icalTime(now.Unix()))
+		line("DTSTART:%s", icalTime(r.Since))
+		line("DTEND:%s", icalTime(now.Unix()))
+		line("SUMMARY:Clocked in")
+		line("END:VEVENT")
+	}
+	line("END:VCALENDAR")
+
+	_, err = io.WriteString(w, b.String())
+	return stacktrace.Propagate(err, "failed to write calendar")
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"database/sql"
+	"strconv"
+	"strings"
+
+	"github.com/palantir/stacktrace"
+)
+
+// Users are known by other ids in other systems: the badge they scan at kiosks, their personnel number
+// at the payroll provider, their id in the HR system and their LDAP DN. Imports and exports go by those
+// instead of assuming the other system uses wms2's uids. Badges and payroll ids are kept with the user
+// (see setBadge and setPayrollID), the others in user_identities. A user has at most one id per system
+// and an id belongs to at most one user.
+
+// identity systems
+const (
+	idBadge   = "badge"
+	idPayroll = "payroll" // defaults to the uid, see reportUser.PayrollID
+	idHRIS    = "hris"
+	idLDAP    = "ldap" // the user's DN
+)
+
+// identityLengths are the systems and how long their ids may be
+var identityLengths = map[string]int{
+	idBadge: maxBadgeLength, idPayroll: maxPayrollIDLength, idHRIS: maxIdentityLength, idLDAP: maxIdentityLength,
+}
+
+// checkIdentity returns why the id can't be the user's in the system, nil if it can.
+// An empty id removes the user's.
+func checkIdentity(db *sql.DB, uid uidT, system, id string) (err error) {
+	max, ok := identityLengths[system]
+	if !ok {
+		return stacktrace.NewError("unknown system %q", system)
+	}
+	if err = checkText("id", id, max); err != nil {
+		return err
+	}
+	if system == idPayroll && strings.ContainsAny(id, "; ") {
+		return stacktrace.NewError("payroll ids can't contain spaces or semicolons")
+	}
+	if id == "" {
+		return nil
+	}
+
+	other, found, err := identityToUID(db, system, id)
+	if err != nil {
+		return err
+	}
+	if found && other != uid {
+		return stacktrace.NewError("%s id %q is user %d's", system, id, other)
+	}
+	return nil
+}
+
+// setIdentity makes id the user's in the system, see checkIdentity.
+// found is false if there's no such user, taken is true if a badge turned out to be another user's.
+func setIdentity(db *sql.DB, uid uidT, system, id string) (found, taken bool, err error) {
+	err = db.QueryRow("SELECT 1 FROM users WHERE uid = ?", uid).Scan(new(int))
+	if err == sql.ErrNoRows {
+		return false, false, nil
+	}
+	if err != nil {
+		return false, false, stacktrace.Propagate(err, "failed to get user")
+	}
+
+	switch system {
+	case idBadge:
+		taken, err = setBadge(db, uid, id)
+		return true, taken, err
+	case idPayroll:
+		found, err = setPayrollID(db, uid, id)
+		return found, false, err
+	}
+	if id == "" {
+		_, err = db.Exec("DELETE FROM user_identities WHERE uid = ?1 AND system = ?2", uid, system)
+		return true, false, stacktrace.Propagate(err, "failed to remove identity")
+	}
+	_, err = db.Exec("INSERT OR REPLACE INTO user_identities (uid, system, external_id) VALUES (?1, ?2, ?3)",
+		uid, system, id)
+	return true, false, stacktrace.Propagate(err, "failed to set identity")
+}
+
+// identityToUID returns the user whose id in the system it is, found is false if there's none
+func identityToUID(db *sql.DB, system, id string) (uid uidT, found bool, err error) {
+	switch system {
+	case idBadge:
+		uid, err = badgeToUID(db, id)
+	case idPayroll:
+		err = db.QueryRow(`SELECT uid FROM users WHERE payroll_id = ?1
+			OR (payroll_id IS NULL AND CAST(uid AS TEXT) = ?1) ORDER BY payroll_id IS NULL LIMIT 1`, id).Scan(&uid)
+	default:
+		err = db.QueryRow("SELECT uid FROM user_identities WHERE system = ?1 AND external_id = ?2", system, id).
+			Scan(&uid)
+	}
+	if err == sql.ErrNoRows {
+		return 0, false, nil
+	}
+	return uid, err == nil, stacktrace.Propagate(err, "failed to look up %s id", system)
+}
+
+// getIdentities returns the user's ids by system, systems they have none in are left out.
+// found is false if there's no such user.
+func getIdentities(db *sql.DB, uid uidT) (ids map[string]string, found bool, err error) {
+	var badge, sealed sql.NullString
+	var payrollID string
+	err = db.QueryRow("SELECT badge, badge_sealed, IFNULL(payroll_id, uid) FROM users WHERE uid = ?", uid).
+		Scan(&badge, &sealed, &payrollID)
+	if err == sql.ErrNoRows {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, stacktrace.Propagate(err, "failed to get user")
+	}
+
+	ids = map[string]string{idPayroll: payrollID}
+	switch {
+	case sealed.Valid && fieldKeys != nil:
+		ids[idBadge], err = fieldKeys.open(sealed.String)
+		if err != nil {
+			return nil, false, stacktrace.Propagate(err, "failed to open badge of "+strconv.Itoa(int(uid)))
+		}
+	case badge.Valid && !sealed.Valid:
+		ids[idBadge] = badge.String
+	}
+
+	rows, err := db.Query("SELECT system, external_id FROM user_identities WHERE uid = ?", uid)
+	if err != nil {
+		return nil, false, stacktrace.Propagate(err, "failed to get identities")
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var system, id string
+		err = rows.Scan(&system, &id)
+		if err != nil {
+			return nil, false, stacktrace.Propagate(err, "failed to scan row")
+		}
+		ids[system] = id
+	}
+	return ids, true, nil
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/palantir/stacktrace"
+)
+
+// A desktop agent reports the periods its user was idle. Long enough ones that fall within
+// worked time become break suggestions, which only take effect once the user confirms them.
+
+type ipidT int
+
+// minIdle is how long an idle period has to be before it's suggested as a break
+const minIdle = 10 * time.Minute
+
+const (
+	idlePending   = "pending"
+	idleConfirmed = "confirmed"
+	idleDismissed = "dismissed"
+)
+
+type idlePeriod struct {
+	IPID   ipidT  `json:"ipid"`
+	From   int    `json:"from"`
+	To     int    `json:"to"`
+	Status string `json:"status"`
+}
+
+// reportIdle records an idle period as a break suggestion,
+// periods that are too short or weren't worked are dropped and suggested is false
+func reportIdle(db *sql.DB, uid uidT, from, to int64) (suggested bool, err error) {
+	if time.Duration(to-from)*time.Second < minIdle || to > clk.Now().Unix() {
+		return false, nil
+	}
+
+	// it has to lie within an entry or the time since clocking in
+	err = entryStore.queryRow(context.TODO(), db,
+		`SELECT 1 FROM entries WHERE uid = ?1 AND from_unix_s <= ?2 AND to_unix_s >= ?3 AND deleted_unix_s IS NULL
+			UNION ALL
+		SELECT 1 FROM user_states WHERE uid = ?1 AND state = ?4 AND since_unix_s <= ?2`,
+		uid, from, to, stateIn).Scan(new(int))
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, stacktrace.Propagate(err, "failed to find worked time")
+	}
+
+	_, err = db.Exec("INSERT INTO idle_periods (uid, from_unix_s, to_unix_s) VALUES (?1, ?2, ?3)", uid, from, to)
+	return true, stacktrace.Propagate(err, "failed to insert idle period")
+}
+
+func listPendingIdle(db *sql.DB, uid uidT) (ips []idlePeriod, err error) {
+	rows, err := db.Query(
+		`SELECT ipid, from_unix_s, to_unix_s, status FROM idle_periods
+			WHERE uid = ?1 AND status = ?2 ORDER BY from_unix_s`, uid, idlePending)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed to list idle periods")
+	}
+	defer rows.Close()
+
+	ips = []idlePeriod{}
+	for rows.Next() {
+		var ip idlePeriod
+		err = rows.Scan(&ip.IPID, &ip.From, &ip.To, &ip.Status)
+		if err != nil {
+			return nil, stacktrace.Propagate(err, "failed to scan row")
+		}
+		ips = append(ips, ip)
+	}
+	return ips, nil
+}
+
+func dismissIdle(db *sql.DB, uid uidT, ipid ipidT) (found bool, err error) {
+	res, err := db.Exec(
+		"UPDATE idle_periods SET status = ?1 WHERE ipid = ?2 AND uid = ?3 AND status = ?4",
+		idleDismissed, ipid, uid, idlePending)
+	if err != nil {
+		return false, stacktrace.Propagate(err, "failed to dismiss idle period")
+	}
+	n, err := res.RowsAffected()
+	return n == 1, stacktrace.Propagate(err, "failed to dismiss idle period")
+}
+
+// confirmIdle takes an idle period out of the user's worked time by splitting the entry around it,
+// or if it's in the time since they clocked in, closing an entry at its start and resuming at its end.
+// found is false if there's no such pending period or it's no longer within worked time.
+func confirmIdle(db *sql.DB, uid uidT, ipid ipidT) (found bool, err error) {
+	tx, err := db.Begin()
+	rollback := func() {
+		if err := tx.Rollback(); err != nil {
+			logError(stacktrace.Propagate(err, "failed to roll back transaction"))
+		}
+	}
+	if err != nil {
+		return false, stacktrace.Propagate(err, "failed to begin transaction")
+	}
+
+	var from, to int
+	err = tx.QueryRow(
+		"SELECT from_unix_s, to_unix_s FROM idle_periods WHERE ipid = ?1 AND uid = ?2 AND status = ?3",
+		ipid, uid, idlePending).Scan(&from, &to)
+	if err == sql.ErrNoRows {
+		rollback()
+		return false, nil
+	}
+	if err != nil {
+		rollback()
+		return false, stacktrace.Propagate(err, "failed to get idle period")
+	}
+
+	found, err = splitEntry(tx, uid, from, to)
+	if err == nil && !found {
+		found, err = splitRunning(tx, uid, from, to)
+	}
+	if err != nil || !found {
+		rollback()
+		return false, err
+	}
+
+	_, err = tx.Exec("UPDATE idle_periods SET status = ?1 WHERE ipid = ?2", idleConfirmed, ipid)
+	if err != nil {
+		rollback()
+		return false, stacktrace.Propagate(err, "failed to confirm idle period")
+	}
+
+	err = audit(tx, uid, uid, auditIdle, 0, nil, entryRange{From: from, To: to})
+	if err != nil {
+		rollback()
+		return false, err
+	}
+
+	err = tx.Commit()
+	return true, stacktrace.Propagate(err, "failed to commit transaction")
+}
+
+// splitEntry cuts [from, to] out of the entry containing it, found is false if there's none
+func splitEntry(tx *sql.Tx, uid uidT, from, to int) (found bool, err error) {
+	var eid eidT
+	var enFrom, enTo int
+	err = entryStore.queryRow(context.TODO(), tx,
+		`SELECT eid, from_unix_s, to_unix_s FROM entries
+			WHERE uid = ?1 AND from_unix_s <= ?2 AND to_unix_s >= ?3 AND deleted_unix_s IS NULL`, uid, from, to).Scan(&eid, &enFrom, &enTo)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, stacktrace.Propagate(err, "failed to find entry")
+	}
+
+	if to < enTo {
+		_, err = entryStore.exec(context.TODO(), tx,
+			`INSERT INTO entries (uid, from_unix_s, to_unix_s, valid, source, stid, ctid, catid, missed_heartbeat)
+				SELECT uid, ?1, to_unix_s, valid, source, stid, ctid, catid, missed_heartbeat FROM entries WHERE eid = ?2`, to, eid)
+		if err != nil {
+			return false, stacktrace.Propagate(err, "failed to insert the rest of the entry")
+		}
+	}
+
+	if from > enFrom {
+		_, err = entryStore.exec(context.TODO(), tx, "UPDATE entries SET to_unix_s = ?1 WHERE eid = ?2", from, eid)
+	} else {
+		_, err = entryStore.exec(context.TODO(), tx, "DELETE FROM entries WHERE eid = ?", eid)
+	}
+	return true, stacktrace.Propagate(err, "failed to shorten entry")
+}
+
+// splitRunning cuts [from, to] out of the time since the user clocked in, found is false if they aren't
+func splitRunning(tx *sql.Tx, uid uidT, from, to int) (found bool, err error) {
+	var since int
+	err = tx.QueryRow(
+		"SELECT since_unix_s FROM user_states WHERE uid = ?1 AND state = ?2", uid, stateIn).Scan(&since)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, stacktrace.Propagate(err, "failed to get user state")
+	}
+	if since > from {
+		return false, nil
+	}
+
+	if from > since {
+		_, err = entryStore.exec(context.TODO(), tx,
+			`INSERT INTO entries (uid, from_unix_s, to_unix_s, valid, source, stid, ctid, missed_heartbeat)
+				SELECT uid, since_unix_s, ?1, 1, 'clock', stid, ctid, missed_heartbeat FROM user_states WHERE uid = ?2`, from, uid)
+		if err != nil {
+			return false, stacktrace.Propagate(err, "failed to insert an entry")
+		}
+	}
+
+	_, err = tx.Exec("UPDATE user_states SET since_unix_s = ?1 WHERE uid = ?2", to, uid)
+	return true, stacktrace.Propagate(err, "failed to resume after idle period")
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/palantir/stacktrace"
+)
+
+// The approvals inbox gathers what waits for an admin's decision across the workflows, with counts
+// per type for the badge in the UI: manual entries and edits (see edits.go), leave requests, timesheet
+// sign offs and punches held for a kiosk (see approvals.go). Each item says where to decide it.
+// wms2 has no overtime or shift swap requests to include. It has no managers either, the closest is
+// the sponsor of a contractor, so an inbox can be narrowed to the users someone sponsors. Sponsors get
+// their own, admins everyone's.
+
+// inbox item types
+const (
+	inboxEntry     = "entry"
+	inboxEdit      = "edit"
+	inboxLeave     = "leave"
+	inboxTimesheet = "timesheet"
+	inboxHeldPunch = "held-punch"
+)
+
+var inboxTypes = []string{inboxEntry, inboxEdit, inboxLeave, inboxTimesheet, inboxHeldPunch}
+
+type inboxItem struct {
+	Type      string `json:"type"`
+	ID        int    `json:"id,omitempty"` // the apid, lrid or hpid, timesheets go by user, year and month
+	UID       uidT   `json:"uid"`
+	Email     string `json:"email"`
+	Year      int    `json:"year,omitempty"`
+	Month     int    `json:"month,omitempty"`
+	Submitted int64  `json:"submitted"`
+}
+
+type inbox struct {
+	Counts map[string]int `json:"counts"` // every type, 0 if nothing of it waits
+	Total  int            `json:"total"`
+	Items  []inboxItem    `json:"items"` // oldest first
+}
+
+// getInbox returns everything pending, only of the users sponsor sponsors unless it's 0
+func getInbox(db *sql.DB, sponsor uidT) (in inbox, err error) {
+	rows, err := entryStore.query(context.TODO(), db,
+		`SELECT type, id, uid, email, year, month, submitted FROM (
+			SELECT CASE approvals.kind WHEN ?1 THEN ?3 ELSE ?4 END AS type, apid AS id, entries.uid AS uid,
+					0 AS year, 0 AS month, submitted_unix_s AS submitted
+				FROM approvals JOIN entries USING (eid)
+				WHERE status = ?9 AND deleted_unix_s IS NULL AND approvals.kind IN (?1, ?2)
+			UNION ALL
+			SELECT ?5, lrid, uid, 0, 0, submitted_unix_s FROM leave_requests WHERE status = ?10
+			UNION ALL
+			SELECT ?6, 0, uid, year, month, submitted_unix_s FROM timesheet_signoffs WHERE approved_unix_s IS NULL
+			UNION ALL
+			SELECT ?7, hpid, uid, 0, 0, at_unix_s FROM held_punches WHERE status = ?11
+		) JOIN users USING (uid)
+		WHERE ?8 = 0 OR sponsor = ?8
+		ORDER BY submitted, type, id`,
+		approvalEntry, approvalEdit, inboxEntry, inboxEdit, inboxLeave, inboxTimesheet, inboxHeldPunch, sponsor,
+		approvalPending, leavePending, holdPending)
+	if err != nil {
+		return in, stacktrace.Propagate(err, "failed to list inbox")
+	}
+	defer rows.Close()
+
+	in = inbox{Counts: map[string]int{}, Items: []inboxItem{}}
+	for _, t := range inboxTypes {
+		in.Counts[t] = 0
+	}
+	for rows.Next() {
+		var it inboxItem
+		err = rows.Scan(&it.Type, &it.ID, &it.UID, &it.Email, &it.Year, &it.Month, &it.Submitted)
+		if err != nil {
+			return in, stacktrace.Propagate(err, "failed to scan row")
+		}
+		in.Items = append(in.Items, it)
+		in.Counts[it.Type]++
+		in.Total++
+	}
+	return in, stacktrace.Propagate(rows.Err(), "failed to list inbox")
+}
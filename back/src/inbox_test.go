@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestInbox(t *testing.T) {
+	loc := testLocation(t)
+	at := func(day, hour int) int { return int(time.Date(2019, time.October, day, hour, 0, 0, 0, loc).Unix()) }
+	db, done := newTestDB(t, time.Unix(int64(at(31, 12)), 0))
+	defer done()
+	h := newTestServer(db)
+	admin := seedUser(t, db, "admin@example.com", true)
+	sponsor := seedUser(t, db, "sponsor@example.com", false)
+	a := seedUser(t, db, "a@example.com", false)
+	b := seedUser(t, db, "b@example.com", false)
+	if _, err := db.Exec("UPDATE users SET sponsor = ? WHERE uid = ?", sponsor, a); err != nil {
+		t.Fatal(err)
+	}
+
+	submitted := func(day int) { clk = fixedClock(time.Unix(int64(at(day, 12)), 0)) }
+	submitted(1)
+	entry, err := submitEntry(db, a, at(1, 8), at(1, 12), false, entryWork, a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	submitted(2)
+	edit, _, err := submitEdit(db, a, entry.EID, at(1, 9), at(1, 12), false, a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decided, err := submitEntry(db, b, at(2, 8), at(2, 12), false, entryWork, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = decideApproval(db, decided.APID, true, admin); err != nil {
+		t.Fatal(err)
+	}
+	for _, q := range []struct {
+		query string
+		args  []interface{}
+	}{
+		{"INSERT INTO leave_requests (uid, type, from_date, to_date, submitted_unix_s) VALUES (?, 'vacation', '2019-11-04', '2019-11-08', ?)",
+			[]interface{}{b, at(3, 12)}},
+		{"INSERT INTO leave_requests (uid, type, from_date, to_date, status, submitted_unix_s) VALUES (?, 'sick', '2019-10-01', '2019-10-01', 'approved', ?)",
+			[]interface{}{b, at(3, 12)}},
+		{"INSERT INTO timesheet_signoffs (uid, year, month, snapshot, submitted_unix_s) VALUES (?, 2019, 9, '{}', ?)",
+			[]interface{}{a, at(4, 12)}},
+		{"INSERT INTO timesheet_signoffs (uid, year, month, snapshot, submitted_unix_s, approved_by, approved_unix_s) VALUES (?, 2019, 8, '{}', ?, ?, ?)",
+			[]interface{}{b, at(4, 12), admin, at(4, 13)}},
+		{"INSERT INTO devices (name, kind, token) VALUES ('kiosk', 'kiosk', 'token')", nil},
+		{"INSERT INTO held_punches (uid, did, kind, at_unix_s) VALUES (?, 1, 'I', ?)", []interface{}{b, at(5, 8)}},
+		{"INSERT INTO held_punches (uid, did, kind, at_unix_s, status) VALUES (?, 1, 'O', ?, 'rejected')", []interface{}{b, at(5, 9)}},
+	} {
+		if _, err = db.Exec(q.query, q.args...); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	in, err := getInbox(db, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []inboxItem{
+		{inboxEntry, int(entry.APID), a, "a@example.com", 0, 0, int64(at(1, 12))},
+		{inboxEdit, int(edit.APID), a, "a@example.com", 0, 0, int64(at(2, 12))},
+		{inboxLeave, 1, b, "b@example.com", 0, 0, int64(at(3, 12))},
+		{inboxTimesheet, 0, a, "a@example.com", 2019, 9, int64(at(4, 12))},
+		{inboxHeldPunch, 1, b, "b@example.com", 0, 0, int64(at(5, 8))},
+	}
+	if !reflect.DeepEqual(in.Items, want) {
+		t.Errorf("got items %+v, want %+v", in.Items, want)
+	}
+	wantCounts := map[string]int{inboxEntry: 1, inboxEdit: 1, inboxLeave: 1, inboxTimesheet: 1, inboxHeldPunch: 1}
+	if !reflect.DeepEqual(in.Counts, wantCounts) || in.Total != 5 {
+		t.Errorf("got counts %v and total %d", in.Counts, in.Total)
+	}
+
+	// the sponsor's inbox has their contractor's items, and every type even if it's 0
+	in, err = getInbox(db, sponsor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantCounts = map[string]int{inboxEntry: 1, inboxEdit: 1, inboxLeave: 0, inboxTimesheet: 1, inboxHeldPunch: 0}
+	if !reflect.DeepEqual(in.Counts, wantCounts) || in.Total != 3 || len(in.Items) != 3 {
+		t.Errorf("sponsor got counts %v, total %d and %d items", in.Counts, in.Total, len(in.Items))
+	}
+
+	w := serve(h, "GET", fmt.Sprintf("/a/inbox?sponsor=%d", sponsor), seedSession(t, db, admin), nil)
+	if w.Code != 200 {
+		t.Fatalf("got %d", w.Code)
+	}
+	var served inbox
+	if err = json.Unmarshal(w.Body.Bytes(), &served); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(served, in) {
+		t.Errorf("served %+v, want %+v", served, in)
+	}
+	if w = serve(h, "GET", "/a/inbox?sponsor=x", seedSession(t, db, admin), nil); w.Code != 400 {
+		t.Errorf("an invalid sponsor got %d", w.Code)
+	}
+	if w = serve(h, "GET", "/a/inbox", seedSession(t, db, a), nil); w.Code != 401 {
+		t.Errorf("a user got %d", w.Code)
+	}
+	auditor := seedUser(t, db, "auditor@example.com", false)
+	if err = setAuditor(db, auditor, true); err != nil {
+		t.Fatal(err)
+	}
+	if w = serve(h, "GET", "/a/inbox", seedSession(t, db, auditor), nil); w.Code != 401 {
+		t.Errorf("an auditor got %d", w.Code)
+	}
+
+	// sponsors see the inbox of the users they sponsor, everyone else an empty one
+	empty := inbox{Counts: map[string]int{}, Items: []inboxItem{}}
+	for _, typ := range inboxTypes {
+		empty.Counts[typ] = 0
+	}
+	for uid, want := range map[uidT]inbox{sponsor: in, b: empty} {
+		w = serve(h, "GET", "/u/inbox", seedSession(t, db, uid), nil)
+		if w.Code != 200 {
+			t.Fatalf("user %d got %d", uid, w.Code)
+		}
+		var own inbox
+		if err = json.Unmarshal(w.Body.Bytes(), &own); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(own, want) {
+			t.Errorf("user %d got %+v, want %+v", uid, own, want)
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/palantir/stacktrace"
+)
+
+// Background jobs record their runs in job_runs so that a failed run shows up in GET /a/jobs
+// instead of at the end of the month. Scheduled jobs record every run, pollers that run every
+// minute or so only record the runs that did something or failed.
+
+// job names, see job_runs.job
+const (
+	jobDisqualify      = "disqualify"
+	jobHeartbeats      = "heartbeats"
+	jobOutbox          = "outbox"
+	jobWeeklySummaries = "weekly-summaries"
+	jobExceptionDigest = "exception-digest"
+	jobReminders       = "reminders"
+	jobHolidays        = "holidays"
+	jobAccessLog       = "access-log"
+)
+
+// job run statuses, see job_runs.status
+const (
+	jobRunning = "running"
+	jobOK      = "ok"
+	jobFailed  = "failed"
+)
+
+// jobRunRetention is how long runs are kept
+const jobRunRetention = 90 * 24 * time.Hour
+
+type jobRun struct {
+	JRID     int    `json:"jrid"`
+	Job      string `json:"job"`
+	Started  int64  `json:"started"`
+	Ended    int64  `json:"ended,omitempty"` // 0 while running
+	Duration int64  `json:"durationMs"`
+	Status   string `json:"status"`
+	Error    string `json:"error,omitempty"`
+	Affected int    `json:"affected"`
+}
+
+// runJob runs fn as a run of the job, fn returns how many things it affected.
+// The run is recorded before fn starts so that hung runs show up, its error is returned.
+// While the server shuts down it doesn't run fn at all, see shutdown.go.
+func runJob(db *sql.DB, job string, fn func() (int, error)) (err error) {
+	if !startJobRun() {
+		return nil
+	}
+	defer jobRunDone()
+
+	start := time.Now()
+	res, err := db.Exec("INSERT INTO job_runs (job, started_unix_s) VALUES (?1, ?2)", job, start.Unix())
+	if err != nil {
+		logError(stacktrace.Propagate(err, "failed to record start of "+job))
+		_, err = fn()
+		return err
+	}
+	jrid, _ := res.LastInsertId()
+
+	affected, err := fn()
+	if rerr := endJobRun(db, jrid, start, affected, err); rerr != nil {
+		logError(rerr)
+	}
+	return err
+}
+
+// pollJob is runJob for pollers, the run is only recorded if fn affected something or failed
+func pollJob(db *sql.DB, job string, fn func() (int, error)) (err error) {
+	if !startJobRun() {
+		return nil
+	}
+	defer jobRunDone()
+
+	start := time.Now()
+	affected, err := fn()
+	if affected == 0 && err == nil {
+		return nil
+	}
+
+	res, rerr := db.Exec("INSERT INTO job_runs (job, started_unix_s) VALUES (?1, ?2)", job, start.Unix())
+	if rerr != nil {
+		logError(stacktrace.Propagate(rerr, "failed to record run of "+job))
+		return err
+	}
+	jrid, _ := res.LastInsertId()
+	if rerr = endJobRun(db, jrid, start, affected, err); rerr != nil {
+		logError(rerr)
+	}
+	return err
+}
+
+func endJobRun(db *sql.DB, jrid int64, start time.Time, affected int, jobErr error) (err error) {
+	status, msg := jobOK, sql.NullString{}
+	if jobErr != nil {
+		status, msg = jobFailed, sql.NullString{String: jobErr.Error(), Valid: true}
+	}
+	end := time.Now()
+	_, err = db.Exec(
+		`UPDATE job_runs SET ended_unix_s = ?1, duration_ms = ?2, status = ?3, error = ?4, affected = ?5
+			WHERE jrid = ?6`, end.Unix(), end.Sub(start).Milliseconds(), status, msg, affected, jrid)
+	if err != nil {
+		return stacktrace.Propagate(err, "failed to record end of job run")
+	}
+
+	_, err = db.Exec("DELETE FROM job_runs WHERE started_unix_s < ?", start.Add(-jobRunRetention).Unix())
+	return stacktrace.Propagate(err, "failed to delete old job runs")
+}
+
+// failInterruptedJobRuns marks the runs the last server process didn't finish as failed,
+// it's called on start up before any jobs run
+func failInterruptedJobRuns(db *sql.DB) (err error) {
+	_, err = db.Exec(
+		"UPDATE job_runs SET status = ?1, error = 'interrupted' WHERE status = ?2", jobFailed, jobRunning)
+	return stacktrace.Propagate(err, "failed to fail interrupted job runs")
+}
+
+const jobRunColumns = `jrid, job, started_unix_s, IFNULL(ended_unix_s, 0), IFNULL(duration_ms, 0), status,
+	IFNULL(error, ''), affected`
+
+func scanJobRun(rows *sql.Rows) (jr jobRun, err error) {
+	err = rows.Scan(&jr.JRID, &jr.Job, &jr.Started, &jr.Ended, &jr.Duration, &jr.Status, &jr.Error, &jr.Affected)
+	return jr, stacktrace.Propagate(err, "failed to scan row")
+}
+
+// listJobRuns lists runs newest first, job and status are optional filters
+func listJobRuns(db *sql.DB, job, status string, offset, limit int) (jrs []jobRun, more bool, err error) {
+	query := "SELECT " + jobRunColumns + " FROM job_runs WHERE 1"
+	args := []interface{}{}
+	if job != "" {
+		query += " AND job = ?"
+		args = append(args, job)
+	}
+	if status != "" {
+		query += " AND status = ?"
+		args = append(args, status)
+	}
+	query += " ORDER BY jrid DESC LIMIT ? OFFSET ?"
+	args = append(args, limit+1, offset)
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, false, stacktrace.Propagate(err, "failed to list job runs")
+	}
+	defer rows.Close()
+
+	jrs = []jobRun{}
+	for rows.Next() {
+		jr, err := scanJobRun(rows)
+		if err != nil {
+			return nil, false, err
+		}
+		jrs = append(jrs, jr)
+	}
+	if len(jrs) > limit {
+		jrs, more = jrs[:limit], true
+	}
+	return jrs, more, nil
+}
+
+// latestJobRuns gets the latest recorded run of each job
+func latestJobRuns(db *sql.DB) (jrs []jobRun, err error) {
+	rows, err := db.Query(
+		"SELECT " + jobRunColumns + ` FROM job_runs
+			WHERE jrid IN (SELECT MAX(jrid) FROM job_runs GROUP BY job) ORDER BY job`)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed to get latest job runs")
+	}
+	defer rows.Close()
+
+	jrs = []jobRun{}
+	for rows.Next() {
+		jr, err := scanJobRun(rows)
+		if err != nil {
+			return nil, err
+		}
+		jrs = append(jrs, jr)
+	}
+	return jrs, nil
+}
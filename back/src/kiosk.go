@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/palantir/stacktrace"
+)
+
+// kioskView is what a shared kiosk screen may show after a badge scan,
+// deliberately much less than the user's full history
+type kioskView struct {
+	State   userState `json:"state"`
+	Punches []punch   `json:"punches"` // the last few, newest first
+	Today   int       `json:"today"`   // seconds worked today
+	Held    bool      `json:"held"`    // the punch waits for an admin to approve the kiosk, see approvals.go
+}
+
+func getKioskView(ctx context.Context, db *sql.DB, uid uidT) (v kioskView, err error) {
+	err = db.QueryRowContext(ctx, "SELECT state FROM user_states WHERE uid = ?", uid).Scan(&v.State)
+	if err != nil {
+		return v, stacktrace.Propagate(err, "failed to get user state")
+	}
+
+	v.Punches, err = listLastPunches(db, uid, 3)
+	if err != nil {
+		return v, err
+	}
+
+	v.Today, err = getWorkedForDay(ctx, db, uid, clk.Now())
+	return v, err
+}
+
+// togglePunch clocks the user out if they're in and in otherwise
+func togglePunch(ctx context.Context, db *sql.DB, uid uidT, did didT) (err error) {
+	var state userState
+	err = db.QueryRowContext(ctx, "SELECT state FROM user_states WHERE uid = ?", uid).Scan(&state)
+	if err != nil {
+		return stacktrace.Propagate(err, "failed to get user state")
+	}
+
+	if state == stateIn {
+		return clockOut(ctx, db, uid, did)
+	}
+	return clockIn(ctx, db, uid, did, 0)
+}
+
+// kioskPunch is togglePunch at a kiosk, unless the user hasn't been approved there yet,
+// then the punch is held
+func kioskPunch(ctx context.Context, db *sql.DB, uid uidT, did didT) (held bool, err error) {
+	approved, err := deviceApproved(db, uid, did)
+	if err != nil {
+		return false, err
+	}
+	if approved {
+		return false, togglePunch(ctx, db, uid, did)
+	}
+
+	var state userState
+	err = db.QueryRowContext(ctx, "SELECT state FROM user_states WHERE uid = ?", uid).Scan(&state)
+	if err != nil {
+		return false, stacktrace.Propagate(err, "failed to get user state")
+	}
+	return true, holdPunch(db, uid, did, state)
+}
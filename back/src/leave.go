@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/palantir/stacktrace"
+)
+
+type lridT int
+
+// leave types, see leave_requests.type
+const (
+	leaveVacation = "vacation"
+	leaveSick     = "sick"
+	leaveOther    = "other"
+)
+
+// leave request statuses, see leave_requests.status
+const (
+	leavePending  = "pending"
+	leaveApproved = "approved"
+	leaveDenied   = "denied"
+)
+
+// maxLeaveDays is the longest leave that can be asked for at once
+const maxLeaveDays = 366
+
+// leaveRequest asks for the days from From through To off, nothing is expected to be worked on them
+// once it's approved
+type leaveRequest struct {
+	LRID   lridT  `json:"lrid"`
+	UID    uidT   `json:"uid"`
+	Email  string `json:"email,omitempty"`
+	Type   string `json:"type"`
+	From   string `json:"from"` // like holiday.Date
+	To     string `json:"to"`   // inclusive
+	Status string `json:"status"`
+}
+
+func (lr leaveRequest) validate() error {
+	switch lr.Type {
+	case leaveVacation, leaveSick, leaveOther:
+	default:
+		return stacktrace.NewError("type has to be vacation, sick or other")
+	}
+	from, err := time.Parse(holidayDate, lr.From)
+	if err != nil {
+		return stacktrace.NewError("from has to be like 2019-10-03")
+	}
+	to, err := time.Parse(holidayDate, lr.To)
+	if err != nil {
+		return stacktrace.NewError("to has to be like 2019-10-03")
+	}
+	if to.Before(from) {
+		return stacktrace.NewError("to can't be before from")
+	}
+	if to.Sub(from) >= maxLeaveDays*24*time.Hour {
+		return stacktrace.NewError("leave can't be longer than %d days", maxLeaveDays)
+	}
+	return nil
+}
+
+// leaveSet holds the type of leave on each day (like holiday.Date) a user has approved leave
+type leaveSet map[string]string
+
+func (ls leaveSet) of(date time.Time) string {
+	return ls[date.Format(holidayDate)]
+}
+
+// getLeave returns the user's approved leave from the day of from up to the day of to, inclusive
+func getLeave(ctx context.Context, db *sql.DB, uid uidT, from, to time.Time) (ls leaveSet, err error) {
+	rows, err := db.QueryContext(ctx,
+		`SELECT type, from_date, to_date FROM leave_requests
+			WHERE uid = ?1 AND status = ?2 AND from_date <= ?4 AND to_date >= ?3`,
+		uid, leaveApproved, from.Format(holidayDate), to.Format(holidayDate))
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed to get leave")
+	}
+	defer rows.Close()
+
+	ls = make(leaveSet)
+	for rows.Next() {
+		var kind, strFrom, strTo string
+		err = rows.Scan(&kind, &strFrom, &strTo)
+		if err != nil {
+			return nil, stacktrace.Propagate(err, "failed to scan row")
+		}
+		lFrom, _ := time.Parse(holidayDate, strFrom)
+		lTo, _ := time.Parse(holidayDate, strTo)
+		for d := lFrom; !d.After(lTo); d = d.AddDate(0, 0, 1) {
+			ls[d.Format(holidayDate)] = kind
+		}
+	}
+	return ls, nil
+}
+
+func submitLeave(db *sql.DB, lr leaveRequest) (lrid lridT, err error) {
+	res, err := db.Exec(
+		`INSERT INTO leave_requests (uid, type, from_date, to_date, submitted_unix_s)
+			VALUES (?1, ?2, ?3, ?4, ?5)`, lr.UID, lr.Type, lr.From, lr.To, clk.Now().Unix())
+	if err != nil {
+		return 0, stacktrace.Propagate(err, "failed to insert leave request")
+	}
+	id, err := res.LastInsertId()
+	return lridT(id), stacktrace.Propagate(err, "failed to get leave request id")
+}
+
+// cancelLeave withdraws the user's pending leave request
+func cancelLeave(db *sql.DB, uid uidT, lrid lridT) (found bool, err error) {
+	res, err := db.Exec(
+		"DELETE FROM leave_requests WHERE lrid = ?1 AND uid = ?2 AND status = ?3", lrid, uid, leavePending)
+	if err != nil {
+		return false, stacktrace.Propagate(err, "failed to cancel leave request")
+	}
+	n, err := res.RowsAffected()
+	return n == 1, stacktrace.Propagate(err, "failed to get rows affected")
+}
+
+// listLeave returns the leave requests of the user, or of everyone with the status if uid is 0
+func listLeave(db *sql.DB, uid uidT, status string) (lrs []leaveRequest, err error) {
+	query := `SELECT lrid, uid, email, type, from_date, to_date, status
+		FROM leave_requests JOIN users USING (uid) WHERE 1 = 1`
+	args := []interface{}{}
+	if uid != 0 {
+		query += " AND uid = ?"
+		args = append(args, uid)
+	}
+	if status != "" {
+		query += " AND status = ?"
+		args = append(args, status)
+	}
+	query += " ORDER BY from_date"
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed to list leave requests")
+	}
+	defer rows.Close()
+
+	lrs = []leaveRequest{}
+	for rows.Next() {
+		var lr leaveRequest
+		err = rows.Scan(&lr.LRID, &lr.UID, &lr.Email, &lr.Type, &lr.From, &lr.To, &lr.Status)
+		if err != nil {
+			return nil, stacktrace.Propagate(err, "failed to scan row")
+		}
+		lrs = append(lrs, lr)
+	}
+	return lrs, nil
+}
+
+// decideLeave approves or denies a pending leave request
+func decideLeave(db *sql.DB, lrid lridT, approve bool, by uidT) (found bool, err error) {
+	status := leaveDenied
+	if approve {
+		status = leaveApproved
+	}
+	res, err := db.Exec(
+		`UPDATE leave_requests SET status = ?1, decided_by = ?2, decided_unix_s = ?3
+			WHERE lrid = ?4 AND status = ?5`, status, by, clk.Now().Unix(), lrid, leavePending)
+	if err != nil {
+		return false, stacktrace.Propagate(err, "failed to decide leave request")
+	}
+	n, err := res.RowsAffected()
+	return n == 1, stacktrace.Propagate(err, "failed to get rows affected")
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/palantir/stacktrace"
+)
+
+// maxBodySize caps every request body, the largest legitimate one is a bulk entry request
+const maxBodySize = 64 << 10
+
+// field length limits, in characters
+const (
+	maxNameLength      = 100 // devices and sites
+	maxEmailLength     = 254
+	maxPasswordLength  = 256
+	maxBadgeLength     = 64
+	maxIPsLength       = 1000
+	maxReasonLength    = 500 // why an admin changed an entry, see noticeEntryChanged
+	maxURLLength       = 2000
+	maxPayrollIDLength = 10 // the width of the field in fixed width payroll exports
+	maxSecretLength    = 200
+	maxSlackIDLength   = 32
+	maxIdentityLength  = 256 // ids in other systems like LDAP DNs, see identity.go
+)
+
+// checkText checks that value is printable text of at most max characters,
+// the error says what's wrong with the named field and is safe to show to clients
+func checkText(field, value string, max int) error {
+	if !utf8.ValidString(value) {
+		return fmt.Errorf("%s has to be valid UTF-8", field)
+	}
+	if utf8.RuneCountInString(value) > max {
+		return fmt.Errorf("%s is longer than %d characters", field, max)
+	}
+	for _, c := range value {
+		if !unicode.IsPrint(c) {
+			return fmt.Errorf("%s may only contain printable characters", field)
+		}
+	}
+	return nil
+}
+
+func (env *env) bodyLimitMiddleware(w http.ResponseWriter, r *http.Request, n func(http.ResponseWriter, *http.Request)) {
+	limit := int64(maxBodySize)
+	if strings.HasSuffix(r.URL.Path, "/training/certificate") {
+		limit = maxCertificateSize
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, limit)
+	n(w, r)
+}
+
+func do413(w http.ResponseWriter) {
+	w.WriteHeader(413)
+	w.Write([]byte(fmt.Sprintf("413 Request Entity Too Large: at most %d bytes", maxBodySize)))
+}
+
+const defaultRequestTimeout = 30 * time.Second
+
+// requestTimeout is how long a request may take, queries that honor the request's context are
+// cancelled after it
+var requestTimeout = defaultRequestTimeout
+
+// requestTimeoutFromEnv reads WMS2_REQUEST_TIMEOUT, a duration like 30s
+func requestTimeoutFromEnv() time.Duration {
+	s := os.Getenv("WMS2_REQUEST_TIMEOUT")
+	if s == "" {
+		return defaultRequestTimeout
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		logWarning(stacktrace.NewError("invalid WMS2_REQUEST_TIMEOUT %q, using %s", s, defaultRequestTimeout))
+		return defaultRequestTimeout
+	}
+	return d
+}
+
+func (env *env) timeoutMiddleware(w http.ResponseWriter, r *http.Request, n func(http.ResponseWriter, *http.Request)) {
+	ctx, cancel := context.WithTimeout(r.Context(), requestTimeout)
+	defer cancel()
+	n(w, r.WithContext(ctx))
+}
+
+// do500Or503 is do500, unless the request ran out of time, then the client may try again
+func do500Or503(w http.ResponseWriter, r *http.Request) {
+	if r.Context().Err() == context.DeadlineExceeded {
+		do503With(w, "the request took too long")
+		return
+	}
+	do500(w)
+}
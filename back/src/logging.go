@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/AndrewBurian/powermux"
+)
+
+// Logs go to stderr through log/slog, as text or, with WMS2_LOG_FORMAT=json, as JSON for log
+// collectors. WMS2_LOG_LEVEL is debug, info, warn or error, info by default. Errors are logged with
+// their outermost message and the whole stack trace as error, those of requests also with the
+// request's id, route and user.
+
+// loggerFromEnv makes the logger WMS2_LOG_FORMAT and WMS2_LOG_LEVEL ask for,
+// invalid values are logged and left at their default
+func loggerFromEnv() *slog.Logger {
+	var level slog.Level
+	levelErr := level.UnmarshalText([]byte(os.Getenv("WMS2_LOG_LEVEL")))
+	if os.Getenv("WMS2_LOG_LEVEL") == "" {
+		levelErr = nil
+	}
+
+	opts := &slog.HandlerOptions{Level: level}
+	var logger *slog.Logger
+	format := os.Getenv("WMS2_LOG_FORMAT")
+	switch format {
+	case "json":
+		logger = slog.New(slog.NewJSONHandler(os.Stderr, opts))
+	default:
+		logger = slog.New(slog.NewTextHandler(os.Stderr, opts))
+	}
+
+	if levelErr != nil {
+		logger.Warn("invalid WMS2_LOG_LEVEL, using info", "value", os.Getenv("WMS2_LOG_LEVEL"))
+	}
+	if format != "" && format != "json" && format != "text" {
+		logger.Warn("invalid WMS2_LOG_FORMAT, using text", "value", format)
+	}
+	return logger
+}
+
+// errorSummary is the outermost message of a stacktrace error, it has a line per frame
+func errorSummary(err error) string {
+	for _, line := range strings.Split(err.Error(), "\n") {
+		line = strings.TrimPrefix(line, "Caused by: ")
+		if line != "" && !strings.HasPrefix(line, " --- at ") {
+			return line
+		}
+	}
+	return err.Error()
+}
+
+// logError logs the error, args are more attributes like with slog.Error
+func logError(err error, args ...interface{}) {
+	slog.Error(errorSummary(err), append(args, "error", err.Error())...)
+}
+
+// logWarning logs something that's wrong but taken care of, like a setting that falls back to its default
+func logWarning(err error, args ...interface{}) {
+	slog.Warn(errorSummary(err), args...)
+}
+
+// requestAttrs are the attributes of the request's log records
+func requestAttrs(r *http.Request) []interface{} {
+	args := []interface{}{"method", r.Method, "route", powermux.RequestPath(r)}
+	if id, ok := r.Context().Value(requestIDKey).(string); ok {
+		args = append(args, "request", id)
+	}
+	if uid, ok := r.Context().Value(uidKey).(uidT); ok {
+		args = append(args, "uid", uid)
+	}
+	if d, ok := r.Context().Value(deviceKey).(device); ok {
+		args = append(args, "device", d.DID)
+	}
+	return args
+}
+
+// logRequestError logs the error the request ran into
+func logRequestError(r *http.Request, err error) {
+	logError(err, requestAttrs(r)...)
+}
+
+// newRequestID makes an id to find a request's log records by
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// requestIDMiddleware gives the request an id for its log records, the one from the X-Request-ID header
+// if a proxy set it. It's sent back in the same header.
+func (env *env) requestIDMiddleware(w http.ResponseWriter, r *http.Request, n func(http.ResponseWriter, *http.Request)) {
+	id := r.Header.Get("X-Request-ID")
+	if id == "" || len(id) > 64 {
+		id = newRequestID()
+	}
+	w.Header().Set("X-Request-ID", id)
+	n(w, r.WithContext(context.WithValue(r.Context(), requestIDKey, id)))
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// lunchPolicy deducts Deduct seconds from every entry longer than After seconds, for sites where
+// people don't clock out for lunch. It's applied when time worked is summed up, entries stay as punched.
+type lunchPolicy struct {
+	After  int // 0 for no deduction
+	Deduct int
+}
+
+var lunchDeduction lunchPolicy
+
+// lunchDeductionFromEnv reads WMS2_LUNCH_DEDUCTION, like "6h:30m" to deduct 30 minutes from entries
+// longer than 6 hours. There's no deduction if it isn't set.
+func lunchDeductionFromEnv() (p lunchPolicy, err error) {
+	s := os.Getenv("WMS2_LUNCH_DEDUCTION")
+	if s == "" {
+		return p, nil
+	}
+
+	parts := strings.Split(s, ":")
+	if len(parts) != 2 {
+		return p, fmt.Errorf("WMS2_LUNCH_DEDUCTION has to be like 6h:30m")
+	}
+	after, err := time.ParseDuration(parts[0])
+	if err != nil || after <= 0 {
+		return p, fmt.Errorf("WMS2_LUNCH_DEDUCTION: invalid entry length %q", parts[0])
+	}
+	deduct, err := time.ParseDuration(parts[1])
+	if err != nil || deduct <= 0 || deduct >= after {
+		return p, fmt.Errorf("WMS2_LUNCH_DEDUCTION: invalid deduction %q", parts[1])
+	}
+	return lunchPolicy{After: int(after / time.Second), Deduct: int(deduct / time.Second)}, nil
+}
+
+// deduction is how many of the seconds of an entry length long don't count as worked
+func (p lunchPolicy) deduction(length int) int {
+	if p.After == 0 || length <= p.After {
+		return 0
+	}
+	return p.Deduct
+}
@@ -1,10 +1,13 @@
 package main
 
 import (
+	"crypto/tls"
 	"database/sql"
-	"fmt"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	_ "github.com/mattn/go-sqlite3"
@@ -14,94 +17,146 @@ import (
 )
 
 type env struct {
-	db *sql.DB
-}
+	db        *sql.DB
+	latencies *latencies
 
-func disqualifier(db *sql.DB) {
-	for {
-		now := time.Now()
-		cutoff := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, now.Location())
-		time.Sleep(time.Until(cutoff))
-		disqualify(db)
-	}
+	extensionOrigins []string     // allowed CORS origins for /x, empty for any
+	extensionLimiter *rateLimiter // per extension token
+	calendarLimiter  *rateLimiter // per calendar token, see icalfeed.go
+	badgeFailures    *rateLimiter // unknown badges per kiosk, see badgeFailed
+	countryHeader    string       // request header with the client's country, empty if there's none
+	slackSecret      string       // the Slack app's signing secret, empty disables its commands, see slack.go
+	telegramSecret   string       // the Telegram bot's webhook secret token, empty disables it, see telegram.go
+
+	breakGlassLimiter *rateLimiter // break-glass attempts per address, see breakglass.go
 }
 
 func main() {
-	const init = `
-	CREATE TABLE users (
-		uid INTEGER PRIMARY KEY AUTOINCREMENT, -- so that they don't repeat
-		email TEXT,
-		password_hash BLOB,
-		password_salt BLOB,
-		admin INTEGER CHECK(admin IN (0, 1)),
-		UNIQUE(email)
-	);
-
-	CREATE TABLE user_states (
-		uid INTEGER,
-		state TEXT CHECK(state IN ('I', 'O')),
-		since_unix_s, -- see entries.from_unix_s
-		FOREIGN KEY (uid) REFERENCES users(uid),
-		UNIQUE(uid)
-	);
-
-	CREATE TABLE entries (
-		eid INTEGER PRIMARY KEY AUTOINCREMENT, -- so that they don't repeat
-		uid INTEGER,
-		from_unix_s INTEGER, -- "_s" stands for seconds, unlike the JS millisecond unix time
-		to_unix_s INTEGER, -- see above, can be null, signifies disqualifed entry
-		valid INTEGER CHECK(valid IN (0, 1)),
-		FOREIGN KEY (uid) REFERENCES users(uid),
-		CHECK(from_unix_s <= to_unix_s)
-	);
-
-	CREATE TABLE sessions (
-		sid TEXT,
-		uid INTEGER,
-		expires_unix_s INTEGER, -- see entries.from_unix_s
-		FOREIGN KEY (uid) REFERENCES users(uid)
-	);
-
-	CREATE INDEX sessions_id ON sessions (sid);
-	`
-	var db *sql.DB
-	if _, err := os.Stat("./wms2.db"); os.IsNotExist(err) {
-		// the database hasn't been created yet
-		// so we create it...
-		db, err = sql.Open("sqlite3", "./wms2.db?mode=rwc")
-		if err != nil {
-			fmt.Println(stacktrace.Propagate(err, "failed to open the database"))
-			return
-		}
-		defer db.Close()
+	slog.SetDefault(loggerFromEnv())
+	var err error
+	fieldKeys, err = keyringFromEnv()
+	if err != nil {
+		logError(err)
+		return
+	}
+	overtimeBuckets, err = overtimeBucketsFromEnv()
+	if err != nil {
+		logError(err)
+		return
+	}
+	wageTypes, err = wageTypesFromEnv() // after the overtime buckets, they're pay components
+	if err != nil {
+		logError(err)
+		return
+	}
+	signingKey, err = signingKeyFromEnv()
+	if err != nil {
+		logError(err)
+		return
+	}
+	policy, err = policyFromEnv()
+	if err != nil {
+		logError(err)
+		return
+	}
+	disqualifyRules, err = disqualifyRulesFromEnv()
+	if err != nil {
+		logError(err)
+		return
+	}
+	weekendApproval = weekendApprovalFromEnv()
+	auditChain = auditChainFromEnv()
+	confirmDays = confirmDaysFromEnv()
+	manualEntryLimit = manualEntryLimitFromEnv()
+	weekStart = weekStartFromEnv()
+	probationMonths = probationMonthsFromEnv()
+	startBy = startByFromEnv()
+	accessLogDays = accessLogDaysFromEnv()
+	requestTimeout = requestTimeoutFromEnv()
+	breakGlass = breakGlassFromEnv()
+	breakGlassMinutes = breakGlassMinutesFromEnv()
+	lunchDeduction, err = lunchDeductionFromEnv()
+	if err != nil {
+		logError(err)
+		return
+	}
 
-		// ...and execute the code
-		_, err = db.Exec(init)
-		if err != nil {
-			fmt.Println(stacktrace.Propagate(err, "failed to execute init SQL"))
-			return
-		}
-	} else {
-		// the database exists so we assume it's initialised
-		db, err = sql.Open("sqlite3", "./wms2.db?mode=rw")
-		if err != nil {
-			fmt.Println(stacktrace.Propagate(err, "failed to open the database"))
-			return
-		}
-		defer db.Close()
+	db, err := openDB("./wms2.db")
+	if err != nil {
+		logError(err)
+		return
 	}
+	defer db.Close()
 
-	db.Exec(`PRAGMA foreign_keys = on;`)
+	if runCommand(db, os.Args[1:]) {
+		return
+	}
 
 	cleanSessions(db)
+	if err := failInterruptedJobRuns(db); err != nil {
+		logError(err)
+	}
 	createUser(db, "test@invalid", "hunter2", false)
 	createUser(db, "admin@invalid", "hunter2", true)
 
-	go disqualifier(db)
+	onTransition(func(uid uidT, from, to userState, at int64) {
+		if from == stateIn { // an entry ended
+			if err := checkCap(db, uid, at); err != nil {
+				logError(stacktrace.Propagate(err, "failed to check contractor cap"))
+			}
+		}
+	})
+	// if the server was down for days, those clocked in since before then go to the admins for review,
+	// then whoever was clocked in at a site's clock out time while it was down gets disqualified
+	err = runJob(db, jobDisqualify, func() (int, error) {
+		reviewed, err := reviewStale(db, time.Now())
+		if err != nil {
+			return reviewed, err
+		}
+		disqualified, err := disqualifyDue(db, time.Now())
+		return reviewed + disqualified, err
+	})
+	if err != nil {
+		logError(err, "job", jobDisqualify)
+	}
+	goJobLoop(func() {
+		runScheduled(db, jobDisqualify, disqualifyRules.Schedule, true, func() (int, error) { return disqualifyDue(db, time.Now()) })
+	})
+	heartbeatTimeout := heartbeatTimeoutFromEnv()
+	goJobLoop(func() { heartbeatWatcher(db, heartbeatTimeout) })
+	m := newMailerFromEnv()
+	deliverers := map[string]deliverer{outboxEmail: m.deliverEmail, outboxWebhook: webhookDeliverer(db)}
+	goJobLoop(func() { outboxDispatcher(db, deliverers) })
+	goJobLoop(func() { weeklySummarizer(db) })
+	goJobLoop(func() { exceptionDigester(db) })
+	goJobLoop(func() { reminder(db) })
+	goJobLoop(func() { holidaySyncer(db) })
+	goJobLoop(func() { accessLogPruner(db) })
 
 	mux := powermux.NewServeMux()
-	env := env{db}
+	env := env{db, newLatencies(), extensionOriginsFromEnv(), newRateLimiter(20, time.Minute),
+		newRateLimiter(20, time.Minute), newRateLimiter(badgeFailureLimit, badgeFailureWindow), os.Getenv("WMS2_COUNTRY_HEADER"),
+		os.Getenv("WMS2_SLACK_SIGNING_SECRET"), os.Getenv("WMS2_TELEGRAM_SECRET"), newRateLimiter(5, time.Hour)}
 	routes(mux, env)
-	err := http.ListenAndServe(":3000", mux)
-	fmt.Println(stacktrace.Propagate(err, ""))
+	server := &http.Server{Addr: ":3000", Handler: mux}
+	served := make(chan error, 1)
+	if cert, key := os.Getenv("WMS2_TLS_CERT"), os.Getenv("WMS2_TLS_KEY"); cert != "" && key != "" {
+		// client certificates are asked for but checked per device, see device.allows
+		server.TLSConfig = &tls.Config{ClientAuth: tls.RequestClientCert}
+		go func() { served <- server.ListenAndServeTLS(cert, key) }()
+	} else {
+		go func() { served <- server.ListenAndServe() }()
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	select {
+	case err = <-served:
+		logError(stacktrace.Propagate(err, ""))
+	case s := <-signals:
+		slog.Info("shutting down", "signal", s.String())
+		if err = shutdown(server); err != nil {
+			logError(err)
+		}
+	}
 }
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+
+	"github.com/palantir/stacktrace"
+)
+
+// When HR finds that someone has two users, merging moves the records of one (from) to the other (into)
+// in a transaction. Balances are worked out from entries and leave, so they follow. Every moved row is
+// kept in user_merge_rows so the merge can be undone, which moves those rows back and nothing else.
+// Entries of from that overlap into's make the merge fail, those have to be fixed first. Other rows that would
+// clash with one into already has, like a signoff of the same month, stay where they are and are reported.
+// The from user itself isn't touched, its sign in and badge keep working until it's removed.
+
+// mergedTables are the tables whose rows move, by their uid column. The change feed comes before entries
+// so that only its history moves, the changes of moving the entries stay with whose feed they belong to.
+var mergedTables = []string{
+	"entry_changes", "entries", "punches", "leave_requests", "contracts", "school_days", "weekend_approvals", "timesheet_signoffs",
+	"idle_periods", "punch_suggestions", "held_punches", "schedule_profile_users", "reminder_snoozes", "cap_notices",
+	"user_identities",
+}
+
+type userMerge struct {
+	MGID   int            `json:"mgid"`
+	From   uidT           `json:"from"`
+	Into   uidT           `json:"into"`
+	By     uidT           `json:"by"`
+	At     int64          `json:"at"`
+	Undone int64          `json:"undone,omitempty"` // when it was undone, 0 if it wasn't
+	Moved  map[string]int `json:"moved"`            // rows by table
+	Kept   map[string]int `json:"kept,omitempty"`   // rows by table that stayed with from as into has ones like them
+}
+
+// mergeOverlap is an entry of from and the entries of into it overlaps
+type mergeOverlap struct {
+	entryRange
+	Conflicts []entryRange `json:"conflicts"`
+}
+
+// mergeOverlapError is what mergeUsers returns if entries of from overlap entries of into
+type mergeOverlapError struct {
+	Entries []mergeOverlap `json:"entries"`
+}
+
+func (e *mergeOverlapError) Error() string {
+	return fmt.Sprintf("%d entries overlap entries of the user they'd be merged into", len(e.Entries))
+}
+
+// checkMerge returns why from can't be merged into into, nil if it can
+func checkMerge(db *sql.DB, from, into uidT) (err error) {
+	if from == into {
+		return stacktrace.NewError("a user can't be merged into themselves")
+	}
+	for _, uid := range []uidT{from, into} {
+		var state userState
+		err = db.QueryRow("SELECT state FROM user_states WHERE uid = ?", uid).Scan(&state)
+		if err == sql.ErrNoRows {
+			return stacktrace.NewError("there's no user %d", uid)
+		}
+		if err != nil {
+			return stacktrace.Propagate(err, "failed to get state")
+		}
+		if state != stateOut {
+			return stacktrace.NewError("user %d has to be clocked out", uid)
+		}
+	}
+	return nil
+}
+
+// findMergeOverlaps returns a mergeOverlapError if any of from's entries overlap into's, nil if none do.
+// Entries in the trash don't count, restoring them checks for overlaps again.
+func findMergeOverlaps(tx *sql.Tx, from, into uidT) (oe *mergeOverlapError, err error) {
+	rows, err := entryStore.query(context.TODO(), tx, "SELECT eid, from_unix_s, to_unix_s FROM entries WHERE uid = ? AND deleted_unix_s IS NULL", from)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed to select entries")
+	}
+	var ers []entryRange
+	for rows.Next() {
+		var er entryRange
+		if err = rows.Scan(&er.EID, &er.From, &er.To); err != nil {
+			rows.Close()
+			return nil, stacktrace.Propagate(err, "failed to scan row")
+		}
+		ers = append(ers, er)
+	}
+	rows.Close()
+
+	oe = &mergeOverlapError{Entries: []mergeOverlap{}}
+	for _, er := range ers {
+		overlap, err := findOverlaps(tx, into, er.EID, er.From, er.To)
+		if err != nil {
+			return nil, err
+		}
+		if overlap != nil {
+			oe.Entries = append(oe.Entries, mergeOverlap{er, overlap.Conflicts})
+		}
+	}
+	if len(oe.Entries) == 0 {
+		return nil, nil
+	}
+	return oe, nil
+}
+
+// mergeUsers moves from's records to into, see merge.go. They should pass checkMerge.
+// If entries of the users overlap nothing moves and the error is a *mergeOverlapError.
+func mergeUsers(db *sql.DB, from, into, by uidT) (m userMerge, err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return m, stacktrace.Propagate(err, "failed to begin a transaction")
+	}
+	rollback := func() {
+		if err := tx.Rollback(); err != nil {
+			logError(stacktrace.Propagate(err, "failed to roll back transaction"))
+		}
+	}
+
+	oe, err := findMergeOverlaps(tx, from, into)
+	if err != nil {
+		rollback()
+		return m, err
+	}
+	if oe != nil {
+		rollback()
+		return m, oe
+	}
+
+	m = userMerge{From: from, Into: into, By: by, At: clk.Now().Unix(), Moved: make(map[string]int), Kept: make(map[string]int)}
+	res, err := tx.Exec("INSERT INTO user_merges (from_uid, into_uid, by_uid, at_unix_s) VALUES (?1, ?2, ?3, ?4)",
+		from, into, by, m.At)
+	if err != nil {
+		rollback()
+		return m, stacktrace.Propagate(err, "failed to insert merge")
+	}
+	mgid, err := res.LastInsertId()
+	if err != nil {
+		rollback()
+		return m, stacktrace.Propagate(err, "failed to get mgid")
+	}
+	m.MGID = int(mgid)
+
+	for _, table := range mergedTables {
+		rowids, err := selectRowids(tx, "SELECT rowid FROM "+table+" WHERE uid = ?", from)
+		if err != nil {
+			rollback()
+			return m, stacktrace.Propagate(err, "failed to select rows of "+table)
+		}
+		for _, rowid := range rowids {
+			moved, err := moveRow(tx, table, rowid, from, into)
+			if err != nil {
+				rollback()
+				return m, err
+			}
+			if !moved {
+				m.Kept[table]++
+				continue
+			}
+			_, err = tx.Exec("INSERT INTO user_merge_rows (mgid, tbl, row) VALUES (?1, ?2, ?3)", mgid, table, rowid)
+			if err != nil {
+				rollback()
+				return m, stacktrace.Propagate(err, "failed to record moved row")
+			}
+			m.Moved[table]++
+		}
+	}
+
+	err = audit(tx, by, into, auditMerge, 0, map[string]uidT{"from": from}, map[string]interface{}{"moved": m.Moved, "kept": m.Kept})
+	if err != nil {
+		rollback()
+		return m, err
+	}
+	return m, stacktrace.Propagate(tx.Commit(), "failed to commit transaction")
+}
+
+// undoMerge moves the rows the merge moved back, as long as they're still into's.
+// found is false if there's no such merge that wasn't undone yet.
+func undoMerge(db *sql.DB, mgid int, by uidT) (found bool, err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, stacktrace.Propagate(err, "failed to begin a transaction")
+	}
+	rollback := func() {
+		if err := tx.Rollback(); err != nil {
+			logError(stacktrace.Propagate(err, "failed to roll back transaction"))
+		}
+	}
+
+	var from, into uidT
+	err = tx.QueryRow("SELECT from_uid, into_uid FROM user_merges WHERE mgid = ? AND undone_unix_s IS NULL", mgid).
+		Scan(&from, &into)
+	if err == sql.ErrNoRows {
+		rollback()
+		return false, nil
+	}
+	if err != nil {
+		rollback()
+		return false, stacktrace.Propagate(err, "failed to get merge")
+	}
+
+	moved := make(map[string]int)
+	for _, table := range mergedTables {
+		rowids, err := selectRowids(tx, "SELECT row FROM user_merge_rows WHERE mgid = ?1 AND tbl = ?2", mgid, table)
+		if err != nil {
+			rollback()
+			return false, stacktrace.Propagate(err, "failed to select moved rows")
+		}
+		for _, rowid := range rowids {
+			ok, err := moveRow(tx, table, rowid, into, from)
+			if err != nil {
+				rollback()
+				return false, err
+			}
+			if ok {
+				moved[table]++
+			}
+		}
+	}
+
+	_, err = tx.Exec("UPDATE user_merges SET undone_unix_s = ?1 WHERE mgid = ?2", clk.Now().Unix(), mgid)
+	if err != nil {
+		rollback()
+		return false, stacktrace.Propagate(err, "failed to mark merge undone")
+	}
+	err = audit(tx, by, from, auditMerge, 0, map[string]interface{}{"from": into, "undoes": mgid}, moved)
+	if err != nil {
+		rollback()
+		return false, err
+	}
+	return true, stacktrace.Propagate(tx.Commit(), "failed to commit transaction")
+}
+
+// moveRow gives the row of the table to user to if it's user from's, moved is false if it isn't
+// or to already has one like it
+func moveRow(tx *sql.Tx, table string, rowid int64, from, to uidT) (moved bool, err error) {
+	res, err := entryStore.exec(context.TODO(), tx, "UPDATE OR IGNORE "+table+" SET uid = ?1 WHERE rowid = ?2 AND uid = ?3", to, rowid, from)
+	if err != nil {
+		return false, stacktrace.Propagate(err, "failed to move row "+strconv.FormatInt(rowid, 10)+" of "+table)
+	}
+	n, err := res.RowsAffected()
+	return n == 1, stacktrace.Propagate(err, "failed to get rows affected")
+}
+
+func selectRowids(tx *sql.Tx, query string, args ...interface{}) (rowids []int64, err error) {
+	rows, err := entryStore.query(context.TODO(), tx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var rowid int64
+		if err = rows.Scan(&rowid); err != nil {
+			return nil, err
+		}
+		rowids = append(rowids, rowid)
+	}
+	return rowids, rows.Err()
+}
+
+// listMerges returns all merges newest first, with how many rows of each table they moved
+func listMerges(db *sql.DB) (ms []userMerge, err error) {
+	rows, err := db.Query(`SELECT mgid, from_uid, into_uid, by_uid, at_unix_s, IFNULL(undone_unix_s, 0)
+		FROM user_merges ORDER BY mgid DESC`)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed to list merges")
+	}
+	ms = []userMerge{}
+	byID := make(map[int]int)
+	for rows.Next() {
+		m := userMerge{Moved: make(map[string]int)}
+		err = rows.Scan(&m.MGID, &m.From, &m.Into, &m.By, &m.At, &m.Undone)
+		if err != nil {
+			rows.Close()
+			return nil, stacktrace.Propagate(err, "failed to scan row")
+		}
+		byID[m.MGID] = len(ms)
+		ms = append(ms, m)
+	}
+	rows.Close()
+
+	rows, err = db.Query("SELECT mgid, tbl, COUNT(*) FROM user_merge_rows GROUP BY mgid, tbl")
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed to count moved rows")
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var mgid, n int
+		var table string
+		err = rows.Scan(&mgid, &table, &n)
+		if err != nil {
+			return nil, stacktrace.Propagate(err, "failed to scan row")
+		}
+		if i, ok := byID[mgid]; ok {
+			ms[i].Moved[table] = n
+		}
+	}
+	return ms, nil
+}
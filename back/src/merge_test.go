@@ -0,0 +1,101 @@
+package main
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+)
+
+func countRows(t *testing.T, db *sql.DB, query string, args ...interface{}) (n int) {
+	t.Helper()
+	if err := db.QueryRow(query, args...).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestMergeUsers(t *testing.T) {
+	loc := testLocation(t)
+	at := func(day, hour int) time.Time { return time.Date(2019, time.October, day, hour, 0, 0, 0, loc) }
+	db, done := newTestDB(t, at(31, 12))
+	defer done()
+	from := seedUser(t, db, "from@example.com", false)
+	into := seedUser(t, db, "into@example.com", false)
+	admin := seedUser(t, db, "admin@example.com", true)
+
+	seedEntry(t, db, from, at(1, 8), at(1, 16), entryWork)
+	seedEntry(t, db, from, at(2, 8), at(2, 16), entryWork)
+	seedEntry(t, db, into, at(3, 8), at(3, 16), entryWork)
+	clash := seedEntry(t, db, into, at(2, 15), at(2, 17), entryWork)
+	for _, uid := range []uidT{from, into} {
+		_, err := db.Exec(`INSERT INTO timesheet_signoffs (uid, year, month, snapshot, submitted_unix_s)
+			VALUES (?, 2019, 9, '{}', 0)`, uid)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err := db.Exec(`INSERT INTO timesheet_signoffs (uid, year, month, snapshot, submitted_unix_s)
+		VALUES (?, 2019, 8, '{}', 0)`, from)
+	if err != nil {
+		t.Fatal(err)
+	}
+	changes := countRows(t, db, "SELECT COUNT(*) FROM entry_changes WHERE uid = ?", from)
+
+	// overlapping entries stop the merge
+	_, err = mergeUsers(db, from, into, admin)
+	oe, ok := err.(*mergeOverlapError)
+	if !ok {
+		t.Fatalf("merging overlapping entries got %v", err)
+	}
+	if len(oe.Entries) != 1 || len(oe.Entries[0].Conflicts) != 1 || oe.Entries[0].Conflicts[0].EID != clash {
+		t.Errorf("got overlaps %+v, want entry %d", oe.Entries, clash)
+	}
+	if n := countRows(t, db, "SELECT COUNT(*) FROM entries WHERE uid = ?", from); n != 2 {
+		t.Errorf("%d entries stayed with from, want all 2", n)
+	}
+	if n := countRows(t, db, "SELECT COUNT(*) FROM user_merges"); n != 0 {
+		t.Errorf("%d merges recorded", n)
+	}
+
+	// trashed entries don't count
+	if _, err = db.Exec("UPDATE entries SET deleted_unix_s = 1 WHERE eid = ?", clash); err != nil {
+		t.Fatal(err)
+	}
+	m, err := mergeUsers(db, from, into, admin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Moved["entries"] != 2 || m.Moved["timesheet_signoffs"] != 1 || m.Moved["entry_changes"] != changes {
+		t.Errorf("moved %v, want 2 entries, 1 signoff and %d changes", m.Moved, changes)
+	}
+	if m.Kept["timesheet_signoffs"] != 1 || len(m.Kept) != 1 {
+		t.Errorf("kept %v, want the signoff of the month into has one of", m.Kept)
+	}
+	if n := countRows(t, db, "SELECT COUNT(*) FROM timesheet_signoffs WHERE uid = ?", from); n != 1 {
+		t.Errorf("%d signoffs stayed with from, want 1", n)
+	}
+	// from's change feed says its entries are gone, its history moved along
+	if n := countRows(t, db, "SELECT COUNT(*) FROM entry_changes WHERE uid = ? AND deleted = 1", from); n != 2 {
+		t.Errorf("from's feed has %d deletions, want 2", n)
+	}
+	if n := countRows(t, db, "SELECT COUNT(*) FROM entry_changes WHERE uid = ?", from); n != 2 {
+		t.Errorf("from's feed has %d changes, want only the 2 deletions", n)
+	}
+	if n := countRows(t, db, "SELECT COUNT(*) FROM audit_log WHERE uid = ? AND action = ?", into, auditMerge); n != 1 {
+		t.Errorf("%d merges audited", n)
+	}
+
+	found, err := undoMerge(db, m.MGID, admin)
+	if err != nil || !found {
+		t.Fatalf("undo got %t, %v", found, err)
+	}
+	if n := countRows(t, db, "SELECT COUNT(*) FROM entries WHERE uid = ?", from); n != 2 {
+		t.Errorf("%d entries moved back, want 2", n)
+	}
+	if n := countRows(t, db, "SELECT COUNT(*) FROM timesheet_signoffs WHERE uid = ?", from); n != 2 {
+		t.Errorf("from has %d signoffs after the undo, want 2", n)
+	}
+	if n := countRows(t, db, "SELECT COUNT(*) FROM timesheet_signoffs WHERE uid = ?", into); n != 1 {
+		t.Errorf("into has %d signoffs after the undo, want 1", n)
+	}
+}
@@ -0,0 +1,807 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"strconv"
+	"strings"
+
+	"github.com/palantir/stacktrace"
+)
+
+// Databases made by an older wms2 are brought up to schema one step at a time. Step n takes a database from
+// version n to n+1, see schemaVersion, and a database from before versions is at 0. Each step runs in a
+// transaction together with setting the new version, so a step that fails can be run again once its cause is
+// fixed. Changes ALTER TABLE can't make, like to a CHECK, rebuild the table, see alterTable.
+// A new database gets schema right away, migrating one has to give the same tables.
+
+// migration changes the schema of a database in a transaction
+type migration func(tx *sql.Tx) error
+
+// migrations are the steps, never change one that was released. Every change to schema needs a new one.
+var migrations = [...][]migration{
+	// entry sources
+	{migrateSQL(`ALTER TABLE entries ADD COLUMN source TEXT CHECK(source IN ('clock', 'auto-close'))`)},
+
+	// weekly summary emails
+	{migrateSQL(`ALTER TABLE users ADD COLUMN weekly_summary INTEGER DEFAULT 0 CHECK(weekly_summary IN (0, 1))`)},
+
+	// auditors
+	{migrateSQL(`ALTER TABLE users ADD COLUMN auditor INTEGER DEFAULT 0 CHECK(auditor IN (0, 1))`)},
+
+	// raw punches
+	{migrateSQL(`
+		CREATE TABLE punches (
+			pid INTEGER PRIMARY KEY AUTOINCREMENT,
+			uid INTEGER,
+			kind TEXT CHECK(kind IN ('I', 'O')), -- see user_states.state
+			at_unix_s INTEGER, -- see entries.from_unix_s
+			result TEXT CHECK(result IN ('accepted', 'duplicate', 'failed')),
+			FOREIGN KEY (uid) REFERENCES users(uid)
+		);
+
+		CREATE INDEX punches_uid ON punches (uid);`)},
+
+	// one open state per user, states without a user can't be anyone's
+	{
+		migrateSQL(`
+			DELETE FROM user_states WHERE uid IS NULL;
+			UPDATE user_states SET state = 'O' WHERE state IS NULL;
+			UPDATE user_states SET since_unix_s = CAST(strftime('%s', 'now') AS INTEGER) WHERE since_unix_s IS NULL;`),
+		alterTable("user_states",
+			"uid INTEGER,", "uid INTEGER NOT NULL,",
+			"state TEXT CHECK", "state TEXT NOT NULL CHECK",
+			"since_unix_s,", "since_unix_s INTEGER NOT NULL,"),
+	},
+
+	// expected ends
+	{migrateSQL(`ALTER TABLE user_states ADD COLUMN expected_end_unix_s INTEGER`)},
+
+	// badges and kiosks
+	{
+		migrateSQL(`
+			ALTER TABLE users ADD COLUMN badge TEXT;
+
+			CREATE TABLE devices (
+				did INTEGER PRIMARY KEY AUTOINCREMENT,
+				name TEXT,
+				token TEXT, -- sent by the device instead of a session id
+				UNIQUE(token)
+			);
+
+			ALTER TABLE punches ADD COLUMN did INTEGER REFERENCES devices(did);`),
+		alterTable("users", "UNIQUE(email)", "UNIQUE(email),\n\tUNIQUE(badge)"),
+	},
+
+	// display panels
+	{migrateSQL(`ALTER TABLE devices ADD COLUMN kind TEXT CHECK(kind IN ('kiosk', 'display'))`)},
+
+	// evacuation musters
+	{migrateSQL(`
+		ALTER TABLE users ADD COLUMN warden INTEGER DEFAULT 0 CHECK(warden IN (0, 1));
+
+		CREATE TABLE musters (
+			mid INTEGER PRIMARY KEY AUTOINCREMENT,
+			started_unix_s INTEGER,
+			started_by INTEGER,
+			FOREIGN KEY (started_by) REFERENCES users(uid)
+		);
+
+		CREATE TABLE muster_users ( -- who was clocked in when the muster started
+			mid INTEGER,
+			uid INTEGER,
+			accounted_by INTEGER, -- null until a warden accounts for the user
+			accounted_unix_s INTEGER,
+			FOREIGN KEY (mid) REFERENCES musters(mid),
+			FOREIGN KEY (uid) REFERENCES users(uid),
+			FOREIGN KEY (accounted_by) REFERENCES users(uid),
+			UNIQUE(mid, uid)
+		);`)},
+
+	// sites
+	{migrateSQL(`
+		CREATE TABLE sites (
+			stid INTEGER PRIMARY KEY AUTOINCREMENT,
+			name TEXT,
+			timezone TEXT, -- IANA name, or Local for the server's
+			clock_out_s INTEGER DEFAULT 0, -- when open states get disqualified, seconds after local midnight
+			UNIQUE(name)
+		);
+
+		INSERT INTO sites (name, timezone) VALUES ('Main', 'Local');
+
+		ALTER TABLE users ADD COLUMN stid INTEGER DEFAULT 1 REFERENCES sites(stid);
+		ALTER TABLE user_states ADD COLUMN stid INTEGER REFERENCES sites(stid);
+		ALTER TABLE devices ADD COLUMN stid INTEGER DEFAULT 1 REFERENCES sites(stid);
+		ALTER TABLE punches ADD COLUMN stid INTEGER REFERENCES sites(stid);
+		ALTER TABLE musters ADD COLUMN stid INTEGER REFERENCES sites(stid);
+		ALTER TABLE muster_users ADD COLUMN stid INTEGER REFERENCES sites(stid);`)},
+
+	// sites of entries
+	{migrateSQL(`ALTER TABLE entries ADD COLUMN stid INTEGER REFERENCES sites(stid)`)},
+
+	// heartbeat mode
+	{migrateSQL(`
+		ALTER TABLE user_states ADD COLUMN heartbeat_unix_s INTEGER;
+		ALTER TABLE user_states ADD COLUMN missed_heartbeat INTEGER DEFAULT 0 CHECK(missed_heartbeat IN (0, 1));
+		ALTER TABLE entries ADD COLUMN missed_heartbeat INTEGER DEFAULT 0 CHECK(missed_heartbeat IN (0, 1));`)},
+
+	// idle periods
+	{migrateSQL(`
+		CREATE TABLE idle_periods (
+			ipid INTEGER PRIMARY KEY AUTOINCREMENT,
+			uid INTEGER NOT NULL,
+			from_unix_s INTEGER NOT NULL, -- as reported by the user's desktop agent
+			to_unix_s INTEGER NOT NULL,
+			status TEXT NOT NULL DEFAULT 'pending' CHECK(status IN ('pending', 'confirmed', 'dismissed')),
+			FOREIGN KEY (uid) REFERENCES users(uid),
+			CHECK(from_unix_s < to_unix_s)
+		);`)},
+
+	// browser extension
+	{migrateSQL(`
+		CREATE TABLE extension_tokens (
+			uid INTEGER NOT NULL,
+			token TEXT NOT NULL,
+			created_unix_s INTEGER,
+			FOREIGN KEY (uid) REFERENCES users(uid),
+			UNIQUE(uid), -- a new token replaces the old one
+			UNIQUE(token)
+		);`)},
+
+	// presence events
+	{
+		migrateSQL(`
+			ALTER TABLE users ADD COLUMN presence TEXT DEFAULT 'off' CHECK(presence IN ('off', 'suggest', 'punch'));
+
+			CREATE TABLE punch_suggestions (
+				psid INTEGER PRIMARY KEY AUTOINCREMENT,
+				uid INTEGER NOT NULL,
+				did INTEGER, -- the presence device that saw the user
+				kind TEXT CHECK(kind IN ('I', 'O')), -- see user_states.state
+				at_unix_s INTEGER NOT NULL,
+				status TEXT NOT NULL DEFAULT 'pending' CHECK(status IN ('pending', 'accepted', 'dismissed')),
+				FOREIGN KEY (uid) REFERENCES users(uid),
+				FOREIGN KEY (did) REFERENCES devices(did)
+			);`),
+		alterTable("devices", "'kiosk', 'display'", "'kiosk', 'display', 'presence'"),
+	},
+
+	// manual entries
+	{alterTable("entries", "'clock', 'auto-close'", "'clock', 'auto-close', 'manual'")},
+
+	// entry change feed
+	{migrateSQL(`
+		CREATE TABLE entry_changes (
+			cid INTEGER PRIMARY KEY AUTOINCREMENT, -- the cursor of the change feed
+			uid INTEGER NOT NULL,
+			eid INTEGER NOT NULL, -- no foreign key, deletions are changes too
+			deleted INTEGER NOT NULL DEFAULT 0 CHECK(deleted IN (0, 1))
+		);
+
+		CREATE TRIGGER entries_inserted AFTER INSERT ON entries BEGIN
+			INSERT INTO entry_changes (uid, eid) VALUES (NEW.uid, NEW.eid);
+		END;
+
+		CREATE TRIGGER entries_updated AFTER UPDATE ON entries BEGIN
+			INSERT INTO entry_changes (uid, eid) VALUES (NEW.uid, NEW.eid);
+		END;
+
+		CREATE TRIGGER entries_deleted AFTER DELETE ON entries BEGIN
+			INSERT INTO entry_changes (uid, eid, deleted) VALUES (OLD.uid, OLD.eid, 1);
+		END;
+
+		CREATE INDEX entry_changes_uid ON entry_changes (uid, cid);`)},
+
+	// notification outbox
+	{migrateSQL(`
+		CREATE TABLE outbox (
+			oid INTEGER PRIMARY KEY AUTOINCREMENT,
+			kind TEXT NOT NULL, -- what delivers it, e.g. email
+			payload TEXT NOT NULL, -- JSON, depends on the kind
+			created_unix_s INTEGER NOT NULL,
+			attempts INTEGER NOT NULL DEFAULT 0,
+			next_attempt_unix_s INTEGER NOT NULL,
+			last_error TEXT,
+			status TEXT NOT NULL DEFAULT 'pending' CHECK(status IN ('pending', 'sent', 'dead'))
+		);
+
+		CREATE INDEX outbox_status ON outbox (status, next_attempt_unix_s);`)},
+
+	// encrypted badges
+	{migrateSQL(`ALTER TABLE users ADD COLUMN badge_sealed TEXT`)},
+
+	// device IP and certificate restrictions
+	{migrateSQL(`
+		ALTER TABLE devices ADD COLUMN allowed_ips TEXT;
+		ALTER TABLE devices ADD COLUMN cert_fingerprint TEXT;`)},
+
+	// session countries
+	{migrateSQL(`ALTER TABLE sessions ADD COLUMN country TEXT`)},
+
+	// contractors
+	{migrateSQL(`
+		ALTER TABLE users ADD COLUMN monthly_cap_s INTEGER;
+		ALTER TABLE users ADD COLUMN sponsor INTEGER REFERENCES users(uid);
+		ALTER TABLE entries ADD COLUMN over_cap INTEGER DEFAULT 0 CHECK(over_cap IN (0, 1));
+
+		CREATE TABLE cap_notices ( -- contractor cap notices that were sent
+			uid INTEGER,
+			month TEXT, -- like 2019-10
+			level INTEGER, -- percent of the cap
+			FOREIGN KEY (uid) REFERENCES users(uid),
+			UNIQUE(uid, month, level)
+		);`)},
+
+	// kiosk approvals
+	{migrateSQL(`
+		CREATE TABLE device_users ( -- users approved to punch at a kiosk, see approvals.go
+			did INTEGER NOT NULL,
+			uid INTEGER NOT NULL,
+			FOREIGN KEY (did) REFERENCES devices(did),
+			FOREIGN KEY (uid) REFERENCES users(uid),
+			UNIQUE(did, uid)
+		);
+
+		CREATE TABLE held_punches ( -- kiosk punches waiting for the device to be approved
+			hpid INTEGER PRIMARY KEY AUTOINCREMENT,
+			uid INTEGER NOT NULL,
+			did INTEGER NOT NULL,
+			kind TEXT CHECK(kind IN ('I', 'O')), -- see user_states.state
+			at_unix_s INTEGER NOT NULL,
+			status TEXT NOT NULL DEFAULT 'pending' CHECK(status IN ('pending', 'approved', 'rejected')),
+			FOREIGN KEY (uid) REFERENCES users(uid),
+			FOREIGN KEY (did) REFERENCES devices(did)
+		);`)},
+
+	// holidays
+	{migrateSQL(`
+		CREATE TABLE holidays (
+			hid INTEGER PRIMARY KEY AUTOINCREMENT,
+			date TEXT NOT NULL, -- like 2019-10-03, in whatever timezone the day is looked at
+			name TEXT,
+			stid INTEGER, -- the site it's a holiday at, null for all sites
+			FOREIGN KEY (stid) REFERENCES sites(stid)
+		);`)},
+
+	// daily targets
+	{migrateSQL(`ALTER TABLE users ADD COLUMN daily_target_s INTEGER NOT NULL DEFAULT 28800`)},
+
+	// breaks
+	{
+		migrateSQL(`
+			ALTER TABLE user_states ADD COLUMN after_break INTEGER DEFAULT 0 CHECK(after_break IN (0, 1));
+			ALTER TABLE entries ADD COLUMN after_break INTEGER DEFAULT 0 CHECK(after_break IN (0, 1));`),
+		alterTable("user_states", "'I', 'O'", "'I', 'O', 'B'"),
+		alterTable("punches", "'I', 'O'", "'I', 'O', 'B'"),
+	},
+
+	// approval of manual entries and edits
+	{migrateSQL(`
+		ALTER TABLE entries ADD COLUMN approved INTEGER NOT NULL DEFAULT 1 CHECK(approved IN (0, 1));
+
+		CREATE TABLE approvals ( -- manual entries and edits waiting for an admin, see edits.go
+			apid INTEGER PRIMARY KEY AUTOINCREMENT,
+			kind TEXT NOT NULL CHECK(kind IN ('entry', 'edit')),
+			eid INTEGER NOT NULL,
+			from_unix_s INTEGER NOT NULL, -- what the entry is to be changed to for edits
+			to_unix_s INTEGER NOT NULL,
+			submitted_by INTEGER,
+			submitted_unix_s INTEGER NOT NULL,
+			status TEXT NOT NULL DEFAULT 'pending' CHECK(status IN ('pending', 'approved', 'rejected')),
+			decided_by INTEGER,
+			decided_unix_s INTEGER,
+			FOREIGN KEY (eid) REFERENCES entries(eid) ON DELETE CASCADE,
+			FOREIGN KEY (submitted_by) REFERENCES users(uid),
+			FOREIGN KEY (decided_by) REFERENCES users(uid)
+		);`)},
+
+	// weekend approvals
+	{migrateSQL(`
+		CREATE TABLE weekend_approvals ( -- weekend days users may work on, see weekend.go
+			uid INTEGER NOT NULL,
+			date TEXT NOT NULL, -- like holidays.date
+			approved_by INTEGER,
+			approved_unix_s INTEGER NOT NULL,
+			UNIQUE (uid, date),
+			FOREIGN KEY (uid) REFERENCES users(uid),
+			FOREIGN KEY (approved_by) REFERENCES users(uid)
+		);`)},
+
+	// trash
+	{migrateSQL(`
+		ALTER TABLE entries ADD COLUMN deleted_unix_s INTEGER;
+		ALTER TABLE entries ADD COLUMN deleted_by INTEGER REFERENCES users(uid);
+
+		DROP TRIGGER entries_updated;
+		CREATE TRIGGER entries_updated AFTER UPDATE ON entries BEGIN
+			INSERT INTO entry_changes (uid, eid, deleted) VALUES (NEW.uid, NEW.eid, NEW.deleted_unix_s IS NOT NULL);
+		END;`)},
+
+	// audit log
+	{migrateSQL(`
+		CREATE TABLE audit_log ( -- who changed what, see audit.go
+			alid INTEGER PRIMARY KEY AUTOINCREMENT,
+			at_unix_s INTEGER NOT NULL,
+			by_uid INTEGER, -- null for the server itself
+			uid INTEGER NOT NULL, -- whose data it is
+			action TEXT NOT NULL,
+			eid INTEGER, -- no foreign key, the log outlives entries
+			before TEXT, -- JSON, depends on the action
+			after TEXT,
+			FOREIGN KEY (by_uid) REFERENCES users(uid),
+			FOREIGN KEY (uid) REFERENCES users(uid)
+		);
+
+		CREATE INDEX audit_log_at ON audit_log (at_unix_s);`)},
+
+	// confirming auto-closed entries
+	{migrateSQL(`ALTER TABLE entries ADD COLUMN confirmed_unix_s INTEGER`)},
+
+	// clock out reminders
+	{migrateSQL(`
+		CREATE TABLE reminder_snoozes ( -- days users don't want clock out reminders on, see reminders.go
+			uid INTEGER NOT NULL,
+			date TEXT NOT NULL, -- like holidays.date
+			UNIQUE (uid, date),
+			FOREIGN KEY (uid) REFERENCES users(uid)
+		);
+
+		CREATE TABLE snooze_tokens ( -- for the snooze links in reminders
+			token TEXT PRIMARY KEY,
+			uid INTEGER NOT NULL,
+			date TEXT NOT NULL, -- what it snoozes
+			expires_unix_s INTEGER NOT NULL,
+			FOREIGN KEY (uid) REFERENCES users(uid)
+		);`)},
+
+	// leave requests
+	{migrateSQL(`
+		CREATE TABLE leave_requests ( -- see leave.go
+			lrid INTEGER PRIMARY KEY AUTOINCREMENT,
+			uid INTEGER NOT NULL,
+			type TEXT NOT NULL CHECK(type IN ('vacation', 'sick', 'other')),
+			from_date TEXT NOT NULL, -- like holidays.date
+			to_date TEXT NOT NULL, -- inclusive
+			status TEXT NOT NULL DEFAULT 'pending' CHECK(status IN ('pending', 'approved', 'denied')),
+			submitted_unix_s INTEGER NOT NULL,
+			decided_by INTEGER,
+			decided_unix_s INTEGER,
+			FOREIGN KEY (uid) REFERENCES users(uid),
+			FOREIGN KEY (decided_by) REFERENCES users(uid)
+		);`)},
+
+	// entry kinds
+	{migrateSQL(`ALTER TABLE entries ADD COLUMN kind TEXT NOT NULL DEFAULT 'work'
+		CHECK(kind IN ('work', 'sick', 'vacation', 'other'))`)},
+
+	// job runs
+	{migrateSQL(`
+		CREATE TABLE job_runs ( -- background job runs, see jobs.go
+			jrid INTEGER PRIMARY KEY AUTOINCREMENT,
+			job TEXT NOT NULL,
+			started_unix_s INTEGER NOT NULL,
+			ended_unix_s INTEGER, -- null while running
+			duration_ms INTEGER,
+			status TEXT NOT NULL DEFAULT 'running' CHECK(status IN ('running', 'ok', 'failed')),
+			error TEXT,
+			affected INTEGER NOT NULL DEFAULT 0 -- what the job did, like users disqualified or emails queued
+		);
+
+		CREATE INDEX job_runs_job ON job_runs (job, started_unix_s);`)},
+
+	// holiday calendars
+	{migrateSQL(`
+		CREATE TABLE holiday_calendars ( -- iCal feeds holidays are synced from, see holidaycal.go
+			hcid INTEGER PRIMARY KEY AUTOINCREMENT,
+			url TEXT NOT NULL,
+			stid INTEGER, -- like holidays.stid
+			synced_unix_s INTEGER, -- the last successful sync, null if there was none
+			last_error TEXT, -- why the last sync failed, null if it didn't
+			FOREIGN KEY (stid) REFERENCES sites(stid)
+		);
+
+		ALTER TABLE holidays ADD COLUMN hcid INTEGER REFERENCES holiday_calendars(hcid);`)},
+
+	// user time zones
+	{migrateSQL(`ALTER TABLE users ADD COLUMN timezone TEXT`)},
+
+	// schedule profiles
+	{migrateSQL(`
+		CREATE TABLE schedule_profiles ( -- temporary daily targets for groups of users, see profiles.go
+			spid INTEGER PRIMARY KEY AUTOINCREMENT,
+			name TEXT NOT NULL,
+			from_date TEXT NOT NULL, -- like holidays.date
+			to_date TEXT NOT NULL, -- inclusive
+			daily_target_s INTEGER NOT NULL, -- replaces users.daily_target_s on the days it covers
+			weekdays INTEGER NOT NULL DEFAULT 127, -- the days of the week it covers, bit n is time.Weekday n
+			stid INTEGER, -- covers everyone at the site besides its users, can be null
+			FOREIGN KEY (stid) REFERENCES sites(stid)
+		);
+
+		CREATE TABLE schedule_profile_users (
+			spid INTEGER NOT NULL,
+			uid INTEGER NOT NULL,
+			UNIQUE (spid, uid),
+			FOREIGN KEY (spid) REFERENCES schedule_profiles(spid),
+			FOREIGN KEY (uid) REFERENCES users(uid)
+		);`)},
+
+	// school days
+	{migrateSQL(`
+		CREATE TABLE school_days ( -- recurring school days of apprentices, see school.go
+			sdid INTEGER PRIMARY KEY AUTOINCREMENT,
+			uid INTEGER NOT NULL,
+			weekdays INTEGER NOT NULL, -- like schedule_profiles.weekdays
+			from_date TEXT NOT NULL, -- like holidays.date
+			to_date TEXT NOT NULL, -- inclusive
+			FOREIGN KEY (uid) REFERENCES users(uid)
+		);`)},
+
+	// contracts
+	{migrateSQL(`
+		CREATE TABLE contracts ( -- concurrent employment contracts of a user, see contracts.go
+			ctid INTEGER PRIMARY KEY AUTOINCREMENT,
+			uid INTEGER NOT NULL,
+			name TEXT NOT NULL,
+			cost_center TEXT NOT NULL DEFAULT '',
+			daily_target_s INTEGER NOT NULL, -- seconds expected per working day under the contract
+			from_date TEXT NOT NULL, -- like holidays.date
+			to_date TEXT, -- inclusive, null if it's open-ended
+			FOREIGN KEY (uid) REFERENCES users(uid)
+		);
+
+		ALTER TABLE user_states ADD COLUMN ctid INTEGER REFERENCES contracts(ctid);
+		ALTER TABLE entries ADD COLUMN ctid INTEGER REFERENCES contracts(ctid);`)},
+
+	// when entries were created and changed. Columns can only be added with constant defaults, so they're
+	// changed after. Entries that are there already are taken to be written when they ended, like clock outs.
+	{
+		migrateSQL(`
+			DROP TRIGGER entries_updated;
+			ALTER TABLE entries ADD COLUMN created_unix_s INTEGER NOT NULL DEFAULT 0;
+			ALTER TABLE entries ADD COLUMN updated_unix_s INTEGER NOT NULL DEFAULT 0;
+			UPDATE entries
+				SET created_unix_s = IFNULL(to_unix_s, IFNULL(from_unix_s, CAST(strftime('%s', 'now') AS INTEGER)));
+			UPDATE entries SET updated_unix_s = created_unix_s;`),
+		alterTable("entries",
+			"created_unix_s INTEGER NOT NULL DEFAULT 0",
+			"created_unix_s INTEGER NOT NULL DEFAULT (CAST(strftime('%s', 'now') AS INTEGER))",
+			"updated_unix_s INTEGER NOT NULL DEFAULT 0",
+			"updated_unix_s INTEGER NOT NULL DEFAULT (CAST(strftime('%s', 'now') AS INTEGER))"),
+		migrateSQL(`
+			CREATE TRIGGER entries_updated AFTER UPDATE ON entries BEGIN
+				INSERT INTO entry_changes (uid, eid, deleted) VALUES (NEW.uid, NEW.eid, NEW.deleted_unix_s IS NOT NULL);
+				UPDATE entries SET updated_unix_s = CAST(strftime('%s', 'now') AS INTEGER) WHERE eid = NEW.eid;
+			END;`),
+	},
+
+	// iCal feed
+	{migrateSQL(`
+		CREATE TABLE calendar_tokens ( -- see icalfeed.go
+			uid INTEGER NOT NULL,
+			token TEXT NOT NULL,
+			created_unix_s INTEGER,
+			FOREIGN KEY (uid) REFERENCES users(uid),
+			UNIQUE(uid), -- a new token replaces the old one
+			UNIQUE(token)
+		);`)},
+
+	// payroll ids
+	{migrateSQL(`ALTER TABLE users ADD COLUMN payroll_id TEXT`)},
+
+	// hash chained audit log
+	{migrateSQL(`ALTER TABLE audit_log ADD COLUMN hash TEXT`)},
+
+	// timesheet signoffs
+	{migrateSQL(`
+		CREATE TABLE timesheet_signoffs ( -- months users submitted and admins approved, see signoff.go
+			uid INTEGER NOT NULL,
+			year INTEGER NOT NULL,
+			month INTEGER NOT NULL,
+			snapshot TEXT NOT NULL, -- JSON of the month report as submitted
+			submitted_unix_s INTEGER NOT NULL,
+			approved_by INTEGER,
+			approved_unix_s INTEGER,
+			key_id TEXT, -- of the key that signed it
+			signature TEXT, -- base64 Ed25519
+			PRIMARY KEY (uid, year, month),
+			FOREIGN KEY (uid) REFERENCES users(uid),
+			FOREIGN KEY (approved_by) REFERENCES users(uid)
+		);`)},
+
+	// webhooks
+	{migrateSQL(`
+		CREATE TABLE webhooks ( -- see webhooks.go
+			whid INTEGER PRIMARY KEY AUTOINCREMENT,
+			url TEXT NOT NULL,
+			secret TEXT NOT NULL,
+			events TEXT NOT NULL, -- comma separated, empty for all
+			created_unix_s INTEGER NOT NULL
+		);`)},
+
+	// Slack
+	{migrateSQL(`
+		CREATE TABLE slack_users ( -- see slack.go
+			slack_id TEXT NOT NULL,
+			uid INTEGER NOT NULL,
+			FOREIGN KEY (uid) REFERENCES users(uid),
+			UNIQUE(slack_id),
+			UNIQUE(uid)
+		);`)},
+
+	// kiosk greetings
+	{migrateSQL(`
+		ALTER TABLE users ADD COLUMN display_name TEXT;
+		ALTER TABLE users ADD COLUMN language TEXT;
+		ALTER TABLE users ADD COLUMN photo BLOB;
+		ALTER TABLE users ADD COLUMN photo_type TEXT;`)},
+
+	// entry categories
+	{migrateSQL(`
+		CREATE TABLE categories ( -- of entries, see categories.go
+			catid INTEGER PRIMARY KEY AUTOINCREMENT,
+			name TEXT NOT NULL,
+			label TEXT NOT NULL,
+			color TEXT NOT NULL,
+			UNIQUE(name)
+		);
+
+		INSERT INTO categories (name, label, color) VALUES
+			('regular', 'Regular', '#4a90d9'),
+			('on-call', 'On call', '#e67e22'),
+			('training', 'Training', '#27ae60'),
+			('travel', 'Travel', '#8e44ad');
+
+		ALTER TABLE entries ADD COLUMN catid INTEGER REFERENCES categories(catid) ON DELETE SET NULL;`)},
+
+	// Telegram
+	{migrateSQL(`
+		CREATE TABLE telegram_users ( -- see telegram.go
+			telegram_id INTEGER NOT NULL,
+			uid INTEGER NOT NULL,
+			FOREIGN KEY (uid) REFERENCES users(uid),
+			UNIQUE(telegram_id),
+			UNIQUE(uid)
+		);`)},
+
+	// training
+	{migrateSQL(`
+		CREATE TABLE training_details ( -- of entries in the training category, see training.go
+			eid INTEGER PRIMARY KEY,
+			course TEXT NOT NULL, -- can be empty
+			certificate BLOB, -- a PDF or an image, can be null
+			certificate_type TEXT, -- its content type
+			FOREIGN KEY (eid) REFERENCES entries(eid) ON DELETE CASCADE
+		);`)},
+
+	// weekly summaries are opt-out, for new users. Existing ones keep what they had.
+	{alterTable("users", "weekly_summary INTEGER DEFAULT 0", "weekly_summary INTEGER DEFAULT 1")},
+
+	// probation
+	{migrateSQL(`ALTER TABLE users ADD COLUMN hired_date TEXT`)},
+
+	// access log
+	{migrateSQL(`
+		CREATE TABLE access_log ( -- who read whose records, see access.go
+			acid INTEGER PRIMARY KEY AUTOINCREMENT,
+			at_unix_s INTEGER NOT NULL,
+			by_uid INTEGER NOT NULL,
+			uid INTEGER, -- whose records they were, null for reads across users
+			route TEXT NOT NULL, -- like GET /a/users/:id/reports/month
+			path TEXT NOT NULL,
+			FOREIGN KEY (by_uid) REFERENCES users(uid),
+			FOREIGN KEY (uid) REFERENCES users(uid)
+		);
+
+		CREATE INDEX access_log_at ON access_log (at_unix_s);`)},
+
+	// break-glass access
+	{migrateSQL(`
+		CREATE TABLE break_glass ( -- emergency admin sessions, see breakglass.go
+			bgid INTEGER PRIMARY KEY AUTOINCREMENT,
+			uid INTEGER NOT NULL,
+			sid TEXT NOT NULL,
+			reason TEXT NOT NULL,
+			from_unix_s INTEGER NOT NULL,
+			until_unix_s INTEGER NOT NULL, -- when it expires or was closed
+			FOREIGN KEY (uid) REFERENCES users(uid)
+		);
+
+		CREATE INDEX break_glass_sid ON break_glass (sid);
+
+		ALTER TABLE access_log ADD COLUMN break_glass INTEGER REFERENCES break_glass(bgid);`)},
+
+	// merging users
+	{migrateSQL(`
+		CREATE TRIGGER entries_moved AFTER UPDATE OF uid ON entries WHEN OLD.uid IS NOT NEW.uid BEGIN
+			INSERT INTO entry_changes (uid, eid, deleted) VALUES (OLD.uid, OLD.eid, 1);
+		END;
+
+		CREATE TABLE user_merges ( -- see merge.go
+			mgid INTEGER PRIMARY KEY AUTOINCREMENT,
+			from_uid INTEGER NOT NULL,
+			into_uid INTEGER NOT NULL,
+			by_uid INTEGER NOT NULL,
+			at_unix_s INTEGER NOT NULL,
+			undone_unix_s INTEGER, -- null unless it was undone
+			FOREIGN KEY (from_uid) REFERENCES users(uid),
+			FOREIGN KEY (into_uid) REFERENCES users(uid),
+			FOREIGN KEY (by_uid) REFERENCES users(uid)
+		);
+
+		CREATE TABLE user_merge_rows ( -- the rows a merge moved, so it can be undone
+			mgid INTEGER NOT NULL,
+			tbl TEXT NOT NULL,
+			row INTEGER NOT NULL, -- rowid in tbl
+			FOREIGN KEY (mgid) REFERENCES user_merges(mgid)
+		);
+
+		CREATE INDEX user_merge_rows_mgid ON user_merge_rows (mgid, tbl);`)},
+
+	// ids in other systems
+	{migrateSQL(`
+		CREATE TABLE user_identities ( -- ids of users in other systems, see identity.go
+			uid INTEGER NOT NULL,
+			system TEXT NOT NULL CHECK(system IN ('hris', 'ldap')),
+			external_id TEXT NOT NULL,
+			FOREIGN KEY (uid) REFERENCES users(uid),
+			UNIQUE(uid, system),
+			UNIQUE(system, external_id)
+		);`)},
+
+	// sealed training details
+	{migrateSQL(`
+		ALTER TABLE training_details ADD COLUMN course_sealed INTEGER NOT NULL DEFAULT 0 CHECK(course_sealed IN (0, 1));
+		ALTER TABLE training_details ADD COLUMN certificate_sealed INTEGER NOT NULL DEFAULT 0 CHECK(certificate_sealed IN (0, 1));`)},
+}
+
+// migrateSQL is a migration running statements
+func migrateSQL(statements string) migration {
+	return func(tx *sql.Tx) (err error) {
+		_, err = tx.Exec(statements)
+		return err
+	}
+}
+
+// alterTable is a migration rebuilding the table with its CREATE TABLE statement changed, replacements are
+// pairs of text in it and what to replace that with. The text has to be in the statement once.
+// Rows, indexes, triggers and where AUTOINCREMENT is at are kept. Foreign keys have to be off.
+func alterTable(table string, replacements ...string) migration {
+	return func(tx *sql.Tx) (err error) {
+		var create string
+		err = tx.QueryRow("SELECT sql FROM sqlite_master WHERE type = 'table' AND name = ?", table).Scan(&create)
+		if err != nil {
+			return stacktrace.Propagate(err, "failed to get table "+table)
+		}
+		for i := 0; i+1 < len(replacements); i += 2 {
+			if n := strings.Count(create, replacements[i]); n != 1 {
+				return stacktrace.NewError("%q is in table %s %d times", replacements[i], table, n)
+			}
+			create = strings.Replace(create, replacements[i], replacements[i+1], 1)
+		}
+		// the name may be quoted after an earlier rebuild, the columns start at the first parenthesis
+		create = "CREATE TABLE " + table + "_new " + create[strings.Index(create, "("):]
+
+		var columns []string
+		rows, err := tx.Query("SELECT name FROM pragma_table_info(?)", table)
+		if err != nil {
+			return stacktrace.Propagate(err, "failed to get columns of "+table)
+		}
+		for rows.Next() {
+			var column string
+			if err = rows.Scan(&column); err != nil {
+				rows.Close()
+				return stacktrace.Propagate(err, "failed to scan row")
+			}
+			columns = append(columns, column)
+		}
+		rows.Close()
+
+		var others []string
+		rows, err = tx.Query(`SELECT sql FROM sqlite_master
+			WHERE tbl_name = ? AND type IN ('index', 'trigger') AND sql IS NOT NULL`, table)
+		if err != nil {
+			return stacktrace.Propagate(err, "failed to get indexes and triggers of "+table)
+		}
+		for rows.Next() {
+			var other string
+			if err = rows.Scan(&other); err != nil {
+				rows.Close()
+				return stacktrace.Propagate(err, "failed to scan row")
+			}
+			others = append(others, other)
+		}
+		rows.Close()
+
+		var seq sql.NullInt64
+		err = tx.QueryRow("SELECT seq FROM sqlite_sequence WHERE name = ?", table).Scan(&seq)
+		if err != nil && err != sql.ErrNoRows {
+			return stacktrace.Propagate(err, "failed to get sequence of "+table)
+		}
+
+		list := strings.Join(columns, ", ")
+		statements := []string{
+			create,
+			"INSERT INTO " + table + "_new (" + list + ") SELECT " + list + " FROM " + table,
+			"DROP TABLE " + table,
+			"ALTER TABLE " + table + "_new RENAME TO " + table,
+		}
+		statements = append(statements, others...)
+		if seq.Valid {
+			statements = append(statements, "UPDATE sqlite_sequence SET seq = MAX(seq, "+
+				strconv.FormatInt(seq.Int64, 10)+") WHERE name = '"+table+"'")
+		}
+		for _, statement := range statements {
+			if _, err = tx.Exec(statement); err != nil {
+				return stacktrace.Propagate(err, "failed to rebuild "+table)
+			}
+		}
+		return nil
+	}
+}
+
+// migrate brings the database from the version it's at to schemaVersion
+func migrate(db *sql.DB) (err error) {
+	ctx := context.Background()
+	// foreign keys are a setting of the connection, the steps have to run where they're off
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return stacktrace.Propagate(err, "failed to get a connection")
+	}
+	defer conn.Close()
+
+	var version int
+	err = conn.QueryRowContext(ctx, "PRAGMA user_version").Scan(&version)
+	if err != nil {
+		return stacktrace.Propagate(err, "failed to get schema version")
+	}
+	if version > schemaVersion {
+		return stacktrace.NewError("the database is at schema version %d, this wms2 only knows up to %d",
+			version, schemaVersion)
+	}
+	_, err = conn.ExecContext(ctx, "PRAGMA foreign_keys = off")
+	if err != nil {
+		return stacktrace.Propagate(err, "failed to disable foreign keys")
+	}
+	// the connection goes back to the pool afterwards
+	defer func() {
+		if _, err := conn.ExecContext(ctx, "PRAGMA foreign_keys = on"); err != nil {
+			logError(stacktrace.Propagate(err, "failed to enable foreign keys"))
+		}
+	}()
+
+	for ; version < schemaVersion; version++ {
+		err = migrateStep(ctx, conn, version)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateStep takes the database from version to the next one
+func migrateStep(ctx context.Context, conn *sql.Conn, version int) (err error) {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return stacktrace.Propagate(err, "failed to begin a transaction")
+	}
+	rollback := func() {
+		if err := tx.Rollback(); err != nil {
+			logError(stacktrace.Propagate(err, "failed to roll back transaction"))
+		}
+	}
+
+	for _, m := range migrations[version] {
+		if err = m(tx); err != nil {
+			rollback()
+			return stacktrace.Propagate(err, "failed to migrate to schema version %d", version+1)
+		}
+	}
+	_, err = tx.Exec("PRAGMA user_version = " + strconv.Itoa(version+1))
+	if err != nil {
+		rollback()
+		return stacktrace.Propagate(err, "failed to set schema version")
+	}
+	return stacktrace.Propagate(tx.Commit(), "failed to commit transaction")
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// baselineSchema is what the first wms2 created, without a schema version
+const baselineSchema = `
+CREATE TABLE users (
+	uid INTEGER PRIMARY KEY AUTOINCREMENT, -- so that they don't repeat
+	email TEXT,
+	password_hash BLOB,
+	password_salt BLOB,
+	admin INTEGER CHECK(admin IN (0, 1)),
+	UNIQUE(email)
+);
+
+CREATE TABLE user_states (
+	uid INTEGER,
+	state TEXT CHECK(state IN ('I', 'O')),
+	since_unix_s, -- see entries.from_unix_s
+	FOREIGN KEY (uid) REFERENCES users(uid),
+	UNIQUE(uid)
+);
+
+CREATE TABLE entries (
+	eid INTEGER PRIMARY KEY AUTOINCREMENT, -- so that they don't repeat
+	uid INTEGER,
+	from_unix_s INTEGER, -- "_s" stands for seconds, unlike the JS millisecond unix time
+	to_unix_s INTEGER, -- see above, can be null, signifies disqualifed entry
+	valid INTEGER CHECK(valid IN (0, 1)),
+	FOREIGN KEY (uid) REFERENCES users(uid),
+	CHECK(from_unix_s <= to_unix_s)
+);
+
+CREATE TABLE sessions (
+	sid TEXT,
+	uid INTEGER,
+	expires_unix_s INTEGER, -- see entries.from_unix_s
+	FOREIGN KEY (uid) REFERENCES users(uid)
+);
+
+CREATE INDEX sessions_id ON sessions (sid);
+
+INSERT INTO users (email, admin) VALUES ('a@example.com', 1), ('b@example.com', 0), ('gone@example.com', 0);
+DELETE FROM users WHERE email = 'gone@example.com';
+INSERT INTO user_states (uid, state, since_unix_s) VALUES (1, 'O', 1570000000), (2, 'I', 1570100000);
+INSERT INTO entries (uid, from_unix_s, to_unix_s, valid) VALUES (1, 1570000000, 1570003600, 1), (2, 1570010000, 1570020000, 0);
+INSERT INTO sessions (sid, uid, expires_unix_s) VALUES ('s1', 1, 1570500000);
+`
+
+func openBaselineDB(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+	if _, err = db.Exec(baselineSchema); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+var checkRegexp = regexp.MustCompile(`CHECK\s*\(`)
+
+// checks returns the CHECK constraints in a CREATE TABLE statement
+func checks(create string) (cs []string) {
+	for _, loc := range checkRegexp.FindAllStringIndex(create, -1) {
+		depth := 1
+		end := loc[1]
+		for ; end < len(create) && depth > 0; end++ {
+			switch create[end] {
+			case '(':
+				depth++
+			case ')':
+				depth--
+			}
+		}
+		cs = append(cs, strings.Join(strings.Fields(create[loc[1]:end-1]), " "))
+	}
+	return cs
+}
+
+// describeSchema returns a line for every column, foreign key, index, trigger and check of the database,
+// sorted so that the order tables and columns were made in doesn't matter
+func describeSchema(t *testing.T, db *sql.DB) []string {
+	t.Helper()
+	var lines []string
+	query := func(q string, scan func(rows *sql.Rows) string, args ...interface{}) {
+		rows, err := db.Query(q, args...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rows.Close()
+		for rows.Next() {
+			lines = append(lines, scan(rows))
+		}
+		if err = rows.Err(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var tables []string
+	query("SELECT name, sql FROM sqlite_master WHERE type = 'table' AND name != 'sqlite_sequence'",
+		func(rows *sql.Rows) string {
+			var name, create string
+			if err := rows.Scan(&name, &create); err != nil {
+				t.Fatal(err)
+			}
+			tables = append(tables, name)
+			cs := checks(create)
+			sort.Strings(cs)
+			return fmt.Sprintf("table %s checks %q", name, cs)
+		})
+	for _, table := range tables {
+		query("SELECT name, type, \"notnull\", IFNULL(dflt_value, ''), pk FROM pragma_table_info(?)",
+			func(rows *sql.Rows) string {
+				var name, typ, dflt string
+				var notNull, pk int
+				if err := rows.Scan(&name, &typ, &notNull, &dflt, &pk); err != nil {
+					t.Fatal(err)
+				}
+				return fmt.Sprintf("column %s.%s %s notnull=%d default=%s pk=%d", table, name, typ, notNull, dflt, pk)
+			}, table)
+		query("SELECT \"table\", \"from\", IFNULL(\"to\", ''), on_delete FROM pragma_foreign_key_list(?)",
+			func(rows *sql.Rows) string {
+				var parent, from, to, onDelete string
+				if err := rows.Scan(&parent, &from, &to, &onDelete); err != nil {
+					t.Fatal(err)
+				}
+				return fmt.Sprintf("foreign key %s.%s -> %s.%s on delete %s", table, from, parent, to, onDelete)
+			}, table)
+		query(`SELECT il."unique", il.origin, IFNULL(m.sql, ''), (SELECT group_concat(name) FROM pragma_index_info(il.name))
+			FROM pragma_index_list(?) il LEFT JOIN sqlite_master m ON m.name = il.name`,
+			func(rows *sql.Rows) string {
+				var unique int
+				var origin, create, columns string
+				if err := rows.Scan(&unique, &origin, &create, &columns); err != nil {
+					t.Fatal(err)
+				}
+				return fmt.Sprintf("index on %s (%s) unique=%d origin=%s %s", table, columns, unique, origin, create)
+			}, table)
+	}
+	query("SELECT name, tbl_name, sql FROM sqlite_master WHERE type = 'trigger'", func(rows *sql.Rows) string {
+		var name, table, create string
+		if err := rows.Scan(&name, &table, &create); err != nil {
+			t.Fatal(err)
+		}
+		return fmt.Sprintf("trigger %s on %s: %s", name, table, strings.Join(strings.Fields(create), " "))
+	})
+	sort.Strings(lines)
+	return lines
+}
+
+func TestMigrateBaseline(t *testing.T) {
+	db := openBaselineDB(t)
+	defer db.Close()
+	if err := migrate(db); err != nil {
+		t.Fatal(err)
+	}
+
+	fresh, err := openMemoryDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fresh.Close()
+
+	got, want := describeSchema(t, db), describeSchema(t, fresh)
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		gotSet := make(map[string]bool)
+		for _, line := range got {
+			gotSet[line] = true
+		}
+		wantSet := make(map[string]bool)
+		for _, line := range want {
+			wantSet[line] = true
+			if !gotSet[line] {
+				t.Errorf("migrated database lacks: %s", line)
+			}
+		}
+		for _, line := range got {
+			if !wantSet[line] {
+				t.Errorf("migrated database has extra: %s", line)
+			}
+		}
+	}
+
+	version, err := getSchemaVersion(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != schemaVersion {
+		t.Errorf("version is %d, want %d", version, schemaVersion)
+	}
+}
+
+func TestMigrateKeepsRows(t *testing.T) {
+	db := openBaselineDB(t)
+	defer db.Close()
+	if err := migrate(db); err != nil {
+		t.Fatal(err)
+	}
+
+	var n int
+	if err := db.QueryRow("SELECT COUNT(*) FROM entries WHERE created_unix_s = to_unix_s AND approved = 1").
+		Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("%d entries kept with created times, want 2", n)
+	}
+	var state string
+	if err := db.QueryRow("SELECT state FROM user_states WHERE uid = 2").Scan(&state); err != nil {
+		t.Fatal(err)
+	}
+	if state != "I" {
+		t.Errorf("state of user 2 is %q, want I", state)
+	}
+	var stid, weekly int
+	if err := db.QueryRow("SELECT stid, weekly_summary FROM users WHERE uid = 1").Scan(&stid, &weekly); err != nil {
+		t.Fatal(err)
+	}
+	if stid != 1 || weekly != 0 {
+		t.Errorf("user 1 has site %d and weekly summary %d, want 1 and 0", stid, weekly)
+	}
+
+	// AUTOINCREMENT still doesn't give out the uid of the deleted user
+	res, err := db.Exec("INSERT INTO users (email, admin) VALUES ('c@example.com', 0)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uid, _ := res.LastInsertId(); uid != 4 {
+		t.Errorf("new user got uid %d, want 4", uid)
+	}
+
+	// the rebuilt entries table still feeds the change feed
+	if _, err = db.Exec("UPDATE entries SET valid = 1 WHERE eid = 2"); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.QueryRow("SELECT COUNT(*) FROM entry_changes WHERE eid = 2").Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("%d changes of entry 2, want 1", n)
+	}
+}
+
+func TestMigrateCurrentIsNoop(t *testing.T) {
+	db, err := openMemoryDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = migrate(db); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = db.Exec(fmt.Sprintf("PRAGMA user_version = %d", schemaVersion+1)); err != nil {
+		t.Fatal(err)
+	}
+	if err = migrate(db); err == nil {
+		t.Error("migrating a newer database didn't fail")
+	}
+}
+
+// foreign keys hold on every connection of the pool, not only the one that opened or migrated the database
+func TestForeignKeysOnEveryConnection(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wms2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := openDB(filepath.Join(dir, "wms2.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	uid := seedUser(t, db, "a@example.com", false)
+	res, err := db.Exec("INSERT INTO entries (uid, from_unix_s, to_unix_s, valid, source, catid) VALUES (?, 0, 1, 1, 'manual', 1)", uid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	eid, err := res.LastInsertId()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// holding the connection that's open makes the pool open a fresh one
+	ctx := context.Background()
+	held, err := db.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer held.Close()
+	fresh, err := db.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fresh.Close()
+	if _, err = fresh.ExecContext(ctx, "DELETE FROM categories WHERE catid = 1"); err != nil {
+		t.Fatal(err)
+	}
+	var catid sql.NullInt64
+	if err = held.QueryRowContext(ctx, "SELECT catid FROM entries WHERE eid = ?", eid).Scan(&catid); err != nil {
+		t.Fatal(err)
+	}
+	if catid.Valid {
+		t.Errorf("the entry is still in deleted category %d", catid.Int64)
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"math"
+	"time"
+)
+
+// The monthly report workbook has a sheet per employee with a row per day, the month's totals
+// and a block for the employee and their manager to sign.
+
+// xlsxHours is seconds as hours, rounded to the minute
+func xlsxHours(s int) xlsxCell {
+	return xlsxCell{Value: math.Round(float64(s)/60) / 60}
+}
+
+func boldCells(values ...interface{}) (row []xlsxCell) {
+	for _, v := range values {
+		row = append(row, xlsxCell{Value: v, Bold: true})
+	}
+	return row
+}
+
+// monthReportSheet lays out the report of the user with the email on a sheet
+func monthReportSheet(mr monthReport, email string, loc *time.Location) xlsxSheet {
+	sh := xlsxSheet{Name: email, Widths: []float64{12, 6, 10, 10, 10}}
+	sh.Rows = append(sh.Rows,
+		boldCells("Monthly report", email),
+		[]xlsxCell{{Value: "Month"}, {Value: fmt.Sprintf("%d-%02d", mr.Year, mr.Month)}},
+		nil)
+
+	header := boldCells("Date", "Day", "Expected", "Worked", "Delta")
+	for _, b := range overtimeBuckets {
+		header = append(header, xlsxCell{Value: b.Name, Bold: true})
+		sh.Widths = append(sh.Widths, 12)
+	}
+	header = append(header, boldCells("Holiday worked", "Absent", "Notes")...)
+	sh.Widths = append(sh.Widths, 14, 10, 30)
+	sh.Rows = append(sh.Rows, header)
+
+	absent := func(m map[string]int) (s int) {
+		for _, n := range m {
+			s += n
+		}
+		return s
+	}
+	for _, d := range mr.Days {
+		date := time.Unix(d.Date, 0).In(loc)
+		row := []xlsxCell{
+			{Value: date.Format(holidayDate)},
+			{Value: date.Format("Mon")},
+			xlsxHours(d.Expected),
+			xlsxHours(d.Worked),
+			xlsxHours(d.Delta),
+		}
+		for _, b := range overtimeBuckets {
+			row = append(row, xlsxHours(d.OvertimeBuckets[b.Name]))
+		}
+		notes := ""
+		note := func(s string) {
+			if notes != "" {
+				notes += ", "
+			}
+			notes += s
+		}
+		if d.Holiday {
+			note("holiday")
+		}
+		if d.Leave != "" {
+			note(d.Leave)
+		}
+		if d.School {
+			note("school")
+		}
+		for _, kind := range []string{entrySick, entryVacation, entryOther} {
+			if d.Absent[kind] > 0 {
+				note(kind)
+			}
+		}
+		if d.WeekendUnapproved > 0 {
+			note("unapproved weekend work")
+		}
+		row = append(row, xlsxHours(d.HolidayWorked), xlsxHours(absent(d.Absent)), xlsxCell{Value: notes})
+		sh.Rows = append(sh.Rows, row)
+	}
+
+	totals := []xlsxCell{{Value: "Total", Bold: true}, {}}
+	for _, s := range []int{mr.Expected, mr.Worked, mr.Delta} {
+		totals = append(totals, xlsxCell{Value: xlsxHours(s).Value, Bold: true})
+	}
+	for _, b := range overtimeBuckets {
+		totals = append(totals, xlsxCell{Value: xlsxHours(mr.OvertimeBuckets[b.Name]).Value, Bold: true})
+	}
+	totals = append(totals,
+		xlsxCell{Value: xlsxHours(mr.HolidayWorked).Value, Bold: true},
+		xlsxCell{Value: xlsxHours(absent(mr.Absent)).Value, Bold: true})
+	sh.Rows = append(sh.Rows, totals, nil, nil,
+		[]xlsxCell{{Value: "Employee signature"}, {}, {Value: "____________________"}, {}, {Value: "Date"},
+			{Value: "__________"}},
+		nil,
+		[]xlsxCell{{Value: "Manager signature"}, {}, {Value: "____________________"}, {}, {Value: "Date"},
+			{Value: "__________"}})
+	return sh
+}
+
+// writeMonthReportXLSX writes the month reports of everyone at the site, or everyone if site is 0,
+// or just the user if uid isn't 0, as a workbook. Days are in each user's time zone.
+func writeMonthReportXLSX(db *sql.DB, w io.Writer, year int, month time.Month, uid uidT, site stidT) (err error) {
+	users, err := listReportUsers(db, uid, site)
+	if err != nil {
+		return err
+	}
+
+	sheets := []xlsxSheet{}
+	for _, u := range users {
+		mr, err := getMonthReport(db, u.UID, year, month, u.loc)
+		if err != nil {
+			return err
+		}
+		sheets = append(sheets, monthReportSheet(mr, u.Email, u.loc))
+	}
+	if len(sheets) == 0 {
+		sheets = append(sheets, xlsxSheet{Name: "Report", Rows: [][]xlsxCell{{{Value: "No employees"}}}})
+	}
+	return writeXLSX(w, sheets)
+}
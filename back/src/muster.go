@@ -0,0 +1,122 @@
+package main
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/palantir/stacktrace"
+)
+
+type musterUser struct {
+	UID         uidT   `json:"uid"`
+	Email       string `json:"email"`
+	Site        stidT  `json:"site"`        // where they were clocked in
+	LastDevice  string `json:"lastDevice"`  // name of the device of the last punch, empty if none
+	AccountedBy uidT   `json:"accountedBy"` // 0 until a warden has accounted for them
+	AccountedAt int    `json:"accountedAt"`
+}
+
+type muster struct {
+	MID       int          `json:"mid"`
+	StartedAt int          `json:"startedAt"`
+	StartedBy uidT         `json:"startedBy"`
+	Site      stidT        `json:"site"` // 0 if it covers all sites
+	Users     []musterUser `json:"users"`
+}
+
+// startMuster takes a snapshot of everyone who is clocked in right now at the site, or anywhere if stid is 0
+func startMuster(db *sql.DB, startedBy uidT, stid stidT) (mid int, err error) {
+	tx, err := db.Begin()
+	rollback := func() {
+		if err := tx.Rollback(); err != nil {
+			logError(stacktrace.Propagate(err, "failed to roll back transaction"))
+		}
+	}
+	if err != nil {
+		return mid, stacktrace.Propagate(err, "failed to begin transaction")
+	}
+
+	res, err := tx.Exec(
+		"INSERT INTO musters (started_unix_s, started_by, stid) VALUES (?1, ?2, ?3)",
+		time.Now().Unix(), startedBy, sql.NullInt64{Int64: int64(stid), Valid: stid != 0})
+	if err != nil {
+		rollback()
+		return mid, stacktrace.Propagate(err, "failed to insert muster")
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		rollback()
+		return mid, stacktrace.Propagate(err, "failed to get muster id")
+	}
+	mid = int(id)
+
+	_, err = tx.Exec(
+		`INSERT INTO muster_users (mid, uid, stid)
+			SELECT ?1, uid, stid FROM user_states
+			WHERE state IN (?2, ?4) AND (?3 = 0 OR stid = ?3)`, mid, stateIn, stid, stateBreak)
+	if err != nil {
+		rollback()
+		return mid, stacktrace.Propagate(err, "failed to snapshot clocked in users")
+	}
+
+	return mid, stacktrace.Propagate(tx.Commit(), "failed to commit transaction")
+}
+
+func getMuster(db *sql.DB, mid int) (m muster, err error) {
+	err = db.QueryRow("SELECT mid, started_unix_s, started_by, IFNULL(stid, 0) FROM musters WHERE mid = ?", mid).Scan(&m.MID, &m.StartedAt, &m.StartedBy, &m.Site)
+	if err != nil {
+		return m, stacktrace.Propagate(err, "failed to get muster")
+	}
+
+	rows, err := db.Query(
+		`SELECT muster_users.uid, users.email, IFNULL(muster_users.stid, 0),
+				IFNULL((SELECT devices.name FROM punches JOIN devices ON devices.did = punches.did
+					WHERE punches.uid = muster_users.uid ORDER BY punches.pid DESC LIMIT 1), ''),
+				IFNULL(accounted_by, 0), IFNULL(accounted_unix_s, 0)
+			FROM muster_users JOIN users ON users.uid = muster_users.uid
+			WHERE mid = ? ORDER BY muster_users.stid, users.email`, mid)
+	if err != nil {
+		return m, stacktrace.Propagate(err, "failed to get muster users")
+	}
+	defer rows.Close()
+
+	m.Users = []musterUser{}
+	for rows.Next() {
+		var mu musterUser
+		err = rows.Scan(&mu.UID, &mu.Email, &mu.Site, &mu.LastDevice, &mu.AccountedBy, &mu.AccountedAt)
+		if err != nil {
+			return m, stacktrace.Propagate(err, "failed to scan row")
+		}
+		m.Users = append(m.Users, mu)
+	}
+
+	return m, nil
+}
+
+// accountFor marks a user of a muster as accounted for, it's a no-op if they already were.
+// found is false if the user isn't part of the muster.
+func accountFor(db *sql.DB, mid int, uid, warden uidT) (found bool, err error) {
+	err = db.QueryRow("SELECT 1 FROM muster_users WHERE mid = ?1 AND uid = ?2", mid, uid).Scan(new(int))
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, stacktrace.Propagate(err, "failed to find user in muster")
+	}
+
+	_, err = db.Exec(
+		`UPDATE muster_users SET accounted_by = ?1, accounted_unix_s = ?2
+			WHERE mid = ?3 AND uid = ?4 AND accounted_by IS NULL`, warden, time.Now().Unix(), mid, uid)
+	return true, stacktrace.Propagate(err, "failed to account for user")
+}
+
+// checkWarden reports whether the user may run musters, admins always can
+func checkWarden(db *sql.DB, uid uidT) (warden bool, err error) {
+	err = db.QueryRow("SELECT admin = 1 OR warden = 1 FROM users WHERE uid = ?", uid).Scan(&warden)
+	return warden, err
+}
+
+func setWarden(db *sql.DB, uid uidT, warden bool) (err error) {
+	_, err = db.Exec("UPDATE users SET warden = ?1 WHERE uid = ?2", warden, uid)
+	return stacktrace.Propagate(err, "failed to update warden role")
+}
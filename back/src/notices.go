@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/palantir/stacktrace"
+)
+
+// formatRange formats an entry's range as e.g. "Mon Oct 14 09:00 - 17:00"
+func formatRange(from, to int) string {
+	return time.Unix(int64(from), 0).Format("Mon Jan 2 15:04") + " - " + time.Unix(int64(to), 0).Format("15:04")
+}
+
+// noticeEntryChanged tells the owner of the entry that someone else changed it from old to new,
+// or deleted it if new is nil. Changes users make to their own entries don't need a notice.
+func noticeEntryChanged(db *sql.DB, old entryRange, new *entryRange, by uidT, reason string) (err error) {
+	var uid uidT
+	var email string
+	err = entryStore.queryRow(context.TODO(), db,
+		"SELECT uid, email FROM entries JOIN users USING (uid) WHERE eid = ?", old.EID).Scan(&uid, &email)
+	if err != nil {
+		return stacktrace.Propagate(err, "failed to get owner of entry")
+	}
+	if by == uid {
+		return nil
+	}
+	byEmail, err := uidToEmail(db, by)
+	if err != nil {
+		return stacktrace.Propagate(err, "failed to get email of editor")
+	}
+
+	var subject, body string
+	if new == nil {
+		subject = "Your entry was deleted"
+		body = fmt.Sprintf("%s deleted your entry\n\n    %s\n", byEmail, formatRange(old.From, old.To))
+	} else {
+		subject = "Your entry was changed"
+		body = fmt.Sprintf("%s changed your entry\n\n    %s\n\nto\n\n    %s\n",
+			byEmail, formatRange(old.From, old.To), formatRange(new.From, new.To))
+	}
+	if reason != "" {
+		body += "\nReason: " + reason + "\n"
+	}
+
+	err = enqueueEmail(db, email, subject, body)
+	return stacktrace.Propagate(err, "failed to queue entry change notice")
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net"
+	"net/smtp"
+	"os"
+	"strings"
+
+	"github.com/palantir/stacktrace"
+)
+
+// mailer sends plain text emails through an SMTP relay
+type mailer struct {
+	addr string
+	from string
+	auth smtp.Auth
+}
+
+// newMailerFromEnv configures a mailer from the WMS2_SMTP_* environment variables,
+// it returns nil if WMS2_SMTP_ADDR isn't set, which disables sending
+func newMailerFromEnv() *mailer {
+	addr := os.Getenv("WMS2_SMTP_ADDR")
+	if addr == "" {
+		return nil
+	}
+
+	m := &mailer{addr: addr, from: os.Getenv("WMS2_SMTP_FROM")}
+	if user := os.Getenv("WMS2_SMTP_USER"); user != "" {
+		host, _, _ := net.SplitHostPort(addr)
+		m.auth = smtp.PlainAuth("", user, os.Getenv("WMS2_SMTP_PASSWORD"), host)
+	}
+	return m
+}
+
+func (m *mailer) send(to, subject, body string) error {
+	if m == nil {
+		slog.Info("mail disabled, not sending", "subject", subject, "to", to)
+		return nil
+	}
+
+	msg := strings.Join([]string{
+		"From: " + m.from,
+		"To: " + to,
+		"Subject: " + subject,
+		"Content-Type: text/plain; charset=utf-8",
+		"",
+		body,
+	}, "\r\n")
+	err := smtp.SendMail(m.addr, m.auth, m.from, []string{to}, []byte(msg))
+	return stacktrace.Propagate(err, "failed to send mail to "+to)
+}
+
+// deliverEmail is the outbox deliverer for emails
+func (m *mailer) deliverEmail(payload []byte) error {
+	var p emailPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return stacktrace.Propagate(err, "invalid email payload")
+	}
+	return m.send(p.To, p.Subject, p.Body)
+}
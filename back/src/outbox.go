@@ -0,0 +1,219 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"github.com/palantir/stacktrace"
+)
+
+// Outgoing notifications go through the outbox table instead of being sent right away,
+// so one that fails is retried and, if it keeps failing, left for an admin to look at.
+// enqueue takes an execer so events can be written in the same transaction as the change they're about.
+
+// execer is satisfied by both *sql.DB and *sql.Tx
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// outbox kinds, each needs a deliverer
+const (
+	outboxEmail   = "email"
+	outboxWebhook = "webhook" // see webhooks.go
+)
+
+// outbox statuses, see outbox.status
+const (
+	outboxPending = "pending"
+	outboxSent    = "sent"
+	outboxDead    = "dead"
+)
+
+// maxOutboxAttempts is how often delivery is tried before the event is given up on
+const maxOutboxAttempts = 8
+
+// deliverer delivers an event of one kind, given its JSON payload
+type deliverer func(payload []byte) error
+
+type outboxEvent struct {
+	OID       int    `json:"oid"`
+	Kind      string `json:"kind"`
+	Created   int    `json:"created"`
+	Attempts  int    `json:"attempts"`
+	LastError string `json:"lastError"`
+	Status    string `json:"status"`
+
+	Payload json.RawMessage `json:"payload,omitempty"` // only set by getOutboxEvent
+}
+
+type emailPayload struct {
+	To      string `json:"to"`
+	Subject string `json:"subject"`
+	Body    string `json:"body"`
+}
+
+func enqueue(ex execer, kind string, payload interface{}) (err error) {
+	js, err := json.Marshal(payload)
+	if err != nil {
+		return stacktrace.Propagate(err, "failed to marshal payload")
+	}
+
+	now := clk.Now().Unix()
+	_, err = ex.Exec(
+		`INSERT INTO outbox (kind, payload, created_unix_s, next_attempt_unix_s)
+			VALUES (?1, ?2, ?3, ?3)`, kind, string(js), now)
+	return stacktrace.Propagate(err, "failed to enqueue "+kind)
+}
+
+func enqueueEmail(ex execer, to, subject, body string) (err error) {
+	return enqueue(ex, outboxEmail, emailPayload{to, subject, body})
+}
+
+// outboxBackoff is how long to wait before the next attempt after the given number of failed ones
+func outboxBackoff(attempts int) time.Duration {
+	d := time.Minute << uint(attempts-1)
+	if d > 6*time.Hour {
+		d = 6 * time.Hour
+	}
+	return d
+}
+
+// dispatchOutbox tries to deliver every event that's due, affected is how many it tried.
+// Failed deliveries are recorded on the events, they aren't errors of the run.
+func dispatchOutbox(db *sql.DB, deliverers map[string]deliverer) (affected int, err error) {
+	now := clk.Now()
+	rows, err := db.Query(
+		`SELECT oid, kind, payload, attempts FROM outbox
+			WHERE status = ?1 AND next_attempt_unix_s <= ?2 ORDER BY oid`, outboxPending, now.Unix())
+	if err != nil {
+		return 0, stacktrace.Propagate(err, "failed to select due events")
+	}
+
+	type due struct {
+		oid      int
+		kind     string
+		payload  string
+		attempts int
+	}
+	dues := []due{}
+	for rows.Next() {
+		var d due
+		err = rows.Scan(&d.oid, &d.kind, &d.payload, &d.attempts)
+		if err != nil {
+			rows.Close()
+			return 0, stacktrace.Propagate(err, "failed to scan row")
+		}
+		dues = append(dues, d)
+	}
+	rows.Close()
+
+	for _, d := range dues {
+		deliver, ok := deliverers[d.kind]
+		if !ok {
+			err = stacktrace.NewError("no deliverer for " + d.kind)
+		} else {
+			err = deliver([]byte(d.payload))
+		}
+
+		if err == nil {
+			_, err = db.Exec("UPDATE outbox SET status = ?1, attempts = ?2, last_error = NULL WHERE oid = ?3", outboxSent, d.attempts+1, d.oid)
+			if err != nil {
+				logError(stacktrace.Propagate(err, "failed to mark event as sent"))
+			}
+			continue
+		}
+
+		logError(stacktrace.Propagate(err, "failed to deliver event %d", d.oid))
+		status := outboxPending
+		if d.attempts+1 >= maxOutboxAttempts {
+			status = outboxDead
+		}
+		_, err = db.Exec(
+			`UPDATE outbox SET status = ?1, attempts = ?2, next_attempt_unix_s = ?3, last_error = ?4
+				WHERE oid = ?5`, status, d.attempts+1, now.Add(outboxBackoff(d.attempts+1)).Unix(), stacktrace.RootCause(err).Error(), d.oid)
+		if err != nil {
+			logError(stacktrace.Propagate(err, "failed to record failed delivery"))
+		}
+	}
+
+	return len(dues), nil
+}
+
+func outboxDispatcher(db *sql.DB, deliverers map[string]deliverer) {
+	for {
+		err := pollJob(db, jobOutbox, func() (int, error) { return dispatchOutbox(db, deliverers) })
+		if err != nil {
+			logError(err)
+		}
+		if !jobSleep(30 * time.Second) {
+			return
+		}
+	}
+}
+
+// outboxFailed lists events that are dead or have failed at least once and are being retried
+const outboxFailed = "failed"
+
+// failedSQL matches the events replayOutbox accepts
+const failedSQL = "(status = 'dead' OR (status = 'pending' AND last_error IS NOT NULL))"
+
+// listOutbox lists the events with the status, or outboxFailed
+func listOutbox(db *sql.DB, status string) (evs []outboxEvent, err error) {
+	where, args := "status = ?", []interface{}{status}
+	if status == outboxFailed {
+		where, args = failedSQL, nil
+	}
+	rows, err := db.Query(
+		`SELECT oid, kind, created_unix_s, attempts, IFNULL(last_error, ''), status FROM outbox
+			WHERE `+where+` ORDER BY oid`, args...)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed to list outbox")
+	}
+	defer rows.Close()
+
+	evs = []outboxEvent{}
+	for rows.Next() {
+		var ev outboxEvent
+		err = rows.Scan(&ev.OID, &ev.Kind, &ev.Created, &ev.Attempts, &ev.LastError, &ev.Status)
+		if err != nil {
+			return nil, stacktrace.Propagate(err, "failed to scan row")
+		}
+		evs = append(evs, ev)
+	}
+	return evs, nil
+}
+
+func getOutboxEvent(db *sql.DB, oid int) (ev outboxEvent, found bool, err error) {
+	var payload string
+	err = db.QueryRow(
+		`SELECT oid, kind, created_unix_s, attempts, IFNULL(last_error, ''), status, payload FROM outbox
+			WHERE oid = ?`, oid).Scan(&ev.OID, &ev.Kind, &ev.Created, &ev.Attempts, &ev.LastError, &ev.Status, &payload)
+	if err == sql.ErrNoRows {
+		return ev, false, nil
+	}
+	ev.Payload = json.RawMessage(payload)
+	return ev, err == nil, stacktrace.Propagate(err, "failed to get outbox event")
+}
+
+// replayOutbox makes failed events due again with a fresh set of attempts,
+// oid 0 replays all of them, of the kind if one is given
+func replayOutbox(db *sql.DB, oid int, kind string) (replayed int64, err error) {
+	query := `UPDATE outbox SET status = ?1, attempts = 0, next_attempt_unix_s = ?2, last_error = NULL
+		WHERE ` + failedSQL
+	args := []interface{}{outboxPending, clk.Now().Unix()}
+	if oid != 0 {
+		query += " AND oid = ?3"
+		args = append(args, oid)
+	} else if kind != "" {
+		query += " AND kind = ?3"
+		args = append(args, kind)
+	}
+
+	res, err := db.Exec(query, args...)
+	if err != nil {
+		return 0, stacktrace.Propagate(err, "failed to replay outbox events")
+	}
+	replayed, err = res.RowsAffected()
+	return replayed, stacktrace.Propagate(err, "failed to replay outbox events")
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// overtimeBucket takes up to Max seconds of a day's overtime, the ones before it filled first
+type overtimeBucket struct {
+	Name string
+	Max  int // 0 for no limit, only for the last bucket
+}
+
+// overtimeBuckets split each day's overtime, e.g. into the first two hours paid under
+// the contract and the rest under the statutory rules, see overtimeBucketsFromEnv
+var overtimeBuckets = []overtimeBucket{{Name: "overtime"}}
+
+// overtimeBucketsFromEnv reads WMS2_OVERTIME_BUCKETS, a comma separated list of NAME:DURATION
+// like "contractual:2h,statutory", where the last bucket takes the rest and has no duration.
+// It returns the default single bucket if it isn't set.
+func overtimeBucketsFromEnv() (buckets []overtimeBucket, err error) {
+	s := os.Getenv("WMS2_OVERTIME_BUCKETS")
+	if s == "" {
+		return overtimeBuckets, nil
+	}
+
+	parts := strings.Split(s, ",")
+	for i, p := range parts {
+		name, max := strings.TrimSpace(p), ""
+		if j := strings.Index(name, ":"); j != -1 {
+			name, max = name[:j], name[j+1:]
+		}
+		if name == "" {
+			return nil, fmt.Errorf("WMS2_OVERTIME_BUCKETS: bucket %d has no name", i+1)
+		}
+
+		b := overtimeBucket{Name: name}
+		last := i == len(parts)-1
+		if max == "" && !last {
+			return nil, fmt.Errorf("WMS2_OVERTIME_BUCKETS: bucket %s needs a duration", name)
+		}
+		if max != "" {
+			if last {
+				return nil, fmt.Errorf("WMS2_OVERTIME_BUCKETS: the last bucket takes the rest, %s can't have a duration", name)
+			}
+			d, err := time.ParseDuration(max)
+			if err != nil || d <= 0 {
+				return nil, fmt.Errorf("WMS2_OVERTIME_BUCKETS: invalid duration for bucket %s", name)
+			}
+			b.Max = int(d.Seconds())
+		}
+		buckets = append(buckets, b)
+	}
+	return buckets, nil
+}
+
+// splitOvertime splits a day's delta into the overtime buckets, nothing if it isn't positive
+func splitOvertime(delta int) map[string]int {
+	split := make(map[string]int)
+	for _, b := range overtimeBuckets {
+		s := delta
+		if b.Max != 0 && s > b.Max {
+			s = b.Max
+		}
+		if s < 0 {
+			s = 0
+		}
+		split[b.Name] = s
+		delta -= s
+	}
+	return split
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/palantir/stacktrace"
+)
+
+// Payroll exports turn a month into the wage type records payroll providers import. Each pay component
+// of a user's month, like the hours worked or the days of approved vacation, is mapped to the provider's
+// wage type code, see wageTypesFromEnv. Components without a code aren't exported.
+
+// pay components besides the overtime buckets, which are components under their own names
+const (
+	payWorked        = "worked"        // hours, all of the month's work
+	payHolidayWorked = "holidayWorked" // hours worked on holidays
+	payLeavePrefix   = "leave."        // days of approved leave by type, like leave.vacation
+)
+
+type payUnit string
+
+const (
+	payHours payUnit = "H"
+	payDays  payUnit = "D"
+)
+
+// payrollFormats are the file formats of the payroll export
+const (
+	payrollDATEV = "datev" // semicolon separated with decimal commas, like DATEV's ASCII import
+	payrollFixed = "fixed" // fixed width records, like ADP's
+)
+
+// wageTypes maps pay components to wage type codes, see wageTypesFromEnv
+var wageTypes = map[string]string{}
+
+// wageTypesFromEnv reads WMS2_WAGE_TYPES, a comma separated list of COMPONENT:CODE like
+// "worked:1000,overtime:1200,holidayWorked:1300,sick:2000,leave.vacation:3000". Components are worked,
+// holidayWorked, the overtime buckets (see WMS2_OVERTIME_BUCKETS), the entry kinds besides work
+// (hours) and leave. followed by a leave type (days). Codes are at most 6 characters.
+func wageTypesFromEnv() (types map[string]string, err error) {
+	types = map[string]string{}
+	s := os.Getenv("WMS2_WAGE_TYPES")
+	if s == "" {
+		return types, nil
+	}
+
+	for _, p := range strings.Split(s, ",") {
+		p = strings.TrimSpace(p)
+		i := strings.Index(p, ":")
+		if i < 1 || i == len(p)-1 {
+			return nil, fmt.Errorf("WMS2_WAGE_TYPES: %q has to be like worked:1000", p)
+		}
+		component, code := p[:i], p[i+1:]
+		if len(code) > 6 || strings.ContainsAny(code, "; ") {
+			return nil, fmt.Errorf("WMS2_WAGE_TYPES: code %q has to be at most 6 characters without spaces", code)
+		}
+		if !isPayComponent(component) {
+			return nil, fmt.Errorf("WMS2_WAGE_TYPES: unknown pay component %q", component)
+		}
+		types[component] = code
+	}
+	return types, nil
+}
+
+func isPayComponent(component string) bool {
+	switch component {
+	case payWorked, payHolidayWorked, entrySick, entryVacation, entryOther:
+		return true
+	case payLeavePrefix + leaveVacation, payLeavePrefix + leaveSick, payLeavePrefix + leaveOther:
+		return true
+	}
+	for _, b := range overtimeBuckets {
+		if component == b.Name {
+			return true
+		}
+	}
+	return false
+}
+
+// payRecord is a quantity of a wage type for a user, hours or days in hundredths
+type payRecord struct {
+	PayrollID string
+	WageType  string
+	Quantity  int
+	Unit      payUnit
+}
+
+// payRecords are the records of the user's month that have a wage type, in the order of components
+func payRecords(u reportUser, mr monthReport, loc *time.Location) (prs []payRecord) {
+	add := func(component string, quantity int, unit payUnit) {
+		code, ok := wageTypes[component]
+		if !ok || quantity == 0 {
+			return
+		}
+		prs = append(prs, payRecord{u.PayrollID, code, quantity, unit})
+	}
+	hours := func(s int) int {
+		return (s*100 + 1800) / 3600
+	}
+
+	add(payWorked, hours(mr.Worked), payHours)
+	for _, b := range overtimeBuckets {
+		add(b.Name, hours(mr.OvertimeBuckets[b.Name]), payHours)
+	}
+	add(payHolidayWorked, hours(mr.HolidayWorked), payHours)
+	for _, kind := range []string{entrySick, entryVacation, entryOther} {
+		add(kind, hours(mr.Absent[kind]), payHours)
+	}
+
+	// leave counts in working days, weekends and holidays off don't use it up
+	leaveDays := map[string]int{}
+	for _, d := range mr.Days {
+		if d.Leave != "" && !d.Holiday && !isWeekend(time.Unix(d.Date, 0).In(loc)) {
+			leaveDays[d.Leave]++
+		}
+	}
+	for _, t := range []string{leaveVacation, leaveSick, leaveOther} {
+		add(payLeavePrefix+t, leaveDays[t]*100, payDays)
+	}
+	return prs
+}
+
+// formatPayRecord formats the record as a line of the format for the month
+func formatPayRecord(pr payRecord, format string, year int, month time.Month) string {
+	switch format {
+	case payrollFixed:
+		// payroll id (10, zero padded), period YYYYMM, wage type (6, space padded), quantity (9, hundredths), unit
+		id := pr.PayrollID
+		if len(id) < 10 {
+			id = strings.Repeat("0", 10-len(id)) + id
+		}
+		return fmt.Sprintf("%.10s%04d%02d%-6s%09d%s", id, year, month, pr.WageType, pr.Quantity, pr.Unit)
+	default:
+		return fmt.Sprintf("%s;%02d/%04d;%s;%d,%02d;%s",
+			pr.PayrollID, month, year, pr.WageType, pr.Quantity/100, pr.Quantity%100, pr.Unit)
+	}
+}
+
+// writePayrollExport writes the pay records of the month of everyone at the site, or everyone if site is 0,
+// in the format. Days are in each user's time zone.
+func writePayrollExport(db *sql.DB, w io.Writer, year int, month time.Month, site stidT, format string) (err error) {
+	users, err := listReportUsers(db, 0, site)
+	if err != nil {
+		return err
+	}
+
+	var b strings.Builder
+	if format == payrollDATEV {
+		b.WriteString("payroll id;period;wage type;quantity;unit\r\n")
+	}
+	for _, u := range users {
+		mr, err := getMonthReport(db, u.UID, year, month, u.loc)
+		if err != nil {
+			return err
+		}
+		for _, pr := range payRecords(u, mr, u.loc) {
+			b.WriteString(formatPayRecord(pr, format, year, month) + "\r\n")
+		}
+	}
+	_, err = io.WriteString(w, b.String())
+	return stacktrace.Propagate(err, "failed to write payroll export")
+}
+
+func setPayrollID(db *sql.DB, uid uidT, payrollID string) (found bool, err error) {
+	var id interface{}
+	if payrollID != "" {
+		id = payrollID
+	}
+	res, err := db.Exec("UPDATE users SET payroll_id = ?1 WHERE uid = ?2", id, uid)
+	if err != nil {
+		return false, stacktrace.Propagate(err, "failed to set payroll id")
+	}
+	n, err := res.RowsAffected()
+	return n == 1, stacktrace.Propagate(err, "failed to set payroll id")
+}
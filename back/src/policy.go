@@ -0,0 +1,158 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/AndrewBurian/powermux"
+	"github.com/palantir/stacktrace"
+)
+
+// Who may use the admin (/a) and warden (/w) routes is up to the access policy. It maps routes like
+// "GET /a/users/:id/entries" to what the caller needs, any one of which will do. Methods can be *
+// for all of them and routes can end in /* for everything under them, the most specific rule wins.
+// The defaults are that auditors may read /a, admins may also change things and wardens may use /w.
+// Only admins get the approvals inbox, it's the queue of what they decide.
+// WMS2_POLICY names a JSON file with rules that add to or replace them, like
+//
+//	{"GET /a/users/:id/reports/probation": ["admin", "sponsor-of-target"]}
+
+// what a rule can require
+const (
+	policyAdmin   = "admin"
+	policyAuditor = "auditor" // or admin, see checkAuditor
+	policyWarden  = "warden"  // or admin, see checkWarden
+	policyAnyone  = "anyone"  // any signed in user
+	policySelf    = "self"    // the caller is the user of the route's /users/:id
+	policySponsor = "sponsor-of-target"
+)
+
+// policyRelationships are the requirements about the user of the route's /users/:id
+var policyRelationships = map[string]bool{policySelf: true, policySponsor: true}
+
+var policyRoles = map[string]bool{policyAdmin: true, policyAuditor: true, policyWarden: true, policyAnyone: true}
+
+type accessPolicy map[string][]string
+
+func defaultAccessPolicy() accessPolicy {
+	return accessPolicy{
+		"GET /a/*":     {policyAuditor},
+		"* /a/*":       {policyAdmin},
+		"* /w/*":       {policyWarden},
+		"GET /a/inbox": {policyAdmin},
+	}
+}
+
+var policy = defaultAccessPolicy()
+
+// policyFromEnv reads the rules in the file WMS2_POLICY names on top of the defaults
+func policyFromEnv() (p accessPolicy, err error) {
+	p = defaultAccessPolicy()
+	path := os.Getenv("WMS2_POLICY")
+	if path == "" {
+		return p, nil
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed to read WMS2_POLICY")
+	}
+	rules := accessPolicy{}
+	err = json.Unmarshal(b, &rules)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "WMS2_POLICY has to be a JSON object of rules")
+	}
+	for key, reqs := range rules {
+		if err = checkPolicyRule(key, reqs); err != nil {
+			return nil, err
+		}
+		p[key] = reqs
+	}
+	return p, nil
+}
+
+// checkPolicyRule checks that the key looks like "GET /a/users/:id" and that the requirements exist,
+// relationships only make sense on routes of a user
+func checkPolicyRule(key string, reqs []string) error {
+	parts := strings.SplitN(key, " ", 2)
+	if len(parts) != 2 || parts[0] == "" || !strings.HasPrefix(parts[1], "/") {
+		return stacktrace.NewError("policy rule %q has to look like \"GET /a/users/:id\"", key)
+	}
+	if len(reqs) == 0 {
+		return stacktrace.NewError("policy rule %q has no requirements, use %q to let everyone in", key, policyAnyone)
+	}
+	for _, req := range reqs {
+		if policyRelationships[req] && !strings.Contains(parts[1]+"/", "/users/:id/") {
+			return stacktrace.NewError("policy rule %q needs a /users/:id route for %q", key, req)
+		}
+		if !policyRoles[req] && !policyRelationships[req] {
+			return stacktrace.NewError("policy rule %q has unknown requirement %q", key, req)
+		}
+	}
+	return nil
+}
+
+// rule returns the requirements of the most specific rule for the request to the route,
+// ok is false if there's none. HEAD requests go by the rules for GET.
+func (p accessPolicy) rule(method, route string) (reqs []string, ok bool) {
+	if method == http.MethodHead {
+		method = http.MethodGet
+	}
+	for path := route; ; {
+		for _, m := range []string{method, "*"} {
+			if reqs, ok = p[m+" "+path]; ok {
+				return reqs, true
+			}
+		}
+		i := strings.LastIndex(strings.TrimSuffix(path, "/*"), "/")
+		if i < 0 {
+			return nil, false
+		}
+		path = path[:i] + "/*"
+	}
+}
+
+// routeUser is the user of the request's /users/:id route, 0 if it isn't one
+func routeUser(r *http.Request) uidT {
+	id, err := strconv.Atoi(powermux.PathParam(r, "id"))
+	if err != nil || !strings.Contains(powermux.RequestPath(r)+"/", "/users/:id/") {
+		return 0
+	}
+	return uidT(id)
+}
+
+// checkPolicy reports whether the user meets any of the requirements, target is the user of the
+// route's /users/:id, 0 if it has none
+func checkPolicy(db *sql.DB, uid uidT, reqs []string, target uidT) (allowed bool, err error) {
+	for _, req := range reqs {
+		switch req {
+		case policyAnyone:
+			allowed = true
+		case policyAdmin:
+			allowed, err = checkAdmin(db, uid)
+		case policyAuditor:
+			allowed, err = checkAuditor(db, uid)
+		case policyWarden:
+			allowed, err = checkWarden(db, uid)
+		case policySelf:
+			allowed = target != 0 && target == uid
+		case policySponsor:
+			err = db.QueryRow("SELECT sponsor IS ?1 FROM users WHERE uid = ?2", uid, target).Scan(&allowed)
+			if err == sql.ErrNoRows {
+				allowed, err = false, nil
+			}
+		}
+		if err != nil {
+			return false, stacktrace.Propagate(err, "failed to check "+req)
+		}
+		if allowed {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPolicyRule(t *testing.T) {
+	p := defaultAccessPolicy()
+	p["PUT /a/users/:id/target"] = []string{policyAuditor}
+	p["* /a/users/*"] = []string{policyWarden}
+	p["GET /a/users/:id/reports/*"] = []string{policySelf}
+	p["GET /a/users/:id/reports/probation"] = []string{policyAdmin, policySponsor}
+	p["POST /a/users/:id/reports/*"] = []string{policyAnyone}
+
+	for _, c := range []struct {
+		method, route string
+		want          []string // nil if no rule applies
+	}{
+		// the defaults
+		{"GET", "/a/entries/recent", []string{policyAuditor}},
+		{"GET", "/a/inbox", []string{policyAdmin}},
+		{"PUT", "/a/entries/:id", []string{policyAdmin}},
+		{"DELETE", "/a/entries/:id", []string{policyAdmin}},
+		{"POST", "/w/musters", []string{policyWarden}},
+		{"GET", "/w/musters/:id", []string{policyWarden}},
+		{"GET", "/u/status", nil},
+		{"GET", "/a", nil},
+
+		// HEAD goes by GET, other methods don't
+		{"HEAD", "/a/entries/recent", []string{policyAuditor}},
+		{"HEAD", "/a/users/:id/reports/probation", []string{policyAdmin, policySponsor}},
+		{"OPTIONS", "/a/entries/recent", []string{policyAdmin}},
+
+		// an exact route beats everything under a path, a method beats * on the same path
+		{"PUT", "/a/users/:id/target", []string{policyAuditor}},
+		{"GET", "/a/users/:id/target", []string{policyWarden}},
+		{"GET", "/a/users/:id/reports/probation", []string{policyAdmin, policySponsor}},
+		{"GET", "/a/users/:id/reports/month", []string{policySelf}},
+		{"POST", "/a/users/:id/reports/month", []string{policyAnyone}},
+
+		// a more specific path beats a method, falling back /* by /*
+		{"PUT", "/a/users/:id/reports/month", []string{policyWarden}},
+		{"GET", "/a/users/:id", []string{policyWarden}},
+		{"GET", "/a/users", []string{policyAuditor}},
+	} {
+		got, ok := p.rule(c.method, c.route)
+		if ok != (c.want != nil) || !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s %s: got %v (%t), want %v", c.method, c.route, got, ok, c.want)
+		}
+	}
+}
+
+func TestCheckPolicyRule(t *testing.T) {
+	for _, c := range []struct {
+		key  string
+		reqs []string
+		ok   bool
+	}{
+		{"GET /a/users/:id/entries", []string{policySelf, policyAuditor}, true},
+		{"* /a/users/:id", []string{policySponsor}, true},
+		{"GET /a/*", []string{policyAnyone}, true},
+		{"GET /a/entries", []string{policySelf}, false}, // no user to be
+		{"GET /a/users", []string{policySponsor}, false},
+		{"GET /a/users/:idle", []string{policySelf}, false},
+		{"GET /a/entries", []string{}, false},
+		{"GET /a/entries", []string{"manager-of-target"}, false},
+		{"GET", []string{policyAdmin}, false},
+		{"/a/entries", []string{policyAdmin}, false},
+		{" /a/entries", []string{policyAdmin}, false},
+		{"GET a/entries", []string{policyAdmin}, false},
+	} {
+		if err := checkPolicyRule(c.key, c.reqs); (err == nil) != c.ok {
+			t.Errorf("%q %v: got %v, want ok %t", c.key, c.reqs, err, c.ok)
+		}
+	}
+}
+
+func TestPolicyFromEnv(t *testing.T) {
+	dir, err := ioutil.TempDir("", "policy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	saved, wasSet := os.LookupEnv("WMS2_POLICY")
+	defer func() {
+		if wasSet {
+			os.Setenv("WMS2_POLICY", saved)
+		} else {
+			os.Unsetenv("WMS2_POLICY")
+		}
+	}()
+
+	os.Unsetenv("WMS2_POLICY")
+	p, err := policyFromEnv()
+	if err != nil || !reflect.DeepEqual(p, defaultAccessPolicy()) {
+		t.Errorf("without WMS2_POLICY got %v, %v, want the defaults", p, err)
+	}
+
+	for _, c := range []struct {
+		json string
+		ok   bool
+	}{
+		{`{"GET /a/*": ["admin"], "GET /a/users/:id/entries": ["self", "auditor"]}`, true},
+		{`{"GET /a/entries": ["self"]}`, false},
+		{`{"GET /a/entries": "admin"}`, false},
+		{`not json`, false},
+	} {
+		path := filepath.Join(dir, "policy.json")
+		if err = ioutil.WriteFile(path, []byte(c.json), 0600); err != nil {
+			t.Fatal(err)
+		}
+		os.Setenv("WMS2_POLICY", path)
+		p, err = policyFromEnv()
+		if (err == nil) != c.ok {
+			t.Errorf("%s: got %v, want ok %t", c.json, err, c.ok)
+		}
+	}
+
+	// a valid file replaces the defaults it has rules for and adds the others
+	os.Setenv("WMS2_POLICY", filepath.Join(dir, "valid.json"))
+	ioutil.WriteFile(filepath.Join(dir, "valid.json"), []byte(`{"GET /a/*": ["admin"], "GET /a/users/:id/entries": ["self"]}`), 0600)
+	p, err = policyFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := defaultAccessPolicy()
+	want["GET /a/*"] = []string{policyAdmin}
+	want["GET /a/users/:id/entries"] = []string{policySelf}
+	if !reflect.DeepEqual(p, want) {
+		t.Errorf("got %v, want %v", p, want)
+	}
+
+	os.Setenv("WMS2_POLICY", filepath.Join(dir, "missing.json"))
+	if _, err = policyFromEnv(); err == nil {
+		t.Error("a missing policy file didn't fail")
+	}
+}
+
+// the policy decides who gets past requirePolicy, by role and by relationship to the route's user
+func TestRequirePolicy(t *testing.T) {
+	db, done := newTestDB(t, time.Now())
+	defer done()
+	h := newTestServer(db)
+	admin := seedUser(t, db, "admin@example.com", true)
+	auditor := seedUser(t, db, "auditor@example.com", false)
+	warden := seedUser(t, db, "warden@example.com", false)
+	sponsor := seedUser(t, db, "sponsor@example.com", false)
+	contractor := seedUser(t, db, "contractor@example.com", false)
+	plain := seedUser(t, db, "plain@example.com", false)
+	if _, err := db.Exec("UPDATE users SET auditor = 1 WHERE uid = ?", auditor); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("UPDATE users SET warden = 1 WHERE uid = ?", warden); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("UPDATE users SET sponsor = ? WHERE uid = ?", sponsor, contractor); err != nil {
+		t.Fatal(err)
+	}
+	auth := map[uidT]string{}
+	for _, uid := range []uidT{admin, auditor, warden, sponsor, contractor, plain} {
+		auth[uid] = seedSession(t, db, uid)
+	}
+
+	saved := policy
+	defer func() { policy = saved }()
+	check := func(name string, uid uidT, method, path string, allowed bool) {
+		t.Helper()
+		w := serve(h, method, path, auth[uid], nil)
+		if (w.Code != 401) != allowed {
+			t.Errorf("%s: %s %s by %d got %d, want allowed %t", name, method, path, uid, w.Code, allowed)
+		}
+	}
+
+	policy = defaultAccessPolicy()
+	check("defaults", auditor, "GET", "/a/entries/recent", true)
+	check("defaults", auditor, "HEAD", "/a/entries/recent", true)
+	check("defaults", auditor, "PUT", fmt.Sprintf("/a/users/%d/target", plain), false)
+	check("defaults", admin, "GET", "/a/entries/recent", true)
+	check("defaults", admin, "PUT", fmt.Sprintf("/a/users/%d/target", plain), true)
+	check("defaults", plain, "GET", "/a/entries/recent", false)
+	check("defaults", plain, "GET", fmt.Sprintf("/a/users/%d/entries", plain), false)
+	check("defaults", warden, "GET", "/a/entries/recent", false)
+	check("defaults", warden, "POST", "/w/musters", true)
+	check("defaults", admin, "POST", "/w/musters", true)
+	check("defaults", auditor, "POST", "/w/musters", false)
+
+	policy = defaultAccessPolicy()
+	policy["GET /a/users/:id/entries"] = []string{policySelf, policyAuditor}
+	policy["GET /a/users/:id/reports/probation"] = []string{policyAdmin, policySponsor}
+	check("self", plain, "GET", fmt.Sprintf("/a/users/%d/entries", plain), true)
+	check("self", plain, "GET", fmt.Sprintf("/a/users/%d/entries", contractor), false)
+	check("self", auditor, "GET", fmt.Sprintf("/a/users/%d/entries", contractor), true)
+	check("self", plain, "GET", fmt.Sprintf("/a/users/%d/entries/deleted", plain), false)
+	check("sponsor", sponsor, "GET", fmt.Sprintf("/a/users/%d/reports/probation", contractor), true)
+	check("sponsor", sponsor, "GET", fmt.Sprintf("/a/users/%d/reports/probation", plain), false)
+	check("sponsor", sponsor, "GET", "/a/users/999/reports/probation", false)
+	check("sponsor", contractor, "GET", fmt.Sprintf("/a/users/%d/reports/probation", contractor), false)
+	check("sponsor", auditor, "GET", fmt.Sprintf("/a/users/%d/reports/probation", contractor), false)
+	check("sponsor", admin, "GET", fmt.Sprintf("/a/users/%d/reports/probation", contractor), true)
+
+	// without a session nothing gets that far
+	if w := serve(h, "GET", "/a/entries/recent", "", nil); w.Code != 401 {
+		t.Errorf("no session got %d", w.Code)
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/palantir/stacktrace"
+)
+
+// Presence devices, e.g. a Home Assistant instance, report people entering or leaving the office.
+// What happens then is up to each user: nothing, a suggested punch they can accept later, or a punch.
+
+// presence modes, see users.presence
+const (
+	presenceOff     = "off"
+	presenceSuggest = "suggest"
+	presencePunch   = "punch"
+)
+
+// what handlePresence did with an event
+const (
+	presenceIgnored   = "ignored"
+	presenceSuggested = "suggested"
+	presencePunched   = "punched"
+)
+
+const (
+	suggestionPending   = "pending"
+	suggestionAccepted  = "accepted"
+	suggestionDismissed = "dismissed"
+)
+
+type punchSuggestion struct {
+	PSID int       `json:"psid"`
+	Kind userState `json:"kind"` // the state the user would move to
+	At   int       `json:"at"`
+}
+
+func setPresenceMode(db *sql.DB, uid uidT, mode string) (err error) {
+	_, err = db.Exec("UPDATE users SET presence = ?1 WHERE uid = ?2", mode, uid)
+	return stacktrace.Propagate(err, "failed to update presence mode")
+}
+
+// handlePresence acts on the user entering (kind is stateIn) or leaving (stateOut) as seen by the device did
+func handlePresence(ctx context.Context, db *sql.DB, did didT, uid uidT, kind userState) (action string, err error) {
+	var mode string
+	var state userState
+	err = db.QueryRowContext(ctx,
+		`SELECT presence, state FROM users JOIN user_states USING (uid) WHERE uid = ?`, uid).Scan(&mode, &state)
+	if err != nil {
+		return "", stacktrace.Propagate(err, "failed to get presence mode")
+	}
+
+	if mode == presenceOff || state == kind {
+		return presenceIgnored, nil
+	}
+
+	if mode == presencePunch {
+		if kind == stateIn {
+			err = clockIn(ctx, db, uid, did, 0)
+		} else {
+			err = clockOut(ctx, db, uid, did)
+		}
+		return presencePunched, err
+	}
+
+	// only the latest suggestion can still make sense
+	_, err = db.ExecContext(ctx,
+		"UPDATE punch_suggestions SET status = ?1 WHERE uid = ?2 AND status = ?3", suggestionDismissed, uid, suggestionPending)
+	if err != nil {
+		return "", stacktrace.Propagate(err, "failed to dismiss old suggestions")
+	}
+	_, err = db.ExecContext(ctx,
+		`INSERT INTO punch_suggestions (uid, did, kind, at_unix_s)
+			VALUES (?1, ?2, ?3, ?4)`, uid, did, kind, clk.Now().Unix())
+	return presenceSuggested, stacktrace.Propagate(err, "failed to insert punch suggestion")
+}
+
+func listPendingSuggestions(db *sql.DB, uid uidT) (pss []punchSuggestion, err error) {
+	rows, err := db.Query(
+		`SELECT psid, kind, at_unix_s FROM punch_suggestions
+			WHERE uid = ?1 AND status = ?2 ORDER BY at_unix_s`, uid, suggestionPending)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed to list punch suggestions")
+	}
+	defer rows.Close()
+
+	pss = []punchSuggestion{}
+	for rows.Next() {
+		var ps punchSuggestion
+		err = rows.Scan(&ps.PSID, &ps.Kind, &ps.At)
+		if err != nil {
+			return nil, stacktrace.Propagate(err, "failed to scan row")
+		}
+		pss = append(pss, ps)
+	}
+	return pss, nil
+}
+
+func dismissSuggestion(db *sql.DB, uid uidT, psid int) (found bool, err error) {
+	res, err := db.Exec(
+		"UPDATE punch_suggestions SET status = ?1 WHERE psid = ?2 AND uid = ?3 AND status = ?4",
+		suggestionDismissed, psid, uid, suggestionPending)
+	if err != nil {
+		return false, stacktrace.Propagate(err, "failed to dismiss punch suggestion")
+	}
+	n, err := res.RowsAffected()
+	return n == 1, stacktrace.Propagate(err, "failed to dismiss punch suggestion")
+}
+
+// acceptSuggestion punches as of when the presence event happened.
+// found is false if there's no such pending suggestion or the user has punched since.
+func acceptSuggestion(ctx context.Context, db *sql.DB, uid uidT, psid int) (found bool, err error) {
+	var did didT
+	var kind, state userState
+	var at, since int64
+	err = db.QueryRowContext(ctx,
+		`SELECT did, kind, at_unix_s, state, since_unix_s FROM punch_suggestions JOIN user_states USING (uid)
+			WHERE psid = ?1 AND uid = ?2 AND status = ?3`, psid, uid, suggestionPending).Scan(&did, &kind, &at, &state, &since)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, stacktrace.Propagate(err, "failed to get punch suggestion")
+	}
+	if state == kind || since > at {
+		return false, nil
+	}
+
+	if kind == stateIn {
+		err = clockInAt(ctx, db, uid, did, 0, at)
+	} else {
+		err = clockOutAt(ctx, db, uid, did, at)
+	}
+	if err != nil {
+		return false, err
+	}
+
+	_, err = db.ExecContext(ctx, "UPDATE punch_suggestions SET status = ?1 WHERE psid = ?2", suggestionAccepted, psid)
+	return true, stacktrace.Propagate(err, "failed to accept punch suggestion")
+}
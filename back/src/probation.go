@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/palantir/stacktrace"
+)
+
+// Users are on probation for probationMonths from their hire date (users.hired_date). While they are,
+// the admins' exception digest has a line on how punctual they are and how often they were absent,
+// and the probation report has the details.
+
+const defaultProbationMonths = 6
+
+var probationMonths = defaultProbationMonths
+
+// probationMonthsFromEnv reads WMS2_PROBATION_MONTHS, how long probation lasts
+func probationMonthsFromEnv() int {
+	s := os.Getenv("WMS2_PROBATION_MONTHS")
+	if s == "" {
+		return defaultProbationMonths
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n <= 0 {
+		logWarning(stacktrace.NewError("invalid WMS2_PROBATION_MONTHS %q, using %d", s, defaultProbationMonths))
+		return defaultProbationMonths
+	}
+	return n
+}
+
+const defaultStartBy = 9 * 60 * 60
+
+// startBy is the latest a working day's first work entry may start to be on time, in seconds after midnight
+var startBy = defaultStartBy
+
+// startByFromEnv reads WMS2_START_BY, a time of day like 09:00
+func startByFromEnv() int {
+	s := os.Getenv("WMS2_START_BY")
+	if s == "" {
+		return defaultStartBy
+	}
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		logWarning(stacktrace.NewError("invalid WMS2_START_BY %q, using 09:00", s))
+		return defaultStartBy
+	}
+	return t.Hour()*60*60 + t.Minute()*60
+}
+
+// setHired sets the day the user was hired, like 2026-04-01, empty if it isn't known.
+// found is false if there's no such user.
+func setHired(db *sql.DB, uid uidT, date string) (found bool, err error) {
+	var dateValue interface{}
+	if date != "" {
+		dateValue = date
+	}
+	res, err := db.Exec("UPDATE users SET hired_date = ?1 WHERE uid = ?2", dateValue, uid)
+	if err != nil {
+		return false, stacktrace.Propagate(err, "failed to set hire date")
+	}
+	n, err := res.RowsAffected()
+	return n == 1, stacktrace.Propagate(err, "failed to get rows affected")
+}
+
+// probationReport is how a user did during probation, up to a day. Working days are those something
+// was expected on, absences are days with sick, vacation or other entries.
+type probationReport struct {
+	UID          uidT           `json:"uid"`
+	Email        string         `json:"email"`
+	Hired        string         `json:"hired"`        // like 2026-04-01
+	Ends         string         `json:"ends"`         // the last day of probation
+	WorkingDays  int            `json:"workingDays"`  // up to the day of the report
+	Late         int            `json:"late"`         // working days the first work entry started after startBy
+	LateDates    []string       `json:"lateDates"`    // which ones
+	AverageStart int            `json:"averageStart"` // of the first work entries of working days, seconds after midnight
+	Absent       int            `json:"absent"`       // days
+	Absences     map[string]int `json:"absences"`     // days by kind
+	Missed       int            `json:"missed"`       // past working days without any entries or leave
+	Worked       int            `json:"worked"`
+	Delta        int            `json:"delta"`
+}
+
+// onProbation is whether the report's user is still on probation on the day of date, like 2026-04-01
+func (pr probationReport) onProbation(date string) bool {
+	return pr.Hired <= date && date <= pr.Ends
+}
+
+// getProbationReport reports on the user's probation up to and including the day of at, in their time zone.
+// found is false if there's no such user or they have no hire date.
+func getProbationReport(db *sql.DB, uid uidT, at time.Time) (pr probationReport, found bool, err error) {
+	var hired sql.NullString
+	err = db.QueryRow("SELECT email, hired_date FROM users WHERE uid = ?", uid).Scan(&pr.Email, &hired)
+	if err == sql.ErrNoRows || (err == nil && !hired.Valid) {
+		return pr, false, nil
+	}
+	if err != nil {
+		return pr, false, stacktrace.Propagate(err, "failed to get hire date")
+	}
+
+	loc, err := userLocation(context.TODO(), db, uid)
+	if err != nil {
+		return pr, false, err
+	}
+	from, err := time.ParseInLocation(holidayDate, hired.String, loc)
+	if err != nil {
+		return pr, false, stacktrace.Propagate(err, "invalid hire date")
+	}
+	end := from.AddDate(0, probationMonths, 0)
+	pr.UID = uid
+	pr.Hired = hired.String
+	pr.Ends = end.AddDate(0, 0, -1).Format(holidayDate)
+	pr.LateDates = []string{}
+	pr.Absences = make(map[string]int)
+
+	at = at.In(loc)
+	today := time.Date(at.Year(), at.Month(), at.Day(), 0, 0, 0, 0, loc)
+	if next := today.AddDate(0, 0, 1); next.Before(end) {
+		end = next
+	}
+	days := 0
+	for x := from; x.Before(end); x = x.AddDate(0, 0, 1) {
+		days++
+	}
+	if days == 0 {
+		return pr, true, nil
+	}
+
+	drs, err := getDayReports(db, uid, from, days)
+	if err != nil {
+		return pr, false, err
+	}
+
+	starts := 0
+	for _, dr := range drs {
+		pr.Worked += dr.Worked
+		pr.Delta += dr.Delta
+		for kind := range dr.Absent {
+			pr.Absences[kind]++
+		}
+		if len(dr.Absent) > 0 {
+			pr.Absent++
+		}
+		if dr.Expected == 0 {
+			continue
+		}
+		pr.WorkingDays++
+
+		date := time.Unix(dr.Date, 0).In(loc)
+		if len(dr.Entries) == 0 && dr.Leave == "" && date.Before(today) {
+			pr.Missed++
+		}
+		for _, en := range dr.Entries {
+			if en.Kind != entryWork {
+				continue
+			}
+			start := en.From - int(dr.Date)
+			if start > startBy {
+				pr.Late++
+				pr.LateDates = append(pr.LateDates, date.Format(holidayDate))
+			}
+			pr.AverageStart += start
+			starts++
+			break
+		}
+	}
+	if starts > 0 {
+		pr.AverageStart /= starts
+	}
+	return pr, true, nil
+}
+
+// listProbationReports reports on everyone who's on probation on the day of at, ordered by email
+func listProbationReports(db *sql.DB, at time.Time) (prs []probationReport, err error) {
+	rows, err := db.Query("SELECT uid FROM users WHERE hired_date IS NOT NULL ORDER BY email")
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed to list hired users")
+	}
+	uids := []uidT{}
+	for rows.Next() {
+		var uid uidT
+		err = rows.Scan(&uid)
+		if err != nil {
+			rows.Close()
+			return nil, stacktrace.Propagate(err, "failed to scan row")
+		}
+		uids = append(uids, uid)
+	}
+	rows.Close()
+
+	prs = []probationReport{}
+	for _, uid := range uids {
+		pr, found, err := getProbationReport(db, uid, at)
+		if err != nil {
+			return nil, err
+		}
+		loc, err := userLocation(context.TODO(), db, uid)
+		if err != nil {
+			return nil, err
+		}
+		if found && pr.onProbation(at.In(loc).Format(holidayDate)) {
+			prs = append(prs, pr)
+		}
+	}
+	return prs, nil
+}
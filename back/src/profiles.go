@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"time"
+
+	"github.com/palantir/stacktrace"
+)
+
+// Schedule profiles temporarily replace the daily target of a group of users, like 6 hours
+// during Ramadan or short Fridays over the summer. A profile covers its members and, if it has a site,
+// everyone at the site. Where profiles overlap the newest one counts.
+
+type spidT int
+
+// maxProfileDays is the longest a schedule profile can last
+const maxProfileDays = 366
+
+type scheduleProfile struct {
+	SPID     spidT    `json:"spid"`
+	Name     string   `json:"name"`
+	From     string   `json:"from"` // like holiday.Date
+	To       string   `json:"to"`   // inclusive
+	Target   int      `json:"target"`
+	Weekdays []string `json:"weekdays"` // like "fri", the days of the week it covers, all of them if empty
+	Site     stidT    `json:"site"`     // 0 if it doesn't cover a site
+	Users    []uidT   `json:"users"`
+}
+
+var weekdayNames = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// weekdayMask is schedule_profiles.weekdays of the names, all days if there are none
+func weekdayMask(names []string) (mask int, err error) {
+	if len(names) == 0 {
+		return 1<<7 - 1, nil
+	}
+	for _, name := range names {
+		found := false
+		for d, n := range weekdayNames {
+			if strings.EqualFold(name, n) {
+				mask |= 1 << uint(d)
+				found = true
+			}
+		}
+		if !found {
+			return 0, stacktrace.NewError("weekdays have to be like mon,fri")
+		}
+	}
+	return mask, nil
+}
+
+func weekdaysOf(mask int) (names []string) {
+	names = []string{}
+	if mask == 1<<7-1 {
+		return names
+	}
+	for d, n := range weekdayNames {
+		if mask&(1<<uint(d)) != 0 {
+			names = append(names, n)
+		}
+	}
+	return names
+}
+
+func (sp scheduleProfile) validate() error {
+	if sp.Name == "" {
+		return stacktrace.NewError("profile needs a name")
+	}
+	if err := checkText("name", sp.Name, maxNameLength); err != nil {
+		return err
+	}
+	from, err := time.Parse(holidayDate, sp.From)
+	if err != nil {
+		return stacktrace.NewError("from has to be like 2019-10-03")
+	}
+	to, err := time.Parse(holidayDate, sp.To)
+	if err != nil {
+		return stacktrace.NewError("to has to be like 2019-10-03")
+	}
+	if to.Before(from) {
+		return stacktrace.NewError("to can't be before from")
+	}
+	if to.Sub(from) >= maxProfileDays*24*time.Hour {
+		return stacktrace.NewError("profile can't be longer than %d days", maxProfileDays)
+	}
+	if sp.Target < 0 || sp.Target > 24*60*60 {
+		return stacktrace.NewError("hours has to be between 0 and 24")
+	}
+	_, err = weekdayMask(sp.Weekdays)
+	return err
+}
+
+// profileTargets holds the daily targets of schedule profiles by date (like holiday.Date)
+type profileTargets map[string]int
+
+func (pt profileTargets) of(date time.Time) (target int, ok bool) {
+	target, ok = pt[date.Format(holidayDate)]
+	return target, ok
+}
+
+// getProfileTargets returns the targets of the profiles covering the user from the day of from
+// up to the day of to, inclusive
+func getProfileTargets(ctx context.Context, db *sql.DB, uid uidT, from, to time.Time) (pt profileTargets, err error) {
+	rows, err := db.QueryContext(ctx,
+		`SELECT from_date, to_date, daily_target_s, weekdays FROM schedule_profiles
+			WHERE from_date <= ?2 AND to_date >= ?1
+			AND (stid = (SELECT stid FROM users WHERE uid = ?3)
+				OR spid IN (SELECT spid FROM schedule_profile_users WHERE uid = ?3))
+			ORDER BY spid`,
+		from.Format(holidayDate), to.Format(holidayDate), uid)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed to get schedule profiles")
+	}
+	defer rows.Close()
+
+	pt = make(profileTargets)
+	for rows.Next() {
+		var strFrom, strTo string
+		var target, mask int
+		err = rows.Scan(&strFrom, &strTo, &target, &mask)
+		if err != nil {
+			return nil, stacktrace.Propagate(err, "failed to scan row")
+		}
+		pFrom, _ := time.Parse(holidayDate, strFrom)
+		pTo, _ := time.Parse(holidayDate, strTo)
+		for d := pFrom; !d.After(pTo); d = d.AddDate(0, 0, 1) {
+			if mask&(1<<uint(d.Weekday())) != 0 {
+				pt[d.Format(holidayDate)] = target
+			}
+		}
+	}
+	return pt, nil
+}
+
+func createProfile(db *sql.DB, sp scheduleProfile) (spid spidT, err error) {
+	mask, err := weekdayMask(sp.Weekdays)
+	if err != nil {
+		return 0, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, stacktrace.Propagate(err, "failed to begin transaction")
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(
+		`INSERT INTO schedule_profiles (name, from_date, to_date, daily_target_s, weekdays, stid)
+			VALUES (?1, ?2, ?3, ?4, ?5, ?6)`, sp.Name, sp.From, sp.To, sp.Target, mask, nullSite(sp.Site))
+	if err != nil {
+		return 0, stacktrace.Propagate(err, "failed to insert schedule profile")
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, stacktrace.Propagate(err, "failed to get schedule profile id")
+	}
+	for _, uid := range sp.Users {
+		_, err = tx.Exec("INSERT OR IGNORE INTO schedule_profile_users (spid, uid) VALUES (?1, ?2)", id, uid)
+		if err != nil {
+			return 0, stacktrace.Propagate(err, "failed to add user to schedule profile")
+		}
+	}
+	return spidT(id), stacktrace.Propagate(tx.Commit(), "failed to commit transaction")
+}
+
+func listProfiles(db *sql.DB) (sps []scheduleProfile, err error) {
+	rows, err := db.Query(
+		`SELECT spid, name, from_date, to_date, daily_target_s, weekdays, IFNULL(stid, 0)
+			FROM schedule_profiles ORDER BY from_date, spid`)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed to list schedule profiles")
+	}
+
+	sps = []scheduleProfile{}
+	index := map[spidT]int{}
+	for rows.Next() {
+		var sp scheduleProfile
+		var mask int
+		err = rows.Scan(&sp.SPID, &sp.Name, &sp.From, &sp.To, &sp.Target, &mask, &sp.Site)
+		if err != nil {
+			rows.Close()
+			return nil, stacktrace.Propagate(err, "failed to scan row")
+		}
+		sp.Weekdays, sp.Users = weekdaysOf(mask), []uidT{}
+		index[sp.SPID] = len(sps)
+		sps = append(sps, sp)
+	}
+	rows.Close()
+
+	rows, err = db.Query("SELECT spid, uid FROM schedule_profile_users ORDER BY uid")
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed to list schedule profile users")
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var spid spidT
+		var uid uidT
+		err = rows.Scan(&spid, &uid)
+		if err != nil {
+			return nil, stacktrace.Propagate(err, "failed to scan row")
+		}
+		if i, ok := index[spid]; ok {
+			sps[i].Users = append(sps[i].Users, uid)
+		}
+	}
+	return sps, nil
+}
+
+func deleteProfile(db *sql.DB, spid spidT) (found bool, err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, stacktrace.Propagate(err, "failed to begin transaction")
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("DELETE FROM schedule_profile_users WHERE spid = ?", spid)
+	if err != nil {
+		return false, stacktrace.Propagate(err, "failed to delete schedule profile users")
+	}
+	res, err := tx.Exec("DELETE FROM schedule_profiles WHERE spid = ?", spid)
+	if err != nil {
+		return false, stacktrace.Propagate(err, "failed to delete schedule profile")
+	}
+	n, err := res.RowsAffected()
+	if err != nil || n != 1 {
+		return false, stacktrace.Propagate(err, "failed to delete schedule profile")
+	}
+	return true, stacktrace.Propagate(tx.Commit(), "failed to commit transaction")
+}
+
+// addProfileUser adds the user to the profile, found is false if either doesn't exist
+func addProfileUser(db *sql.DB, spid spidT, uid uidT) (found bool, err error) {
+	res, err := db.Exec(
+		`INSERT OR IGNORE INTO schedule_profile_users (spid, uid)
+			SELECT spid, uid FROM schedule_profiles, users WHERE spid = ?1 AND uid = ?2`, spid, uid)
+	if err != nil {
+		return false, stacktrace.Propagate(err, "failed to add user to schedule profile")
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 1 {
+		return n == 1, stacktrace.Propagate(err, "failed to add user to schedule profile")
+	}
+
+	// already a member
+	err = db.QueryRow("SELECT 1 FROM schedule_profile_users WHERE spid = ?1 AND uid = ?2", spid, uid).Scan(new(int))
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, stacktrace.Propagate(err, "failed to check schedule profile user")
+}
+
+func removeProfileUser(db *sql.DB, spid spidT, uid uidT) (found bool, err error) {
+	res, err := db.Exec("DELETE FROM schedule_profile_users WHERE spid = ?1 AND uid = ?2", spid, uid)
+	if err != nil {
+		return false, stacktrace.Propagate(err, "failed to remove user from schedule profile")
+	}
+	n, err := res.RowsAffected()
+	return n == 1, stacktrace.Propagate(err, "failed to remove user from schedule profile")
+}
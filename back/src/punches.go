@@ -0,0 +1,71 @@
+package main
+
+import (
+	"database/sql"
+	"strconv"
+
+	"github.com/palantir/stacktrace"
+)
+
+// punch results
+const (
+	punchAccepted  = "accepted"
+	punchDuplicate = "duplicate" // e.g. clocking in while already clocked in
+	punchFailed    = "failed"
+)
+
+// punch is a raw clock in/out attempt, kept even if it didn't change anything
+type punch struct {
+	PID    int       `json:"pid"`
+	DID    didT      `json:"did"` // 0 if not punched on a device
+	Site   stidT     `json:"site"`
+	Kind   userState `json:"kind"` // stateIn or stateOut
+	At     int       `json:"at"`
+	Result string    `json:"result"`
+}
+
+// logPunch records a punch, errors are only printed since the punch itself already happened
+func logPunch(db *sql.DB, uid uidT, did didT, kind userState, result string) {
+	_, err := db.Exec(
+		`INSERT INTO punches (uid, did, stid, kind, at_unix_s, result)
+			VALUES (?1, ?2, `+punchSiteSQL+`, ?3, ?4, ?5)`, uid, sql.NullInt64{Int64: int64(did), Valid: did != 0}, kind, clk.Now().Unix(), result)
+	if err != nil {
+		logError(stacktrace.Propagate(err, "failed to log punch for "+strconv.Itoa(int(uid))))
+	}
+}
+
+// listPunches lists the user's punches from from until to (exclusive).
+// If there are more than limit, none are returned and tooMany is set.
+func listPunches(db *sql.DB, uid uidT, from, to int64, limit int) (punches []punch, tooMany bool, err error) {
+	punches, err = queryPunches(db,
+		`SELECT pid, IFNULL(did, 0), IFNULL(stid, 0), kind, at_unix_s, result FROM punches
+			WHERE uid = ?1 AND at_unix_s >= ?2 AND at_unix_s < ?3 ORDER BY pid LIMIT ?4`, uid, from, to, limit+1)
+	if err != nil || len(punches) > limit {
+		return nil, err == nil, err
+	}
+	return punches, false, nil
+}
+
+func listLastPunches(db *sql.DB, uid uidT, n int) (punches []punch, err error) {
+	return queryPunches(db, "SELECT pid, IFNULL(did, 0), IFNULL(stid, 0), kind, at_unix_s, result FROM punches WHERE uid = ?1 ORDER BY pid DESC LIMIT ?2", uid, n)
+}
+
+func queryPunches(db *sql.DB, query string, args ...interface{}) (punches []punch, err error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed to list punches")
+	}
+	defer rows.Close()
+
+	punches = []punch{}
+	for rows.Next() {
+		var p punch
+		err = rows.Scan(&p.PID, &p.DID, &p.Site, &p.Kind, &p.At, &p.Result)
+		if err != nil {
+			return nil, stacktrace.Propagate(err, "failed to scan row")
+		}
+		punches = append(punches, p)
+	}
+
+	return punches, nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/palantir/stacktrace"
+)
+
+// Users still clocked in after the time they said they'd clock out (user_states.expected_end_unix_s)
+// are reminded every reminderInterval, until they clock out or snooze the reminders for the day.
+// Each reminder has a link that snoozes them without logging in.
+
+const reminderInterval = 30 * time.Minute
+
+// publicURL is where the server can be reached from users' mail clients, from WMS2_PUBLIC_URL.
+// Reminders have no snooze link if it isn't set.
+var publicURL = os.Getenv("WMS2_PUBLIC_URL")
+
+// snoozeReminders stops the user's reminders for the day of date
+func snoozeReminders(db *sql.DB, uid uidT, date time.Time) (err error) {
+	_, err = db.Exec(
+		"INSERT OR IGNORE INTO reminder_snoozes (uid, date) VALUES (?1, ?2)", uid, date.Format(holidayDate))
+	return stacktrace.Propagate(err, "failed to snooze reminders")
+}
+
+// snoozeByToken snoozes reminders for the day the token's reminder was sent on,
+// found is false if there's no such token or it expired
+func snoozeByToken(db *sql.DB, token string) (found bool, err error) {
+	var uid uidT
+	var date string
+	err = db.QueryRow(
+		"SELECT uid, date FROM snooze_tokens WHERE token = ?1 AND expires_unix_s > ?2",
+		token, clk.Now().Unix()).Scan(&uid, &date)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, stacktrace.Propagate(err, "failed to get snooze token")
+	}
+
+	_, err = db.Exec("INSERT OR IGNORE INTO reminder_snoozes (uid, date) VALUES (?1, ?2)", uid, date)
+	return true, stacktrace.Propagate(err, "failed to snooze reminders")
+}
+
+// sendReminders reminds everyone who's overdue to clock out and hasn't snoozed today,
+// affected is how many reminders were queued
+func sendReminders(db *sql.DB) (affected int, err error) {
+	now := clk.Now()
+	eod := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, now.Location())
+
+	_, err = db.Exec("DELETE FROM snooze_tokens WHERE expires_unix_s <= ?", now.Unix())
+	if err != nil {
+		return 0, stacktrace.Propagate(err, "failed to delete expired snooze tokens")
+	}
+
+	rows, err := db.Query(
+		`SELECT uid, email, expected_end_unix_s FROM user_states JOIN users USING (uid)
+			WHERE state = ?1 AND expected_end_unix_s < ?2
+			AND uid NOT IN (SELECT uid FROM reminder_snoozes WHERE date = ?3)`,
+		stateIn, now.Unix(), now.Format(holidayDate))
+	if err != nil {
+		return 0, stacktrace.Propagate(err, "failed to select users to remind")
+	}
+	type due struct {
+		uid         uidT
+		email       string
+		expectedEnd int64
+	}
+	dues := []due{}
+	for rows.Next() {
+		var d due
+		err = rows.Scan(&d.uid, &d.email, &d.expectedEnd)
+		if err != nil {
+			rows.Close()
+			return 0, stacktrace.Propagate(err, "failed to scan row")
+		}
+		dues = append(dues, d)
+	}
+	rows.Close()
+
+	for _, d := range dues {
+		body := fmt.Sprintf("You're still clocked in, you planned to clock out at %s.\n",
+			time.Unix(d.expectedEnd, 0).Format("15:04"))
+		if publicURL != "" {
+			tokenRaw := make([]byte, 18)
+			rand.Read(tokenRaw)
+			token := base64.URLEncoding.EncodeToString(tokenRaw)
+			_, err = db.Exec(
+				"INSERT INTO snooze_tokens (token, uid, date, expires_unix_s) VALUES (?1, ?2, ?3, ?4)",
+				token, d.uid, now.Format(holidayDate), eod.Unix())
+			if err != nil {
+				return affected, stacktrace.Propagate(err, "failed to insert snooze token")
+			}
+			body += "\nNot done yet? Snooze these reminders for tonight: " + publicURL + "/snooze/" + token + "\n"
+		}
+
+		err = enqueueEmail(db, d.email, "Don't forget to clock out", body)
+		if err != nil {
+			return affected, stacktrace.Propagate(err, "failed to queue reminder")
+		}
+		affected++
+	}
+	return affected, nil
+}
+
+func reminder(db *sql.DB) {
+	for {
+		if !jobSleep(reminderInterval) {
+			return
+		}
+		if err := pollJob(db, jobReminders, func() (int, error) { return sendReminders(db) }); err != nil {
+			logError(err)
+		}
+	}
+}
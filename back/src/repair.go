@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/palantir/stacktrace"
+)
+
+// repairStates fixes user_states rows that a crash or manual database edits could have left behind:
+// states of users that no longer exist, users without a state, open states that can't be
+// turned into an entry (since_unix_s in the future) and orphaned open states (see closeOrphanedStates).
+// It prints what it changed.
+func repairStates(db *sql.DB) (err error) {
+	tx, err := db.Begin()
+	rollback := func() {
+		if err := tx.Rollback(); err != nil {
+			logError(stacktrace.Propagate(err, "failed to roll back transaction"))
+		}
+	}
+	if err != nil {
+		return stacktrace.Propagate(err, "failed to begin transaction")
+	}
+
+	now := clk.Now().Unix()
+	steps := []struct {
+		what  string
+		query string
+		args  []interface{}
+	}{
+		{
+			"removed states of missing users",
+			"DELETE FROM user_states WHERE uid NOT IN (SELECT uid FROM users)",
+			nil,
+		},
+		{
+			"added missing states",
+			`INSERT INTO user_states (uid, state, since_unix_s)
+				SELECT uid, ?1, ?2 FROM users WHERE uid NOT IN (SELECT uid FROM user_states)`,
+			[]interface{}{stateOut, now},
+		},
+		{
+			"closed open states from the future",
+			"UPDATE user_states SET state = ?1, since_unix_s = ?2 WHERE state IN (?3, ?4) AND since_unix_s > ?2",
+			[]interface{}{stateOut, now, stateIn, stateBreak},
+		},
+	}
+
+	for _, step := range steps {
+		res, err := tx.Exec(step.query, step.args...)
+		if err != nil {
+			rollback()
+			return stacktrace.Propagate(err, "failed to run repair step: "+step.what)
+		}
+		n, _ := res.RowsAffected()
+		fmt.Printf("%s: %d\n", step.what, n)
+	}
+
+	n, err := closeOrphanedStates(tx, now)
+	if err != nil {
+		rollback()
+		return err
+	}
+	fmt.Printf("closed orphaned open states: %d\n", n)
+
+	return stacktrace.Propagate(tx.Commit(), "failed to commit transaction")
+}
+
+// orphanedState is an open state closeOrphanedStates closes
+type orphanedState struct {
+	uid        uidT
+	state      userState
+	since      int64
+	stid       stidT
+	ctid       ctidT
+	missed     bool
+	afterBreak bool
+	lastEnd    int64 // when the user's last entry ended, 0 if they have none
+}
+
+// closeOrphanedStates clocks out the users whose open state nothing else would close or that
+// can't be right: those without a site, which disqualify never reaches, and those with an entry
+// ending after they clocked in, whose clock out was recorded without closing the state. Each gets
+// an invalid auto-close entry until now, starting after their last entry, and an audit record,
+// so that the time shows up for review instead of being lost or counted.
+func closeOrphanedStates(tx *sql.Tx, now int64) (n int, err error) {
+	ctx := context.TODO()
+	rows, err := entryStore.query(ctx, tx,
+		`SELECT uid, state, since_unix_s, IFNULL(stid, 0), IFNULL(ctid, 0), missed_heartbeat, after_break, last_end
+			FROM (SELECT user_states.*, (SELECT IFNULL(MAX(to_unix_s), 0) FROM entries
+					WHERE entries.uid = user_states.uid AND deleted_unix_s IS NULL) AS last_end
+				FROM user_states)
+			WHERE state IN (?1, ?2) AND since_unix_s <= ?3
+				AND (stid IS NULL OR stid NOT IN (SELECT stid FROM sites) OR last_end > since_unix_s)`,
+		stateIn, stateBreak, now)
+	if err != nil {
+		return 0, stacktrace.Propagate(err, "failed to select orphaned open states")
+	}
+	var orphans []orphanedState
+	for rows.Next() {
+		var o orphanedState
+		err = rows.Scan(&o.uid, &o.state, &o.since, &o.stid, &o.ctid, &o.missed, &o.afterBreak, &o.lastEnd)
+		if err != nil {
+			rows.Close()
+			return 0, stacktrace.Propagate(err, "failed to scan row")
+		}
+		orphans = append(orphans, o)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, stacktrace.Propagate(err, "failed to select orphaned open states")
+	}
+
+	for _, o := range orphans {
+		_, err = tx.Exec(
+			`UPDATE user_states SET state = ?1, since_unix_s = ?2, expected_end_unix_s = NULL, stid = NULL, ctid = NULL,
+				after_break = 0
+				WHERE uid = ?3`, stateOut, now, o.uid)
+		if err != nil {
+			return n, stacktrace.Propagate(err, "failed to close orphaned state")
+		}
+
+		from := o.since
+		if o.lastEnd > from {
+			from = o.lastEnd
+		}
+		if from > now {
+			from = now
+		}
+		var site interface{}
+		if o.stid != 0 {
+			site = o.stid
+			var known bool
+			err = tx.QueryRow("SELECT COUNT(*) > 0 FROM sites WHERE stid = ?", o.stid).Scan(&known)
+			if err != nil {
+				return n, stacktrace.Propagate(err, "failed to check site")
+			}
+			if !known {
+				site = nil
+			}
+		}
+		eid, err := entryStore.insert(ctx, tx, "eid",
+			`INSERT INTO entries (uid, from_unix_s, to_unix_s, valid, source, stid, ctid, missed_heartbeat, after_break)
+				VALUES (?1, ?2, ?3, 0, 'auto-close', ?4, ?5, ?6, ?7)`,
+			o.uid, from, now, site, nullContract(o.ctid), o.missed, o.afterBreak)
+		if err != nil {
+			return n, stacktrace.Propagate(err, "failed to add entry for orphaned state")
+		}
+		err = audit(tx, auditSystem, o.uid, auditRepair, eidT(eid), auditState{State: o.state, At: o.since},
+			entryRange{eidT(eid), int(from), int(now)})
+		if err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
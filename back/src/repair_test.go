@@ -0,0 +1,70 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRepairStates(t *testing.T) {
+	now := time.Unix(1570000000, 0)
+	db, done := newTestDB(t, now)
+	defer done()
+	hour := func(h int) time.Time { return now.Add(time.Duration(h) * time.Hour) }
+
+	healthy := seedUser(t, db, "healthy@example.com", false)
+	seedEntry(t, db, healthy, hour(-10), hour(-8), entryWork)
+	seedState(t, db, healthy, stateIn, hour(-2))
+	noSite := seedUser(t, db, "nosite@example.com", false)
+	seedState(t, db, noSite, stateIn, hour(-3))
+	clockedOut := seedUser(t, db, "clockedout@example.com", false)
+	seedEntry(t, db, clockedOut, hour(-5), hour(-1), entryWork)
+	seedState(t, db, clockedOut, stateBreak, hour(-5))
+	future := seedUser(t, db, "future@example.com", false)
+	seedState(t, db, future, stateIn, hour(2))
+	_, err := db.Exec("UPDATE user_states SET stid = 1 WHERE uid IN (?, ?, ?)", healthy, clockedOut, future)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = repairStates(db); err != nil {
+		t.Fatal(err)
+	}
+
+	for uid, want := range map[uidT]userState{healthy: stateIn, noSite: stateOut, clockedOut: stateOut, future: stateOut} {
+		state, _, _, _ := getStateRow(t, db, uid)
+		if state != want {
+			t.Errorf("user %d is %s, want %s", uid, state, want)
+		}
+	}
+
+	// the orphaned states were recorded for review, after the entries they had
+	for _, c := range []struct {
+		uid      uidT
+		from, to time.Time
+	}{{noSite, hour(-3), now}, {clockedOut, hour(-1), now}} {
+		n := countRows(t, db, `SELECT COUNT(*) FROM entries WHERE uid = ?1 AND from_unix_s = ?2 AND to_unix_s = ?3
+			AND valid = 0 AND source = 'auto-close'`, c.uid, c.from.Unix(), c.to.Unix())
+		if n != 1 {
+			t.Errorf("user %d has %d entries from %d to %d for review, want 1", c.uid, n, c.from.Unix(), c.to.Unix())
+		}
+		n = countRows(t, db, `SELECT COUNT(*) FROM audit_log JOIN entries USING (eid)
+			WHERE audit_log.uid = ?1 AND action = ?2 AND valid = 0`, c.uid, auditRepair)
+		if n != 1 {
+			t.Errorf("user %d has %d repair audit records, want 1", c.uid, n)
+		}
+	}
+	if n := countRows(t, db, "SELECT COUNT(*) FROM audit_log WHERE action = ?", auditRepair); n != 2 {
+		t.Errorf("%d repair audit records, want 2", n)
+	}
+	if n := countRows(t, db, "SELECT COUNT(*) FROM entries WHERE uid IN (?, ?) AND valid = 0", healthy, future); n != 0 {
+		t.Errorf("%d entries for the states that weren't orphaned", n)
+	}
+
+	// repairing again changes nothing
+	if err = repairStates(db); err != nil {
+		t.Fatal(err)
+	}
+	if n := countRows(t, db, "SELECT COUNT(*) FROM audit_log WHERE action = ?", auditRepair); n != 2 {
+		t.Errorf("%d repair audit records after repairing twice, want 2", n)
+	}
+}
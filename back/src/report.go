@@ -0,0 +1,465 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/palantir/stacktrace"
+)
+
+type dayReport struct {
+	Date     int64         `json:"date"` // unix time of the start of the day
+	Entries  []entry       `json:"entries"`
+	Worked   int           `json:"worked"`
+	Expected int           `json:"expected"`
+	Delta    int           `json:"delta"`
+	Sites    map[stidT]int `json:"sites"` // seconds worked per site
+
+	OvertimeBuckets map[string]int `json:"overtimeBuckets"` // the positive delta split, see overtimeBuckets
+	Holiday         bool           `json:"holiday"`         // a public holiday at the user's site
+	Leave           string         `json:"leave,omitempty"` // the type of approved leave on the day, see leave.go
+	School          bool           `json:"school"`          // an apprentice's school day, see school.go
+	HolidayWorked   int            `json:"holidayWorked"`   // seconds worked on a holiday, paid at a premium instead of as overtime
+
+	// seconds worked on a weekend day without approval, not counted as overtime, see weekendApproval
+	WeekendUnapproved int `json:"weekendUnapproved"`
+	LunchDeducted     int `json:"lunchDeducted"` // seconds taken off Worked for lunch, see lunchDeduction
+
+	// seconds of sick, vacation and other entries by kind, they count towards Delta but not Worked
+	Absent map[string]int `json:"absent"`
+}
+
+type monthReport struct {
+	UID      uidT          `json:"uid"`
+	Year     int           `json:"year"`
+	Month    time.Month    `json:"month"`
+	Days     []dayReport   `json:"days"`
+	Worked   int           `json:"worked"`
+	Expected int           `json:"expected"`
+	Delta    int           `json:"delta"`
+	Sites    map[stidT]int `json:"sites"`
+
+	OvertimeBuckets   map[string]int `json:"overtimeBuckets"`
+	HolidayWorked     int            `json:"holidayWorked"`
+	WeekendUnapproved int            `json:"weekendUnapproved"`
+	LunchDeducted     int            `json:"lunchDeducted"`
+	Absent            map[string]int `json:"absent"`
+}
+
+// getDayReports reports on the given number of days starting with the day of from.
+// Entries belong to the day they started on and only valid ones count as worked,
+// or as absent if they aren't work entries.
+// If the user is clocked in, the time since then counts for the day they clocked in on.
+func getDayReports(db *sql.DB, uid uidT, from time.Time, days int) (reports []dayReport, err error) {
+	now := clk.Now()
+	sod := time.Date(from.Year(), from.Month(), from.Day(), 0, 0, 0, 0, from.Location())
+	end := sod.AddDate(0, 0, days)
+
+	sc, err := getSchedule(context.TODO(), db, uid, sod, end.AddDate(0, 0, -1))
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := entryStore.query(context.TODO(), db,
+		`SELECT `+entryColumns+` FROM entries
+			WHERE uid = ?1 AND from_unix_s >= ?2 AND from_unix_s < ?3 AND deleted_unix_s IS NULL
+			ORDER BY from_unix_s`, uid, sod.Unix(), end.Unix())
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed to get entries in date range")
+	}
+	defer rows.Close()
+
+	ens := []entry{}
+	for rows.Next() {
+		en, err := scanEntry(rows)
+		if err != nil {
+			return nil, err
+		}
+		ens = append(ens, en)
+	}
+
+	r, err := getRunning(context.TODO(), db, uid)
+	if err != nil {
+		return nil, err
+	}
+
+	weekends := weekendSet{}
+	if weekendApproval {
+		weekends, err = getApprovedWeekends(db, uid, sod, end.AddDate(0, 0, -1))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for i := 0; i < days; i++ {
+		date := sod.AddDate(0, 0, i)
+		next := date.AddDate(0, 0, 1)
+		dr := dayReport{
+			Date:     date.Unix(),
+			Entries:  []entry{},
+			Expected: expectedForDay(date, sc),
+			Sites:    make(map[stidT]int),
+			Absent:   make(map[string]int),
+		}
+
+		for _, en := range ens {
+			if int64(en.From) < date.Unix() || int64(en.From) >= next.Unix() {
+				continue
+			}
+			dr.Entries = append(dr.Entries, en)
+			if en.Valid && !en.Pending && en.Kind != entryWork {
+				dr.Absent[en.Kind] += en.To - en.From
+			} else if en.Valid && !en.Pending {
+				lunch := lunchDeduction.deduction(en.To - en.From)
+				dr.Worked += en.To - en.From - lunch
+				dr.Sites[en.Site] += en.To - en.From - lunch
+				dr.LunchDeducted += lunch
+			}
+		}
+
+		if running := r.in(date, next, now); running > 0 {
+			lunch := lunchDeduction.deduction(running)
+			dr.Worked += running - lunch
+			dr.Sites[r.Site] += running - lunch
+			dr.LunchDeducted += lunch
+		}
+
+		dr.Delta = dr.Worked - dr.Expected
+		for _, s := range dr.Absent {
+			dr.Delta += s
+		}
+		dr.Holiday = sc.holidays.has(date)
+		dr.Leave = sc.leave.of(date)
+		dr.School = sc.school.has(date)
+		if dr.Holiday {
+			dr.HolidayWorked = dr.Worked
+		}
+		if weekendApproval && isWeekend(date) && !weekends.has(date) && !dr.Holiday {
+			dr.WeekendUnapproved = dr.Worked
+		}
+		dr.OvertimeBuckets = splitOvertime(dr.Delta - dr.HolidayWorked - dr.WeekendUnapproved)
+		reports = append(reports, dr)
+	}
+
+	return reports, nil
+}
+
+func getMonthReport(db *sql.DB, uid uidT, year int, month time.Month, loc *time.Location) (mr monthReport, err error) {
+	som := time.Date(year, month, 1, 0, 0, 0, 0, loc)
+	days := som.AddDate(0, 1, 0).AddDate(0, 0, -1).Day()
+
+	mr = monthReport{
+		UID: uid, Year: year, Month: month,
+		Sites: make(map[stidT]int), OvertimeBuckets: splitOvertime(0), Absent: make(map[string]int),
+	}
+	mr.Days, err = getDayReports(db, uid, som, days)
+	if err != nil {
+		return mr, err
+	}
+
+	for _, dr := range mr.Days {
+		mr.Worked += dr.Worked
+		mr.Expected += dr.Expected
+		mr.Delta += dr.Delta
+		mr.HolidayWorked += dr.HolidayWorked
+		mr.WeekendUnapproved += dr.WeekendUnapproved
+		mr.LunchDeducted += dr.LunchDeducted
+		for stid, s := range dr.Sites {
+			mr.Sites[stid] += s
+		}
+		for name, s := range dr.OvertimeBuckets {
+			mr.OvertimeBuckets[name] += s
+		}
+		for kind, s := range dr.Absent {
+			mr.Absent[kind] += s
+		}
+	}
+
+	return mr, nil
+}
+
+// day flags, see gridDay
+const (
+	flagNotClockedOut   = "not-clocked-out" // an entry was closed by disqualify
+	flagMissedHeartbeat = "missed-heartbeat"
+	flagOverCap         = "over-cap"
+	flagWeekend         = "weekend-unapproved" // worked on a weekend day without approval
+)
+
+// gridDay is a cell of the calendar's month grid
+type gridDay struct {
+	dayReport
+	Weekend bool     `json:"weekend"`
+	InMonth bool     `json:"inMonth"` // false for the days of the first and last weeks outside the month
+	Flags   []string `json:"flags"`
+}
+
+type monthGrid struct {
+	Year       int        `json:"year"`
+	Month      time.Month `json:"month"`
+	Days       []gridDay  `json:"days"`       // whole weeks, see weekStart
+	Categories []category `json:"categories"` // to show the entries' categories with
+}
+
+// getMonthGrid is everything the calendar shows for a month, in one go
+func getMonthGrid(db *sql.DB, uid uidT, year int, month time.Month, loc *time.Location) (mg monthGrid, err error) {
+	som := time.Date(year, month, 1, 0, 0, 0, 0, loc)
+	from := startOfWeek(som)
+	to := startOfWeek(som.AddDate(0, 1, -1)).AddDate(0, 0, 7)
+	days := int(to.Sub(from).Hours()/24 + 0.5) // DST days aren't 24 hours long
+
+	drs, err := getDayReports(db, uid, from, days)
+	if err != nil {
+		return mg, err
+	}
+
+	cs, err := listCategories(db)
+	if err != nil {
+		return mg, err
+	}
+
+	mg = monthGrid{Year: year, Month: month, Days: []gridDay{}, Categories: cs}
+	for i, dr := range drs {
+		date := from.AddDate(0, 0, i)
+		gd := gridDay{
+			dayReport: dr,
+			Weekend:   isWeekend(date),
+			InMonth:   date.Month() == month,
+			Flags:     []string{},
+		}
+		for _, en := range dr.Entries {
+			if !en.Valid && !gd.hasFlag(flagNotClockedOut) {
+				gd.Flags = append(gd.Flags, flagNotClockedOut)
+			}
+			if en.MissedHeartbeat && !gd.hasFlag(flagMissedHeartbeat) {
+				gd.Flags = append(gd.Flags, flagMissedHeartbeat)
+			}
+			if en.OverCap && !gd.hasFlag(flagOverCap) {
+				gd.Flags = append(gd.Flags, flagOverCap)
+			}
+		}
+		if dr.WeekendUnapproved > 0 {
+			gd.Flags = append(gd.Flags, flagWeekend)
+		}
+		mg.Days = append(mg.Days, gd)
+	}
+
+	return mg, nil
+}
+
+func (gd gridDay) hasFlag(flag string) bool {
+	for _, f := range gd.Flags {
+		if f == flag {
+			return true
+		}
+	}
+	return false
+}
+
+// monthTotals sums up a month for comparing it to another
+type monthTotals struct {
+	Year        int        `json:"year,omitempty"`
+	Month       time.Month `json:"month,omitempty"`
+	Worked      int        `json:"worked"`
+	Expected    int        `json:"expected"`
+	Delta       int        `json:"delta"`
+	Overtime    int        `json:"overtime"`    // seconds worked beyond what was expected, day by day
+	AbsenceDays int        `json:"absenceDays"` // days that should have been worked but weren't and have no absence recorded, before today
+}
+
+func getMonthTotals(db *sql.DB, uid uidT, year int, month time.Month, loc *time.Location) (mt monthTotals, err error) {
+	mr, err := getMonthReport(db, uid, year, month, loc)
+	if err != nil {
+		return mt, err
+	}
+
+	mt = monthTotals{Year: year, Month: month, Worked: mr.Worked, Expected: mr.Expected, Delta: mr.Delta}
+	now := clk.Now().Unix()
+	for _, dr := range mr.Days {
+		if dr.Delta > 0 {
+			mt.Overtime += dr.Delta
+		}
+		over := time.Unix(dr.Date, 0).In(loc).AddDate(0, 0, 1).Unix() <= now
+		if dr.Expected > 0 && dr.Worked == 0 && len(dr.Absent) == 0 && over {
+			mt.AbsenceDays++
+		}
+	}
+	return mt, nil
+}
+
+// monthComparison compares a month to a baseline month, change is month minus baseline
+type monthComparison struct {
+	Month    monthTotals `json:"month"`
+	Baseline monthTotals `json:"baseline"`
+	Change   monthTotals `json:"change"`
+}
+
+// compareMonths compares the month to the previous one, or the same month a year earlier if lastYear is set
+func compareMonths(db *sql.DB, uid uidT, year int, month time.Month, lastYear bool, loc *time.Location) (mc monthComparison, err error) {
+	mc.Month, err = getMonthTotals(db, uid, year, month, loc)
+	if err != nil {
+		return mc, err
+	}
+
+	baseline := time.Date(year, month, 1, 0, 0, 0, 0, loc).AddDate(0, -1, 0)
+	if lastYear {
+		baseline = time.Date(year-1, month, 1, 0, 0, 0, 0, loc)
+	}
+	mc.Baseline, err = getMonthTotals(db, uid, baseline.Year(), baseline.Month(), loc)
+	if err != nil {
+		return mc, err
+	}
+
+	mc.Change = monthTotals{
+		Worked:      mc.Month.Worked - mc.Baseline.Worked,
+		Expected:    mc.Month.Expected - mc.Baseline.Expected,
+		Delta:       mc.Month.Delta - mc.Baseline.Delta,
+		Overtime:    mc.Month.Overtime - mc.Baseline.Overtime,
+		AbsenceDays: mc.Month.AbsenceDays - mc.Baseline.AbsenceDays,
+	}
+	return mc, nil
+}
+
+// yearToDate sums up a year from January 1st through a day, for the annual review
+type yearToDate struct {
+	UID         uidT   `json:"uid"`
+	Email       string `json:"email"`
+	Year        int    `json:"year"`
+	Through     int64  `json:"through"` // unix time of the start of the last day included
+	Worked      int    `json:"worked"`
+	Expected    int    `json:"expected"`
+	Delta       int    `json:"delta"`
+	Overtime    int    `json:"overtime"`    // see monthTotals
+	AbsenceDays int    `json:"absenceDays"` // see monthTotals
+
+	LeaveDays map[string]int `json:"leaveDays"` // working days of approved leave by type
+	Absent    map[string]int `json:"absent"`    // seconds of sick, vacation and other entries by kind
+}
+
+// yearThrough is the day the year to date runs through as of now, ok is false for future years
+func yearThrough(year int, now time.Time) (through time.Time, ok bool) {
+	switch {
+	case year > now.Year():
+		return through, false
+	case year == now.Year():
+		return now, true
+	default:
+		return time.Date(year, time.December, 31, 0, 0, 0, 0, now.Location()), true
+	}
+}
+
+// getYearToDate sums up the year of through up to and including the day of through,
+// with days starting in the user's time zone
+func getYearToDate(db *sql.DB, uid uidT, through time.Time) (ytd yearToDate, err error) {
+	loc, err := userLocation(context.TODO(), db, uid)
+	if err != nil {
+		return ytd, err
+	}
+	soy := time.Date(through.Year(), time.January, 1, 0, 0, 0, 0, loc)
+	sod := time.Date(through.Year(), through.Month(), through.Day(), 0, 0, 0, 0, loc)
+	days := sod.YearDay()
+
+	ytd = yearToDate{UID: uid, Year: through.Year(), Through: sod.Unix(),
+		LeaveDays: make(map[string]int), Absent: make(map[string]int)}
+	ytd.Email, err = uidToEmail(db, uid)
+	if err != nil {
+		return ytd, stacktrace.Propagate(err, "failed to get email")
+	}
+
+	drs, err := getDayReports(db, uid, soy, days)
+	if err != nil {
+		return ytd, err
+	}
+
+	now := clk.Now().Unix()
+	for _, dr := range drs {
+		ytd.Worked += dr.Worked
+		ytd.Expected += dr.Expected
+		ytd.Delta += dr.Delta
+		if dr.Delta > 0 {
+			ytd.Overtime += dr.Delta
+		}
+		for kind, s := range dr.Absent {
+			ytd.Absent[kind] += s
+		}
+		if d := time.Unix(dr.Date, 0).In(loc); dr.Leave != "" && !isWeekend(d) && !dr.Holiday {
+			ytd.LeaveDays[dr.Leave]++
+		}
+		over := time.Unix(dr.Date, 0).In(loc).AddDate(0, 0, 1).Unix() <= now
+		if dr.Expected > 0 && dr.Worked == 0 && len(dr.Absent) == 0 && over {
+			ytd.AbsenceDays++
+		}
+	}
+	return ytd, nil
+}
+
+// listYearToDate sums up the year of through for every user
+func listYearToDate(db *sql.DB, through time.Time) (ytds []yearToDate, err error) {
+	rows, err := db.Query("SELECT uid FROM users ORDER BY uid")
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed to list users")
+	}
+	uids := []uidT{}
+	for rows.Next() {
+		var uid uidT
+		err = rows.Scan(&uid)
+		if err != nil {
+			rows.Close()
+			return nil, stacktrace.Propagate(err, "failed to scan row")
+		}
+		uids = append(uids, uid)
+	}
+	rows.Close()
+
+	ytds = []yearToDate{}
+	for _, uid := range uids {
+		ytd, err := getYearToDate(db, uid, through)
+		if err != nil {
+			return nil, err
+		}
+		ytds = append(ytds, ytd)
+	}
+	return ytds, nil
+}
+
+// reportUser is who a report covers
+type reportUser struct {
+	UID       uidT
+	Email     string
+	PayrollID string // users.payroll_id, the uid if it isn't set
+	loc       *time.Location
+}
+
+// listReportUsers returns the user if uid isn't 0, else everyone at the site, or everyone if site is 0 too,
+// ordered by email
+func listReportUsers(db *sql.DB, uid uidT, site stidT) (users []reportUser, err error) {
+	query := "SELECT uid, email, IFNULL(payroll_id, uid), IFNULL(timezone, '') FROM users WHERE 1 = 1"
+	args := []interface{}{}
+	if uid != 0 {
+		query += " AND uid = ?"
+		args = append(args, uid)
+	}
+	if site != 0 {
+		query += " AND stid = ?"
+		args = append(args, site)
+	}
+	rows, err := db.Query(query+" ORDER BY email", args...)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed to list users")
+	}
+	defer rows.Close()
+
+	users = []reportUser{}
+	for rows.Next() {
+		var u reportUser
+		var tz string
+		err = rows.Scan(&u.UID, &u.Email, &u.PayrollID, &tz)
+		if err != nil {
+			return nil, stacktrace.Propagate(err, "failed to scan row")
+		}
+		u.loc = timezoneLocation(u.UID, tz)
+		users = append(users, u)
+	}
+	return users, nil
+}
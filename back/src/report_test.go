@@ -0,0 +1,48 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// seedOctober seeds two users with a month of entries around the German Unity holiday
+// with the clock at the 31st, 10:00, while a is clocked in since 8:00
+func seedOctober(t *testing.T) (db *sql.DB, a, b uidT, done func()) {
+	t.Helper()
+	loc := testLocation(t)
+	at := func(day, hour, min int) time.Time { return time.Date(2019, time.October, day, hour, min, 0, 0, loc) }
+	db, done = newTestDB(t, at(31, 10, 0))
+	a = seedUser(t, db, "a@example.com", false)
+	b = seedUser(t, db, "b@example.com", false)
+	seedHoliday(t, db, "2019-10-03", "Tag der Deutschen Einheit")
+
+	seedEntry(t, db, a, at(1, 8, 0), at(1, 12, 0), entryWork)
+	seedEntry(t, db, a, at(1, 12, 30), at(1, 17, 0), entryWork)
+	seedEntry(t, db, a, at(2, 9, 0), at(2, 15, 0), entryWork)
+	seedEntry(t, db, a, at(3, 10, 0), at(3, 12, 0), entryWork) // the holiday
+	seedEntry(t, db, a, at(4, 8, 0), at(4, 16, 0), entrySick)
+	seedEntry(t, db, a, at(5, 10, 0), at(5, 11, 30), entryWork) // a Saturday
+	seedEntry(t, db, a, at(7, 22, 0), at(8, 2, 0), entryWork)   // over midnight, counts for the 7th
+	seedState(t, db, a, stateIn, at(31, 8, 0))
+
+	seedEntry(t, db, b, at(1, 7, 0), at(1, 15, 0), entryWork)
+	seedEntry(t, db, b, at(30, 7, 0), at(30, 15, 0), entryVacation)
+	return db, a, b, done
+}
+
+func TestMonthReportGolden(t *testing.T) {
+	db, a, _, done := seedOctober(t)
+	defer done()
+
+	mr, err := getMonthReport(db, a, 2019, time.October, testLocation(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := json.MarshalIndent(mr, "", "\t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkGolden(t, "month_report.json", append(got, '\n'))
+}
@@ -1,12 +1,20 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/ed25519"
+	"crypto/subtle"
+	"database/sql"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"net/url"
 	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/AndrewBurian/powermux"
@@ -20,23 +28,203 @@ type key int
 const (
 	sidKey key = iota
 	uidKey
+	deviceKey
+	requestIDKey
+	breakGlassKey
 )
 
 func routes(mux *powermux.ServeMux, env env) {
-	mux.Route("/").MiddlewareFunc(env.corsMiddleware)
+	mux.Route("/").MiddlewareFunc(env.requestIDMiddleware).MiddlewareFunc(env.corsMiddleware).MiddlewareFunc(env.latencyMiddleware).MiddlewareFunc(env.bodyLimitMiddleware).
+		MiddlewareFunc(env.timeoutMiddleware)
 	mux.Route("/version").GetFunc(env.version)
+	mux.Route("/healthz").GetFunc(env.healthz)
+	mux.Route("/readyz").GetFunc(env.readyz)
 	mux.Route("/authorize").PostFunc(env.authorize)
+	mux.Route("/break-glass").PostFunc(env.openBreakGlass)
+	mux.Route("/snooze/:token").GetFunc(env.snoozeLink)
+	mux.Route("/ical/:token").GetFunc(env.icalFeed)
+	mux.Route("/timesheet-key").GetFunc(env.timesheetKey)
+	mux.Route("/slack/commands").PostFunc(env.slackCommand)
+	mux.Route("/telegram/updates").PostFunc(env.telegramUpdate)
 	u := mux.Route("/u").MiddlewareFunc(env.requireSession)
 	u.Route("/status").GetFunc(env.status)
 	u.Route("/entries").GetFunc(env.entries)
+	u.Route("/entries").PostFunc(env.entrySubmit)
+	u.Route("/entries/bulk").PostFunc(env.entriesBulk)
+	u.Route("/entries/:id").PutFunc(env.entrySubmitEdit)
+	u.Route("/entries/:id/category").PutFunc(env.entryCategory)
+	u.Route("/entries/:id/training/course").PutFunc(env.entryTrainingCourse)
+	u.Route("/entries/:id/training/certificate").GetFunc(env.entryCertificate)
+	u.Route("/entries/:id/training/certificate").PutFunc(env.entryCertificateUpload)
+	u.Route("/entries/:id/training/certificate").DeleteFunc(env.entryCertificateDelete)
+	u.Route("/categories").GetFunc(env.categories)
+	u.Route("/entries/export").GetFunc(env.entriesExport)
+	u.Route("/auto-closed").GetFunc(env.autoClosed)
+	u.Route("/auto-closed/:id").PutFunc(env.autoClosedConfirm)
+	u.Route("/punches").GetFunc(env.punches)
+	u.Route("/changes").GetFunc(env.changes)
+	u.Route("/reports/month").GetFunc(env.monthReport)
+	u.Route("/reports/compare").GetFunc(env.monthComparison)
+	u.Route("/reports/ytd").GetFunc(env.yearToDate)
+	u.Route("/reports/contracts").GetFunc(env.contractReports)
+	u.Route("/reports/timesheet").GetFunc(env.timesheet)
+	u.Route("/reports/training").GetFunc(env.trainingReport)
+	u.Route("/access-log").GetFunc(env.ownAccessLog)
+	u.Route("/break-glass").DeleteFunc(env.closeBreakGlass)
+	u.Route("/timesheets/signoff").GetFunc(env.timesheetSignoff)
+	u.Route("/timesheets/signoff").PutFunc(env.timesheetSubmit)
+	u.Route("/contracts").GetFunc(env.contracts)
+	u.Route("/calendar/month").GetFunc(env.monthGrid)
 	u.Route("/clock/in").PutFunc(env.clockIn)
 	u.Route("/clock/out").PutFunc(env.clockOut)
+	u.Route("/break/start").PutFunc(env.breakStart)
+	u.Route("/break/end").PutFunc(env.breakEnd)
 	u.Route("/users/online/count").GetFunc(env.usersOnlineCount)
-	a := mux.Route("/a").MiddlewareFunc(env.requireSession).MiddlewareFunc(env.requireAdmin)
+	u.Route("/settings/weekly-summary").PutFunc(env.weeklySummary)
+	u.Route("/settings/timezone").PutFunc(env.timezone)
+	u.Route("/settings/kiosk").PutFunc(env.kioskProfile)
+	u.Route("/settings/photo").PutFunc(env.photo)
+	u.Route("/settings/photo").DeleteFunc(env.photoDelete)
+	u.Route("/reminders/snooze").PutFunc(env.remindersSnooze)
+	u.Route("/school-days").GetFunc(env.schoolDays)
+	u.Route("/inbox").GetFunc(env.ownInbox)
+	u.Route("/leave").GetFunc(env.leave)
+	u.Route("/leave").PostFunc(env.leaveSubmit)
+	u.Route("/leave/:id").DeleteFunc(env.leaveCancel)
+	u.Route("/heartbeat").PutFunc(env.heartbeat)
+	u.Route("/idle").GetFunc(env.idleList)
+	u.Route("/idle").PostFunc(env.idleReport)
+	u.Route("/idle/:id").PutFunc(env.idleResolve)
+	u.Route("/settings/presence").PutFunc(env.presenceMode)
+	u.Route("/suggestions").GetFunc(env.suggestions)
+	u.Route("/suggestions/:id").PutFunc(env.suggestionResolve)
+	u.Route("/extension/token").PostFunc(env.extensionTokenCreate)
+	u.Route("/extension/token").DeleteFunc(env.extensionTokenRevoke)
+	u.Route("/calendar/token").PostFunc(env.calendarTokenCreate)
+	u.Route("/calendar/token").DeleteFunc(env.calendarTokenRevoke)
+	// who may use /a and /w is up to the access policy, by default auditors may read /a and admins may do anything
+	a := mux.Route("/a").MiddlewareFunc(env.requireSession).MiddlewareFunc(env.requirePolicy).
+		MiddlewareFunc(env.logAccessMiddleware)
+	a.Route("/entries/export").GetFunc(env.allEntriesExport)
+	a.Route("/entries/recent").GetFunc(env.entriesRecent)
 	a.Route("/entries/:id").PutFunc(env.entriesEdit)
 	a.Route("/entries/:id").DeleteFunc(env.entriesDelete)
+	a.Route("/entries/:id/restore").PutFunc(env.entriesRestore)
+	a.Route("/approvals").GetFunc(env.approvals)
+	a.Route("/inbox").GetFunc(env.inbox)
+	a.Route("/audit").GetFunc(env.auditLog)
+	a.Route("/access-log").GetFunc(env.accessLog)
+	a.Route("/break-glass").GetFunc(env.breakGlassGrants)
+	a.Route("/audit/export").GetFunc(env.auditExport)
+	a.Route("/leave").GetFunc(env.leaveAll)
+	a.Route("/leave/:id").PutFunc(env.leaveDecide)
+	a.Route("/approvals/:id").PutFunc(env.approvalDecide)
 	a.Route("/users/:id")
+	a.Route("/users/:id/entries").GetFunc(env.userEntries)
+	a.Route("/users/:id/entries/bulk").PostFunc(env.userEntriesBulk)
+	a.Route("/users/:id/entries/deleted").GetFunc(env.userEntriesDeleted)
+	a.Route("/users/:id/punches").GetFunc(env.userPunches)
+	a.Route("/users/:id/reports/month").GetFunc(env.userMonthReport)
+	a.Route("/users/:id/reports/compare").GetFunc(env.userMonthComparison)
+	a.Route("/users/:id/reports/ytd").GetFunc(env.userYearToDate)
+	a.Route("/users/:id/reports/contracts").GetFunc(env.userContractReports)
+	a.Route("/users/:id/reports/timesheet").GetFunc(env.userTimesheet)
+	a.Route("/users/:id/reports/training").GetFunc(env.userTrainingReport)
+	a.Route("/users/:id/reports/probation").GetFunc(env.userProbationReport)
+	a.Route("/users/:id/timesheets/signoff").GetFunc(env.userTimesheetSignoff)
+	a.Route("/users/:id/timesheets/approve").PutFunc(env.userTimesheetApprove)
+	a.Route("/users/:id/calendar/month").GetFunc(env.userMonthGrid)
+	a.Route("/users/:id/auditor").PutFunc(env.userAuditor)
+	a.Route("/users/:id/warden").PutFunc(env.userWarden)
+	a.Route("/users/:id/contract").PutFunc(env.userContract)
+	a.Route("/users/:id/target").PutFunc(env.userTarget)
+	a.Route("/users/:id/timezone").PutFunc(env.userTimezone)
+	a.Route("/users/:id/hired").PutFunc(env.userHired)
+	a.Route("/users/:id/merge").PostFunc(env.userMerge)
+	a.Route("/merges").GetFunc(env.merges)
+	a.Route("/merges/:id/undo").PutFunc(env.mergesUndo)
+	a.Route("/users/:id/kiosk").PutFunc(env.userKioskProfile)
+	a.Route("/users/:id/photo").PutFunc(env.userPhoto)
+	a.Route("/users/:id/photo").DeleteFunc(env.userPhotoDelete)
+	a.Route("/users/:id/school-days").GetFunc(env.userSchoolDays)
+	a.Route("/users/:id/school-days").PostFunc(env.userSchoolDaysCreate)
+	a.Route("/school-days/:id").DeleteFunc(env.schoolDaysDelete)
+	a.Route("/users/:id/contracts").GetFunc(env.userContracts)
+	a.Route("/users/:id/contracts").PostFunc(env.userContractsCreate)
+	a.Route("/contracts/:id").DeleteFunc(env.contractsDelete)
+	a.Route("/entries/:id/contract").PutFunc(env.entriesContract)
+	a.Route("/entries/:id/category").PutFunc(env.entriesCategory)
+	a.Route("/entries/:id/training/course").PutFunc(env.entriesTrainingCourse)
+	a.Route("/entries/:id/training/certificate").GetFunc(env.entriesCertificate)
+	a.Route("/entries/:id/training/certificate").PutFunc(env.entriesCertificateUpload)
+	a.Route("/entries/:id/training/certificate").DeleteFunc(env.entriesCertificateDelete)
+	a.Route("/categories").PostFunc(env.categoriesCreate)
+	a.Route("/categories/:id").PutFunc(env.categoriesEdit)
+	a.Route("/categories/:id").DeleteFunc(env.categoriesDelete)
+	a.Route("/users/:id/weekends/:date").PutFunc(env.userWeekendApprove)
+	a.Route("/users/:id/weekends/:date").DeleteFunc(env.userWeekendRevoke)
 	a.Route("/users/online/list").GetFunc(env.usersOnlineList)
+	a.Route("/stats").GetFunc(env.stats)
+	a.Route("/webhooks").GetFunc(env.webhooks)
+	a.Route("/webhooks").PostFunc(env.webhooksCreate)
+	a.Route("/webhooks/:id").DeleteFunc(env.webhooksDelete)
+	a.Route("/outbox").GetFunc(env.outbox)
+	a.Route("/outbox/replay").PostFunc(env.outboxReplayAll)
+	a.Route("/outbox/:id").GetFunc(env.outboxEvent)
+	a.Route("/outbox/:id/replay").PutFunc(env.outboxReplay)
+	a.Route("/jobs").GetFunc(env.jobs)
+	a.Route("/jobs/runs").GetFunc(env.jobRuns)
+	a.Route("/reports/benchmark").GetFunc(env.benchmark)
+	a.Route("/reports/ytd").GetFunc(env.yearToDateAll)
+	a.Route("/reports/training").GetFunc(env.trainingReportAll)
+	a.Route("/reports/probation").GetFunc(env.probationReportAll)
+	a.Route("/reports/month/export").GetFunc(env.monthReportExport)
+	a.Route("/payroll/export").GetFunc(env.payrollExport)
+	a.Route("/devices").PostFunc(env.devicesCreate)
+	a.Route("/devices/:id/site").PutFunc(env.deviceSite)
+	a.Route("/held-punches").GetFunc(env.heldPunches)
+	a.Route("/held-punches/:id").PutFunc(env.heldPunchResolve)
+	a.Route("/devices/:id/allowed-ips").PutFunc(env.deviceAllowedIPs)
+	a.Route("/devices/:id/certificate").PutFunc(env.deviceCertificate)
+	a.Route("/sites").GetFunc(env.sites)
+	a.Route("/sites").PostFunc(env.sitesCreate)
+	a.Route("/sites/:id").PutFunc(env.sitesEdit)
+	a.Route("/holidays").GetFunc(env.holidays)
+	a.Route("/holidays").PostFunc(env.holidaysCreate)
+	a.Route("/holidays/:id").PutFunc(env.holidaysEdit)
+	a.Route("/holidays/:id").DeleteFunc(env.holidaysDelete)
+	a.Route("/schedule-profiles").GetFunc(env.scheduleProfiles)
+	a.Route("/schedule-profiles").PostFunc(env.scheduleProfilesCreate)
+	a.Route("/schedule-profiles/:id").DeleteFunc(env.scheduleProfilesDelete)
+	a.Route("/schedule-profiles/:id/users/:uid").PutFunc(env.scheduleProfileUserAdd)
+	a.Route("/schedule-profiles/:id/users/:uid").DeleteFunc(env.scheduleProfileUserRemove)
+	a.Route("/holiday-calendars").GetFunc(env.holidayCalendars)
+	a.Route("/holiday-calendars").PostFunc(env.holidayCalendarsCreate)
+	a.Route("/holiday-calendars/:id").DeleteFunc(env.holidayCalendarsDelete)
+	a.Route("/holiday-calendars/:id/sync").PutFunc(env.holidayCalendarSync)
+	a.Route("/users/:id/site").PutFunc(env.userSite)
+	a.Route("/users/:id/payroll-id").PutFunc(env.userPayrollID)
+	a.Route("/users/:id/identities").GetFunc(env.userIdentities)
+	a.Route("/users/:id/identities/:system").PutFunc(env.userIdentity)
+	a.Route("/identities/:system/:externalId").GetFunc(env.identity)
+	a.Route("/users/:id/slack").PutFunc(env.userSlack)
+	a.Route("/users/:id/telegram").PutFunc(env.userTelegram)
+	a.Route("/users/:id/badge").PutFunc(env.userBadge)
+	wd := mux.Route("/w").MiddlewareFunc(env.requireSession).MiddlewareFunc(env.requirePolicy)
+	wd.Route("/musters").PostFunc(env.mustersStart)
+	wd.Route("/musters/:id").GetFunc(env.musterGet)
+	wd.Route("/musters/:id/users/:uid").PutFunc(env.musterAccountFor)
+	k := mux.Route("/k").MiddlewareFunc(env.requireKiosk)
+	k.Route("/badges/:badge").GetFunc(env.kioskView)
+	k.Route("/badges/:badge/punch").PutFunc(env.kioskPunch)
+	k.Route("/badges/:badge/greeting").GetFunc(env.kioskGreeting)
+	x := mux.Route("/x").MiddlewareFunc(env.requireExtension)
+	x.Route("/status").GetFunc(env.extensionStatus)
+	x.Route("/toggle").PutFunc(env.extensionToggle)
+	h := mux.Route("/h").MiddlewareFunc(env.requirePresence)
+	h.Route("/presence").PostFunc(env.presenceEvent)
+	d := mux.Route("/display").MiddlewareFunc(env.requireDisplay)
+	d.Route("/users/online/count").GetFunc(env.displayOnlineCount)
 }
 
 func do400(w http.ResponseWriter) {
@@ -44,11 +232,27 @@ func do400(w http.ResponseWriter) {
 	w.Write([]byte("400 Bad Request"))
 }
 
+// do400With tells the client what's wrong with the request
+func do400With(w http.ResponseWriter, reason string) {
+	w.WriteHeader(400)
+	w.Write([]byte("400 Bad Request: " + reason))
+}
+
 func do401(w http.ResponseWriter) {
 	w.WriteHeader(401)
 	w.Write([]byte("401 Unauthorized"))
 }
 
+func do404(w http.ResponseWriter) {
+	w.WriteHeader(404)
+	w.Write([]byte("404 Not Found"))
+}
+
+func do429(w http.ResponseWriter) {
+	w.WriteHeader(429)
+	w.Write([]byte("429 Too Many Requests"))
+}
+
 func do500(w http.ResponseWriter) {
 	w.WriteHeader(500)
 	w.Write([]byte("500 Internal Server Error"))
@@ -58,10 +262,52 @@ func (env *env) version(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte(strconv.Itoa(apiVersion)))
 }
 
+func (env *env) healthz(w http.ResponseWriter, r *http.Request) {
+	err := checkDB(env.db)
+	if err != nil {
+		logRequestError(r, err)
+		do503With(w, "database unavailable")
+		return
+	}
+	w.Write([]byte("ok"))
+}
+
+func (env *env) readyz(w http.ResponseWriter, r *http.Request) {
+	err := checkDB(env.db)
+	if err != nil {
+		logRequestError(r, err)
+		do503With(w, "database unavailable")
+		return
+	}
+
+	version, err := getSchemaVersion(env.db)
+	if err != nil {
+		logRequestError(r, err)
+		do503With(w, "database unavailable")
+		return
+	}
+	if version != schemaVersion {
+		do503With(w, fmt.Sprintf("schema version is %d, expected %d", version, schemaVersion))
+		return
+	}
+	w.Write([]byte("ok"))
+}
+
 func (env *env) corsMiddleware(w http.ResponseWriter, r *http.Request, n func(http.ResponseWriter, *http.Request)) {
-	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if strings.HasPrefix(r.URL.Path, "/x/") && len(env.extensionOrigins) > 0 {
+		// only the configured extensions may call the extension endpoints
+		w.Header().Set("Vary", "Origin")
+		for _, o := range env.extensionOrigins {
+			if r.Header.Get("Origin") == o {
+				w.Header().Set("Access-Control-Allow-Origin", o)
+			}
+		}
+	} else {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+	}
 	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS, PUT, DELETE")
 	w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+	w.Header().Set("Access-Control-Expose-Headers", "X-Next-Offset, X-Next-Cursor")
 	if r.Method == "OPTIONS" {
 		w.WriteHeader(200)
 	} else {
@@ -69,21 +315,31 @@ func (env *env) corsMiddleware(w http.ResponseWriter, r *http.Request, n func(ht
 	}
 }
 
-func (env *env) requireAdmin(w http.ResponseWriter, r *http.Request, n func(http.ResponseWriter, *http.Request)) {
+// requirePolicy lets the request through if the user meets the access policy's rule for the route,
+// routes without one are off limits
+func (env *env) requirePolicy(w http.ResponseWriter, r *http.Request, n func(http.ResponseWriter, *http.Request)) {
 	uid, ok := r.Context().Value(uidKey).(uidT)
 	if !ok {
-		fmt.Println(stacktrace.NewError("malformed context, use requireSession first"))
+		logRequestError(r, stacktrace.NewError("malformed context, use requireSession first"))
 		do500(w)
 		return
 	}
 
-	admin, err := checkAdmin(env.db, uid)
+	reqs, ok := policy.rule(r.Method, powermux.RequestPath(r))
+	if !ok {
+		do401(w)
+		return
+	}
+	allowed, err := checkPolicy(env.db, uid, reqs, routeUser(r))
 	if err != nil {
-		fmt.Println(stacktrace.Propagate(err, "checkAdmin failed"))
+		logRequestError(r, stacktrace.Propagate(err, "checkPolicy failed"))
 		do500(w)
 		return
 	}
-	if !admin {
+	if bgid, _ := r.Context().Value(breakGlassKey).(int); bgid != 0 && !allowed {
+		allowed = breakGlassAllows(reqs)
+	}
+	if !allowed {
 		do401(w)
 		return
 	}
@@ -106,16 +362,105 @@ func (env *env) requireSession(w http.ResponseWriter, r *http.Request, n func(ht
 		return
 	}
 
+	if country := r.Header.Get(env.countryHeader); env.countryHeader != "" && country != "" {
+		err = noteSessionCountry(env.db, sid, uid, country)
+		if err != nil {
+			logRequestError(r, stacktrace.Propagate(err, ""))
+		}
+	}
+
+	bgid, err := activeBreakGlass(env.db, sid, clk.Now())
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+
 	ctx := context.WithValue(r.Context(), sidKey, sid)
 	ctx = context.WithValue(ctx, uidKey, uid)
+	if bgid != 0 {
+		ctx = context.WithValue(ctx, breakGlassKey, bgid)
+		env.logBreakGlass(w, r.WithContext(ctx), n, bgid)
+		return
+	}
+	n(w, r.WithContext(ctx))
+}
+
+func (env *env) requireExtension(w http.ResponseWriter, r *http.Request, n func(http.ResponseWriter, *http.Request)) {
+	h := r.Header.Get("Authorization")
+	if !strings.HasPrefix(h, "Extension ") {
+		do401(w)
+		return
+	}
+
+	token := h[len("Extension "):]
+	if !env.extensionLimiter.allow(token) {
+		do429(w)
+		return
+	}
+
+	uid, err := getUserByExtensionToken(env.db, token)
+	if err != nil {
+		do401(w)
+		return
+	}
+
+	ctx := context.WithValue(r.Context(), uidKey, uid)
+	n(w, r.WithContext(ctx))
+}
+
+func (env *env) requirePresence(w http.ResponseWriter, r *http.Request, n func(http.ResponseWriter, *http.Request)) {
+	h := r.Header.Get("Authorization")
+	if !strings.HasPrefix(h, "Device ") {
+		do401(w)
+		return
+	}
+
+	d, err := getDeviceByToken(env.db, h[len("Device "):])
+	if err != nil || d.Kind != devicePresence || !d.allows(r) {
+		do401(w)
+		return
+	}
+
+	ctx := context.WithValue(r.Context(), deviceKey, d)
+	n(w, r.WithContext(ctx))
+}
+
+func (env *env) requireKiosk(w http.ResponseWriter, r *http.Request, n func(http.ResponseWriter, *http.Request)) {
+	h := r.Header.Get("Authorization")
+	if !strings.HasPrefix(h, "Device ") {
+		do401(w)
+		return
+	}
+
+	d, err := getDeviceByToken(env.db, h[len("Device "):])
+	if err != nil || d.Kind != deviceKiosk || !d.allows(r) {
+		do401(w)
+		return
+	}
+
+	ctx := context.WithValue(r.Context(), deviceKey, d)
+	n(w, r.WithContext(ctx))
+}
+
+// requireDisplay takes the token from the query string since the panels can only be given a URL,
+// which is fine because a display token can't do anything but read the online count
+func (env *env) requireDisplay(w http.ResponseWriter, r *http.Request, n func(http.ResponseWriter, *http.Request)) {
+	d, err := getDeviceByToken(env.db, r.URL.Query().Get("token"))
+	if err != nil || d.Kind != deviceDisplay || !d.allows(r) {
+		do401(w)
+		return
+	}
+
+	ctx := context.WithValue(r.Context(), deviceKey, d)
 	n(w, r.WithContext(ctx))
 }
 
 func (env *env) status(w http.ResponseWriter, r *http.Request) {
 	uid, ok := r.Context().Value(uidKey).(uidT)
 	if !ok {
-		fmt.Println(stacktrace.NewError("malformed context"))
-		do500(w)
+		logRequestError(r, stacktrace.NewError("malformed context"))
+		do500Or503(w, r)
 		return
 	}
 
@@ -125,36 +470,46 @@ func (env *env) status(w http.ResponseWriter, r *http.Request) {
 		Online        int    `json:"online"`
 		DeltaForMonth int    `json:"deltaForMonth"`
 		DeltaForDay   int    `json:"deltaForDay"`
+
+		ProjectedDeltaForMonth int `json:"projectedDeltaForMonth"` // if nothing more is worked this month
 	}{}
 
 	online, err := countOnlineUsers(env.db)
 	info.Online = online
 	if err != nil {
-		fmt.Println(stacktrace.Propagate(err, "failed to count online users"))
-		do500(w)
+		logRequestError(r, stacktrace.Propagate(err, "failed to count online users"))
+		do500Or503(w, r)
 		return
 	}
 
-	deltaForMonth, err := getDeltaForMonth(env.db, uid, time.Now())
+	now := clk.Now()
+	deltaForMonth, err := getDeltaForMonth(r.Context(), env.db, uid, now, deltaToDate)
 	info.DeltaForMonth = deltaForMonth
 	if err != nil {
-		fmt.Println(stacktrace.Propagate(err, "failed to get monthly delta"))
-		do500(w)
+		logRequestError(r, stacktrace.Propagate(err, "failed to get monthly delta"))
+		do500Or503(w, r)
+		return
+	}
+
+	info.ProjectedDeltaForMonth, err = getDeltaForMonth(r.Context(), env.db, uid, now, deltaProjected)
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, "failed to get projected monthly delta"))
+		do500Or503(w, r)
 		return
 	}
 
-	deltaForDay, err := getDeltaForDay(env.db, uid, time.Now())
+	deltaForDay, err := getDeltaForDay(r.Context(), env.db, uid, now)
 	info.DeltaForDay = deltaForDay
 	if err != nil {
-		fmt.Println(stacktrace.Propagate(err, "failed to get daily delta"))
-		do500(w)
+		logRequestError(r, stacktrace.Propagate(err, "failed to get daily delta"))
+		do500Or503(w, r)
 		return
 	}
 
 	err = env.db.QueryRow("SELECT state, since_unix_s FROM user_states WHERE uid = ?", uid).Scan(&info.State, &info.Since)
 	if err != nil {
-		fmt.Println(stacktrace.Propagate(err, "failed to get user info"))
-		do500(w)
+		logRequestError(r, stacktrace.Propagate(err, "failed to get user info"))
+		do500Or503(w, r)
 		return
 	}
 
@@ -165,15 +520,63 @@ func (env *env) status(w http.ResponseWriter, r *http.Request) {
 func (env *env) clockIn(w http.ResponseWriter, r *http.Request) {
 	uid, ok := r.Context().Value(uidKey).(uidT)
 	if !ok {
-		fmt.Println(stacktrace.NewError("malformed context"))
-		do500(w)
+		logRequestError(r, stacktrace.NewError("malformed context"))
+		do500Or503(w, r)
 		return
 	}
 
-	err := clockIn(env.db, uid)
+	// the expected end can be given either as a time (until) or a duration (for), both in seconds
+	err := r.ParseForm()
 	if err != nil {
-		fmt.Println(stacktrace.Propagate(err, "failed to clock in"))
-		do500(w)
+		do400(w)
+		return
+	}
+	var expectedEnd int64
+	if strUntil := r.Form.Get("until"); strUntil != "" {
+		expectedEnd, err = strconv.ParseInt(strUntil, 10, 64)
+		if err != nil || expectedEnd <= time.Now().Unix() {
+			do400(w)
+			return
+		}
+	} else if strFor := r.Form.Get("for"); strFor != "" {
+		duration, err := strconv.ParseInt(strFor, 10, 64)
+		if err != nil || duration <= 0 {
+			do400(w)
+			return
+		}
+		expectedEnd = time.Now().Unix() + duration
+	}
+	// the contract to attribute the time to, see clockInFrom for the default
+	var ctid ctidT
+	if strContract := r.Form.Get("contract"); strContract != "" {
+		intCTID, err := strconv.Atoi(strContract)
+		if err != nil {
+			do400(w)
+			return
+		}
+		ctid = ctidT(intCTID)
+		loc, err := userLocation(r.Context(), env.db, uid)
+		if err != nil {
+			logRequestError(r, stacktrace.Propagate(err, ""))
+			do500Or503(w, r)
+			return
+		}
+		ok, err := contractInEffect(env.db, uid, ctid, clk.Now().In(loc))
+		if err != nil {
+			logRequestError(r, stacktrace.Propagate(err, ""))
+			do500Or503(w, r)
+			return
+		}
+		if !ok {
+			do400With(w, "contract isn't in effect")
+			return
+		}
+	}
+
+	err = clockInUnder(r.Context(), env.db, uid, 0, expectedEnd, ctid)
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, "failed to clock in"))
+		do500Or503(w, r)
 		return
 	}
 }
@@ -181,157 +584,4931 @@ func (env *env) clockIn(w http.ResponseWriter, r *http.Request) {
 func (env *env) clockOut(w http.ResponseWriter, r *http.Request) {
 	uid, ok := r.Context().Value(uidKey).(uidT)
 	if !ok {
-		fmt.Println(stacktrace.NewError("malformed context"))
-		do500(w)
+		logRequestError(r, stacktrace.NewError("malformed context"))
+		do500Or503(w, r)
 		return
 	}
 
-	err := clockOut(env.db, uid)
+	err := clockOut(r.Context(), env.db, uid, 0)
 	if err != nil {
-		fmt.Println(stacktrace.Propagate(err, "failed to clock out"))
-		do500(w)
+		logRequestError(r, stacktrace.Propagate(err, "failed to clock out"))
+		do500Or503(w, r)
 		return
 	}
 }
 
-func (env *env) entries(w http.ResponseWriter, r *http.Request) {
+func (env *env) breakStart(w http.ResponseWriter, r *http.Request) {
 	uid, ok := r.Context().Value(uidKey).(uidT)
 	if !ok {
-		fmt.Println(stacktrace.NewError("malformed context"))
-		do500(w)
+		logRequestError(r, stacktrace.NewError("malformed context"))
+		do500Or503(w, r)
 		return
 	}
 
-	entries, err := listEntries(env.db, uid)
+	err := clockBreakStart(r.Context(), env.db, uid, 0)
 	if err != nil {
-		fmt.Println(stacktrace.Propagate(err, ""))
-		do500(w)
+		logRequestError(r, stacktrace.Propagate(err, "failed to start break"))
+		do500Or503(w, r)
 		return
 	}
-
-	js, _ := json.Marshal(entries)
-	w.Write([]byte(js))
 }
 
-func (env *env) entriesEdit(w http.ResponseWriter, r *http.Request) {
-	strEID := powermux.PathParam(r, "eid")
-	intEID, err := strconv.Atoi(strEID)
-	eid := eidT(intEID)
+func (env *env) breakEnd(w http.ResponseWriter, r *http.Request) {
+	uid, ok := r.Context().Value(uidKey).(uidT)
+	if !ok {
+		logRequestError(r, stacktrace.NewError("malformed context"))
+		do500Or503(w, r)
+		return
+	}
+
+	err := clockBreakEnd(r.Context(), env.db, uid, 0)
 	if err != nil {
-		do400(w)
+		logRequestError(r, stacktrace.Propagate(err, "failed to end break"))
+		do500Or503(w, r)
 		return
 	}
+}
 
-	err = r.ParseForm()
+func (env *env) weeklySummary(w http.ResponseWriter, r *http.Request) {
+	uid, ok := r.Context().Value(uidKey).(uidT)
+	if !ok {
+		logRequestError(r, stacktrace.NewError("malformed context"))
+		do500(w)
+		return
+	}
+
+	err := r.ParseForm()
 	if err != nil {
 		do400(w)
 		return
 	}
-	strFrom := r.Form.Get("from")
-	from, err := strconv.Atoi(strFrom)
+	enabled, err := strconv.ParseBool(r.Form.Get("enabled"))
 	if err != nil {
 		do400(w)
 		return
 	}
-	strTo := r.Form.Get("to")
-	to, err := strconv.Atoi(strTo)
+
+	err = setWeeklySummary(env.db, uid, enabled)
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+}
+
+func (env *env) timezone(w http.ResponseWriter, r *http.Request) {
+	uid, ok := r.Context().Value(uidKey).(uidT)
+	if !ok {
+		logRequestError(r, stacktrace.NewError("malformed context"))
+		do500(w)
+		return
+	}
+
+	env.writeTimezone(w, r, uid)
+}
+
+func (env *env) userTimezone(w http.ResponseWriter, r *http.Request) {
+	intUID, err := strconv.Atoi(powermux.PathParam(r, "id"))
 	if err != nil {
 		do400(w)
 		return
 	}
 
-	if to < from {
+	env.writeTimezone(w, r, uidT(intUID))
+}
+
+// writeTimezone sets the user's time zone to the form value timezone, an IANA name like Europe/Berlin
+// or empty for the server's
+func (env *env) writeTimezone(w http.ResponseWriter, r *http.Request, uid uidT) {
+	err := r.ParseForm()
+	if err != nil {
 		do400(w)
 		return
 	}
+	tz := r.Form.Get("timezone")
+	if err = checkTimezone(tz); err != nil {
+		do400With(w, err.Error())
+		return
+	}
 
-	err = editEntry(env.db, eid, from, to)
+	err = setTimezone(env.db, uid, tz)
 	if err != nil {
-		fmt.Println(stacktrace.Propagate(err, ""))
+		logRequestError(r, stacktrace.Propagate(err, ""))
 		do500(w)
 		return
 	}
 }
 
-func (env *env) entriesDelete(w http.ResponseWriter, r *http.Request) {
-	strEID := powermux.PathParam(r, "eid")
-	intEID, err := strconv.Atoi(strEID)
-	eid := eidT(intEID)
+func (env *env) heartbeat(w http.ResponseWriter, r *http.Request) {
+	uid, ok := r.Context().Value(uidKey).(uidT)
+	if !ok {
+		logRequestError(r, stacktrace.NewError("malformed context"))
+		do500(w)
+		return
+	}
+
+	in, err := heartbeat(env.db, uid)
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+	if !in {
+		do400(w) // there's nothing to keep alive
+		return
+	}
+}
+
+func (env *env) idleReport(w http.ResponseWriter, r *http.Request) {
+	uid, ok := r.Context().Value(uidKey).(uidT)
+	if !ok {
+		logRequestError(r, stacktrace.NewError("malformed context"))
+		do500(w)
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		do400(w)
+		return
+	}
+	from, err := strconv.ParseInt(r.Form.Get("from"), 10, 64)
 	if err != nil {
 		do400(w)
 		return
 	}
+	to, err := strconv.ParseInt(r.Form.Get("to"), 10, 64)
+	if err != nil || to <= from {
+		do400(w)
+		return
+	}
 
-	err = deleteEntry(env.db, eid)
+	suggested, err := reportIdle(env.db, uid, from, to)
 	if err != nil {
-		fmt.Println(stacktrace.Propagate(err, ""))
+		logRequestError(r, stacktrace.Propagate(err, ""))
 		do500(w)
 		return
 	}
+
+	js, _ := json.Marshal(struct {
+		Suggested bool `json:"suggested"`
+	}{suggested})
+	w.Write([]byte(js))
 }
 
-func (env *env) usersOnlineCount(w http.ResponseWriter, r *http.Request) {
-	onlineUsers, err := countOnlineUsers(env.db)
+func (env *env) idleList(w http.ResponseWriter, r *http.Request) {
+	uid, ok := r.Context().Value(uidKey).(uidT)
+	if !ok {
+		logRequestError(r, stacktrace.NewError("malformed context"))
+		do500(w)
+		return
+	}
+
+	ips, err := listPendingIdle(env.db, uid)
 	if err != nil {
-		fmt.Print(stacktrace.Propagate(err, "failed to count online users"))
+		logRequestError(r, stacktrace.Propagate(err, ""))
 		do500(w)
 		return
 	}
 
-	w.Write([]byte(strconv.Itoa(onlineUsers)))
+	js, _ := json.Marshal(ips)
+	w.Write([]byte(js))
 }
 
-func (env *env) usersOnlineList(w http.ResponseWriter, r *http.Request) {
-	onlineUsers, err := listOnlineUsers(env.db)
-	if err != nil {
-		fmt.Print(stacktrace.Propagate(err, "failed to list online users"))
+// idleResolve confirms (action=confirm) or dismisses (action=dismiss) a break suggestion
+func (env *env) idleResolve(w http.ResponseWriter, r *http.Request) {
+	uid, ok := r.Context().Value(uidKey).(uidT)
+	if !ok {
+		logRequestError(r, stacktrace.NewError("malformed context"))
 		do500(w)
 		return
 	}
 
-	if onlineUsers == nil { // empty list
-		onlineUsers = make([]onlineUser, 0) // doesn't marshal to null
+	intIPID, err := strconv.Atoi(powermux.PathParam(r, "id"))
+	if err != nil {
+		do400(w)
+		return
+	}
+	err = r.ParseForm()
+	if err != nil {
+		do400(w)
+		return
 	}
 
-	js, _ := json.Marshal(onlineUsers)
-	w.Write([]byte(js))
+	var found bool
+	switch r.Form.Get("action") {
+	case "confirm":
+		found, err = confirmIdle(env.db, uid, ipidT(intIPID))
+	case "dismiss":
+		found, err = dismissIdle(env.db, uid, ipidT(intIPID))
+	default:
+		do400(w)
+		return
+	}
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+	if !found {
+		do404(w)
+		return
+	}
 }
 
-func (env *env) authorize(w http.ResponseWriter, r *http.Request) {
-	body, err := ioutil.ReadAll(r.Body)
+func (env *env) extensionTokenCreate(w http.ResponseWriter, r *http.Request) {
+	uid, ok := r.Context().Value(uidKey).(uidT)
+	if !ok {
+		logRequestError(r, stacktrace.NewError("malformed context"))
+		do500(w)
+		return
+	}
+
+	token, err := createExtensionToken(env.db, uid)
 	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, ""))
 		do500(w)
 		return
 	}
 
-	type form struct {
-		Email    string `json:"email"`
-		Password string `json:"password"`
+	js, _ := json.Marshal(struct {
+		Token string `json:"token"`
+	}{token})
+	w.Write([]byte(js))
+}
+
+func (env *env) extensionTokenRevoke(w http.ResponseWriter, r *http.Request) {
+	uid, ok := r.Context().Value(uidKey).(uidT)
+	if !ok {
+		logRequestError(r, stacktrace.NewError("malformed context"))
+		do500(w)
+		return
 	}
-	f := form{}
-	json.Unmarshal(body, &f)
 
-	uid, err := emailToUID(env.db, f.Email)
+	err := revokeExtensionToken(env.db, uid)
 	if err != nil {
-		do401(w)
+		logRequestError(r, stacktrace.Propagate(err, ""))
+		do500(w)
 		return
 	}
+}
 
-	ok := checkPassword(env.db, uid, f.Password)
+// calendarTokenCreate responds with a new calendar token and, if WMS2_PUBLIC_URL is set, the feed's URL
+func (env *env) calendarTokenCreate(w http.ResponseWriter, r *http.Request) {
+	uid, ok := r.Context().Value(uidKey).(uidT)
 	if !ok {
-		do401(w)
+		logRequestError(r, stacktrace.NewError("malformed context"))
+		do500(w)
 		return
 	}
 
-	sid, err := createSession(env.db, uid, time.Hour*24*31)
+	token, err := createCalendarToken(env.db, uid)
 	if err != nil {
-		fmt.Println(stacktrace.Propagate(err, "failed to create a session"))
+		logRequestError(r, stacktrace.Propagate(err, ""))
 		do500(w)
 		return
 	}
 
+	url := ""
+	if publicURL != "" {
+		url = publicURL + "/ical/" + token
+	}
 	js, _ := json.Marshal(struct {
-		Token sidT `json:"token"`
-	}{sid})
+		Token string `json:"token"`
+		URL   string `json:"url,omitempty"`
+	}{token, url})
+	w.Write([]byte(js))
+}
+
+func (env *env) calendarTokenRevoke(w http.ResponseWriter, r *http.Request) {
+	uid, ok := r.Context().Value(uidKey).(uidT)
+	if !ok {
+		logRequestError(r, stacktrace.NewError("malformed context"))
+		do500(w)
+		return
+	}
+
+	err := revokeCalendarToken(env.db, uid)
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+}
+
+// icalFeed is what calendar apps subscribe to, the token in the path is all they have to authenticate with
+func (env *env) icalFeed(w http.ResponseWriter, r *http.Request) {
+	token := powermux.PathParam(r, "token")
+	if !env.calendarLimiter.allow(token) {
+		do429(w)
+		return
+	}
+	uid, found, err := getUserByCalendarToken(env.db, token)
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+	if !found {
+		do404(w)
+		return
+	}
+
+	var buf bytes.Buffer
+	err = writeICalFeed(env.db, &buf, uid)
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, "failed to write calendar feed"))
+		do500(w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	w.Write(buf.Bytes())
+}
+
+func (env *env) extensionStatus(w http.ResponseWriter, r *http.Request) {
+	uid, ok := r.Context().Value(uidKey).(uidT)
+	if !ok {
+		logRequestError(r, stacktrace.NewError("malformed context"))
+		do500Or503(w, r)
+		return
+	}
+
+	s, err := getExtensionStatus(r.Context(), env.db, uid)
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, ""))
+		do500Or503(w, r)
+		return
+	}
+
+	js, _ := json.Marshal(s)
+	w.Write([]byte(js))
+}
+
+// extensionToggle clocks the user out if they're in and in otherwise, responding with the new status
+func (env *env) extensionToggle(w http.ResponseWriter, r *http.Request) {
+	uid, ok := r.Context().Value(uidKey).(uidT)
+	if !ok {
+		logRequestError(r, stacktrace.NewError("malformed context"))
+		do500Or503(w, r)
+		return
+	}
+
+	err := togglePunch(r.Context(), env.db, uid, 0)
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, ""))
+		do500Or503(w, r)
+		return
+	}
+
+	env.extensionStatus(w, r)
+}
+
+// presenceEvent takes person (the user's email) and event (enter or leave)
+func (env *env) presenceEvent(w http.ResponseWriter, r *http.Request) {
+	d, ok := r.Context().Value(deviceKey).(device)
+	if !ok {
+		logRequestError(r, stacktrace.NewError("malformed context"))
+		do500Or503(w, r)
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		do400(w)
+		return
+	}
+	var kind userState
+	switch r.Form.Get("event") {
+	case "enter":
+		kind = stateIn
+	case "leave":
+		kind = stateOut
+	default:
+		do400(w)
+		return
+	}
+
+	uid, err := emailToUID(env.db, r.Form.Get("person"))
+	if err != nil {
+		do404(w)
+		return
+	}
+
+	action, err := handlePresence(r.Context(), env.db, d.DID, uid, kind)
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, ""))
+		do500Or503(w, r)
+		return
+	}
+
+	js, _ := json.Marshal(struct {
+		Action string `json:"action"`
+	}{action})
+	w.Write([]byte(js))
+}
+
+func (env *env) presenceMode(w http.ResponseWriter, r *http.Request) {
+	uid, ok := r.Context().Value(uidKey).(uidT)
+	if !ok {
+		logRequestError(r, stacktrace.NewError("malformed context"))
+		do500(w)
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		do400(w)
+		return
+	}
+	mode := r.Form.Get("mode")
+	if mode != presenceOff && mode != presenceSuggest && mode != presencePunch {
+		do400(w)
+		return
+	}
+
+	err = setPresenceMode(env.db, uid, mode)
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+}
+
+func (env *env) suggestions(w http.ResponseWriter, r *http.Request) {
+	uid, ok := r.Context().Value(uidKey).(uidT)
+	if !ok {
+		logRequestError(r, stacktrace.NewError("malformed context"))
+		do500(w)
+		return
+	}
+
+	pss, err := listPendingSuggestions(env.db, uid)
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+
+	js, _ := json.Marshal(pss)
+	w.Write([]byte(js))
+}
+
+// suggestionResolve accepts (action=accept) or dismisses (action=dismiss) a punch suggestion
+func (env *env) suggestionResolve(w http.ResponseWriter, r *http.Request) {
+	uid, ok := r.Context().Value(uidKey).(uidT)
+	if !ok {
+		logRequestError(r, stacktrace.NewError("malformed context"))
+		do500Or503(w, r)
+		return
+	}
+
+	psid, err := strconv.Atoi(powermux.PathParam(r, "id"))
+	if err != nil {
+		do400(w)
+		return
+	}
+	err = r.ParseForm()
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	var found bool
+	switch r.Form.Get("action") {
+	case "accept":
+		found, err = acceptSuggestion(r.Context(), env.db, uid, psid)
+	case "dismiss":
+		found, err = dismissSuggestion(env.db, uid, psid)
+	default:
+		do400(w)
+		return
+	}
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, ""))
+		do500Or503(w, r)
+		return
+	}
+	if !found {
+		do404(w)
+		return
+	}
+}
+
+func (env *env) heldPunches(w http.ResponseWriter, r *http.Request) {
+	hps, err := listHeldPunches(env.db)
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+
+	js, _ := json.Marshal(hps)
+	w.Write([]byte(js))
+}
+
+// heldPunchResolve approves (action=approve) the user at the kiosk of a held punch,
+// applying their held punches there, or rejects (action=reject) the punch
+func (env *env) heldPunchResolve(w http.ResponseWriter, r *http.Request) {
+	hpid, err := strconv.Atoi(powermux.PathParam(r, "id"))
+	if err != nil {
+		do400(w)
+		return
+	}
+	err = r.ParseForm()
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	var found bool
+	switch r.Form.Get("action") {
+	case "approve":
+		found, err = approveHeldPunch(r.Context(), env.db, hpid)
+	case "reject":
+		found, err = rejectHeldPunch(env.db, hpid)
+	default:
+		do400(w)
+		return
+	}
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, ""))
+		do500Or503(w, r)
+		return
+	}
+	if !found {
+		do404(w)
+		return
+	}
+}
+
+func (env *env) entries(w http.ResponseWriter, r *http.Request) {
+	uid, ok := r.Context().Value(uidKey).(uidT)
+	if !ok {
+		logRequestError(r, stacktrace.NewError("malformed context"))
+		do500(w)
+		return
+	}
+
+	env.writeEntries(w, r, uid)
+}
+
+func (env *env) entriesExport(w http.ResponseWriter, r *http.Request) {
+	uid, ok := r.Context().Value(uidKey).(uidT)
+	if !ok {
+		logRequestError(r, stacktrace.NewError("malformed context"))
+		do500(w)
+		return
+	}
+
+	env.writeEntriesExport(w, r, exportScope{UID: uid})
+}
+
+// allEntriesExport exports the entries of the user given as uid, of everyone at the site given as site,
+// or of everyone
+func (env *env) allEntriesExport(w http.ResponseWriter, r *http.Request) {
+	var scope exportScope
+	q := r.URL.Query()
+	if s := q.Get("uid"); s != "" {
+		uid, err := strconv.Atoi(s)
+		if err != nil {
+			do400(w)
+			return
+		}
+		scope.UID = uidT(uid)
+	}
+	if s := q.Get("site"); s != "" {
+		stid, err := strconv.Atoi(s)
+		if err != nil {
+			do400(w)
+			return
+		}
+		scope.Site = stidT(stid)
+	}
+
+	env.writeEntriesExport(w, r, scope)
+}
+
+// writeEntriesExport streams the entries in scope matching parseEntryFilter as CSV, columns is a comma
+// separated list of exportColumns
+func (env *env) writeEntriesExport(w http.ResponseWriter, r *http.Request, scope exportScope) {
+	filter, err := parseEntryFilter(r)
+	if err != nil {
+		do400With(w, err.Error())
+		return
+	}
+	columns, err := parseExportColumns(r.URL.Query().Get("columns"))
+	if err != nil {
+		do400With(w, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", `attachment; filename="entries.csv"`)
+	err = writeEntriesCSV(env.db, w, scope, filter, columns)
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, "failed to write entries CSV"))
+	}
+}
+
+func (env *env) userEntries(w http.ResponseWriter, r *http.Request) {
+	intUID, err := strconv.Atoi(powermux.PathParam(r, "id"))
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	env.writeEntries(w, r, uidT(intUID))
+}
+
+// writeEntries responds with the entries matching parseEntryFilter, a page of them if offset or limit
+// are given, see parsePage. If there are more, X-Next-Offset is the offset of the next page.
+func (env *env) writeEntries(w http.ResponseWriter, r *http.Request, uid uidT) {
+	filter, err := parseEntryFilter(r)
+	if err != nil {
+		do400With(w, err.Error())
+		return
+	}
+
+	offset, limit, paged, err := parsePage(r)
+	if err != nil {
+		do400With(w, err.Error())
+		return
+	}
+
+	entries, more, err := listEntries(r.Context(), env.db, uid, filter, offset, limit)
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, ""))
+		do500Or503(w, r)
+		return
+	}
+	if more && !paged {
+		do400With(w, fmt.Sprintf("more than %d entries, narrow down the range or ask for pages", maxListLength))
+		return
+	}
+	if more {
+		w.Header().Set("X-Next-Offset", strconv.Itoa(offset+limit))
+	}
+
+	js, _ := json.Marshal(entries)
+	w.Write([]byte(js))
+}
+
+// changes responds with the entries that changed after the cursor query parameter, 0 for all of them
+func (env *env) changes(w http.ResponseWriter, r *http.Request) {
+	uid, ok := r.Context().Value(uidKey).(uidT)
+	if !ok {
+		logRequestError(r, stacktrace.NewError("malformed context"))
+		do500(w)
+		return
+	}
+
+	var cursor int64
+	if strCursor := r.URL.Query().Get("cursor"); strCursor != "" {
+		var err error
+		cursor, err = strconv.ParseInt(strCursor, 10, 64)
+		if err != nil {
+			do400With(w, "cursor has to be a number")
+			return
+		}
+	}
+
+	cf, err := listChanges(env.db, uid, cursor, maxListLength)
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+
+	js, _ := json.Marshal(cf)
+	w.Write([]byte(js))
+}
+
+func (env *env) punches(w http.ResponseWriter, r *http.Request) {
+	uid, ok := r.Context().Value(uidKey).(uidT)
+	if !ok {
+		logRequestError(r, stacktrace.NewError("malformed context"))
+		do500(w)
+		return
+	}
+
+	env.writePunches(w, r, uid)
+}
+
+func (env *env) userPunches(w http.ResponseWriter, r *http.Request) {
+	intUID, err := strconv.Atoi(powermux.PathParam(r, "id"))
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	env.writePunches(w, r, uidT(intUID))
+}
+
+// writePunches responds with the punches in the range given by parseRange
+func (env *env) writePunches(w http.ResponseWriter, r *http.Request, uid uidT) {
+	from, to, err := parseRange(r)
+	if err != nil {
+		do400With(w, err.Error())
+		return
+	}
+
+	punches, tooMany, err := listPunches(env.db, uid, from, to, maxListLength)
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+	if tooMany {
+		do400With(w, fmt.Sprintf("more than %d punches, narrow down the range", maxListLength))
+		return
+	}
+
+	js, _ := json.Marshal(punches)
+	w.Write([]byte(js))
+}
+
+func (env *env) userAuditor(w http.ResponseWriter, r *http.Request) {
+	intUID, err := strconv.Atoi(powermux.PathParam(r, "id"))
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	err = r.ParseForm()
+	if err != nil {
+		do400(w)
+		return
+	}
+	auditor, err := strconv.ParseBool(r.Form.Get("auditor"))
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	err = setAuditor(env.db, uidT(intUID), auditor)
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+}
+
+// userTarget takes hours, what the user is expected to work per working day
+func (env *env) userTarget(w http.ResponseWriter, r *http.Request) {
+	intUID, err := strconv.Atoi(powermux.PathParam(r, "id"))
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	err = r.ParseForm()
+	if err != nil {
+		do400(w)
+		return
+	}
+	hours, err := strconv.ParseFloat(r.Form.Get("hours"), 64)
+	if err != nil || hours < 0 || hours > 24 {
+		do400With(w, "hours has to be between 0 and 24")
+		return
+	}
+
+	err = setDailyTarget(env.db, uidT(intUID), int(hours*3600))
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+}
+
+// userContract takes cap, the monthly hours a contractor may work (0 for a regular user),
+// and optionally sponsor, the uid of the user who gets notified along with them
+func (env *env) userContract(w http.ResponseWriter, r *http.Request) {
+	intUID, err := strconv.Atoi(powermux.PathParam(r, "id"))
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	err = r.ParseForm()
+	if err != nil {
+		do400(w)
+		return
+	}
+	hours, err := strconv.ParseFloat(r.Form.Get("cap"), 64)
+	if err != nil || hours < 0 || hours > 31*24 {
+		do400With(w, "cap has to be the monthly hours, 0 for none")
+		return
+	}
+	sponsor := 0
+	if s := r.Form.Get("sponsor"); s != "" {
+		sponsor, err = strconv.Atoi(s)
+		if err != nil {
+			do400(w)
+			return
+		}
+		if _, err = uidToEmail(env.db, uidT(sponsor)); err != nil {
+			do400With(w, "no such sponsor")
+			return
+		}
+	}
+
+	err = setContract(env.db, uidT(intUID), int(hours*3600), uidT(sponsor))
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+}
+
+func (env *env) devicesCreate(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		do400(w)
+		return
+	}
+	name := r.Form.Get("name")
+	kind := r.Form.Get("kind")
+	if kind == "" {
+		kind = deviceKiosk
+	}
+	if name == "" || (kind != deviceKiosk && kind != deviceDisplay && kind != devicePresence) {
+		do400(w)
+		return
+	}
+	if err := checkText("name", name, maxNameLength); err != nil {
+		do400With(w, err.Error())
+		return
+	}
+	stid := 1 // the site created with the database
+	if strSite := r.Form.Get("site"); strSite != "" {
+		stid, err = strconv.Atoi(strSite)
+		if err != nil {
+			do400(w)
+			return
+		}
+	}
+
+	d, err := createDevice(env.db, name, kind, stidT(stid))
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+
+	js, _ := json.Marshal(d)
+	w.Write([]byte(js))
+}
+
+func (env *env) userBadge(w http.ResponseWriter, r *http.Request) {
+	intUID, err := strconv.Atoi(powermux.PathParam(r, "id"))
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	err = r.ParseForm()
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	badge := r.Form.Get("badge")
+	if err := checkText("badge", badge, maxBadgeLength); err != nil {
+		do400With(w, err.Error())
+		return
+	}
+
+	taken, err := setBadge(env.db, uidT(intUID), badge)
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+	if taken {
+		do400With(w, "the badge is another user's")
+		return
+	}
+}
+
+func (env *env) kioskView(w http.ResponseWriter, r *http.Request) {
+	d, ok := r.Context().Value(deviceKey).(device)
+	if !ok {
+		logRequestError(r, stacktrace.NewError("malformed context"))
+		do500Or503(w, r)
+		return
+	}
+
+	uid, err := badgeToUID(env.db, powermux.PathParam(r, "badge"))
+	if err != nil {
+		env.badgeFailed(d)
+		do401(w)
+		return
+	}
+
+	v, err := getKioskView(r.Context(), env.db, uid)
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, ""))
+		do500Or503(w, r)
+		return
+	}
+
+	js, _ := json.Marshal(v)
+	w.Write([]byte(js))
+}
+
+func (env *env) kioskPunch(w http.ResponseWriter, r *http.Request) {
+	d, ok := r.Context().Value(deviceKey).(device)
+	if !ok {
+		logRequestError(r, stacktrace.NewError("malformed context"))
+		do500Or503(w, r)
+		return
+	}
+
+	uid, err := badgeToUID(env.db, powermux.PathParam(r, "badge"))
+	if err != nil {
+		env.badgeFailed(d)
+		do401(w)
+		return
+	}
+
+	held, err := kioskPunch(r.Context(), env.db, uid, d.DID)
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, "failed to punch"))
+		do500Or503(w, r)
+		return
+	}
+
+	v, err := getKioskView(r.Context(), env.db, uid)
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, ""))
+		do500Or503(w, r)
+		return
+	}
+	v.Held = held
+
+	js, _ := json.Marshal(v)
+	w.Write([]byte(js))
+}
+
+// kioskGreeting is what the kiosk shows after a punch, see greeting.go
+func (env *env) kioskGreeting(w http.ResponseWriter, r *http.Request) {
+	d, ok := r.Context().Value(deviceKey).(device)
+	if !ok {
+		logRequestError(r, stacktrace.NewError("malformed context"))
+		do500Or503(w, r)
+		return
+	}
+
+	uid, err := badgeToUID(env.db, powermux.PathParam(r, "badge"))
+	if err != nil {
+		env.badgeFailed(d)
+		do401(w)
+		return
+	}
+
+	g, err := getKioskGreeting(r.Context(), env.db, uid)
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, ""))
+		do500Or503(w, r)
+		return
+	}
+
+	js, _ := json.Marshal(g)
+	w.Write([]byte(js))
+}
+
+func (env *env) kioskProfile(w http.ResponseWriter, r *http.Request) {
+	uid, ok := r.Context().Value(uidKey).(uidT)
+	if !ok {
+		logRequestError(r, stacktrace.NewError("malformed context"))
+		do500(w)
+		return
+	}
+
+	env.writeKioskProfile(w, r, uid)
+}
+
+func (env *env) userKioskProfile(w http.ResponseWriter, r *http.Request) {
+	intUID, err := strconv.Atoi(powermux.PathParam(r, "id"))
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	env.writeKioskProfile(w, r, uidT(intUID))
+}
+
+// writeKioskProfile sets the name and language (en, de, fr or es) kiosks greet the user with
+// to the form values name and language, empty for the defaults
+func (env *env) writeKioskProfile(w http.ResponseWriter, r *http.Request, uid uidT) {
+	err := r.ParseForm()
+	if err != nil {
+		do400(w)
+		return
+	}
+	name, language := strings.TrimSpace(r.Form.Get("name")), r.Form.Get("language")
+	if err = checkText("name", name, maxNameLength); err != nil {
+		do400With(w, err.Error())
+		return
+	}
+	if err = checkLanguage(language); err != nil {
+		do400With(w, err.Error())
+		return
+	}
+
+	found, err := setKioskProfile(env.db, uid, name, language)
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+	if !found {
+		do404(w)
+		return
+	}
+}
+
+func (env *env) photo(w http.ResponseWriter, r *http.Request) {
+	uid, ok := r.Context().Value(uidKey).(uidT)
+	if !ok {
+		logRequestError(r, stacktrace.NewError("malformed context"))
+		do500(w)
+		return
+	}
+
+	env.writePhoto(w, r, uid)
+}
+
+func (env *env) userPhoto(w http.ResponseWriter, r *http.Request) {
+	intUID, err := strconv.Atoi(powermux.PathParam(r, "id"))
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	env.writePhoto(w, r, uidT(intUID))
+}
+
+// writePhoto sets the user's photo to the request body, a JPEG, PNG, GIF or WebP image
+func (env *env) writePhoto(w http.ResponseWriter, r *http.Request, uid uidT) {
+	photo, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		do413(w)
+		return
+	}
+	if len(photo) > maxPhotoSize {
+		do400With(w, fmt.Sprintf("the photo can be at most %d bytes", maxPhotoSize))
+		return
+	}
+	if photoType(photo) == "" {
+		do400With(w, "the photo has to be a JPEG, PNG, GIF or WebP image")
+		return
+	}
+
+	env.savePhoto(w, r, uid, photo)
+}
+
+func (env *env) photoDelete(w http.ResponseWriter, r *http.Request) {
+	uid, ok := r.Context().Value(uidKey).(uidT)
+	if !ok {
+		logRequestError(r, stacktrace.NewError("malformed context"))
+		do500(w)
+		return
+	}
+
+	env.savePhoto(w, r, uid, nil)
+}
+
+func (env *env) userPhotoDelete(w http.ResponseWriter, r *http.Request) {
+	intUID, err := strconv.Atoi(powermux.PathParam(r, "id"))
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	env.savePhoto(w, r, uidT(intUID), nil)
+}
+
+func (env *env) savePhoto(w http.ResponseWriter, r *http.Request, uid uidT, photo []byte) {
+	found, err := setPhoto(env.db, uid, photo)
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+	if !found {
+		do404(w)
+		return
+	}
+}
+
+func (env *env) userWarden(w http.ResponseWriter, r *http.Request) {
+	intUID, err := strconv.Atoi(powermux.PathParam(r, "id"))
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	err = r.ParseForm()
+	if err != nil {
+		do400(w)
+		return
+	}
+	warden, err := strconv.ParseBool(r.Form.Get("warden"))
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	err = setWarden(env.db, uidT(intUID), warden)
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+}
+
+func (env *env) mustersStart(w http.ResponseWriter, r *http.Request) {
+	uid, ok := r.Context().Value(uidKey).(uidT)
+	if !ok {
+		logRequestError(r, stacktrace.NewError("malformed context"))
+		do500(w)
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		do400(w)
+		return
+	}
+	stid := 0
+	if strSite := r.Form.Get("site"); strSite != "" {
+		stid, err = strconv.Atoi(strSite)
+		if err != nil {
+			do400(w)
+			return
+		}
+	}
+
+	mid, err := startMuster(env.db, uid, stidT(stid))
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, "failed to start muster"))
+		do500(w)
+		return
+	}
+
+	m, err := getMuster(env.db, mid)
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+
+	js, _ := json.Marshal(m)
+	w.Write([]byte(js))
+}
+
+func (env *env) musterGet(w http.ResponseWriter, r *http.Request) {
+	mid, err := strconv.Atoi(powermux.PathParam(r, "id"))
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	m, err := getMuster(env.db, mid)
+	if stacktrace.RootCause(err) == sql.ErrNoRows {
+		do404(w)
+		return
+	}
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+
+	js, _ := json.Marshal(m)
+	w.Write([]byte(js))
+}
+
+func (env *env) musterAccountFor(w http.ResponseWriter, r *http.Request) {
+	warden, ok := r.Context().Value(uidKey).(uidT)
+	if !ok {
+		logRequestError(r, stacktrace.NewError("malformed context"))
+		do500(w)
+		return
+	}
+
+	mid, err := strconv.Atoi(powermux.PathParam(r, "id"))
+	if err != nil {
+		do400(w)
+		return
+	}
+	intUID, err := strconv.Atoi(powermux.PathParam(r, "uid"))
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	found, err := accountFor(env.db, mid, uidT(intUID), warden)
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+	if !found {
+		do404(w)
+		return
+	}
+}
+
+func (env *env) displayOnlineCount(w http.ResponseWriter, r *http.Request) {
+	d, ok := r.Context().Value(deviceKey).(device)
+	if !ok {
+		logRequestError(r, stacktrace.NewError("malformed context"))
+		do500(w)
+		return
+	}
+
+	onlineUsers, err := countOnlineUsersAt(env.db, d.Site)
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, "failed to count online users"))
+		do500(w)
+		return
+	}
+
+	w.Write([]byte(strconv.Itoa(onlineUsers)))
+}
+
+func (env *env) sites(w http.ResponseWriter, r *http.Request) {
+	sites, err := listSites(env.db)
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+
+	js, _ := json.Marshal(sites)
+	w.Write([]byte(js))
+}
+
+func (env *env) sitesCreate(w http.ResponseWriter, r *http.Request) {
+	s, err := parseSite(r)
+	if err != nil {
+		do400With(w, stacktrace.RootCause(err).Error())
+		return
+	}
+
+	s.STID, err = createSite(env.db, s)
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+
+	js, _ := json.Marshal(s)
+	w.Write([]byte(js))
+}
+
+func (env *env) sitesEdit(w http.ResponseWriter, r *http.Request) {
+	stid, err := strconv.Atoi(powermux.PathParam(r, "id"))
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	s, err := parseSite(r)
+	if err != nil {
+		do400With(w, stacktrace.RootCause(err).Error())
+		return
+	}
+	s.STID = stidT(stid)
+
+	err = updateSite(env.db, s)
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+}
+
+// holidays lists the holidays of the year given as year, the current one by default
+func (env *env) holidays(w http.ResponseWriter, r *http.Request) {
+	year := time.Now().Year()
+	if s := r.URL.Query().Get("year"); s != "" {
+		var err error
+		year, err = strconv.Atoi(s)
+		if err != nil {
+			do400(w)
+			return
+		}
+	}
+
+	hs, err := listHolidays(env.db, year)
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+
+	js, _ := json.Marshal(hs)
+	w.Write([]byte(js))
+}
+
+// parseHoliday reads a holiday from the form values date, name and site (optional, all sites if not given)
+func parseHoliday(r *http.Request) (h holiday, err error) {
+	err = r.ParseForm()
+	if err != nil {
+		return h, err
+	}
+
+	h.Date = r.Form.Get("date")
+	h.Name = r.Form.Get("name")
+	if s := r.Form.Get("site"); s != "" {
+		stid, err := strconv.Atoi(s)
+		if err != nil {
+			return h, err
+		}
+		h.Site = stidT(stid)
+	}
+
+	return h, h.validate()
+}
+
+func (env *env) holidaysCreate(w http.ResponseWriter, r *http.Request) {
+	h, err := parseHoliday(r)
+	if err != nil {
+		do400With(w, stacktrace.RootCause(err).Error())
+		return
+	}
+
+	h.HID, err = createHoliday(env.db, h)
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+
+	js, _ := json.Marshal(h)
+	w.Write([]byte(js))
+}
+
+func (env *env) holidaysEdit(w http.ResponseWriter, r *http.Request) {
+	hid, err := strconv.Atoi(powermux.PathParam(r, "id"))
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	h, err := parseHoliday(r)
+	if err != nil {
+		do400With(w, stacktrace.RootCause(err).Error())
+		return
+	}
+	h.HID = hidT(hid)
+
+	found, err := updateHoliday(env.db, h)
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+	if !found {
+		do404(w)
+		return
+	}
+}
+
+func (env *env) scheduleProfiles(w http.ResponseWriter, r *http.Request) {
+	sps, err := listProfiles(env.db)
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+
+	js, _ := json.Marshal(sps)
+	w.Write([]byte(js))
+}
+
+// scheduleProfilesCreate takes the form values name, from, to, hours (the daily target while the profile lasts),
+// and optionally weekdays (like mon,fri), site and users (comma separated uids)
+func (env *env) scheduleProfilesCreate(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		do400(w)
+		return
+	}
+	hours, err := strconv.ParseFloat(r.Form.Get("hours"), 64)
+	if err != nil {
+		do400With(w, "hours has to be between 0 and 24")
+		return
+	}
+	sp := scheduleProfile{
+		Name:     r.Form.Get("name"),
+		From:     r.Form.Get("from"),
+		To:       r.Form.Get("to"),
+		Target:   int(hours * 3600),
+		Weekdays: []string{},
+		Users:    []uidT{},
+	}
+	if s := r.Form.Get("weekdays"); s != "" {
+		sp.Weekdays = strings.Split(s, ",")
+	}
+	if s := r.Form.Get("site"); s != "" {
+		stid, err := strconv.Atoi(s)
+		if err != nil {
+			do400(w)
+			return
+		}
+		sp.Site = stidT(stid)
+	}
+	if s := r.Form.Get("users"); s != "" {
+		for _, strUID := range strings.Split(s, ",") {
+			uid, err := strconv.Atoi(strUID)
+			if err != nil {
+				do400(w)
+				return
+			}
+			if _, err = uidToEmail(env.db, uidT(uid)); err != nil {
+				do400With(w, fmt.Sprintf("unknown user %d", uid))
+				return
+			}
+			sp.Users = append(sp.Users, uidT(uid))
+		}
+	}
+	if err = sp.validate(); err != nil {
+		do400With(w, stacktrace.RootCause(err).Error())
+		return
+	}
+
+	sp.SPID, err = createProfile(env.db, sp)
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+
+	js, _ := json.Marshal(sp)
+	w.Write([]byte(js))
+}
+
+func (env *env) scheduleProfilesDelete(w http.ResponseWriter, r *http.Request) {
+	spid, err := strconv.Atoi(powermux.PathParam(r, "id"))
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	found, err := deleteProfile(env.db, spidT(spid))
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+	if !found {
+		do404(w)
+		return
+	}
+}
+
+// parseProfileUser reads the profile and user ids of /a/schedule-profiles/:id/users/:uid
+func parseProfileUser(r *http.Request) (spid spidT, uid uidT, ok bool) {
+	intSPID, err := strconv.Atoi(powermux.PathParam(r, "id"))
+	if err != nil {
+		return 0, 0, false
+	}
+	intUID, err := strconv.Atoi(powermux.PathParam(r, "uid"))
+	if err != nil {
+		return 0, 0, false
+	}
+	return spidT(intSPID), uidT(intUID), true
+}
+
+func (env *env) scheduleProfileUserAdd(w http.ResponseWriter, r *http.Request) {
+	spid, uid, ok := parseProfileUser(r)
+	if !ok {
+		do400(w)
+		return
+	}
+
+	found, err := addProfileUser(env.db, spid, uid)
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+	if !found {
+		do404(w)
+		return
+	}
+}
+
+func (env *env) scheduleProfileUserRemove(w http.ResponseWriter, r *http.Request) {
+	spid, uid, ok := parseProfileUser(r)
+	if !ok {
+		do400(w)
+		return
+	}
+
+	found, err := removeProfileUser(env.db, spid, uid)
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+	if !found {
+		do404(w)
+		return
+	}
+}
+
+func (env *env) holidayCalendars(w http.ResponseWriter, r *http.Request) {
+	hcs, err := listHolidayCalendars(env.db)
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+
+	js, _ := json.Marshal(hcs)
+	w.Write([]byte(js))
+}
+
+// holidayCalendarsCreate takes the form values url and site (optional, all sites if not given)
+// and syncs the new calendar right away. It responds with the calendar, lastError says if the sync failed.
+func (env *env) holidayCalendarsCreate(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		do400(w)
+		return
+	}
+	hc := holidayCalendar{URL: r.Form.Get("url")}
+	if s := r.Form.Get("site"); s != "" {
+		stid, err := strconv.Atoi(s)
+		if err != nil {
+			do400(w)
+			return
+		}
+		hc.Site = stidT(stid)
+	}
+	if err = hc.validate(); err != nil {
+		do400With(w, stacktrace.RootCause(err).Error())
+		return
+	}
+
+	hc.HCID, err = createHolidayCalendar(env.db, hc)
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+	env.writeHolidayCalendarSync(w, r, hc.HCID)
+}
+
+// holidayCalendarSync syncs the calendar now, it responds like holidayCalendarsCreate
+func (env *env) holidayCalendarSync(w http.ResponseWriter, r *http.Request) {
+	hcid, err := strconv.Atoi(powermux.PathParam(r, "id"))
+	if err != nil {
+		do400(w)
+		return
+	}
+	env.writeHolidayCalendarSync(w, r, hcidT(hcid))
+}
+
+func (env *env) writeHolidayCalendarSync(w http.ResponseWriter, r *http.Request, hcid hcidT) {
+	hc, found, err := getHolidayCalendar(env.db, hcid)
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+	if !found {
+		do404(w)
+		return
+	}
+
+	err = runJob(env.db, jobHolidays, func() (int, error) { return syncHolidayCalendar(env.db, hc) })
+	if err != nil {
+		logRequestError(r, err)
+	}
+
+	hc, _, err = getHolidayCalendar(env.db, hcid)
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+	js, _ := json.Marshal(hc)
+	w.Write([]byte(js))
+}
+
+// holidayCalendarsDelete deletes the calendar and the holidays synced from it
+func (env *env) holidayCalendarsDelete(w http.ResponseWriter, r *http.Request) {
+	hcid, err := strconv.Atoi(powermux.PathParam(r, "id"))
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	found, err := deleteHolidayCalendar(env.db, hcidT(hcid))
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+	if !found {
+		do404(w)
+		return
+	}
+}
+
+func (env *env) holidaysDelete(w http.ResponseWriter, r *http.Request) {
+	hid, err := strconv.Atoi(powermux.PathParam(r, "id"))
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	found, err := deleteHoliday(env.db, hidT(hid))
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+	if !found {
+		do404(w)
+		return
+	}
+}
+
+func (env *env) schoolDays(w http.ResponseWriter, r *http.Request) {
+	uid, ok := r.Context().Value(uidKey).(uidT)
+	if !ok {
+		logRequestError(r, stacktrace.NewError("malformed context"))
+		do500(w)
+		return
+	}
+
+	env.writeSchoolDays(w, r, uid)
+}
+
+func (env *env) userSchoolDays(w http.ResponseWriter, r *http.Request) {
+	intUID, err := strconv.Atoi(powermux.PathParam(r, "id"))
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	env.writeSchoolDays(w, r, uidT(intUID))
+}
+
+func (env *env) writeSchoolDays(w http.ResponseWriter, r *http.Request, uid uidT) {
+	sds, err := listSchoolDays(env.db, uid)
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+
+	js, _ := json.Marshal(sds)
+	w.Write([]byte(js))
+}
+
+// userSchoolDaysCreate takes the form values weekdays (like tue or mon,thu), from and to
+func (env *env) userSchoolDaysCreate(w http.ResponseWriter, r *http.Request) {
+	intUID, err := strconv.Atoi(powermux.PathParam(r, "id"))
+	if err != nil {
+		do400(w)
+		return
+	}
+	if _, err = uidToEmail(env.db, uidT(intUID)); err != nil {
+		do404(w)
+		return
+	}
+
+	err = r.ParseForm()
+	if err != nil {
+		do400(w)
+		return
+	}
+	sd := schoolDays{UID: uidT(intUID), From: r.Form.Get("from"), To: r.Form.Get("to"), Weekdays: []string{}}
+	if s := r.Form.Get("weekdays"); s != "" {
+		sd.Weekdays = strings.Split(s, ",")
+	}
+	if err = sd.validate(); err != nil {
+		do400With(w, stacktrace.RootCause(err).Error())
+		return
+	}
+
+	sd.SDID, err = createSchoolDays(env.db, sd)
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+
+	js, _ := json.Marshal(sd)
+	w.Write([]byte(js))
+}
+
+func (env *env) schoolDaysDelete(w http.ResponseWriter, r *http.Request) {
+	sdid, err := strconv.Atoi(powermux.PathParam(r, "id"))
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	found, err := deleteSchoolDays(env.db, sdidT(sdid))
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+	if !found {
+		do404(w)
+		return
+	}
+}
+
+func (env *env) contracts(w http.ResponseWriter, r *http.Request) {
+	uid, ok := r.Context().Value(uidKey).(uidT)
+	if !ok {
+		logRequestError(r, stacktrace.NewError("malformed context"))
+		do500(w)
+		return
+	}
+
+	env.writeContracts(w, r, uid)
+}
+
+func (env *env) userContracts(w http.ResponseWriter, r *http.Request) {
+	intUID, err := strconv.Atoi(powermux.PathParam(r, "id"))
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	env.writeContracts(w, r, uidT(intUID))
+}
+
+func (env *env) writeContracts(w http.ResponseWriter, r *http.Request, uid uidT) {
+	cs, err := listContracts(env.db, uid)
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+
+	js, _ := json.Marshal(cs)
+	w.Write([]byte(js))
+}
+
+// userContractsCreate takes the form values name, hours (the daily target), from,
+// and optionally costCenter and to
+func (env *env) userContractsCreate(w http.ResponseWriter, r *http.Request) {
+	intUID, err := strconv.Atoi(powermux.PathParam(r, "id"))
+	if err != nil {
+		do400(w)
+		return
+	}
+	if _, err = uidToEmail(env.db, uidT(intUID)); err != nil {
+		do404(w)
+		return
+	}
+
+	err = r.ParseForm()
+	if err != nil {
+		do400(w)
+		return
+	}
+	hours, err := strconv.ParseFloat(r.Form.Get("hours"), 64)
+	if err != nil {
+		do400With(w, "hours has to be between 0 and 24")
+		return
+	}
+	c := contract{
+		UID:        uidT(intUID),
+		Name:       r.Form.Get("name"),
+		CostCenter: r.Form.Get("costCenter"),
+		Target:     int(hours * 3600),
+		From:       r.Form.Get("from"),
+		To:         r.Form.Get("to"),
+	}
+	if err = c.validate(); err != nil {
+		do400With(w, stacktrace.RootCause(err).Error())
+		return
+	}
+
+	c.CTID, err = createContract(env.db, c)
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+
+	js, _ := json.Marshal(c)
+	w.Write([]byte(js))
+}
+
+func (env *env) contractsDelete(w http.ResponseWriter, r *http.Request) {
+	ctid, err := strconv.Atoi(powermux.PathParam(r, "id"))
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	found, err := deleteContract(env.db, ctidT(ctid))
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+	if !found {
+		do404(w)
+		return
+	}
+}
+
+// entriesContract attributes the entry to the contract in the form value contract, 0 for none
+func (env *env) entriesContract(w http.ResponseWriter, r *http.Request) {
+	by, ok := r.Context().Value(uidKey).(uidT)
+	if !ok {
+		logRequestError(r, stacktrace.NewError("malformed context"))
+		do500(w)
+		return
+	}
+	eid, err := strconv.Atoi(powermux.PathParam(r, "id"))
+	if err != nil {
+		do400(w)
+		return
+	}
+	err = r.ParseForm()
+	if err != nil {
+		do400(w)
+		return
+	}
+	ctid, err := strconv.Atoi(r.Form.Get("contract"))
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	found, err := setEntryContract(env.db, eidT(eid), ctidT(ctid), by)
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+	if !found {
+		do404(w)
+		return
+	}
+}
+
+func (env *env) entryCategory(w http.ResponseWriter, r *http.Request) {
+	uid, ok := r.Context().Value(uidKey).(uidT)
+	if !ok {
+		logRequestError(r, stacktrace.NewError("malformed context"))
+		do500(w)
+		return
+	}
+
+	env.writeEntryCategory(w, r, uid, uid)
+}
+
+func (env *env) entriesCategory(w http.ResponseWriter, r *http.Request) {
+	by, ok := r.Context().Value(uidKey).(uidT)
+	if !ok {
+		logRequestError(r, stacktrace.NewError("malformed context"))
+		do500(w)
+		return
+	}
+
+	env.writeEntryCategory(w, r, 0, by)
+}
+
+// writeEntryCategory puts the entry in the category given as the form value category, 0 for none.
+// If owner isn't 0 the entry has to be theirs.
+func (env *env) writeEntryCategory(w http.ResponseWriter, r *http.Request, owner, by uidT) {
+	eid, err := strconv.Atoi(powermux.PathParam(r, "id"))
+	if err != nil {
+		do400(w)
+		return
+	}
+	err = r.ParseForm()
+	if err != nil {
+		do400(w)
+		return
+	}
+	catid, err := strconv.Atoi(r.Form.Get("category"))
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	found, err := setEntryCategory(env.db, eidT(eid), catidT(catid), owner, by)
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+	if !found {
+		do404(w)
+		return
+	}
+}
+
+func (env *env) entryTrainingCourse(w http.ResponseWriter, r *http.Request) {
+	uid, ok := r.Context().Value(uidKey).(uidT)
+	if !ok {
+		logRequestError(r, stacktrace.NewError("malformed context"))
+		do500(w)
+		return
+	}
+
+	env.writeTrainingCourse(w, r, uid)
+}
+
+func (env *env) entriesTrainingCourse(w http.ResponseWriter, r *http.Request) {
+	env.writeTrainingCourse(w, r, 0)
+}
+
+// writeTrainingCourse sets the course of a training entry to the form value course, empty to remove it.
+// If owner isn't 0 the entry has to be theirs.
+func (env *env) writeTrainingCourse(w http.ResponseWriter, r *http.Request, owner uidT) {
+	eid, err := strconv.Atoi(powermux.PathParam(r, "id"))
+	if err != nil {
+		do400(w)
+		return
+	}
+	err = r.ParseForm()
+	if err != nil {
+		do400(w)
+		return
+	}
+	course := strings.TrimSpace(r.Form.Get("course"))
+	if err = checkText("course", course, maxNameLength); err != nil {
+		do400With(w, err.Error())
+		return
+	}
+
+	found, err := setTrainingCourse(env.db, eidT(eid), owner, course)
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+	if !found {
+		do404(w)
+		return
+	}
+}
+
+func (env *env) entryCertificate(w http.ResponseWriter, r *http.Request) {
+	uid, ok := r.Context().Value(uidKey).(uidT)
+	if !ok {
+		logRequestError(r, stacktrace.NewError("malformed context"))
+		do500(w)
+		return
+	}
+
+	env.writeCertificate(w, r, uid)
+}
+
+func (env *env) entriesCertificate(w http.ResponseWriter, r *http.Request) {
+	env.writeCertificate(w, r, 0)
+}
+
+// writeCertificate sends the certificate of a training entry, if owner isn't 0 the entry has to be theirs
+func (env *env) writeCertificate(w http.ResponseWriter, r *http.Request, owner uidT) {
+	eid, err := strconv.Atoi(powermux.PathParam(r, "id"))
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	certificate, contentType, found, err := getCertificate(env.db, eidT(eid), owner)
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+	if !found {
+		do404(w)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="certificate-%d"`, eid))
+	w.Write(certificate)
+}
+
+func (env *env) entryCertificateUpload(w http.ResponseWriter, r *http.Request) {
+	uid, ok := r.Context().Value(uidKey).(uidT)
+	if !ok {
+		logRequestError(r, stacktrace.NewError("malformed context"))
+		do500(w)
+		return
+	}
+
+	env.uploadCertificate(w, r, uid)
+}
+
+func (env *env) entriesCertificateUpload(w http.ResponseWriter, r *http.Request) {
+	env.uploadCertificate(w, r, 0)
+}
+
+// uploadCertificate sets the certificate of a training entry to the request body, a PDF, JPEG or PNG
+func (env *env) uploadCertificate(w http.ResponseWriter, r *http.Request, owner uidT) {
+	certificate, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		do413(w)
+		return
+	}
+	if certificateType(certificate) == "" {
+		do400With(w, "the certificate has to be a PDF, JPEG or PNG")
+		return
+	}
+
+	env.saveCertificate(w, r, owner, certificate)
+}
+
+func (env *env) entryCertificateDelete(w http.ResponseWriter, r *http.Request) {
+	uid, ok := r.Context().Value(uidKey).(uidT)
+	if !ok {
+		logRequestError(r, stacktrace.NewError("malformed context"))
+		do500(w)
+		return
+	}
+
+	env.saveCertificate(w, r, uid, nil)
+}
+
+func (env *env) entriesCertificateDelete(w http.ResponseWriter, r *http.Request) {
+	env.saveCertificate(w, r, 0, nil)
+}
+
+func (env *env) saveCertificate(w http.ResponseWriter, r *http.Request, owner uidT, certificate []byte) {
+	eid, err := strconv.Atoi(powermux.PathParam(r, "id"))
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	found, err := setCertificate(env.db, eidT(eid), owner, certificate)
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+	if !found {
+		do404(w)
+		return
+	}
+}
+
+func (env *env) trainingReport(w http.ResponseWriter, r *http.Request) {
+	uid, ok := r.Context().Value(uidKey).(uidT)
+	if !ok {
+		logRequestError(r, stacktrace.NewError("malformed context"))
+		do500(w)
+		return
+	}
+
+	env.writeTrainingReport(w, r, uid)
+}
+
+func (env *env) userTrainingReport(w http.ResponseWriter, r *http.Request) {
+	intUID, err := strconv.Atoi(powermux.PathParam(r, "id"))
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	env.writeTrainingReport(w, r, uidT(intUID))
+}
+
+// writeTrainingReport sends the user's training in the year given as year, the current one by default
+func (env *env) writeTrainingReport(w http.ResponseWriter, r *http.Request, uid uidT) {
+	through, ok := parseYearThrough(r)
+	if !ok {
+		do400(w)
+		return
+	}
+
+	users, err := listReportUsers(env.db, uid, 0)
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+	if len(users) == 0 {
+		do404(w)
+		return
+	}
+	tr, err := getTrainingReport(env.db, users[0], through.Year(), true)
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, "failed to get training report"))
+		do500(w)
+		return
+	}
+
+	js, _ := json.Marshal(tr)
+	w.Write([]byte(js))
+}
+
+// trainingReportAll sends everyone's training hours in the year given as year, the current one by default
+func (env *env) trainingReportAll(w http.ResponseWriter, r *http.Request) {
+	through, ok := parseYearThrough(r)
+	if !ok {
+		do400(w)
+		return
+	}
+
+	trs, err := listTrainingReports(env.db, through.Year())
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, "failed to list training reports"))
+		do500(w)
+		return
+	}
+
+	js, _ := json.Marshal(trs)
+	w.Write([]byte(js))
+}
+
+// userHired sets the day the user was hired to the form value date, like 2026-04-01, or empty if it isn't known
+func (env *env) userHired(w http.ResponseWriter, r *http.Request) {
+	intUID, err := strconv.Atoi(powermux.PathParam(r, "id"))
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	err = r.ParseForm()
+	if err != nil {
+		do400(w)
+		return
+	}
+	date := r.Form.Get("date")
+	if _, err = time.Parse(holidayDate, date); date != "" && err != nil {
+		do400With(w, "date has to be like 2026-04-01")
+		return
+	}
+
+	found, err := setHired(env.db, uidT(intUID), date)
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+	if !found {
+		do404(w)
+		return
+	}
+}
+
+// userMerge moves the records of user from (a form value) to the user, see merge.go. It responds with the merge,
+// or 409 and the entries of from that overlap the user's like entriesEdit.
+func (env *env) userMerge(w http.ResponseWriter, r *http.Request) {
+	by, ok := r.Context().Value(uidKey).(uidT)
+	if !ok {
+		logRequestError(r, stacktrace.NewError("malformed context"))
+		do500(w)
+		return
+	}
+	intUID, err := strconv.Atoi(powermux.PathParam(r, "id"))
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	err = r.ParseForm()
+	if err != nil {
+		do400(w)
+		return
+	}
+	from, err := strconv.Atoi(r.Form.Get("from"))
+	if err != nil {
+		do400With(w, "from has to be the uid of the user to merge")
+		return
+	}
+
+	err = checkMerge(env.db, uidT(from), uidT(intUID))
+	if err != nil {
+		do400With(w, stacktrace.RootCause(err).Error())
+		return
+	}
+	m, err := mergeUsers(env.db, uidT(from), uidT(intUID), by)
+	if oe, ok := err.(*mergeOverlapError); ok {
+		js, _ := json.Marshal(struct {
+			Error string `json:"error"`
+			*mergeOverlapError
+		}{"overlap", oe})
+		w.WriteHeader(409)
+		w.Write([]byte(js))
+		return
+	}
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, "failed to merge users"))
+		do500(w)
+		return
+	}
+
+	js, _ := json.Marshal(m)
+	w.Write([]byte(js))
+}
+
+func (env *env) merges(w http.ResponseWriter, r *http.Request) {
+	ms, err := listMerges(env.db)
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+
+	js, _ := json.Marshal(ms)
+	w.Write([]byte(js))
+}
+
+func (env *env) mergesUndo(w http.ResponseWriter, r *http.Request) {
+	by, ok := r.Context().Value(uidKey).(uidT)
+	if !ok {
+		logRequestError(r, stacktrace.NewError("malformed context"))
+		do500(w)
+		return
+	}
+	mgid, err := strconv.Atoi(powermux.PathParam(r, "id"))
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	found, err := undoMerge(env.db, mgid, by)
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+	if !found {
+		do404(w) // there's no such merge or it was undone
+		return
+	}
+}
+
+// userProbationReport sends how the user did during probation so far, or all of it if it's over
+func (env *env) userProbationReport(w http.ResponseWriter, r *http.Request) {
+	intUID, err := strconv.Atoi(powermux.PathParam(r, "id"))
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	pr, found, err := getProbationReport(env.db, uidT(intUID), clk.Now())
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, "failed to get probation report"))
+		do500(w)
+		return
+	}
+	if !found {
+		do404(w)
+		return
+	}
+
+	js, _ := json.Marshal(pr)
+	w.Write([]byte(js))
+}
+
+// probationReportAll sends the probation reports of everyone who's on probation today
+func (env *env) probationReportAll(w http.ResponseWriter, r *http.Request) {
+	prs, err := listProbationReports(env.db, clk.Now())
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, "failed to list probation reports"))
+		do500(w)
+		return
+	}
+
+	js, _ := json.Marshal(prs)
+	w.Write([]byte(js))
+}
+
+func (env *env) categories(w http.ResponseWriter, r *http.Request) {
+	cs, err := listCategories(env.db)
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+
+	js, _ := json.Marshal(cs)
+	w.Write([]byte(js))
+}
+
+func parseCategory(r *http.Request) (c category, err error) {
+	err = r.ParseForm()
+	if err != nil {
+		return c, err
+	}
+
+	c = category{Name: r.Form.Get("name"), Label: r.Form.Get("label"), Color: r.Form.Get("color")}
+	return c, c.validate()
+}
+
+func (env *env) categoriesCreate(w http.ResponseWriter, r *http.Request) {
+	c, err := parseCategory(r)
+	if err != nil {
+		do400With(w, stacktrace.RootCause(err).Error())
+		return
+	}
+
+	var taken bool
+	c.CATID, taken, err = createCategory(env.db, c)
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+	if taken {
+		do400With(w, "there's a category with that name already")
+		return
+	}
+
+	js, _ := json.Marshal(c)
+	w.Write([]byte(js))
+}
+
+func (env *env) categoriesEdit(w http.ResponseWriter, r *http.Request) {
+	catid, err := strconv.Atoi(powermux.PathParam(r, "id"))
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	c, err := parseCategory(r)
+	if err != nil {
+		do400With(w, stacktrace.RootCause(err).Error())
+		return
+	}
+	c.CATID = catidT(catid)
+
+	found, err := updateCategory(env.db, c)
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+	if !found {
+		do404(w)
+		return
+	}
+}
+
+func (env *env) categoriesDelete(w http.ResponseWriter, r *http.Request) {
+	catid, err := strconv.Atoi(powermux.PathParam(r, "id"))
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	found, err := deleteCategory(env.db, catidT(catid))
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+	if !found {
+		do404(w)
+		return
+	}
+}
+
+// parseUserWeekend reads the user id and weekend date (like 2006-01-02) of /a/users/:id/weekends/:date
+func parseUserWeekend(r *http.Request) (uid uidT, date time.Time, ok bool) {
+	intUID, err := strconv.Atoi(powermux.PathParam(r, "id"))
+	if err != nil {
+		return 0, date, false
+	}
+	date, err = time.ParseInLocation(holidayDate, powermux.PathParam(r, "date"), time.Local)
+	if err != nil || !isWeekend(date) {
+		return 0, date, false
+	}
+	return uidT(intUID), date, true
+}
+
+// userWeekendApprove lets the user work on a weekend day, see weekendApproval
+func (env *env) userWeekendApprove(w http.ResponseWriter, r *http.Request) {
+	by, ok := r.Context().Value(uidKey).(uidT)
+	if !ok {
+		logRequestError(r, stacktrace.NewError("malformed context"))
+		do500(w)
+		return
+	}
+	uid, date, ok := parseUserWeekend(r)
+	if !ok {
+		do400(w)
+		return
+	}
+
+	if _, err := uidToEmail(env.db, uid); err != nil {
+		do404(w)
+		return
+	}
+
+	err := approveWeekend(env.db, uid, date, by)
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+}
+
+func (env *env) userWeekendRevoke(w http.ResponseWriter, r *http.Request) {
+	uid, date, ok := parseUserWeekend(r)
+	if !ok {
+		do400(w)
+		return
+	}
+
+	found, err := revokeWeekendApproval(env.db, uid, date)
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+	if !found {
+		do404(w)
+		return
+	}
+}
+
+func (env *env) userSite(w http.ResponseWriter, r *http.Request) {
+	intUID, err := strconv.Atoi(powermux.PathParam(r, "id"))
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	err = r.ParseForm()
+	if err != nil {
+		do400(w)
+		return
+	}
+	stid, err := strconv.Atoi(r.Form.Get("site"))
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	err = setUserSite(env.db, uidT(intUID), stidT(stid))
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+}
+
+// userPayrollID takes the form value payrollId, empty to use the uid again
+func (env *env) userPayrollID(w http.ResponseWriter, r *http.Request) {
+	intUID, err := strconv.Atoi(powermux.PathParam(r, "id"))
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	err = r.ParseForm()
+	if err != nil {
+		do400(w)
+		return
+	}
+	payrollID := r.Form.Get("payrollId")
+	if err = checkText("payrollId", payrollID, maxPayrollIDLength); err != nil {
+		do400With(w, err.Error())
+		return
+	}
+	if strings.ContainsAny(payrollID, "; ") {
+		do400With(w, "payrollId can't contain spaces or semicolons")
+		return
+	}
+
+	found, err := setPayrollID(env.db, uidT(intUID), payrollID)
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+	if !found {
+		do404(w)
+		return
+	}
+}
+
+// userIdentities sends the user's ids in other systems by system, see identity.go
+func (env *env) userIdentities(w http.ResponseWriter, r *http.Request) {
+	intUID, err := strconv.Atoi(powermux.PathParam(r, "id"))
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	ids, found, err := getIdentities(env.db, uidT(intUID))
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+	if !found {
+		do404(w)
+		return
+	}
+
+	js, _ := json.Marshal(ids)
+	w.Write([]byte(js))
+}
+
+// userIdentity sets the user's id in the system to the form value id, an empty one removes it
+func (env *env) userIdentity(w http.ResponseWriter, r *http.Request) {
+	intUID, err := strconv.Atoi(powermux.PathParam(r, "id"))
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	err = r.ParseForm()
+	if err != nil {
+		do400(w)
+		return
+	}
+	system, id := powermux.PathParam(r, "system"), r.Form.Get("id")
+	err = checkIdentity(env.db, uidT(intUID), system, id)
+	if err != nil {
+		do400With(w, stacktrace.RootCause(err).Error())
+		return
+	}
+
+	found, taken, err := setIdentity(env.db, uidT(intUID), system, id)
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+	if !found {
+		do404(w)
+		return
+	}
+	if taken {
+		do400With(w, fmt.Sprintf("%s id %q is another user's", system, id))
+		return
+	}
+}
+
+// identity sends the uid of the user with the id in the system, for imports
+func (env *env) identity(w http.ResponseWriter, r *http.Request) {
+	system := powermux.PathParam(r, "system")
+	if _, ok := identityLengths[system]; !ok {
+		do404(w)
+		return
+	}
+
+	uid, found, err := identityToUID(env.db, system, powermux.PathParam(r, "externalId"))
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+	if !found {
+		do404(w)
+		return
+	}
+
+	js, _ := json.Marshal(struct {
+		UID uidT `json:"uid"`
+	}{uid})
+	w.Write([]byte(js))
+}
+
+// userSlack maps the Slack user given as slackUser, like U012AB3CD, to the user, or removes the mapping if it's empty
+func (env *env) userSlack(w http.ResponseWriter, r *http.Request) {
+	intUID, err := strconv.Atoi(powermux.PathParam(r, "id"))
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	err = r.ParseForm()
+	if err != nil {
+		do400(w)
+		return
+	}
+	slackID := r.Form.Get("slackUser")
+	if err = checkText("slackUser", slackID, maxSlackIDLength); err != nil {
+		do400With(w, err.Error())
+		return
+	}
+	if _, err = uidToEmail(env.db, uidT(intUID)); err != nil {
+		do404(w)
+		return
+	}
+
+	err = setSlackUser(env.db, uidT(intUID), slackID)
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+}
+
+// slackCommand runs a slash command of the Slack app, see slack.go. Slack shows replies with
+// response_type in_channel to the channel, and ephemeral ones only to whoever sent the command.
+func (env *env) slackCommand(w http.ResponseWriter, r *http.Request) {
+	if env.slackSecret == "" {
+		do404(w)
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		do413(w)
+		return
+	}
+	if !verifySlackRequest(env.slackSecret, r.Header.Get("X-Slack-Request-Timestamp"),
+		r.Header.Get("X-Slack-Signature"), body) {
+		do401(w)
+		return
+	}
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	respond := func(responseType, text string) {
+		w.Header().Set("Content-Type", "application/json")
+		js, _ := json.Marshal(struct {
+			ResponseType string `json:"response_type"`
+			Text         string `json:"text"`
+		}{responseType, text})
+		w.Write([]byte(js))
+	}
+
+	uid, found, err := getUserBySlackID(env.db, form.Get("user_id"))
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, ""))
+		respond("ephemeral", "Something went wrong, try again later.")
+		return
+	}
+	if !found {
+		respond("ephemeral", "Your Slack account isn't linked to wms2 yet, ask an admin to link it.")
+		return
+	}
+
+	reply, known, err := runSlackCommand(r.Context(), env.db, uid, form.Get("command"))
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, "failed to run slack command"))
+		respond("ephemeral", "Something went wrong, try again later.")
+		return
+	}
+	if !known {
+		respond("ephemeral", "Unknown command, try /clockin, /clockout or /balance.")
+		return
+	}
+	respond("in_channel", reply)
+}
+
+// userTelegram maps the Telegram user with the numeric id given as telegramUser to the user,
+// or removes the mapping if it's empty
+func (env *env) userTelegram(w http.ResponseWriter, r *http.Request) {
+	intUID, err := strconv.Atoi(powermux.PathParam(r, "id"))
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	err = r.ParseForm()
+	if err != nil {
+		do400(w)
+		return
+	}
+	var telegramID int64
+	if s := r.Form.Get("telegramUser"); s != "" {
+		telegramID, err = strconv.ParseInt(s, 10, 64)
+		if err != nil || telegramID <= 0 {
+			do400With(w, "telegramUser has to be a Telegram user id")
+			return
+		}
+	}
+	if _, err = uidToEmail(env.db, uidT(intUID)); err != nil {
+		do404(w)
+		return
+	}
+
+	err = setTelegramUser(env.db, uidT(intUID), telegramID)
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+}
+
+// telegramUpdate handles an update of the Telegram bot, see telegram.go. Updates that aren't commands
+// are acknowledged without a reply, Telegram would send them again otherwise.
+func (env *env) telegramUpdate(w http.ResponseWriter, r *http.Request) {
+	if env.telegramSecret == "" {
+		do404(w)
+		return
+	}
+	token := r.Header.Get("X-Telegram-Bot-Api-Secret-Token")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(env.telegramSecret)) != 1 {
+		do401(w)
+		return
+	}
+	var u telegramUpdate
+	err := json.NewDecoder(r.Body).Decode(&u)
+	if err != nil {
+		do400(w)
+		return
+	}
+	if u.Message == nil || u.Message.From == nil {
+		return
+	}
+	command := telegramCommand(u.Message.Text)
+	if command == "" {
+		return
+	}
+
+	respond := func(text string) {
+		w.Header().Set("Content-Type", "application/json")
+		js, _ := json.Marshal(struct {
+			Method string `json:"method"`
+			ChatID int64  `json:"chat_id"`
+			Text   string `json:"text"`
+		}{"sendMessage", u.Message.Chat.ID, text})
+		w.Write([]byte(js))
+	}
+
+	uid, found, err := getUserByTelegramID(env.db, u.Message.From.ID)
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, ""))
+		respond("Something went wrong, try again later.")
+		return
+	}
+	if !found {
+		respond(fmt.Sprintf("Your Telegram account isn't linked to wms2 yet, ask an admin to link it to your user id %d.",
+			u.Message.From.ID))
+		return
+	}
+
+	reply, known, err := runTelegramCommand(r.Context(), env.db, uid, command)
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, "failed to run telegram command"))
+		respond("Something went wrong, try again later.")
+		return
+	}
+	if !known {
+		respond("Unknown command, try /in, /out or /today.")
+		return
+	}
+	respond(reply)
+}
+
+func (env *env) deviceSite(w http.ResponseWriter, r *http.Request) {
+	did, err := strconv.Atoi(powermux.PathParam(r, "id"))
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	err = r.ParseForm()
+	if err != nil {
+		do400(w)
+		return
+	}
+	stid, err := strconv.Atoi(r.Form.Get("site"))
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	err = setDeviceSite(env.db, didT(did), stidT(stid))
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+}
+
+// deviceAllowedIPs takes ips, a comma separated list of IPs and CIDR ranges, empty for any
+func (env *env) deviceAllowedIPs(w http.ResponseWriter, r *http.Request) {
+	did, err := strconv.Atoi(powermux.PathParam(r, "id"))
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	err = r.ParseForm()
+	if err != nil {
+		do400(w)
+		return
+	}
+	if err := checkText("ips", r.Form.Get("ips"), maxIPsLength); err != nil {
+		do400With(w, err.Error())
+		return
+	}
+	var ips []string
+	if s := r.Form.Get("ips"); s != "" {
+		ips = strings.Split(s, ",")
+	}
+
+	ok, err := setDeviceAllowedIPs(env.db, didT(did), ips)
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+	if !ok {
+		do400With(w, "ips has to be a comma separated list of IPs and CIDR ranges")
+		return
+	}
+}
+
+// deviceCertificate takes fingerprint, the hex SHA-256 of the client certificate the device
+// has to present, empty for none. Devices can only present one if the server runs with TLS.
+func (env *env) deviceCertificate(w http.ResponseWriter, r *http.Request) {
+	did, err := strconv.Atoi(powermux.PathParam(r, "id"))
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	err = r.ParseForm()
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	ok, err := setDeviceCertFingerprint(env.db, didT(did), r.Form.Get("fingerprint"))
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+	if !ok {
+		do400With(w, "fingerprint has to be a hex SHA-256")
+		return
+	}
+}
+
+// parseSite reads a site from the form values name, timezone and clockOut (seconds after midnight)
+func parseSite(r *http.Request) (s site, err error) {
+	err = r.ParseForm()
+	if err != nil {
+		return s, err
+	}
+
+	s.Name = r.Form.Get("name")
+	s.Timezone = r.Form.Get("timezone")
+	s.ClockOut, err = strconv.Atoi(r.Form.Get("clockOut"))
+	if err != nil {
+		return s, err
+	}
+
+	return s, s.validate()
+}
+
+func (env *env) monthReport(w http.ResponseWriter, r *http.Request) {
+	uid, ok := r.Context().Value(uidKey).(uidT)
+	if !ok {
+		logRequestError(r, stacktrace.NewError("malformed context"))
+		do500(w)
+		return
+	}
+
+	env.writeMonthReport(w, r, uid)
+}
+
+func (env *env) userMonthReport(w http.ResponseWriter, r *http.Request) {
+	intUID, err := strconv.Atoi(powermux.PathParam(r, "id"))
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	env.writeMonthReport(w, r, uidT(intUID))
+}
+
+func (env *env) monthComparison(w http.ResponseWriter, r *http.Request) {
+	uid, ok := r.Context().Value(uidKey).(uidT)
+	if !ok {
+		logRequestError(r, stacktrace.NewError("malformed context"))
+		do500(w)
+		return
+	}
+
+	env.writeMonthComparison(w, r, uid)
+}
+
+func (env *env) userMonthComparison(w http.ResponseWriter, r *http.Request) {
+	intUID, err := strconv.Atoi(powermux.PathParam(r, "id"))
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	env.writeMonthComparison(w, r, uidT(intUID))
+}
+
+func (env *env) contractReports(w http.ResponseWriter, r *http.Request) {
+	uid, ok := r.Context().Value(uidKey).(uidT)
+	if !ok {
+		logRequestError(r, stacktrace.NewError("malformed context"))
+		do500(w)
+		return
+	}
+
+	env.writeContractReports(w, r, uid)
+}
+
+func (env *env) userContractReports(w http.ResponseWriter, r *http.Request) {
+	intUID, err := strconv.Atoi(powermux.PathParam(r, "id"))
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	env.writeContractReports(w, r, uidT(intUID))
+}
+
+// writeContractReports sends the user's month (see parseMonth) broken down by contract
+func (env *env) writeContractReports(w http.ResponseWriter, r *http.Request, uid uidT) {
+	year, month, ok := parseMonth(r)
+	if !ok {
+		do400(w)
+		return
+	}
+
+	loc, err := userLocation(r.Context(), env.db, uid)
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, ""))
+		do500Or503(w, r)
+		return
+	}
+	crs, err := getContractReports(env.db, uid, year, month, loc)
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, "failed to get contract reports"))
+		do500Or503(w, r)
+		return
+	}
+
+	js, _ := json.Marshal(crs)
+	w.Write([]byte(js))
+}
+
+func (env *env) timesheet(w http.ResponseWriter, r *http.Request) {
+	uid, ok := r.Context().Value(uidKey).(uidT)
+	if !ok {
+		logRequestError(r, stacktrace.NewError("malformed context"))
+		do500(w)
+		return
+	}
+
+	env.writeTimesheet(w, r, uid)
+}
+
+func (env *env) userTimesheet(w http.ResponseWriter, r *http.Request) {
+	intUID, err := strconv.Atoi(powermux.PathParam(r, "id"))
+	if err != nil {
+		do400(w)
+		return
+	}
+	if _, err = uidToEmail(env.db, uidT(intUID)); err != nil {
+		do404(w)
+		return
+	}
+
+	env.writeTimesheet(w, r, uidT(intUID))
+}
+
+// writeTimesheet sends the user's timesheet for the month (see parseMonth) as a PDF
+func (env *env) writeTimesheet(w http.ResponseWriter, r *http.Request, uid uidT) {
+	year, month, ok := parseMonth(r)
+	if !ok {
+		do400(w)
+		return
+	}
+
+	var buf bytes.Buffer
+	err := writeTimesheetPDF(env.db, &buf, uid, year, month)
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, "failed to write timesheet"))
+		do500(w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="timesheet-%d-%02d.pdf"`, year, month))
+	w.Write(buf.Bytes())
+}
+
+// timesheetKey sends the public key approved timesheets are signed with, see signoff.go
+func (env *env) timesheetKey(w http.ResponseWriter, r *http.Request) {
+	if signingKey == nil {
+		do404(w)
+		return
+	}
+
+	pub := signingKey.Public().(ed25519.PublicKey)
+	js, _ := json.Marshal(struct {
+		KeyID     string `json:"keyId"`
+		PublicKey []byte `json:"publicKey"` // base64
+	}{signingKeyID(pub), pub})
+	w.Write([]byte(js))
+}
+
+func (env *env) timesheetSignoff(w http.ResponseWriter, r *http.Request) {
+	uid, ok := r.Context().Value(uidKey).(uidT)
+	if !ok {
+		logRequestError(r, stacktrace.NewError("malformed context"))
+		do500(w)
+		return
+	}
+
+	env.writeSignoff(w, r, uid)
+}
+
+func (env *env) userTimesheetSignoff(w http.ResponseWriter, r *http.Request) {
+	intUID, err := strconv.Atoi(powermux.PathParam(r, "id"))
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	env.writeSignoff(w, r, uidT(intUID))
+}
+
+// writeSignoff sends the user's sign off of the month (see parseMonth)
+func (env *env) writeSignoff(w http.ResponseWriter, r *http.Request, uid uidT) {
+	year, month, ok := parseMonth(r)
+	if !ok {
+		do400(w)
+		return
+	}
+
+	so, found, err := getSignoff(env.db, uid, year, month)
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, "failed to get sign off"))
+		do500(w)
+		return
+	}
+	if !found {
+		do404(w)
+		return
+	}
+
+	js, _ := json.Marshal(so)
+	w.Write([]byte(js))
+}
+
+// timesheetSubmit signs off the user's month (see parseMonth) once it's over
+func (env *env) timesheetSubmit(w http.ResponseWriter, r *http.Request) {
+	uid, ok := r.Context().Value(uidKey).(uidT)
+	if !ok {
+		logRequestError(r, stacktrace.NewError("malformed context"))
+		do500Or503(w, r)
+		return
+	}
+	year, month, ok := parseMonth(r)
+	if !ok {
+		do400(w)
+		return
+	}
+
+	loc, err := userLocation(r.Context(), env.db, uid)
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, ""))
+		do500Or503(w, r)
+		return
+	}
+	if !monthOver(year, month, loc) {
+		do400With(w, "the month isn't over yet")
+		return
+	}
+	so, ok, err := submitTimesheet(env.db, uid, year, month, loc)
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, "failed to submit timesheet"))
+		do500Or503(w, r)
+		return
+	}
+	if !ok {
+		do400With(w, "the month is approved already")
+		return
+	}
+
+	js, _ := json.Marshal(so)
+	w.Write([]byte(js))
+}
+
+// userTimesheetApprove approves and signs the user's submitted month (see parseMonth)
+func (env *env) userTimesheetApprove(w http.ResponseWriter, r *http.Request) {
+	by, ok := r.Context().Value(uidKey).(uidT)
+	if !ok {
+		logRequestError(r, stacktrace.NewError("malformed context"))
+		do500Or503(w, r)
+		return
+	}
+	intUID, err := strconv.Atoi(powermux.PathParam(r, "id"))
+	if err != nil {
+		do400(w)
+		return
+	}
+	year, month, ok := parseMonth(r)
+	if !ok {
+		do400(w)
+		return
+	}
+	if uidT(intUID) == by {
+		do400With(w, "timesheets have to be approved by someone else")
+		return
+	}
+	if signingKey == nil {
+		do400With(w, "no signing key is configured")
+		return
+	}
+
+	loc, err := userLocation(r.Context(), env.db, uidT(intUID))
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, ""))
+		do500Or503(w, r)
+		return
+	}
+	so, found, unchanged, err := approveTimesheet(env.db, by, uidT(intUID), year, month, loc)
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, "failed to approve timesheet"))
+		do500Or503(w, r)
+		return
+	}
+	if !found {
+		do404(w)
+		return
+	}
+	if !unchanged {
+		do400With(w, "the month changed since it was submitted")
+		return
+	}
+
+	js, _ := json.Marshal(so)
+	w.Write([]byte(js))
+}
+
+func (env *env) yearToDate(w http.ResponseWriter, r *http.Request) {
+	uid, ok := r.Context().Value(uidKey).(uidT)
+	if !ok {
+		logRequestError(r, stacktrace.NewError("malformed context"))
+		do500(w)
+		return
+	}
+
+	env.writeYearToDate(w, r, uid)
+}
+
+func (env *env) userYearToDate(w http.ResponseWriter, r *http.Request) {
+	intUID, err := strconv.Atoi(powermux.PathParam(r, "id"))
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	env.writeYearToDate(w, r, uidT(intUID))
+}
+
+// parseYearThrough reads the year query parameter, the current year by default,
+// and returns the day its year to date runs through
+func parseYearThrough(r *http.Request) (through time.Time, ok bool) {
+	now := clk.Now()
+	year := now.Year()
+	if s := r.URL.Query().Get("year"); s != "" {
+		var err error
+		year, err = strconv.Atoi(s)
+		if err != nil {
+			return through, false
+		}
+	}
+	return yearThrough(year, now)
+}
+
+func (env *env) writeYearToDate(w http.ResponseWriter, r *http.Request, uid uidT) {
+	through, ok := parseYearThrough(r)
+	if !ok {
+		do400(w)
+		return
+	}
+
+	ytd, err := getYearToDate(env.db, uid, through)
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, "failed to get year to date"))
+		do500(w)
+		return
+	}
+
+	js, _ := json.Marshal(ytd)
+	w.Write([]byte(js))
+}
+
+// yearToDateAll is the year to date of every user, for the annual review
+func (env *env) yearToDateAll(w http.ResponseWriter, r *http.Request) {
+	through, ok := parseYearThrough(r)
+	if !ok {
+		do400(w)
+		return
+	}
+
+	ytds, err := listYearToDate(env.db, through)
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, "failed to list year to date"))
+		do500(w)
+		return
+	}
+
+	js, _ := json.Marshal(ytds)
+	w.Write([]byte(js))
+}
+
+// writeMonthComparison compares the month given by parseMonth to the one before,
+// or with=last-year to the same month a year earlier
+func (env *env) writeMonthComparison(w http.ResponseWriter, r *http.Request, uid uidT) {
+	year, month, ok := parseMonth(r)
+	if !ok {
+		do400(w)
+		return
+	}
+	var lastYear bool
+	switch r.URL.Query().Get("with") {
+	case "", "previous":
+	case "last-year":
+		lastYear = true
+	default:
+		do400(w)
+		return
+	}
+
+	loc, err := userLocation(r.Context(), env.db, uid)
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, ""))
+		do500Or503(w, r)
+		return
+	}
+	mc, err := compareMonths(env.db, uid, year, month, lastYear, loc)
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, "failed to compare months"))
+		do500Or503(w, r)
+		return
+	}
+
+	js, _ := json.Marshal(mc)
+	w.Write([]byte(js))
+}
+
+func (env *env) monthGrid(w http.ResponseWriter, r *http.Request) {
+	uid, ok := r.Context().Value(uidKey).(uidT)
+	if !ok {
+		logRequestError(r, stacktrace.NewError("malformed context"))
+		do500(w)
+		return
+	}
+
+	env.writeMonthGrid(w, r, uid)
+}
+
+func (env *env) userMonthGrid(w http.ResponseWriter, r *http.Request) {
+	intUID, err := strconv.Atoi(powermux.PathParam(r, "id"))
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	env.writeMonthGrid(w, r, uidT(intUID))
+}
+
+// writeMonthGrid responds with the calendar grid for the month given by parseMonth
+func (env *env) writeMonthGrid(w http.ResponseWriter, r *http.Request, uid uidT) {
+	year, month, ok := parseMonth(r)
+	if !ok {
+		do400(w)
+		return
+	}
+
+	loc, err := userLocation(r.Context(), env.db, uid)
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, ""))
+		do500Or503(w, r)
+		return
+	}
+	mg, err := getMonthGrid(env.db, uid, year, month, loc)
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, "failed to get month grid"))
+		do500Or503(w, r)
+		return
+	}
+
+	js, _ := json.Marshal(mg)
+	w.Write([]byte(js))
+}
+
+// parseMonth reads the year and month query parameters, which default to the current month
+func parseMonth(r *http.Request) (year int, month time.Month, ok bool) {
+	now := clk.Now()
+	year, month = now.Year(), now.Month()
+	q := r.URL.Query()
+	if strYear := q.Get("year"); strYear != "" {
+		var err error
+		year, err = strconv.Atoi(strYear)
+		if err != nil {
+			return year, month, false
+		}
+	}
+	if strMonth := q.Get("month"); strMonth != "" {
+		intMonth, err := strconv.Atoi(strMonth)
+		if err != nil || intMonth < 1 || intMonth > 12 {
+			return year, month, false
+		}
+		month = time.Month(intMonth)
+	}
+	return year, month, true
+}
+
+// writeMonthReport responds with the report for the month given by parseMonth
+func (env *env) writeMonthReport(w http.ResponseWriter, r *http.Request, uid uidT) {
+	year, month, ok := parseMonth(r)
+	if !ok {
+		do400(w)
+		return
+	}
+
+	loc, err := userLocation(r.Context(), env.db, uid)
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, ""))
+		do500Or503(w, r)
+		return
+	}
+	mr, err := getMonthReport(env.db, uid, year, month, loc)
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, "failed to get month report"))
+		do500Or503(w, r)
+		return
+	}
+
+	js, _ := json.Marshal(mr)
+	w.Write([]byte(js))
+}
+
+// monthReportExport sends the month reports of everyone, the site's users or one user as a workbook
+func (env *env) monthReportExport(w http.ResponseWriter, r *http.Request) {
+	year, month, ok := parseMonth(r)
+	if !ok {
+		do400(w)
+		return
+	}
+	var uid uidT
+	var site stidT
+	q := r.URL.Query()
+	if s := q.Get("uid"); s != "" {
+		intUID, err := strconv.Atoi(s)
+		if err != nil {
+			do400(w)
+			return
+		}
+		uid = uidT(intUID)
+	}
+	if s := q.Get("site"); s != "" {
+		stid, err := strconv.Atoi(s)
+		if err != nil {
+			do400(w)
+			return
+		}
+		site = stidT(stid)
+	}
+
+	// the workbook is a zip, so it's built before anything is sent and a failure can still be reported
+	var buf bytes.Buffer
+	err := writeMonthReportXLSX(env.db, &buf, year, month, uid, site)
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, "failed to write month report workbook"))
+		do500(w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="report-%d-%02d.xlsx"`, year, month))
+	w.Write(buf.Bytes())
+}
+
+// payrollExport sends the month's pay records (see payroll.go) of everyone or the site's users,
+// format is datev (the default) or fixed
+func (env *env) payrollExport(w http.ResponseWriter, r *http.Request) {
+	year, month, ok := parseMonth(r)
+	if !ok {
+		do400(w)
+		return
+	}
+	q := r.URL.Query()
+	format := q.Get("format")
+	switch format {
+	case "":
+		format = payrollDATEV
+	case payrollDATEV, payrollFixed:
+	default:
+		do400With(w, "format has to be datev or fixed")
+		return
+	}
+	var site stidT
+	if s := q.Get("site"); s != "" {
+		stid, err := strconv.Atoi(s)
+		if err != nil {
+			do400(w)
+			return
+		}
+		site = stidT(stid)
+	}
+
+	var buf bytes.Buffer
+	err := writePayrollExport(env.db, &buf, year, month, site, format)
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, "failed to write payroll export"))
+		do500(w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="payroll-%d-%02d.txt"`, year, month))
+	w.Write(buf.Bytes())
+}
+
+// guardrails for list endpoints, so that one request can't pull years of data
+const (
+	maxListRange    = 366 * 24 * time.Hour
+	maxListLength   = 5000
+	maxBulkDates    = 366
+	maxExportLength = 50000 // audit log events per export page, see auditExport
+)
+
+// parseRange reads the from and to query parameters, unix times with to being exclusive.
+// They default to the maxListRange before to and now, and can't be further apart than that.
+// Errors are meant for the client, so they come without a stack trace.
+func parseRange(r *http.Request) (from, to int64, err error) {
+	q := r.URL.Query()
+	to = clk.Now().Unix() + 1
+	if strTo := q.Get("to"); strTo != "" {
+		to, err = strconv.ParseInt(strTo, 10, 64)
+		if err != nil {
+			return 0, 0, fmt.Errorf("to has to be a unix time")
+		}
+	}
+	from = to - int64(maxListRange/time.Second)
+	if strFrom := q.Get("from"); strFrom != "" {
+		from, err = strconv.ParseInt(strFrom, 10, 64)
+		if err != nil {
+			return 0, 0, fmt.Errorf("from has to be a unix time")
+		}
+	}
+
+	if to <= from {
+		return 0, 0, fmt.Errorf("to has to be after from")
+	}
+	if time.Duration(to-from)*time.Second > maxListRange {
+		return 0, 0, fmt.Errorf("the range can't be longer than %d days", maxListRange/(24*time.Hour))
+	}
+	return from, to, nil
+}
+
+// parsePage reads the offset and limit query parameters of lists, paged is false if neither was given.
+// The limit defaults to and can't be more than maxListLength.
+func parsePage(r *http.Request) (offset, limit int, paged bool, err error) {
+	q := r.URL.Query()
+	limit = maxListLength
+	if strOffset := q.Get("offset"); strOffset != "" {
+		offset, err = strconv.Atoi(strOffset)
+		if err != nil || offset < 0 {
+			return 0, 0, false, fmt.Errorf("offset has to be a positive number")
+		}
+		paged = true
+	}
+	if strLimit := q.Get("limit"); strLimit != "" {
+		limit, err = strconv.Atoi(strLimit)
+		if err != nil || limit < 1 || limit > maxListLength {
+			return 0, 0, false, fmt.Errorf("limit has to be between 1 and %d", maxListLength)
+		}
+		paged = true
+	}
+	return offset, limit, paged, nil
+}
+
+func parseEntryFilter(r *http.Request) (filter entryFilter, err error) {
+	filter.From, filter.To, err = parseRange(r)
+	if err != nil {
+		return filter, err
+	}
+
+	q := r.URL.Query()
+	if strValid := q.Get("valid"); strValid != "" {
+		valid, err := strconv.ParseBool(strValid)
+		if err != nil {
+			return filter, fmt.Errorf("valid has to be a boolean")
+		}
+		filter.Valid = &valid
+	}
+	filter.Source = q.Get("source")
+	filter.Kind = q.Get("kind")
+	if filter.Kind != "" && !validEntryKind(filter.Kind) {
+		return filter, fmt.Errorf("kind has to be work, sick, vacation or other")
+	}
+	if strSince := q.Get("updatedSince"); strSince != "" {
+		filter.UpdatedSince, err = strconv.ParseInt(strSince, 10, 64)
+		if err != nil {
+			return filter, fmt.Errorf("updatedSince has to be a unix time")
+		}
+	}
+	return filter, nil
+}
+
+// bulkEntries is a bulk entry request, see userEntriesBulk. The project of the entries is one of the user's
+// contracts, wms2 has no projects apart from them.
+type bulkEntries struct {
+	Dates    []string `json:"dates"`
+	From     string   `json:"from"`
+	To       string   `json:"to"`
+	Kind     string   `json:"kind"`
+	Contract ctidT    `json:"contract"` // 0 for none
+
+	from, to time.Time // the clock times of From and To
+}
+
+// parseBulkEntries reads a bulk entry request, the kind defaults to work.
+// Dates aren't checked, createEntries reports invalid ones, and neither is the contract. The error is meant for clients.
+func parseBulkEntries(body []byte) (b bulkEntries, err error) {
+	b = bulkEntries{Kind: entryWork}
+	if err = json.Unmarshal(body, &b); err != nil {
+		return b, fmt.Errorf("malformed JSON")
+	}
+	if len(b.Dates) == 0 {
+		return b, fmt.Errorf("no dates")
+	}
+	if len(b.Dates) > maxBulkDates {
+		return b, fmt.Errorf("no more than %d dates at once", maxBulkDates)
+	}
+	if !validEntryKind(b.Kind) {
+		return b, fmt.Errorf("unknown kind %q", b.Kind)
+	}
+	b.from, err = time.Parse("15:04", b.From)
+	if err != nil {
+		return b, fmt.Errorf("from has to be like 09:00")
+	}
+	b.to, err = time.Parse("15:04", b.To)
+	if err != nil {
+		return b, fmt.Errorf("to has to be like 17:00")
+	}
+	if !b.to.After(b.from) {
+		return b, fmt.Errorf("to has to be after from")
+	}
+	return b, nil
+}
+
+// userEntriesBulk creates entries from a JSON body like
+// {"dates": ["2019-10-14", "2019-10-15"], "from": "09:00", "to": "17:00"}
+// with an optional "kind" that defaults to work and "contract" for the project of the entries,
+// and responds with what happened on each date
+func (env *env) userEntriesBulk(w http.ResponseWriter, r *http.Request) {
+	by, ok := r.Context().Value(uidKey).(uidT)
+	if !ok {
+		logRequestError(r, stacktrace.NewError("malformed context"))
+		do500Or503(w, r)
+		return
+	}
+	intUID, err := strconv.Atoi(powermux.PathParam(r, "id"))
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		do413(w)
+		return
+	}
+	f, err := parseBulkEntries(body)
+	if err != nil {
+		do400With(w, err.Error())
+		return
+	}
+
+	if _, err = uidToEmail(env.db, uidT(intUID)); err != nil {
+		do404(w)
+		return
+	}
+	if !env.checkBulkContract(w, r, uidT(intUID), f.Contract) {
+		return
+	}
+	loc, err := userLocation(r.Context(), env.db, uidT(intUID))
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, ""))
+		do500Or503(w, r)
+		return
+	}
+
+	results, err := createEntries(env.db, uidT(intUID), f.Dates, f.from, f.to, f.Kind, f.Contract, loc, by)
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, ""))
+		do500Or503(w, r)
+		return
+	}
+
+	js, _ := json.Marshal(results)
+	w.Write([]byte(js))
+}
+
+// checkBulkContract responds with 400 and returns false unless ctid is 0 or one of the user's contracts
+func (env *env) checkBulkContract(w http.ResponseWriter, r *http.Request, uid uidT, ctid ctidT) bool {
+	if ctid == 0 {
+		return true
+	}
+	found, err := hasContract(env.db, uid, ctid)
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, ""))
+		do500Or503(w, r)
+		return false
+	}
+	if !found {
+		do400With(w, "unknown contract")
+		return false
+	}
+	return true
+}
+
+// entriesBulk is userEntriesBulk for the user's own entries, which are submitted for approval like
+// entrySubmit does. Each date's result has the approval's id and status.
+func (env *env) entriesBulk(w http.ResponseWriter, r *http.Request) {
+	uid, ok := r.Context().Value(uidKey).(uidT)
+	if !ok {
+		logRequestError(r, stacktrace.NewError("malformed context"))
+		do500Or503(w, r)
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		do413(w)
+		return
+	}
+	f, err := parseBulkEntries(body)
+	if err != nil {
+		do400With(w, err.Error())
+		return
+	}
+
+	if !env.checkBulkContract(w, r, uid, f.Contract) {
+		return
+	}
+	loc, err := userLocation(r.Context(), env.db, uid)
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, ""))
+		do500Or503(w, r)
+		return
+	}
+
+	results, err := submitEntries(env.db, uid, f.Dates, f.from, f.to, f.Kind, f.Contract, loc)
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, ""))
+		do500Or503(w, r)
+		return
+	}
+
+	js, _ := json.Marshal(results)
+	w.Write([]byte(js))
+}
+
+// entriesEdit takes from and to, and clamp=true to shorten the range to fit between the user's other entries.
+// It responds with the range written, or 409 and the overlapError if the entry would overlap others.
+// The user is told about the change, with the optional reason.
+func (env *env) entriesEdit(w http.ResponseWriter, r *http.Request) {
+	uid, ok := r.Context().Value(uidKey).(uidT)
+	if !ok {
+		logRequestError(r, stacktrace.NewError("malformed context"))
+		do500(w)
+		return
+	}
+	strEID := powermux.PathParam(r, "id")
+	intEID, err := strconv.Atoi(strEID)
+	eid := eidT(intEID)
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	from, to, clamp, ok := parseEntryRange(r)
+	if !ok {
+		do400(w)
+		return
+	}
+	reason := r.Form.Get("reason")
+	if err = checkText("reason", reason, maxReasonLength); err != nil {
+		do400With(w, err.Error())
+		return
+	}
+
+	old, found, err := getEntry(env.db, eid)
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+	if !found {
+		do404(w)
+		return
+	}
+
+	written, found, err := editEntry(env.db, eid, from, to, clamp, uid)
+	if oe, ok := err.(*overlapError); ok {
+		writeOverlap(w, oe)
+		return
+	}
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+	if !found {
+		do404(w)
+		return
+	}
+
+	err = noticeEntryChanged(env.db, entryRange{eid, old.From, old.To}, &written, uid, reason)
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, "failed to notify of edit"))
+	}
+
+	js, _ := json.Marshal(written)
+	w.Write([]byte(js))
+}
+
+// entriesDelete moves the entry to the trash, see entriesRestore. It takes an optional reason
+// query parameter for the notice to the user.
+func (env *env) entriesDelete(w http.ResponseWriter, r *http.Request) {
+	uid, ok := r.Context().Value(uidKey).(uidT)
+	if !ok {
+		logRequestError(r, stacktrace.NewError("malformed context"))
+		do500(w)
+		return
+	}
+	strEID := powermux.PathParam(r, "id")
+	intEID, err := strconv.Atoi(strEID)
+	eid := eidT(intEID)
+	if err != nil {
+		do400(w)
+		return
+	}
+	reason := r.URL.Query().Get("reason")
+	if err = checkText("reason", reason, maxReasonLength); err != nil {
+		do400With(w, err.Error())
+		return
+	}
+
+	old, found, err := getEntry(env.db, eid)
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+	if !found {
+		do404(w)
+		return
+	}
+
+	found, err = deleteEntry(env.db, eid, uid)
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+	if !found {
+		do404(w)
+		return
+	}
+
+	err = noticeEntryChanged(env.db, entryRange{eid, old.From, old.To}, nil, uid, reason)
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, "failed to notify of deletion"))
+	}
+}
+
+// entriesRestore takes an entry out of the trash, or responds with 409 like entriesEdit
+// if it overlaps entries added since it was deleted
+func (env *env) entriesRestore(w http.ResponseWriter, r *http.Request) {
+	uid, ok := r.Context().Value(uidKey).(uidT)
+	if !ok {
+		logRequestError(r, stacktrace.NewError("malformed context"))
+		do500(w)
+		return
+	}
+	intEID, err := strconv.Atoi(powermux.PathParam(r, "id"))
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	found, err := restoreEntry(env.db, eidT(intEID), uid)
+	if oe, ok := err.(*overlapError); ok {
+		writeOverlap(w, oe)
+		return
+	}
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+	if !found {
+		do404(w)
+		return
+	}
+}
+
+func (env *env) userEntriesDeleted(w http.ResponseWriter, r *http.Request) {
+	intUID, err := strconv.Atoi(powermux.PathParam(r, "id"))
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	des, err := listDeletedEntries(env.db, uidT(intUID))
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+
+	js, _ := json.Marshal(des)
+	w.Write([]byte(js))
+}
+
+// parseAuditFilter reads the uid, by, action and eid query parameters of the audit log
+func parseAuditFilter(r *http.Request) (filter auditFilter, err error) {
+	q := r.URL.Query()
+	for _, p := range []struct {
+		name  string
+		value *int
+	}{{"uid", (*int)(&filter.UID)}, {"by", (*int)(&filter.By)}, {"eid", (*int)(&filter.EID)}} {
+		if s := q.Get(p.name); s != "" {
+			*p.value, err = strconv.Atoi(s)
+			if err != nil {
+				return filter, fmt.Errorf("%s has to be a number", p.name)
+			}
+		}
+	}
+	filter.Action = q.Get("action")
+	return filter, nil
+}
+
+// auditLog responds with the audit log in the from/to range (see parseRange), optionally only for the
+// user uid, actor by, action or entry eid. It's paged like writeEntries.
+func (env *env) auditLog(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseAuditFilter(r)
+	if err != nil {
+		do400With(w, err.Error())
+		return
+	}
+	filter.From, filter.To, err = parseRange(r)
+	if err != nil {
+		do400With(w, err.Error())
+		return
+	}
+	offset, limit, _, err := parsePage(r)
+	if err != nil {
+		do400With(w, err.Error())
+		return
+	}
+
+	evs, more, err := listAudit(env.db, filter, offset, limit)
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+	if more {
+		w.Header().Set("X-Next-Offset", strconv.Itoa(offset+limit))
+	}
+
+	js, _ := json.Marshal(evs)
+	w.Write([]byte(js))
+}
+
+func (env *env) ownAccessLog(w http.ResponseWriter, r *http.Request) {
+	uid, ok := r.Context().Value(uidKey).(uidT)
+	if !ok {
+		logRequestError(r, stacktrace.NewError("malformed context"))
+		do500(w)
+		return
+	}
+
+	env.writeAccessLog(w, r, accessFilter{UID: uid})
+}
+
+// accessLog responds with the reads of the users' records in the from/to range (see parseRange),
+// optionally only those of user uid's, by user by or under break-glass grant breakGlass
+func (env *env) accessLog(w http.ResponseWriter, r *http.Request) {
+	var filter accessFilter
+	q := r.URL.Query()
+	for _, p := range []struct {
+		name  string
+		value *uidT
+	}{{"uid", &filter.UID}, {"by", &filter.By}} {
+		if s := q.Get(p.name); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil {
+				do400With(w, p.name+" has to be a number")
+				return
+			}
+			*p.value = uidT(n)
+		}
+	}
+	if s := q.Get("breakGlass"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			do400With(w, "breakGlass has to be a number")
+			return
+		}
+		filter.BreakGlass = n
+	}
+
+	env.writeAccessLog(w, r, filter)
+}
+
+// writeAccessLog sends the reads matching the filter in the from/to range, newest first and paged like writeEntries
+func (env *env) writeAccessLog(w http.ResponseWriter, r *http.Request, filter accessFilter) {
+	var err error
+	filter.From, filter.To, err = parseRange(r)
+	if err != nil {
+		do400With(w, err.Error())
+		return
+	}
+	offset, limit, _, err := parsePage(r)
+	if err != nil {
+		do400With(w, err.Error())
+		return
+	}
+
+	evs, more, err := listAccess(env.db, filter, offset, limit)
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+	if more {
+		w.Header().Set("X-Next-Offset", strconv.Itoa(offset+limit))
+	}
+
+	js, _ := json.Marshal(evs)
+	w.Write([]byte(js))
+}
+
+// auditExport is auditLog for compliance reviews: the range can be any length, from defaults to the
+// beginning, and format=csv gives a spreadsheet instead of JSON. Pages of up to maxExportLength events
+// (or limit) follow the cursor after, the alid of the last event seen; X-Next-Cursor is the next one.
+func (env *env) auditExport(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseAuditFilter(r)
+	if err != nil {
+		do400With(w, err.Error())
+		return
+	}
+
+	q := r.URL.Query()
+	filter.To = clk.Now().Unix() + 1
+	limit := maxExportLength
+	for _, p := range []struct {
+		name  string
+		value *int64
+	}{{"from", &filter.From}, {"to", &filter.To}, {"after", &filter.After}} {
+		if s := q.Get(p.name); s != "" {
+			*p.value, err = strconv.ParseInt(s, 10, 64)
+			if err != nil {
+				do400With(w, p.name+" has to be a number")
+				return
+			}
+		}
+	}
+	if strLimit := q.Get("limit"); strLimit != "" {
+		limit, err = strconv.Atoi(strLimit)
+		if err != nil || limit < 1 || limit > maxExportLength {
+			do400With(w, fmt.Sprintf("limit has to be between 1 and %d", maxExportLength))
+			return
+		}
+	}
+	format := q.Get("format")
+	if format != "" && format != "json" && format != "csv" {
+		do400With(w, "format has to be json or csv")
+		return
+	}
+
+	evs, more, err := listAudit(env.db, filter, 0, limit)
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+	if more {
+		w.Header().Set("X-Next-Cursor", strconv.Itoa(evs[len(evs)-1].ALID))
+	}
+
+	if format != "csv" {
+		js, _ := json.Marshal(evs)
+		w.Write([]byte(js))
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", `attachment; filename="audit.csv"`)
+	err = writeAuditCSV(w, evs)
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, "failed to write audit CSV"))
+	}
+}
+
+func (env *env) leave(w http.ResponseWriter, r *http.Request) {
+	uid, ok := r.Context().Value(uidKey).(uidT)
+	if !ok {
+		logRequestError(r, stacktrace.NewError("malformed context"))
+		do500(w)
+		return
+	}
+
+	lrs, err := listLeave(env.db, uid, "")
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+
+	js, _ := json.Marshal(lrs)
+	w.Write([]byte(js))
+}
+
+// leaveSubmit asks for leave, taking type (vacation, sick or other) and the dates from and to, inclusive
+func (env *env) leaveSubmit(w http.ResponseWriter, r *http.Request) {
+	uid, ok := r.Context().Value(uidKey).(uidT)
+	if !ok {
+		logRequestError(r, stacktrace.NewError("malformed context"))
+		do500(w)
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		do400(w)
+		return
+	}
+	lr := leaveRequest{
+		UID:    uid,
+		Type:   r.Form.Get("type"),
+		From:   r.Form.Get("from"),
+		To:     r.Form.Get("to"),
+		Status: leavePending,
+	}
+	if err = lr.validate(); err != nil {
+		do400With(w, stacktrace.RootCause(err).Error())
+		return
+	}
+
+	lr.LRID, err = submitLeave(env.db, lr)
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+
+	js, _ := json.Marshal(lr)
+	w.Write([]byte(js))
+}
+
+// leaveCancel withdraws a leave request that hasn't been decided yet
+func (env *env) leaveCancel(w http.ResponseWriter, r *http.Request) {
+	uid, ok := r.Context().Value(uidKey).(uidT)
+	if !ok {
+		logRequestError(r, stacktrace.NewError("malformed context"))
+		do500(w)
+		return
+	}
+	lrid, err := strconv.Atoi(powermux.PathParam(r, "id"))
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	found, err := cancelLeave(env.db, uid, lridT(lrid))
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+	if !found {
+		do404(w)
+		return
+	}
+}
+
+// leaveAll responds with everyone's leave requests, only those with the status query parameter if it's given
+func (env *env) leaveAll(w http.ResponseWriter, r *http.Request) {
+	lrs, err := listLeave(env.db, 0, r.URL.Query().Get("status"))
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+
+	js, _ := json.Marshal(lrs)
+	w.Write([]byte(js))
+}
+
+// leaveDecide approves (action=approve) or denies (action=deny) a pending leave request
+func (env *env) leaveDecide(w http.ResponseWriter, r *http.Request) {
+	uid, ok := r.Context().Value(uidKey).(uidT)
+	if !ok {
+		logRequestError(r, stacktrace.NewError("malformed context"))
+		do500(w)
+		return
+	}
+	lrid, err := strconv.Atoi(powermux.PathParam(r, "id"))
+	if err != nil {
+		do400(w)
+		return
+	}
+	err = r.ParseForm()
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	var approve bool
+	switch r.Form.Get("action") {
+	case "approve":
+		approve = true
+	case "deny":
+	default:
+		do400(w)
+		return
+	}
+
+	found, err := decideLeave(env.db, lridT(lrid), approve, uid)
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+	if !found {
+		do404(w)
+		return
+	}
+}
+
+// remindersSnooze stops today's clock out reminders for the user
+func (env *env) remindersSnooze(w http.ResponseWriter, r *http.Request) {
+	uid, ok := r.Context().Value(uidKey).(uidT)
+	if !ok {
+		logRequestError(r, stacktrace.NewError("malformed context"))
+		do500(w)
+		return
+	}
+
+	err := snoozeReminders(env.db, uid, clk.Now())
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+}
+
+// snoozeLink is the link in reminder emails, it's a GET so that it works with one click
+func (env *env) snoozeLink(w http.ResponseWriter, r *http.Request) {
+	found, err := snoozeByToken(env.db, powermux.PathParam(r, "token"))
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+	if !found {
+		do404(w)
+		return
+	}
+
+	w.Write([]byte("Reminders snoozed until tomorrow."))
+}
+
+// autoClosed responds with the user's auto-closed entries that are waiting for them to confirm them
+func (env *env) autoClosed(w http.ResponseWriter, r *http.Request) {
+	uid, ok := r.Context().Value(uidKey).(uidT)
+	if !ok {
+		logRequestError(r, stacktrace.NewError("malformed context"))
+		do500(w)
+		return
+	}
+
+	ues, err := listUnconfirmed(env.db, uid)
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+
+	js, _ := json.Marshal(ues)
+	w.Write([]byte(js))
+}
+
+// autoClosedConfirm confirms an auto-closed entry, taking the time the user actually stopped as to
+// if it wasn't when the entry was closed
+func (env *env) autoClosedConfirm(w http.ResponseWriter, r *http.Request) {
+	uid, ok := r.Context().Value(uidKey).(uidT)
+	if !ok {
+		logRequestError(r, stacktrace.NewError("malformed context"))
+		do500(w)
+		return
+	}
+	intEID, err := strconv.Atoi(powermux.PathParam(r, "id"))
+	if err != nil {
+		do400(w)
+		return
+	}
+	err = r.ParseForm()
+	if err != nil {
+		do400(w)
+		return
+	}
+	var to int
+	if strTo := r.Form.Get("to"); strTo != "" {
+		to, err = strconv.Atoi(strTo)
+		if err != nil {
+			do400(w)
+			return
+		}
+	}
+
+	found, err := confirmAutoClosed(env.db, uid, eidT(intEID), to)
+	if oe, ok := err.(*overlapError); ok {
+		writeOverlap(w, oe)
+		return
+	}
+	if ce, ok := err.(confirmError); ok {
+		do400With(w, ce.Error())
+		return
+	}
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+	if !found {
+		do404(w)
+		return
+	}
+}
+
+// parseEntryRange reads from, to and clamp of entry edits
+func parseEntryRange(r *http.Request) (from, to int, clamp bool, ok bool) {
+	err := r.ParseForm()
+	if err != nil {
+		return 0, 0, false, false
+	}
+	from, err = strconv.Atoi(r.Form.Get("from"))
+	if err != nil {
+		return 0, 0, false, false
+	}
+	to, err = strconv.Atoi(r.Form.Get("to"))
+	if err != nil || to < from {
+		return 0, 0, false, false
+	}
+	return from, to, r.Form.Get("clamp") == "true", true
+}
+
+func writeOverlap(w http.ResponseWriter, oe *overlapError) {
+	js, _ := json.Marshal(struct {
+		Error string `json:"error"`
+		*overlapError
+	}{"overlap", oe})
+	w.WriteHeader(409)
+	w.Write([]byte(js))
+}
+
+// entrySubmit adds a manual entry that waits for approval, taking the same form as entriesEdit
+// and an optional kind that defaults to work. It responds with the approval, whose status is approved
+// if the entry was within the user's weekly manual entry limit, see edits.go.
+func (env *env) entrySubmit(w http.ResponseWriter, r *http.Request) {
+	uid, ok := r.Context().Value(uidKey).(uidT)
+	if !ok {
+		logRequestError(r, stacktrace.NewError("malformed context"))
+		do500(w)
+		return
+	}
+
+	from, to, clamp, ok := parseEntryRange(r)
+	if !ok {
+		do400(w)
+		return
+	}
+
+	kind := r.Form.Get("kind")
+	if kind == "" {
+		kind = entryWork
+	}
+	if !validEntryKind(kind) {
+		do400(w)
+		return
+	}
+
+	ap, err := submitEntry(env.db, uid, from, to, clamp, kind, uid)
+	if oe, ok := err.(*overlapError); ok {
+		writeOverlap(w, oe)
+		return
+	}
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+
+	js, _ := json.Marshal(ap)
+	w.Write([]byte(js))
+}
+
+// entrySubmitEdit proposes an edit to one of the user's own entries, taking the same form as entriesEdit.
+// It responds with the approval.
+func (env *env) entrySubmitEdit(w http.ResponseWriter, r *http.Request) {
+	uid, ok := r.Context().Value(uidKey).(uidT)
+	if !ok {
+		logRequestError(r, stacktrace.NewError("malformed context"))
+		do500(w)
+		return
+	}
+	intEID, err := strconv.Atoi(powermux.PathParam(r, "id"))
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	from, to, clamp, ok := parseEntryRange(r)
+	if !ok {
+		do400(w)
+		return
+	}
+
+	ap, found, err := submitEdit(env.db, uid, eidT(intEID), from, to, clamp, uid)
+	if oe, ok := err.(*overlapError); ok {
+		writeOverlap(w, oe)
+		return
+	}
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+	if !found {
+		do404(w)
+		return
+	}
+
+	js, _ := json.Marshal(ap)
+	w.Write([]byte(js))
+}
+
+func (env *env) approvals(w http.ResponseWriter, r *http.Request) {
+	aps, err := listPendingApprovals(env.db)
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+
+	js, _ := json.Marshal(aps)
+	w.Write([]byte(js))
+}
+
+// inbox lists everything waiting for a decision with counts per type, see inbox.go. sponsor narrows
+// it to the users someone sponsors.
+func (env *env) inbox(w http.ResponseWriter, r *http.Request) {
+	var sponsor uidT
+	if s := r.URL.Query().Get("sponsor"); s != "" {
+		uid, err := strconv.Atoi(s)
+		if err != nil {
+			do400With(w, "sponsor has to be a number")
+			return
+		}
+		sponsor = uidT(uid)
+	}
+
+	in, err := getInbox(env.db, sponsor)
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+
+	js, _ := json.Marshal(in)
+	w.Write([]byte(js))
+}
+
+// ownInbox is inbox for the users the caller sponsors, what they'd have admins decide
+func (env *env) ownInbox(w http.ResponseWriter, r *http.Request) {
+	uid, ok := r.Context().Value(uidKey).(uidT)
+	if !ok {
+		logRequestError(r, stacktrace.NewError("malformed context"))
+		do500(w)
+		return
+	}
+
+	in, err := getInbox(env.db, uid)
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+
+	js, _ := json.Marshal(in)
+	w.Write([]byte(js))
+}
+
+// approvalDecide approves (action=approve) or rejects (action=reject) a pending entry or edit,
+// approving an edit that no longer fits responds with 409 like entriesEdit
+func (env *env) approvalDecide(w http.ResponseWriter, r *http.Request) {
+	uid, ok := r.Context().Value(uidKey).(uidT)
+	if !ok {
+		logRequestError(r, stacktrace.NewError("malformed context"))
+		do500(w)
+		return
+	}
+	apid, err := strconv.Atoi(powermux.PathParam(r, "id"))
+	if err != nil {
+		do400(w)
+		return
+	}
+	err = r.ParseForm()
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	var approve bool
+	switch r.Form.Get("action") {
+	case "approve":
+		approve = true
+	case "reject":
+	default:
+		do400(w)
+		return
+	}
+
+	found, err := decideApproval(env.db, apidT(apid), approve, uid)
+	if oe, ok := err.(*overlapError); ok {
+		writeOverlap(w, oe)
+		return
+	}
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+	if !found {
+		do404(w)
+		return
+	}
+}
+
+func (env *env) usersOnlineCount(w http.ResponseWriter, r *http.Request) {
+	onlineUsers, err := countOnlineUsers(env.db)
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, "failed to count online users"))
+		do500(w)
+		return
+	}
+
+	w.Write([]byte(strconv.Itoa(onlineUsers)))
+}
+
+func (env *env) usersOnlineList(w http.ResponseWriter, r *http.Request) {
+	onlineUsers, err := listOnlineUsers(env.db)
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, "failed to list online users"))
+		do500(w)
+		return
+	}
+
+	if onlineUsers == nil { // empty list
+		onlineUsers = make([]onlineUser, 0) // doesn't marshal to null
+	}
+
+	js, _ := json.Marshal(onlineUsers)
+	w.Write([]byte(js))
+}
+
+func (env *env) stats(w http.ResponseWriter, r *http.Request) {
+	db, err := getDBStats(env.db)
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, "failed to get database stats"))
+		do500(w)
+		return
+	}
+
+	info := struct {
+		DB               dbStats                   `json:"db"`
+		LastDisqualified int64                     `json:"lastDisqualified"`
+		Endpoints        map[string]latencySummary `json:"endpoints"`
+	}{db, atomic.LoadInt64(&lastDisqualified), env.latencies.summaries()}
+
+	js, _ := json.Marshal(info)
+	w.Write([]byte(js))
+}
+
+// benchmark takes the year and quarter (1 to 4) query parameters, defaulting to the last full quarter
+func (env *env) benchmark(w http.ResponseWriter, r *http.Request) {
+	now := clk.Now()
+	year, quarter := now.Year(), (int(now.Month())-1)/3
+	if quarter == 0 {
+		year, quarter = year-1, 4
+	}
+
+	q := r.URL.Query()
+	if strYear := q.Get("year"); strYear != "" {
+		var err error
+		year, err = strconv.Atoi(strYear)
+		if err != nil {
+			do400(w)
+			return
+		}
+	}
+	if strQuarter := q.Get("quarter"); strQuarter != "" {
+		var err error
+		quarter, err = strconv.Atoi(strQuarter)
+		if err != nil || quarter < 1 || quarter > 4 {
+			do400(w)
+			return
+		}
+	}
+
+	bgs, err := getBenchmark(env.db, year, quarter, time.Local)
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, "failed to get benchmark"))
+		do500(w)
+		return
+	}
+
+	js, _ := json.Marshal(bgs)
+	w.Write([]byte(js))
+}
+
+// jobs responds with the latest run of each background job
+func (env *env) jobs(w http.ResponseWriter, r *http.Request) {
+	jrs, err := latestJobRuns(env.db)
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+
+	js, _ := json.Marshal(jrs)
+	w.Write([]byte(js))
+}
+
+// entriesRecent lists everyone's entries changed since the unix time since (a week ago by default),
+// the last changed first
+func (env *env) entriesRecent(w http.ResponseWriter, r *http.Request) {
+	since := clk.Now().Add(-defaultRecentPeriod).Unix()
+	if strSince := r.URL.Query().Get("since"); strSince != "" {
+		var err error
+		since, err = strconv.ParseInt(strSince, 10, 64)
+		if err != nil {
+			do400With(w, "since has to be a unix time")
+			return
+		}
+	}
+	offset, limit, _, err := parsePage(r)
+	if err != nil {
+		do400With(w, err.Error())
+		return
+	}
+
+	ces, more, err := listRecentlyChanged(env.db, since, offset, limit)
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+	if more {
+		w.Header().Set("X-Next-Offset", strconv.Itoa(offset+limit))
+	}
+
+	js, _ := json.Marshal(ces)
+	w.Write([]byte(js))
+}
+
+// jobRuns lists background job runs newest first, optionally those of the job and with the status
+func (env *env) jobRuns(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	status := q.Get("status")
+	switch status {
+	case "", jobRunning, jobOK, jobFailed:
+	default:
+		do400(w)
+		return
+	}
+	offset, limit, _, err := parsePage(r)
+	if err != nil {
+		do400With(w, err.Error())
+		return
+	}
+
+	jrs, more, err := listJobRuns(env.db, q.Get("job"), status, offset, limit)
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+	if more {
+		w.Header().Set("X-Next-Offset", strconv.Itoa(offset+limit))
+	}
+
+	js, _ := json.Marshal(jrs)
+	w.Write([]byte(js))
+}
+
+// outbox lists the outgoing events with the status query parameter, failed ones by default
+func (env *env) webhooks(w http.ResponseWriter, r *http.Request) {
+	whs, err := listWebhooks(env.db)
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+
+	js, _ := json.Marshal(whs)
+	w.Write([]byte(js))
+}
+
+// webhooksCreate registers a webhook from the form values url, secret (generated if there's none) and
+// events, comma separated (all of them if there are none). The response has the secret.
+func (env *env) webhooksCreate(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		do400(w)
+		return
+	}
+	wh := webhook{URL: r.Form.Get("url"), Secret: r.Form.Get("secret")}
+	if s := r.Form.Get("events"); s != "" {
+		wh.Events = strings.Split(s, ",")
+	}
+	if err = wh.validate(); err != nil {
+		do400With(w, stacktrace.RootCause(err).Error())
+		return
+	}
+
+	wh, err = createWebhook(env.db, wh)
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+
+	js, _ := json.Marshal(wh)
+	w.Write([]byte(js))
+}
+
+func (env *env) webhooksDelete(w http.ResponseWriter, r *http.Request) {
+	whid, err := strconv.Atoi(powermux.PathParam(r, "id"))
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	found, err := deleteWebhook(env.db, whidT(whid))
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+	if !found {
+		do404(w)
+		return
+	}
+}
+
+func (env *env) outbox(w http.ResponseWriter, r *http.Request) {
+	status := r.URL.Query().Get("status")
+	switch status {
+	case "":
+		status = outboxFailed
+	case outboxPending, outboxSent, outboxDead, outboxFailed:
+	default:
+		do400(w)
+		return
+	}
+
+	evs, err := listOutbox(env.db, status)
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+
+	js, _ := json.Marshal(evs)
+	w.Write([]byte(js))
+}
+
+func (env *env) outboxEvent(w http.ResponseWriter, r *http.Request) {
+	oid, err := strconv.Atoi(powermux.PathParam(r, "id"))
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	ev, found, err := getOutboxEvent(env.db, oid)
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+	if !found {
+		do404(w)
+		return
+	}
+
+	js, _ := json.Marshal(ev)
+	w.Write([]byte(js))
+}
+
+func (env *env) outboxReplay(w http.ResponseWriter, r *http.Request) {
+	oid, err := strconv.Atoi(powermux.PathParam(r, "id"))
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	replayed, err := replayOutbox(env.db, oid, "")
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+	if replayed == 0 {
+		do404(w) // there's no such failed event
+		return
+	}
+}
+
+// outboxReplayAll replays every failed event, of the kind form value if it's given
+func (env *env) outboxReplayAll(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	replayed, err := replayOutbox(env.db, 0, r.Form.Get("kind"))
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+
+	js, _ := json.Marshal(struct {
+		Replayed int64 `json:"replayed"`
+	}{replayed})
+	w.Write([]byte(js))
+}
+
+func (env *env) authorize(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		do413(w)
+		return
+	}
+
+	type form struct {
+		Email    string `json:"email"`
+		Password string `json:"password"`
+	}
+	f := form{}
+	json.Unmarshal(body, &f)
+	if len(f.Email) > maxEmailLength || len(f.Password) > maxPasswordLength {
+		do401(w)
+		return
+	}
+
+	uid, err := emailToUID(env.db, f.Email)
+	if err != nil {
+		do401(w)
+		return
+	}
+
+	ok := checkPassword(env.db, uid, f.Password)
+	if !ok {
+		do401(w)
+		return
+	}
+
+	sid, err := createSession(env.db, uid, time.Hour*24*31)
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, "failed to create a session"))
+		do500(w)
+		return
+	}
+
+	js, _ := json.Marshal(struct {
+		Token sidT `json:"token"`
+	}{sid})
+	w.Write([]byte(js))
+}
+
+// openBreakGlass signs the user in like authorize, but with admin access for a while if they also
+// give the sealed secret and a reason, see breakglass.go. Every attempt is a security alert.
+func (env *env) openBreakGlass(w http.ResponseWriter, r *http.Request) {
+	if breakGlass == nil {
+		do404(w)
+		return
+	}
+	// attempts are limited from each address, so that guessing from one doesn't lock everyone out.
+	// Not for each user, anyone could lock an admin out by naming them then. Guessing from many
+	// addresses still has to guess the secret.
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !env.breakGlassLimiter.allow(host) {
+		do429(w)
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		do413(w)
+		return
+	}
+
+	type form struct {
+		Email    string `json:"email"`
+		Password string `json:"password"`
+		Secret   string `json:"secret"`
+		Reason   string `json:"reason"`
+	}
+	f := form{}
+	if err = json.Unmarshal(body, &f); err != nil {
+		do400With(w, "malformed JSON")
+		return
+	}
+	if len(f.Email) > maxEmailLength || len(f.Password) > maxPasswordLength || len(f.Secret) > maxSecretLength {
+		do401(w)
+		return
+	}
+	f.Reason = strings.TrimSpace(f.Reason)
+	if f.Reason == "" || len(f.Reason) > maxReasonLength {
+		do400With(w, fmt.Sprintf("a reason of up to %d bytes is required", maxReasonLength))
+		return
+	}
+
+	uid, err := emailToUID(env.db, f.Email)
+	if err != nil || !checkPassword(env.db, uid, f.Password) || !breakGlass.opens(f.Secret) {
+		securityAlert(env.db, "failed break-glass attempt", fmt.Sprintf(
+			"Someone failed to break the glass as %q, giving the reason:\n\n%s", f.Email, f.Reason))
+		do401(w)
+		return
+	}
+
+	bg, sid, err := openBreakGlass(env.db, uid, f.Reason, clk.Now())
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, "failed to break the glass"))
+		do500(w)
+		return
+	}
+
+	js, _ := json.Marshal(struct {
+		Token sidT  `json:"token"`
+		BGID  int   `json:"bgid"`
+		Until int64 `json:"until"`
+	}{sid, bg.BGID, bg.Until})
+	w.Write([]byte(js))
+}
+
+// closeBreakGlass ends the break-glass session it's called with before it expires
+func (env *env) closeBreakGlass(w http.ResponseWriter, r *http.Request) {
+	bgid, _ := r.Context().Value(breakGlassKey).(int)
+	if bgid == 0 {
+		do404(w)
+		return
+	}
+
+	err := closeBreakGlass(env.db, bgid, clk.Now())
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+}
+
+func (env *env) breakGlassGrants(w http.ResponseWriter, r *http.Request) {
+	bgs, err := listBreakGlass(env.db)
+	if err != nil {
+		logRequestError(r, stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+
+	js, _ := json.Marshal(bgs)
 	w.Write([]byte(js))
 }
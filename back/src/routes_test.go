@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func FuzzParseEntryRange(f *testing.F) {
+	f.Add("1570000000", "1570003600", "true")
+	f.Add("10", "5", "")
+	f.Add("-1", "0x10", "false")
+	f.Fuzz(func(t *testing.T, from, to, clamp string) {
+		form := url.Values{"from": {from}, "to": {to}, "clamp": {clamp}}
+		r := httptest.NewRequest("POST", "/entries/1/edit", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+		gotFrom, gotTo, gotClamp, ok := parseEntryRange(r)
+		if !ok {
+			return
+		}
+		if gotTo < gotFrom {
+			t.Errorf("accepted a negative range from %d to %d", gotFrom, gotTo)
+		}
+		if gotClamp != (clamp == "true") {
+			t.Errorf("clamp is %t for %q", gotClamp, clamp)
+		}
+	})
+}
+
+func FuzzParseBulkEntries(f *testing.F) {
+	f.Add(`{"dates": ["2019-10-14", "2019-10-15"], "from": "09:00", "to": "17:00"}`)
+	f.Add(`{"dates": ["2019-10-14"], "from": "09:00", "to": "17:00", "kind": "sick"}`)
+	f.Add(`{"dates": [], "from": "17:00", "to": "09:00", "kind": "nap"}`)
+	f.Add(`{"dates": ["x"], "from": "24:00", "to": "9:0"}`)
+	f.Fuzz(func(t *testing.T, body string) {
+		b, err := parseBulkEntries([]byte(body))
+		if err != nil {
+			return
+		}
+		if len(b.Dates) == 0 || len(b.Dates) > maxBulkDates {
+			t.Errorf("accepted %d dates", len(b.Dates))
+		}
+		if !validEntryKind(b.Kind) {
+			t.Errorf("accepted kind %q", b.Kind)
+		}
+		if !b.to.After(b.from) {
+			t.Errorf("accepted %s to %s", b.From, b.To)
+		}
+	})
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/palantir/stacktrace"
+)
+
+// defaultDailyTarget is what users are expected to work per working day unless set otherwise
+const defaultDailyTarget = 8 * 60 * 60
+
+// schedule is what's needed to know what a user is expected to work on the days of a range,
+// see getSchedule and expectedForDay
+type schedule struct {
+	target    int // seconds per working day, see users.daily_target_s
+	holidays  holidaySet
+	leave     leaveSet
+	school    schoolSet
+	profiles  profileTargets // replace target where they cover a day
+	contracts userContracts  // replace target while they're in effect, unless a profile covers the day
+}
+
+// getSchedule returns the user's schedule from the day of from up to the day of to, inclusive
+func getSchedule(ctx context.Context, db *sql.DB, uid uidT, from, to time.Time) (sc schedule, err error) {
+	err = db.QueryRowContext(ctx, "SELECT daily_target_s FROM users WHERE uid = ?", uid).Scan(&sc.target)
+	if err != nil {
+		return sc, stacktrace.Propagate(err, "failed to get daily target")
+	}
+
+	sc.holidays, err = getHolidays(ctx, db, uid, from, to)
+	if err != nil {
+		return sc, err
+	}
+
+	sc.leave, err = getLeave(ctx, db, uid, from, to)
+	if err != nil {
+		return sc, err
+	}
+
+	sc.school, err = getSchoolDays(ctx, db, uid, from, to)
+	if err != nil {
+		return sc, err
+	}
+
+	sc.profiles, err = getProfileTargets(ctx, db, uid, from, to)
+	if err != nil {
+		return sc, err
+	}
+
+	sc.contracts, err = getContracts(ctx, db, uid, from, to)
+	return sc, err
+}
+
+func setDailyTarget(db *sql.DB, uid uidT, target int) (err error) {
+	_, err = db.Exec("UPDATE users SET daily_target_s = ?1 WHERE uid = ?2", target, uid)
+	return stacktrace.Propagate(err, "failed to set daily target")
+}
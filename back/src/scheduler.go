@@ -0,0 +1,144 @@
+package main
+
+import (
+	"database/sql"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/palantir/stacktrace"
+)
+
+// Jobs that run at fixed times are scheduled in crontab syntax, "minute hour day-of-month month
+// day-of-week" in the server's time zone. Fields are * or lists of numbers and ranges like 1-5,
+// either can have a step like */15. Like cron, if both days are restricted either one will do.
+
+type cronSpec struct {
+	spec                          string
+	minute, hour, dom, month, dow uint64 // bit n is set if n matches
+	anyDom, anyDow                bool
+}
+
+var cronFields = []struct {
+	name     string
+	min, max int
+}{{"minute", 0, 59}, {"hour", 0, 23}, {"day of month", 1, 31}, {"month", 1, 12}, {"day of week", 0, 7}}
+
+func parseCron(spec string) (c cronSpec, err error) {
+	fields := strings.Fields(spec)
+	if len(fields) != len(cronFields) {
+		return c, stacktrace.NewError("schedule %q needs %d fields", spec, len(cronFields))
+	}
+
+	c.spec = spec
+	bits := []*uint64{&c.minute, &c.hour, &c.dom, &c.month, &c.dow}
+	for i, f := range cronFields {
+		*bits[i], err = parseCronField(fields[i], f.min, f.max)
+		if err != nil {
+			return c, stacktrace.Propagate(err, "invalid %s in schedule %q", f.name, spec)
+		}
+	}
+	if c.dow&(1<<7) != 0 { // 7 is Sunday too
+		c.dow |= 1
+	}
+	c.anyDom, c.anyDow = fields[2] == "*", fields[4] == "*"
+
+	if c.next(time.Now()).IsZero() {
+		return c, stacktrace.NewError("schedule %q never runs", spec)
+	}
+	return c, nil
+}
+
+func parseCronField(field string, min, max int) (bits uint64, err error) {
+	for _, item := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(item, "/"); i >= 0 {
+			step, err = strconv.Atoi(item[i+1:])
+			if err != nil || step <= 0 {
+				return 0, stacktrace.NewError("invalid step in %q", item)
+			}
+			item = item[:i]
+		}
+
+		from, to := min, max
+		if item != "*" {
+			parts := strings.SplitN(item, "-", 2)
+			from, err = strconv.Atoi(parts[0])
+			if err != nil {
+				return 0, stacktrace.NewError("invalid number in %q", item)
+			}
+			to = from
+			if len(parts) == 2 {
+				to, err = strconv.Atoi(parts[1])
+				if err != nil {
+					return 0, stacktrace.NewError("invalid number in %q", item)
+				}
+			}
+		}
+		if from < min || to > max || from > to {
+			return 0, stacktrace.NewError("%q is out of range %d-%d", item, min, max)
+		}
+
+		for n := from; n <= to; n += step {
+			bits |= 1 << uint(n)
+		}
+	}
+	return bits, nil
+}
+
+func (c cronSpec) matchesDay(t time.Time) bool {
+	dom := c.dom&(1<<uint(t.Day())) != 0
+	dow := c.dow&(1<<uint(t.Weekday())) != 0
+	switch {
+	case c.anyDom && c.anyDow:
+		return true
+	case c.anyDom:
+		return dow
+	case c.anyDow:
+		return dom
+	}
+	return dom || dow
+}
+
+// next returns the first time after t that's on the schedule, zero if there's none within 5 years
+func (c cronSpec) next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	end := t.AddDate(5, 0, 0)
+	for t.Before(end) {
+		switch {
+		case c.month&(1<<uint(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !c.matchesDay(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case c.hour&(1<<uint(t.Hour())) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case c.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// runScheduled runs fn as the job at the times of the spec, forever. Jobs that run often enough to be
+// polls are recorded like pollJob, the others like runJob.
+func runScheduled(db *sql.DB, job string, c cronSpec, poll bool, fn func() (int, error)) {
+	record := runJob
+	if poll {
+		record = pollJob
+	}
+	for {
+		next := c.next(time.Now())
+		if next.IsZero() {
+			logError(stacktrace.NewError("schedule %q never runs", c.spec), "job", job)
+			return
+		}
+		if !jobSleep(time.Until(next)) {
+			return
+		}
+		if err := record(db, job, fn); err != nil {
+			logError(err, "job", job)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/palantir/stacktrace"
+)
+
+// School days are the weekdays apprentices spend at vocational school, like every Tuesday.
+// They count like leave: nothing more is expected on them, whether or not anything was punched.
+
+type sdidT int
+
+// schoolDays is a recurring school day rule of a user, valid from From through To
+type schoolDays struct {
+	SDID     sdidT    `json:"sdid"`
+	UID      uidT     `json:"uid"`
+	Weekdays []string `json:"weekdays"` // like "tue", see weekdayNames
+	From     string   `json:"from"`     // like holiday.Date
+	To       string   `json:"to"`       // inclusive
+}
+
+func (sd schoolDays) validate() error {
+	if len(sd.Weekdays) == 0 {
+		return stacktrace.NewError("weekdays have to be like mon,fri")
+	}
+	if _, err := weekdayMask(sd.Weekdays); err != nil {
+		return err
+	}
+	from, err := time.Parse(holidayDate, sd.From)
+	if err != nil {
+		return stacktrace.NewError("from has to be like 2019-10-03")
+	}
+	to, err := time.Parse(holidayDate, sd.To)
+	if err != nil {
+		return stacktrace.NewError("to has to be like 2019-10-03")
+	}
+	if to.Before(from) {
+		return stacktrace.NewError("to can't be before from")
+	}
+	return nil
+}
+
+// schoolSet holds the dates (like holiday.Date) that are school days for a user
+type schoolSet map[string]bool
+
+func (ss schoolSet) has(date time.Time) bool {
+	return ss[date.Format(holidayDate)]
+}
+
+// getSchoolDays returns the user's school days from the day of from up to the day of to, inclusive
+func getSchoolDays(ctx context.Context, db *sql.DB, uid uidT, from, to time.Time) (ss schoolSet, err error) {
+	strFrom, strTo := from.Format(holidayDate), to.Format(holidayDate)
+	rows, err := db.QueryContext(ctx,
+		`SELECT weekdays, from_date, to_date FROM school_days
+			WHERE uid = ?1 AND from_date <= ?3 AND to_date >= ?2`, uid, strFrom, strTo)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed to get school days")
+	}
+	defer rows.Close()
+
+	ss = make(schoolSet)
+	for rows.Next() {
+		var mask int
+		var sFrom, sTo string
+		err = rows.Scan(&mask, &sFrom, &sTo)
+		if err != nil {
+			return nil, stacktrace.Propagate(err, "failed to scan row")
+		}
+		// only walk the part of the rule that's in the range, rules can last for years
+		if sFrom < strFrom {
+			sFrom = strFrom
+		}
+		if sTo > strTo {
+			sTo = strTo
+		}
+		dFrom, _ := time.Parse(holidayDate, sFrom)
+		dTo, _ := time.Parse(holidayDate, sTo)
+		for d := dFrom; !d.After(dTo); d = d.AddDate(0, 0, 1) {
+			if mask&(1<<uint(d.Weekday())) != 0 {
+				ss[d.Format(holidayDate)] = true
+			}
+		}
+	}
+	return ss, nil
+}
+
+// listSchoolDays returns the user's school day rules
+func listSchoolDays(db *sql.DB, uid uidT) (sds []schoolDays, err error) {
+	rows, err := db.Query(
+		"SELECT sdid, uid, weekdays, from_date, to_date FROM school_days WHERE uid = ? ORDER BY from_date", uid)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed to list school days")
+	}
+	defer rows.Close()
+
+	sds = []schoolDays{}
+	for rows.Next() {
+		var sd schoolDays
+		var mask int
+		err = rows.Scan(&sd.SDID, &sd.UID, &mask, &sd.From, &sd.To)
+		if err != nil {
+			return nil, stacktrace.Propagate(err, "failed to scan row")
+		}
+		sd.Weekdays = weekdaysOf(mask)
+		sds = append(sds, sd)
+	}
+	return sds, nil
+}
+
+func createSchoolDays(db *sql.DB, sd schoolDays) (sdid sdidT, err error) {
+	mask, err := weekdayMask(sd.Weekdays)
+	if err != nil {
+		return 0, err
+	}
+	res, err := db.Exec(
+		"INSERT INTO school_days (uid, weekdays, from_date, to_date) VALUES (?1, ?2, ?3, ?4)",
+		sd.UID, mask, sd.From, sd.To)
+	if err != nil {
+		return 0, stacktrace.Propagate(err, "failed to insert school days")
+	}
+	id, err := res.LastInsertId()
+	return sdidT(id), stacktrace.Propagate(err, "failed to get school days id")
+}
+
+func deleteSchoolDays(db *sql.DB, sdid sdidT) (found bool, err error) {
+	res, err := db.Exec("DELETE FROM school_days WHERE sdid = ?", sdid)
+	if err != nil {
+		return false, stacktrace.Propagate(err, "failed to delete school days")
+	}
+	n, err := res.RowsAffected()
+	return n == 1, stacktrace.Propagate(err, "failed to delete school days")
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/palantir/stacktrace"
+)
+
+// Security alerts are mailed to WMS2_SECURITY_EMAIL through the outbox, if it's set,
+// and logged either way.
+
+// badge failures at one kiosk within badgeFailureWindow that raise an alert
+const (
+	badgeFailureLimit  = 10
+	badgeFailureWindow = 5 * time.Minute
+)
+
+var securityEmail = os.Getenv("WMS2_SECURITY_EMAIL")
+
+func securityAlert(ex execer, subject, body string) {
+	err := queueSecurityAlert(ex, subject, body)
+	if err != nil {
+		logError(err)
+	}
+}
+
+// queueSecurityAlert is securityAlert for callers that can't go on without the alert
+func queueSecurityAlert(ex execer, subject, body string) (err error) {
+	slog.Warn("security alert", "subject", subject, "body", body)
+	if securityEmail == "" {
+		return nil
+	}
+	err = enqueueEmail(ex, securityEmail, "[wms2 security] "+subject, body)
+	return stacktrace.Propagate(err, "failed to queue security alert")
+}
+
+// badgeFailed counts an unknown badge scanned at the kiosk, alerting once the kiosk hits the limit
+func (env *env) badgeFailed(d device) {
+	if env.badgeFailures.hit(strconv.Itoa(int(d.DID))) != badgeFailureLimit {
+		return
+	}
+
+	securityAlert(env.db, "failed badge scans at "+d.Name, fmt.Sprintf(
+		"Kiosk %q (device %d) had %d scans of unknown badges within %s.",
+		d.Name, d.DID, badgeFailureLimit, badgeFailureWindow))
+}
+
+// noteSessionCountry records the country the session is used from and alerts when it
+// changes. The country comes from a header set by a proxy, see WMS2_COUNTRY_HEADER.
+func noteSessionCountry(db *sql.DB, sid sidT, uid uidT, country string) (err error) {
+	var last string
+	err = db.QueryRow("SELECT IFNULL(country, '') FROM sessions WHERE sid = ?", sid).Scan(&last)
+	if err != nil {
+		return stacktrace.Propagate(err, "failed to get session country")
+	}
+	if last == country {
+		return nil
+	}
+
+	_, err = db.Exec("UPDATE sessions SET country = ?1 WHERE sid = ?2", country, sid)
+	if err != nil {
+		return stacktrace.Propagate(err, "failed to set session country")
+	}
+	if last == "" {
+		return nil
+	}
+
+	email, err := uidToEmail(db, uid)
+	if err != nil {
+		return stacktrace.Propagate(err, "failed to get email")
+	}
+	securityAlert(db, "session used from a new country", fmt.Sprintf(
+		"A session of %s was used from %s after being used from %s.", email, country, last))
+	return nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/palantir/stacktrace"
+)
+
+// On SIGTERM the server stops taking requests and waits for the ones in flight, then for job runs
+// to finish while no new ones start, see runJob. The loops started with goJobLoop wake up from
+// jobSleep and return, and are waited for like runs. After that main closes the database and returns.
+// It waits for shutdownTimeout at most, runs that don't finish by then get failed on the next start
+// (see failInterruptedJobRuns). Jobs are stopped even if requests didn't finish in time.
+
+const shutdownTimeout = 30 * time.Second
+
+// jobRuns lets job runs and loops start until stopJobs is called and waits for them then
+var jobRuns struct {
+	sync.Mutex
+	stopping bool
+	running  sync.WaitGroup
+}
+
+// jobsStopped is closed by stopJobs to wake up the loops
+var jobsStopped = make(chan struct{})
+
+// startJobRun reports whether a job run may start, if it does the run has to call jobRunDone
+func startJobRun() bool {
+	jobRuns.Lock()
+	defer jobRuns.Unlock()
+	if jobRuns.stopping {
+		return false
+	}
+	jobRuns.running.Add(1)
+	return true
+}
+
+func jobRunDone() {
+	jobRuns.running.Done()
+}
+
+// goJobLoop runs loop in the background, stopJobs waits for it to return. Loops sleep with jobSleep
+// so that they return when jobs stop.
+func goJobLoop(loop func()) {
+	if !startJobRun() {
+		return
+	}
+	go func() {
+		defer jobRunDone()
+		loop()
+	}()
+}
+
+// jobSleep sleeps for d, it returns false early if jobs stop
+func jobSleep(d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-jobsStopped:
+		return false
+	}
+}
+
+// stopJobs keeps new job runs from starting and waits for those that are running until ctx is done
+func stopJobs(ctx context.Context) (err error) {
+	jobRuns.Lock()
+	if !jobRuns.stopping {
+		jobRuns.stopping = true
+		close(jobsStopped)
+	}
+	jobRuns.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		jobRuns.running.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return stacktrace.Propagate(ctx.Err(), "job runs didn't finish")
+	}
+}
+
+// shutdown stops the server and the jobs, see shutdown.go
+func shutdown(server *http.Server) (err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	err = server.Shutdown(ctx)
+	if err != nil {
+		// no new runs start either way, the ones that are running get failed on the next start
+		if jerr := stopJobs(ctx); jerr != nil {
+			logError(jerr)
+		}
+		return stacktrace.Propagate(err, "requests didn't finish")
+	}
+	return stopJobs(ctx)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// stopJobs wakes the loops up, waits for them and their runs, and starts nothing after
+func TestStopJobs(t *testing.T) {
+	defer func() {
+		jobRuns.stopping = false
+		jobsStopped = make(chan struct{})
+	}()
+
+	returned := make(chan bool, 1)
+	runFinished := false
+	goJobLoop(func() {
+		if !jobSleep(time.Hour) {
+			returned <- true
+			return
+		}
+		returned <- false
+	})
+	release := make(chan struct{})
+	goJobLoop(func() {
+		if !startJobRun() {
+			return
+		}
+		<-release
+		time.Sleep(10 * time.Millisecond)
+		runFinished = true
+		jobRunDone()
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	if err := stopJobs(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if !runFinished {
+		t.Error("stopJobs didn't wait for the run")
+	}
+	select {
+	case woken := <-returned:
+		if !woken {
+			t.Error("the loop slept through stopJobs")
+		}
+	default:
+		t.Error("stopJobs returned before the loop did")
+	}
+
+	if startJobRun() {
+		jobRunDone()
+		t.Error("a run started after stopJobs")
+	}
+	started := false
+	goJobLoop(func() { started = true })
+	time.Sleep(10 * time.Millisecond)
+	if started {
+		t.Error("a loop started after stopJobs")
+	}
+	if jobSleep(time.Hour) {
+		t.Error("jobSleep slept after stopJobs")
+	}
+	// stopping twice is fine
+	if err := stopJobs(ctx); err != nil {
+		t.Error(err)
+	}
+}
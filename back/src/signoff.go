@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"time"
+
+	"github.com/palantir/stacktrace"
+)
+
+// A user signs off a month's timesheet by submitting it, which stores their month report as a snapshot.
+// An admin approving it is checked against that snapshot, the month can't have changed in between, and
+// the server signs the snapshot along with who submitted and approved it when. The signature and the
+// public key (see /timesheet-key) let anyone check the approved numbers are what both of them saw.
+
+// signingKey signs approved timesheets, nil if none is configured, see signingKeyFromEnv
+var signingKey ed25519.PrivateKey
+
+// signingKeyFromEnv reads WMS2_SIGNING_KEY, a 32 byte Ed25519 seed in base64.
+// It returns nil if the variable isn't set, timesheets can't be approved then.
+func signingKeyFromEnv() (key ed25519.PrivateKey, err error) {
+	s := os.Getenv("WMS2_SIGNING_KEY")
+	if s == "" {
+		return nil, nil
+	}
+	seed, err := base64.StdEncoding.DecodeString(s)
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, stacktrace.NewError("WMS2_SIGNING_KEY has to be 32 bytes in base64")
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// signingKeyID identifies the public key, so signatures made with an earlier key can be told apart
+func signingKeyID(pub ed25519.PublicKey) string {
+	sum := sha256.Sum256(pub)
+	return hex.EncodeToString(sum[:8])
+}
+
+type signoff struct {
+	UID         uidT            `json:"uid"`
+	Year        int             `json:"year"`
+	Month       time.Month      `json:"month"`
+	Snapshot    json.RawMessage `json:"snapshot"` // the month report as submitted
+	Submitted   int64           `json:"submitted"`
+	ApprovedBy  uidT            `json:"approvedBy,omitempty"`
+	Approved    int64           `json:"approved,omitempty"`
+	KeyID       string          `json:"keyId,omitempty"`
+	Signature   string          `json:"signature,omitempty"` // base64, over signedMessage
+	SignatureOK bool            `json:"signatureOk"`         // see verify
+}
+
+// signedMessage is what's signed, JSON of the sign off without the snapshot but with its hash
+func (so signoff) signedMessage() []byte {
+	sum := sha256.Sum256(so.Snapshot)
+	js, _ := json.Marshal(struct {
+		UID        uidT       `json:"uid"`
+		Year       int        `json:"year"`
+		Month      time.Month `json:"month"`
+		Snapshot   string     `json:"snapshotSha256"`
+		Submitted  int64      `json:"submitted"`
+		ApprovedBy uidT       `json:"approvedBy"`
+		Approved   int64      `json:"approved"`
+	}{so.UID, so.Year, so.Month, hex.EncodeToString(sum[:]), so.Submitted, so.ApprovedBy, so.Approved})
+	return js
+}
+
+// verify checks the signature with the current key, false if it was made with another one
+func (so signoff) verify() bool {
+	if signingKey == nil || so.Signature == "" {
+		return false
+	}
+	pub := signingKey.Public().(ed25519.PublicKey)
+	sig, err := base64.StdEncoding.DecodeString(so.Signature)
+	if err != nil || so.KeyID != signingKeyID(pub) {
+		return false
+	}
+	return ed25519.Verify(pub, so.signedMessage(), sig)
+}
+
+// monthSnapshot is the user's month report as it's stored in sign offs
+func monthSnapshot(db *sql.DB, uid uidT, year int, month time.Month, loc *time.Location) (js []byte, err error) {
+	mr, err := getMonthReport(db, uid, year, month, loc)
+	if err != nil {
+		return nil, err
+	}
+	js, err = json.Marshal(mr)
+	return js, stacktrace.Propagate(err, "failed to marshal month report")
+}
+
+// monthOver is whether the month has ended in loc, only then can it be signed off
+func monthOver(year int, month time.Month, loc *time.Location) bool {
+	return !clk.Now().Before(time.Date(year, month+1, 1, 0, 0, 0, 0, loc))
+}
+
+// submitTimesheet signs off the month for the user, replacing an earlier submission.
+// ok is false if the month has already been approved.
+func submitTimesheet(db *sql.DB, uid uidT, year int, month time.Month, loc *time.Location) (so signoff, ok bool, err error) {
+	snapshot, err := monthSnapshot(db, uid, year, month, loc)
+	if err != nil {
+		return so, false, err
+	}
+
+	so = signoff{UID: uid, Year: year, Month: month, Snapshot: snapshot, Submitted: clk.Now().Unix()}
+	res, err := db.Exec(
+		`INSERT INTO timesheet_signoffs (uid, year, month, snapshot, submitted_unix_s) VALUES (?1, ?2, ?3, ?4, ?5)
+			ON CONFLICT (uid, year, month) DO UPDATE SET snapshot = ?4, submitted_unix_s = ?5
+			WHERE approved_unix_s IS NULL`,
+		uid, year, month, string(snapshot), so.Submitted)
+	if err != nil {
+		return so, false, stacktrace.Propagate(err, "failed to submit timesheet")
+	}
+	n, err := res.RowsAffected()
+	return so, n == 1, stacktrace.Propagate(err, "failed to get rows affected")
+}
+
+// getSignoff returns the user's sign off of the month, found is false if there's none
+func getSignoff(db *sql.DB, uid uidT, year int, month time.Month) (so signoff, found bool, err error) {
+	var snapshot string
+	var approvedBy, approved sql.NullInt64
+	var keyID, signature sql.NullString
+	err = db.QueryRow(
+		`SELECT snapshot, submitted_unix_s, approved_by, approved_unix_s, key_id, signature
+			FROM timesheet_signoffs WHERE uid = ?1 AND year = ?2 AND month = ?3`, uid, year, month).
+		Scan(&snapshot, &so.Submitted, &approvedBy, &approved, &keyID, &signature)
+	if err == sql.ErrNoRows {
+		return so, false, nil
+	}
+	if err != nil {
+		return so, false, stacktrace.Propagate(err, "failed to get timesheet sign off")
+	}
+
+	so.UID, so.Year, so.Month, so.Snapshot = uid, year, month, json.RawMessage(snapshot)
+	so.ApprovedBy, so.Approved = uidT(approvedBy.Int64), approved.Int64
+	so.KeyID, so.Signature = keyID.String, signature.String
+	so.SignatureOK = so.verify()
+	return so, true, nil
+}
+
+// approveTimesheet approves and signs the user's submitted month. found is false if it wasn't submitted
+// or is approved already, unchanged is false if the month differs from what the user submitted.
+func approveTimesheet(db *sql.DB, by, uid uidT, year int, month time.Month, loc *time.Location) (
+	so signoff, found, unchanged bool, err error) {
+	so, found, err = getSignoff(db, uid, year, month)
+	if err != nil || !found || so.Approved != 0 {
+		return so, false, false, err
+	}
+	current, err := monthSnapshot(db, uid, year, month, loc)
+	if err != nil {
+		return so, true, false, err
+	}
+	if !bytes.Equal(current, so.Snapshot) {
+		return so, true, false, nil
+	}
+
+	so.ApprovedBy, so.Approved = by, clk.Now().Unix()
+	so.KeyID = signingKeyID(signingKey.Public().(ed25519.PublicKey))
+	so.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(signingKey, so.signedMessage()))
+	so.SignatureOK = true
+	res, err := db.Exec(
+		`UPDATE timesheet_signoffs SET approved_by = ?1, approved_unix_s = ?2, key_id = ?3, signature = ?4
+			WHERE uid = ?5 AND year = ?6 AND month = ?7 AND submitted_unix_s = ?8 AND approved_unix_s IS NULL`,
+		so.ApprovedBy, so.Approved, so.KeyID, so.Signature, uid, year, month, so.Submitted)
+	if err != nil {
+		return so, true, false, stacktrace.Propagate(err, "failed to approve timesheet")
+	}
+	// it was resubmitted or approved in the meantime
+	n, err := res.RowsAffected()
+	return so, n == 1, true, stacktrace.Propagate(err, "failed to get rows affected")
+}
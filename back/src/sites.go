@@ -0,0 +1,118 @@
+package main
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/palantir/stacktrace"
+)
+
+type stidT int
+
+type site struct {
+	STID     stidT  `json:"stid"`
+	Name     string `json:"name"`
+	Timezone string `json:"timezone"` // IANA name, or "Local" for the server's
+	ClockOut int    `json:"clockOut"` // when open states get disqualified, seconds after local midnight
+}
+
+func (s site) location() (*time.Location, error) {
+	loc, err := time.LoadLocation(s.Timezone)
+	return loc, stacktrace.Propagate(err, "invalid timezone for site "+s.Name)
+}
+
+func (s site) clockOutOn(date time.Time) time.Time {
+	return time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, date.Location()).Add(time.Duration(s.ClockOut) * time.Second)
+}
+
+// nextClockOut returns the first time open states at the site get disqualified after t
+func (s site) nextClockOut(t time.Time) (time.Time, error) {
+	loc, err := s.location()
+	if err != nil {
+		return t, err
+	}
+
+	t = t.In(loc)
+	c := s.clockOutOn(t)
+	if !c.After(t) {
+		c = s.clockOutOn(t.AddDate(0, 0, 1))
+	}
+	return c, nil
+}
+
+// lastClockOut returns the last time open states at the site got disqualified, as of t
+func (s site) lastClockOut(t time.Time) (time.Time, error) {
+	loc, err := s.location()
+	if err != nil {
+		return t, err
+	}
+
+	t = t.In(loc)
+	c := s.clockOutOn(t)
+	if c.After(t) {
+		c = s.clockOutOn(t.AddDate(0, 0, -1))
+	}
+	return c, nil
+}
+
+func (s site) validate() error {
+	if s.Name == "" {
+		return stacktrace.NewError("site needs a name")
+	}
+	if err := checkText("name", s.Name, maxNameLength); err != nil {
+		return err
+	}
+	if s.ClockOut < 0 || s.ClockOut >= 24*60*60 {
+		return stacktrace.NewError("clock out time must be within the day")
+	}
+	_, err := s.location()
+	return err
+}
+
+func listSites(db *sql.DB) (sites []site, err error) {
+	rows, err := db.Query("SELECT stid, name, timezone, clock_out_s FROM sites ORDER BY stid")
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed to list sites")
+	}
+	defer rows.Close()
+
+	sites = []site{}
+	for rows.Next() {
+		var s site
+		err = rows.Scan(&s.STID, &s.Name, &s.Timezone, &s.ClockOut)
+		if err != nil {
+			return nil, stacktrace.Propagate(err, "failed to scan row")
+		}
+		sites = append(sites, s)
+	}
+
+	return sites, nil
+}
+
+func createSite(db *sql.DB, s site) (stid stidT, err error) {
+	res, err := db.Exec("INSERT INTO sites (name, timezone, clock_out_s) VALUES (?1, ?2, ?3)", s.Name, s.Timezone, s.ClockOut)
+	if err != nil {
+		return stid, stacktrace.Propagate(err, "failed to insert site")
+	}
+	id, err := res.LastInsertId()
+	return stidT(id), stacktrace.Propagate(err, "failed to get site id")
+}
+
+func updateSite(db *sql.DB, s site) (err error) {
+	_, err = db.Exec("UPDATE sites SET name = ?1, timezone = ?2, clock_out_s = ?3 WHERE stid = ?4", s.Name, s.Timezone, s.ClockOut, s.STID)
+	return stacktrace.Propagate(err, "failed to update site")
+}
+
+func setUserSite(db *sql.DB, uid uidT, stid stidT) (err error) {
+	_, err = db.Exec("UPDATE users SET stid = ?1 WHERE uid = ?2", stid, uid)
+	return stacktrace.Propagate(err, "failed to set site of user")
+}
+
+func setDeviceSite(db *sql.DB, did didT, stid stidT) (err error) {
+	_, err = db.Exec("UPDATE devices SET stid = ?1 WHERE did = ?2", stid, did)
+	return stacktrace.Propagate(err, "failed to set site of device")
+}
+
+// punchSiteSQL is an SQL expression for the site of a punch by user ?1 on device ?2:
+// the device's site, or the user's default site if they didn't use a device
+const punchSiteSQL = "IFNULL((SELECT stid FROM devices WHERE did = ?2), (SELECT stid FROM users WHERE uid = ?1))"
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/palantir/stacktrace"
+)
+
+// The Slack app's slash commands /clockin, /clockout and /balance are POSTed to /slack/commands.
+// Requests are checked with the app's signing secret (WMS2_SLACK_SIGNING_SECRET), and Slack users
+// are mapped to wms2 users by an admin, see setSlackUser. The reply shows the user's state to the
+// channel the command came from.
+
+// slackMaxSkew is how old a request may be, older ones might be replayed
+const slackMaxSkew = 5 * time.Minute
+
+// slack commands, like they're set up in the Slack app
+const (
+	slackClockIn  = "/clockin"
+	slackClockOut = "/clockout"
+	slackBalance  = "/balance"
+)
+
+// verifySlackRequest checks the X-Slack-Signature of the body sent at timestamp (X-Slack-Request-Timestamp)
+func verifySlackRequest(secret, timestamp, signature string, body []byte) bool {
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return false
+	}
+	if skew := clk.Now().Sub(time.Unix(ts, 0)); skew > slackMaxSkew || skew < -slackMaxSkew {
+		return false
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte("v0:" + timestamp + ":"))
+	mac.Write(body)
+	return hmac.Equal([]byte(signature), []byte("v0="+hex.EncodeToString(mac.Sum(nil))))
+}
+
+// setSlackUser maps the Slack user to the user, replacing both of their old mappings.
+// An empty slackID removes the user's mapping.
+func setSlackUser(db *sql.DB, uid uidT, slackID string) (err error) {
+	if slackID == "" {
+		_, err = db.Exec("DELETE FROM slack_users WHERE uid = ?", uid)
+		return stacktrace.Propagate(err, "failed to remove slack user")
+	}
+	_, err = db.Exec("INSERT OR REPLACE INTO slack_users (slack_id, uid) VALUES (?1, ?2)", slackID, uid)
+	return stacktrace.Propagate(err, "failed to set slack user")
+}
+
+// getUserBySlackID returns the user the Slack user is mapped to, found is false if there's none
+func getUserBySlackID(db *sql.DB, slackID string) (uid uidT, found bool, err error) {
+	err = db.QueryRow("SELECT uid FROM slack_users WHERE slack_id = ?", slackID).Scan(&uid)
+	if err == sql.ErrNoRows {
+		return 0, false, nil
+	}
+	return uid, err == nil, stacktrace.Propagate(err, "failed to get slack user")
+}
+
+// runSlackCommand runs the command for the user, reply is the text to post back.
+// known is false for commands that aren't wms2's.
+func runSlackCommand(ctx context.Context, db *sql.DB, uid uidT, command string) (reply string, known bool, err error) {
+	switch command {
+	case slackClockIn:
+		err = clockInUnder(ctx, db, uid, 0, 0, 0)
+	case slackClockOut:
+		err = clockOut(ctx, db, uid, 0)
+	case slackBalance:
+	default:
+		return "", false, nil
+	}
+	if err != nil {
+		return "", true, err
+	}
+
+	reply, err = clockStatusText(ctx, db, uid)
+	return reply, true, err
+}
+
+// clockStatusText is the user's state, what they worked today and their balance for the month as
+// a sentence, for chat replies
+func clockStatusText(ctx context.Context, db *sql.DB, uid uidT) (text string, err error) {
+	email, err := uidToEmail(db, uid)
+	if err != nil {
+		return "", stacktrace.Propagate(err, "failed to get email")
+	}
+	loc, err := userLocation(ctx, db, uid)
+	if err != nil {
+		return "", err
+	}
+	s, err := getExtensionStatus(ctx, db, uid)
+	if err != nil {
+		return "", err
+	}
+	balance, err := getDeltaForMonth(ctx, db, uid, clk.Now(), deltaToDate)
+	if err != nil {
+		return "", err
+	}
+
+	since := time.Unix(int64(s.Since), 0).In(loc).Format("15:04")
+	switch s.State {
+	case stateIn:
+		text = fmt.Sprintf("%s is clocked in since %s", email, since)
+	case stateBreak:
+		text = fmt.Sprintf("%s is on a break since %s", email, since)
+	default:
+		text = fmt.Sprintf("%s is clocked out", email)
+	}
+	text += fmt.Sprintf(", %s worked today, balance for the month %s", formatSeconds(s.Today), formatSeconds(balance))
+	return text, nil
+}
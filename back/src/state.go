@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/palantir/stacktrace"
+)
+
+// userState is what's stored in user_states.state
+type userState string
+
+const (
+	stateIn    userState = "I"
+	stateOut   userState = "O"
+	stateBreak userState = "B" // on a break, which doesn't count as worked
+)
+
+// transitions lists the states a user may move to from each state
+var transitions = map[userState][]userState{
+	stateOut:   {stateIn},
+	stateIn:    {stateOut, stateBreak},
+	stateBreak: {stateIn, stateOut},
+}
+
+func (s userState) in(states []userState) bool {
+	for _, x := range states {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
+
+func (s userState) canTransition(to userState) bool {
+	return to.in(transitions[s])
+}
+
+// transitionHook is called after a state change has been committed,
+// at is the unix time the user entered the new state
+type transitionHook func(uid uidT, from, to userState, at int64)
+
+var transitionHooks []transitionHook
+
+// onTransition registers a hook, it should be called before the server starts
+func onTransition(hook transitionHook) {
+	transitionHooks = append(transitionHooks, hook)
+}
+
+func runTransitionHooks(uid uidT, from, to userState, at int64) {
+	for _, hook := range transitionHooks {
+		hook(uid, from, to, at)
+	}
+}
+
+// setState moves the user to another state, checking that the transition is allowed.
+// did is the device they used, 0 for none.
+func setState(ctx context.Context, tx *sql.Tx, uid uidT, did didT, from, to userState, at int64) (err error) {
+	if !from.canTransition(to) {
+		return stacktrace.NewError("transition from %s to %s is not allowed", from, to)
+	}
+
+	// the site is kept during a break, for disqualify and musters, the contract until after it
+	_, err = tx.ExecContext(ctx,
+		`UPDATE user_states SET state = ?1, since_unix_s = ?2, expected_end_unix_s = NULL,
+			stid = CASE WHEN ?1 = ?4 THEN stid END, ctid = CASE WHEN ?1 = ?4 OR ?5 THEN ctid END,
+			heartbeat_unix_s = NULL, missed_heartbeat = 0,
+			after_break = ?5
+			WHERE uid = ?3`, to, at, uid, stateBreak, from == stateBreak && to == stateIn)
+	if err != nil {
+		return stacktrace.Propagate(err, "failed to update user state")
+	}
+
+	return audit(tx, uid, uid, transitionAction(from, to), 0, auditState{State: from}, auditState{to, at, did})
+}
+
+func getState(ctx context.Context, tx *sql.Tx, uid uidT) (state userState, since int, err error) {
+	err = tx.QueryRowContext(ctx, "SELECT state, since_unix_s FROM user_states WHERE uid = ?", uid).Scan(&state, &since)
+	return state, since, stacktrace.Propagate(err, "failed to find a row in user_states for specified user")
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+)
+
+var allStates = []userState{stateIn, stateOut, stateBreak}
+
+func TestTransitions(t *testing.T) {
+	allowed := map[[2]userState]bool{
+		{stateOut, stateIn}:    true,
+		{stateIn, stateOut}:    true,
+		{stateIn, stateBreak}:  true,
+		{stateBreak, stateIn}:  true,
+		{stateBreak, stateOut}: true,
+	}
+	for _, from := range allStates {
+		for _, to := range allStates {
+			if got := from.canTransition(to); got != allowed[[2]userState{from, to}] {
+				t.Errorf("%s to %s allowed is %t", from, to, got)
+			}
+		}
+	}
+
+	if len(transitions) != len(allStates) {
+		t.Errorf("transitions has %d states, want %d", len(transitions), len(allStates))
+	}
+	for from, tos := range transitions {
+		if !from.in(allStates) {
+			t.Errorf("unknown state %q in transitions", from)
+		}
+		for _, to := range tos {
+			if !to.in(allStates) {
+				t.Errorf("unknown state %q in the transitions from %s", to, from)
+			}
+		}
+	}
+}
+
+func TestTransitionAction(t *testing.T) {
+	want := map[[2]userState]string{
+		{stateOut, stateIn}:    auditClockIn,
+		{stateIn, stateOut}:    auditClockOut,
+		{stateIn, stateBreak}:  auditBreakStart,
+		{stateBreak, stateIn}:  auditBreakEnd,
+		{stateBreak, stateOut}: auditClockOut,
+	}
+	for pair, action := range want {
+		if got := transitionAction(pair[0], pair[1]); got != action {
+			t.Errorf("%s to %s is audited as %s, want %s", pair[0], pair[1], got, action)
+		}
+	}
+}
+
+// getStateRow reads what setState writes besides the state
+func getStateRow(t *testing.T, db *sql.DB, uid uidT) (state userState, since int64, stid, afterBreak int) {
+	t.Helper()
+	err := db.QueryRow("SELECT state, since_unix_s, IFNULL(stid, 0), after_break FROM user_states WHERE uid = ?", uid).
+		Scan(&state, &since, &stid, &afterBreak)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return state, since, stid, afterBreak
+}
+
+func TestSetState(t *testing.T) {
+	ctx := context.Background()
+	for _, from := range allStates {
+		for _, to := range allStates {
+			db, done := newTestDB(t, time.Unix(1570000000, 0))
+			uid := seedUser(t, db, "a@example.com", false)
+			_, err := db.Exec("UPDATE user_states SET state = ?, since_unix_s = 100, stid = 1 WHERE uid = ?", from, uid)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			tx, err := db.Begin()
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = setState(ctx, tx, uid, 0, from, to, 200)
+			if err == nil {
+				err = tx.Commit()
+			} else {
+				tx.Rollback()
+			}
+
+			state, since, stid, afterBreak := getStateRow(t, db, uid)
+			var audited int
+			if err := db.QueryRow("SELECT COUNT(*) FROM audit_log WHERE uid = ? AND action = ?", uid, transitionAction(from, to)).
+				Scan(&audited); err != nil {
+				t.Fatal(err)
+			}
+			if !from.canTransition(to) {
+				if err == nil {
+					t.Errorf("%s to %s didn't fail", from, to)
+				}
+				if state != from || since != 100 || audited != 0 {
+					t.Errorf("%s to %s failed but left %s since %d and %d audit records", from, to, state, since, audited)
+				}
+				done()
+				continue
+			}
+
+			if err != nil {
+				t.Errorf("%s to %s: %v", from, to, err)
+			}
+			if state != to || since != 200 || audited != 1 {
+				t.Errorf("%s to %s left %s since %d and %d audit records", from, to, state, since, audited)
+			}
+			if wantSite := to == stateBreak; (stid != 0) != wantSite {
+				t.Errorf("%s to %s left site %d", from, to, stid)
+			}
+			if wantAfterBreak := from == stateBreak && to == stateIn; (afterBreak == 1) != wantAfterBreak {
+				t.Errorf("%s to %s left after_break %d", from, to, afterBreak)
+			}
+			done()
+		}
+	}
+}
+
+// every state can be stored
+func TestStatesInSchema(t *testing.T) {
+	db, done := newTestDB(t, time.Unix(1570000000, 0))
+	defer done()
+	uid := seedUser(t, db, "a@example.com", false)
+	for _, s := range allStates {
+		if _, err := db.Exec("UPDATE user_states SET state = ? WHERE uid = ?", s, uid); err != nil {
+			t.Errorf("state %s: %v", s, err)
+		}
+	}
+	if _, err := db.Exec("UPDATE user_states SET state = 'X' WHERE uid = ?", uid); err == nil {
+		t.Error("an unknown state was stored")
+	}
+}
+
+type hookCall struct {
+	uid      uidT
+	from, to userState
+	at       int64
+}
+
+func TestTransitionHooks(t *testing.T) {
+	now := time.Unix(1570000000, 0)
+	db, done := newTestDB(t, now)
+	defer done()
+	uid := seedUser(t, db, "a@example.com", false)
+	ctx := context.Background()
+
+	saved := transitionHooks
+	defer func() { transitionHooks = saved }()
+	transitionHooks = nil
+	var calls, second []hookCall
+	onTransition(func(uid uidT, from, to userState, at int64) { calls = append(calls, hookCall{uid, from, to, at}) })
+	onTransition(func(uid uidT, from, to userState, at int64) { second = append(second, hookCall{uid, from, to, at}) })
+
+	at := func(min int) int64 { return now.Unix() + int64(min)*60 }
+	steps := []struct {
+		name  string
+		punch func() error
+	}{
+		{"clock out while out", func() error { return clockOutAt(ctx, db, uid, 0, at(0)) }},
+		{"end a break while out", func() error { return clockBreakEnd(ctx, db, uid, 0) }},
+		{"clock in", func() error { return clockInAt(ctx, db, uid, 0, 0, at(0)) }},
+		{"clock in again", func() error { return clockInAt(ctx, db, uid, 0, 0, at(1)) }},
+		{"start a break", func() error { clk = fixedClock(time.Unix(at(60), 0)); return clockBreakStart(ctx, db, uid, 0) }},
+		{"start another break", func() error { return clockBreakStart(ctx, db, uid, 0) }},
+		{"end the break", func() error { clk = fixedClock(time.Unix(at(90), 0)); return clockBreakEnd(ctx, db, uid, 0) }},
+		{"start a break", func() error { clk = fixedClock(time.Unix(at(120), 0)); return clockBreakStart(ctx, db, uid, 0) }},
+		{"clock out during the break", func() error { return clockOutAt(ctx, db, uid, 0, at(150)) }},
+	}
+	for _, s := range steps {
+		if err := s.punch(); err != nil {
+			t.Fatalf("%s: %v", s.name, err)
+		}
+	}
+
+	want := []hookCall{
+		{uid, stateOut, stateIn, at(0)},
+		{uid, stateIn, stateBreak, at(60)},
+		{uid, stateBreak, stateIn, at(90)},
+		{uid, stateIn, stateBreak, at(120)},
+		{uid, stateBreak, stateOut, at(150)},
+	}
+	for name, got := range map[string][]hookCall{"first": calls, "second": second} {
+		if len(got) != len(want) {
+			t.Fatalf("%s hook was called %d times, want %d: %v", name, len(got), len(want), got)
+		}
+		for i := range want {
+			if got[i] != want[i] {
+				t.Errorf("%s hook call %d is %v, want %v", name, i, got[i], want[i])
+			}
+		}
+	}
+
+	// every transition was audited, the duplicate punches weren't
+	var audited int
+	if err := db.QueryRow("SELECT COUNT(*) FROM audit_log WHERE uid = ?", uid).Scan(&audited); err != nil {
+		t.Fatal(err)
+	}
+	if audited != len(want) {
+		t.Errorf("%d audit records, want %d", audited, len(want))
+	}
+	var entries int
+	if err := db.QueryRow("SELECT COUNT(*) FROM entries WHERE uid = ?", uid).Scan(&entries); err != nil {
+		t.Fatal(err)
+	}
+	if entries != 2 {
+		t.Errorf("%d entries, want the 2 before the breaks", entries)
+	}
+}
+
+func TestDisqualifyRunsHooks(t *testing.T) {
+	now := time.Unix(1570000000, 0)
+	db, done := newTestDB(t, now)
+	defer done()
+	in := seedUser(t, db, "in@example.com", false)
+	onBreak := seedUser(t, db, "break@example.com", false)
+	seedUser(t, db, "out@example.com", false)
+	for uid, state := range map[uidT]userState{in: stateIn, onBreak: stateBreak} {
+		_, err := db.Exec("UPDATE user_states SET state = ?, since_unix_s = ?, stid = 1 WHERE uid = ?", state, now.Unix()-3600, uid)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	saved := transitionHooks
+	defer func() { transitionHooks = saved }()
+	transitionHooks = nil
+	calls := map[uidT]hookCall{}
+	onTransition(func(uid uidT, from, to userState, at int64) { calls[uid] = hookCall{uid, from, to, at} })
+
+	affected, err := disqualify(db, 1, now.Unix(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if affected != 2 || len(calls) != 2 {
+		t.Fatalf("disqualified %d users and ran hooks for %d, want 2", affected, len(calls))
+	}
+	if c := calls[in]; c.from != stateIn || c.to != stateOut {
+		t.Errorf("hook of the clocked in user got %s to %s", c.from, c.to)
+	}
+	if c := calls[onBreak]; c.from != stateBreak || c.to != stateOut {
+		t.Errorf("hook of the user on a break got %s to %s", c.from, c.to)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/AndrewBurian/powermux"
+	"github.com/palantir/stacktrace"
+)
+
+type dbStats struct {
+	Users           int   `json:"users"`
+	Entries         int   `json:"entries"`
+	InvalidEntries  int   `json:"invalidEntries"`
+	Sessions        int   `json:"sessions"`
+	SizeBytes       int64 `json:"sizeBytes"`
+	OldestOpenSince int   `json:"oldestOpenSince"` // 0 if nobody is clocked in
+}
+
+type latencySummary struct {
+	Count  int     `json:"count"`
+	MeanMs float64 `json:"meanMs"`
+	MaxMs  float64 `json:"maxMs"`
+}
+
+// latencies keeps per-route latency summaries since the server was started
+type latencies struct {
+	mu     sync.Mutex
+	routes map[string]*latencySummary
+}
+
+func newLatencies() *latencies {
+	return &latencies{routes: make(map[string]*latencySummary)}
+}
+
+func (l *latencies) record(route string, d time.Duration) {
+	ms := float64(d) / float64(time.Millisecond)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	s, ok := l.routes[route]
+	if !ok {
+		s = &latencySummary{}
+		l.routes[route] = s
+	}
+	s.MeanMs = (s.MeanMs*float64(s.Count) + ms) / float64(s.Count+1)
+	s.Count++
+	if ms > s.MaxMs {
+		s.MaxMs = ms
+	}
+}
+
+func (l *latencies) summaries() map[string]latencySummary {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	m := make(map[string]latencySummary, len(l.routes))
+	for k, v := range l.routes {
+		m[k] = *v
+	}
+	return m
+}
+
+func (env *env) latencyMiddleware(w http.ResponseWriter, r *http.Request, n func(http.ResponseWriter, *http.Request)) {
+	start := time.Now()
+	n(w, r)
+	env.latencies.record(r.Method+" "+powermux.RequestPath(r), time.Since(start))
+}
+
+func getDBStats(db *sql.DB) (s dbStats, err error) {
+	err = db.QueryRow("SELECT COUNT(*) FROM users").Scan(&s.Users)
+	if err != nil {
+		return s, stacktrace.Propagate(err, "failed to count users")
+	}
+
+	err = entryStore.queryRow(context.TODO(), db, "SELECT COUNT(*), COUNT(CASE WHEN valid = 0 THEN 1 END) FROM entries WHERE deleted_unix_s IS NULL").Scan(&s.Entries, &s.InvalidEntries)
+	if err != nil {
+		return s, stacktrace.Propagate(err, "failed to count entries")
+	}
+
+	err = db.QueryRow("SELECT COUNT(*) FROM sessions WHERE expires_unix_s >= ?", time.Now().Unix()).Scan(&s.Sessions)
+	if err != nil {
+		return s, stacktrace.Propagate(err, "failed to count sessions")
+	}
+
+	var pageCount, pageSize int64
+	err = db.QueryRow("PRAGMA page_count").Scan(&pageCount)
+	if err != nil {
+		return s, stacktrace.Propagate(err, "failed to get page count")
+	}
+	err = db.QueryRow("PRAGMA page_size").Scan(&pageSize)
+	if err != nil {
+		return s, stacktrace.Propagate(err, "failed to get page size")
+	}
+	s.SizeBytes = pageCount * pageSize
+
+	err = db.QueryRow("SELECT IFNULL(MIN(since_unix_s), 0) FROM user_states WHERE state = ?", stateIn).Scan(&s.OldestOpenSince)
+	if err != nil {
+		return s, stacktrace.Propagate(err, "failed to get oldest open entry")
+	}
+
+	return s, nil
+}
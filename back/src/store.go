@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/palantir/stacktrace"
+)
+
+// All SQL on the entries table goes through a store, see TestEntriesSQLGoesThroughStore, so that
+// another database can be added for entries by adding a store. Stores don't open databases, the
+// *sql.DB comes with whichever driver the database needs.
+// SQLite is the only store. One for PostgreSQL, MySQL or MariaDB is deferred until the server can
+// link a driver for them. It needs a setting to choose it, its own schema and migrations, queries
+// rewritten for its dialect (placeholders, IFNULL, rowids and UPDATE OR IGNORE, which merging users
+// moves entries with) and tests against a real server to be of use.
+
+// sqlHandle is a database or a transaction
+type sqlHandle interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+type store interface {
+	exec(ctx context.Context, h sqlHandle, query string, args ...interface{}) (sql.Result, error)
+	query(ctx context.Context, h sqlHandle, query string, args ...interface{}) (*sql.Rows, error)
+	queryRow(ctx context.Context, h sqlHandle, query string, args ...interface{}) *sql.Row
+	// insert runs an INSERT of one row and returns its id, the value of the column idColumn
+	insert(ctx context.Context, h sqlHandle, idColumn, query string, args ...interface{}) (id int64, err error)
+}
+
+// entryStore is what entries are kept in
+var entryStore store = sqliteStore{}
+
+type sqliteStore struct{}
+
+func (sqliteStore) exec(ctx context.Context, h sqlHandle, query string, args ...interface{}) (sql.Result, error) {
+	return h.ExecContext(ctx, query, args...)
+}
+
+func (sqliteStore) query(ctx context.Context, h sqlHandle, query string, args ...interface{}) (*sql.Rows, error) {
+	return h.QueryContext(ctx, query, args...)
+}
+
+func (sqliteStore) queryRow(ctx context.Context, h sqlHandle, query string, args ...interface{}) *sql.Row {
+	return h.QueryRowContext(ctx, query, args...)
+}
+
+func (sqliteStore) insert(ctx context.Context, h sqlHandle, idColumn, query string, args ...interface{}) (id int64, err error) {
+	res, err := h.ExecContext(ctx, query, args...)
+	if err != nil {
+		return 0, err
+	}
+	id, err = res.LastInsertId()
+	return id, stacktrace.Propagate(err, "failed to get "+idColumn)
+}
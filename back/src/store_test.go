@@ -0,0 +1,133 @@
+package main
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+var entriesTableRegexp = regexp.MustCompile(`(?i)\b(FROM|JOIN|UPDATE|INTO)\s+entries\b`)
+
+// queries on the entries table go through entryStore, so that they can run on every store
+func TestEntriesSQLGoesThroughStore(t *testing.T) {
+	files, err := filepath.Glob("*.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fset := token.NewFileSet()
+	var parsed []*ast.File
+	for _, name := range files {
+		if strings.HasSuffix(name, "_test.go") || name == "store.go" || name == "db.go" || name == "migrations.go" {
+			continue // tests seed SQLite directly, schemas aren't queries
+		}
+		f, err := parser.ParseFile(fset, name, nil, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		parsed = append(parsed, f)
+	}
+
+	// queries are often package level constants or variables built up in the function
+	consts := map[string]ast.Expr{}
+	for _, f := range parsed {
+		for _, decl := range f.Decls {
+			gen, ok := decl.(*ast.GenDecl)
+			if !ok || gen.Tok != token.CONST {
+				continue
+			}
+			for _, spec := range gen.Specs {
+				vs := spec.(*ast.ValueSpec)
+				for i, name := range vs.Names {
+					if i < len(vs.Values) {
+						consts[name.Name] = vs.Values[i]
+					}
+				}
+			}
+		}
+	}
+	c := constResolver{consts: consts}
+
+	for _, f := range parsed {
+		ast.Inspect(f, func(n ast.Node) bool {
+			call, ok := n.(*ast.CallExpr)
+			if !ok {
+				return true
+			}
+			sel, ok := call.Fun.(*ast.SelectorExpr)
+			if !ok {
+				return true
+			}
+			switch sel.Sel.Name {
+			case "Exec", "Query", "QueryRow", "ExecContext", "QueryContext", "QueryRowContext", "Prepare":
+			default:
+				return true
+			}
+			for _, arg := range call.Args {
+				if query, ok := c.constString(arg); ok && entriesTableRegexp.MatchString(query) {
+					t.Errorf("%s: query on entries doesn't go through entryStore", fset.Position(call.Pos()))
+				}
+			}
+			return true
+		})
+	}
+}
+
+// constResolver finds the string a query argument starts with
+type constResolver struct {
+	consts map[string]ast.Expr
+	seen   map[*ast.Ident]bool
+}
+
+// constString returns the value of a string literal, a constant, a variable assigned one,
+// or a concatenation starting with one of those
+func (c *constResolver) constString(e ast.Expr) (s string, ok bool) {
+	switch e := e.(type) {
+	case *ast.BasicLit:
+		if e.Kind != token.STRING {
+			return "", false
+		}
+		s, err := strconv.Unquote(e.Value)
+		return s, err == nil
+	case *ast.BinaryExpr:
+		l, lok := c.constString(e.X)
+		r, _ := c.constString(e.Y)
+		return l + r, lok
+	case *ast.ParenExpr:
+		return c.constString(e.X)
+	case *ast.Ident:
+		if c.seen == nil {
+			c.seen = map[*ast.Ident]bool{}
+		}
+		if c.seen[e] {
+			return "", false
+		}
+		c.seen[e] = true
+		defer delete(c.seen, e)
+		if e.Obj != nil {
+			switch decl := e.Obj.Decl.(type) {
+			case *ast.AssignStmt:
+				for i, lhs := range decl.Lhs {
+					if id, ok := lhs.(*ast.Ident); ok && id.Name == e.Name && i < len(decl.Rhs) && len(decl.Lhs) == len(decl.Rhs) {
+						return c.constString(decl.Rhs[i])
+					}
+				}
+			case *ast.ValueSpec:
+				for i, name := range decl.Names {
+					if name.Name == e.Name && i < len(decl.Values) {
+						return c.constString(decl.Values[i])
+					}
+				}
+			}
+			return "", false
+		}
+		if v, ok := c.consts[e.Name]; ok {
+			return c.constString(v)
+		}
+	}
+	return "", false
+}
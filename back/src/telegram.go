@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+
+	"github.com/palantir/stacktrace"
+)
+
+// The Telegram bot takes /in, /out and /today. Telegram sends the bot's updates to /telegram/updates,
+// set up with setWebhook and the secret token from WMS2_TELEGRAM_SECRET, and the reply goes back as a
+// sendMessage in the response, so the server never calls Telegram itself. Telegram users are mapped
+// to wms2 users by an admin, see setTelegramUser.
+
+// telegram commands
+const (
+	telegramIn    = "/in"
+	telegramOut   = "/out"
+	telegramToday = "/today"
+)
+
+// telegramUpdate is the part of a Telegram update the bot looks at
+type telegramUpdate struct {
+	Message *struct {
+		From *struct {
+			ID int64 `json:"id"`
+		} `json:"from"`
+		Chat struct {
+			ID int64 `json:"id"`
+		} `json:"chat"`
+		Text string `json:"text"`
+	} `json:"message"`
+}
+
+// telegramCommand is the command of a message like "/in" or "/in@SomeBot", empty if it isn't one
+func telegramCommand(text string) string {
+	fields := strings.Fields(text)
+	if len(fields) == 0 || !strings.HasPrefix(fields[0], "/") {
+		return ""
+	}
+	return strings.SplitN(fields[0], "@", 2)[0]
+}
+
+// setTelegramUser maps the Telegram user to the user, replacing both of their old mappings.
+// A telegramID of 0 removes the user's mapping.
+func setTelegramUser(db *sql.DB, uid uidT, telegramID int64) (err error) {
+	if telegramID == 0 {
+		_, err = db.Exec("DELETE FROM telegram_users WHERE uid = ?", uid)
+		return stacktrace.Propagate(err, "failed to remove telegram user")
+	}
+	_, err = db.Exec("INSERT OR REPLACE INTO telegram_users (telegram_id, uid) VALUES (?1, ?2)", telegramID, uid)
+	return stacktrace.Propagate(err, "failed to set telegram user")
+}
+
+// getUserByTelegramID returns the user the Telegram user is mapped to, found is false if there's none
+func getUserByTelegramID(db *sql.DB, telegramID int64) (uid uidT, found bool, err error) {
+	err = db.QueryRow("SELECT uid FROM telegram_users WHERE telegram_id = ?", telegramID).Scan(&uid)
+	if err == sql.ErrNoRows {
+		return 0, false, nil
+	}
+	return uid, err == nil, stacktrace.Propagate(err, "failed to get telegram user")
+}
+
+// runTelegramCommand runs the command for the user, reply is the text to send back.
+// known is false for commands the bot doesn't have.
+func runTelegramCommand(ctx context.Context, db *sql.DB, uid uidT, command string) (reply string, known bool, err error) {
+	switch command {
+	case telegramIn:
+		err = clockInUnder(ctx, db, uid, 0, 0, 0)
+	case telegramOut:
+		err = clockOut(ctx, db, uid, 0)
+	case telegramToday:
+	default:
+		return "", false, nil
+	}
+	if err != nil {
+		return "", true, err
+	}
+
+	reply, err = clockStatusText(ctx, db, uid)
+	return reply, true, err
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/palantir/stacktrace"
+)
+
+// Timesheets are a user's month as a printable PDF for HR: the entries and totals of every day,
+// the month's delta and lines for the employee and their manager to sign.
+
+const (
+	timesheetMargin    = 50
+	timesheetRow       = 14
+	timesheetFontSize  = 9
+	timesheetMaxDetail = 55 // characters of entries and notes per row
+)
+
+// timesheet columns, x positions in points
+const (
+	tsDate     = timesheetMargin
+	tsDay      = 110
+	tsDetail   = 140
+	tsWorked   = 400
+	tsExpected = 450
+	tsDelta    = 500
+)
+
+// timesheetDetail lists the day's entries like "08:00-12:00, 12:30-17:00" in loc followed by notes
+// like holidays. Entries that don't count are marked with a *.
+func timesheetDetail(d dayReport, loc *time.Location) string {
+	parts := []string{}
+	for _, en := range d.Entries {
+		s := time.Unix(int64(en.From), 0).In(loc).Format("15:04") + "-" +
+			time.Unix(int64(en.To), 0).In(loc).Format("15:04")
+		if en.Kind != entryWork {
+			s += " " + en.Kind
+		}
+		if !en.Valid || en.Pending {
+			s += "*"
+		}
+		parts = append(parts, s)
+	}
+	if d.Holiday {
+		parts = append(parts, "holiday")
+	}
+	if d.Leave != "" {
+		parts = append(parts, d.Leave)
+	}
+	if d.School {
+		parts = append(parts, "school")
+	}
+
+	detail := strings.Join(parts, ", ")
+	if r := []rune(detail); len(r) > timesheetMaxDetail {
+		detail = string(r[:timesheetMaxDetail-3]) + "..."
+	}
+	return detail
+}
+
+// writeTimesheetPDF writes the user's timesheet for the month, days are in the user's time zone
+func writeTimesheetPDF(db *sql.DB, w io.Writer, uid uidT, year int, month time.Month) (err error) {
+	email, err := uidToEmail(db, uid)
+	if err != nil {
+		return stacktrace.Propagate(err, "failed to get email")
+	}
+	loc, err := userLocation(context.TODO(), db, uid)
+	if err != nil {
+		return err
+	}
+	mr, err := getMonthReport(db, uid, year, month, loc)
+	if err != nil {
+		return err
+	}
+
+	var doc pdfDoc
+	y := float64(pdfPageHeight - timesheetMargin)
+	doc.text(timesheetMargin, y, 16, true, "Timesheet")
+	y -= 22
+	doc.text(timesheetMargin, y, 11, false, email)
+	doc.text(tsWorked, y, 11, false, time.Date(year, month, 1, 0, 0, 0, 0, loc).Format("January 2006"))
+	y -= 26
+
+	header := func() {
+		doc.text(tsDate, y, timesheetFontSize, true, "Date")
+		doc.text(tsDay, y, timesheetFontSize, true, "Day")
+		doc.text(tsDetail, y, timesheetFontSize, true, "Entries")
+		doc.text(tsWorked, y, timesheetFontSize, true, "Worked")
+		doc.text(tsExpected, y, timesheetFontSize, true, "Expected")
+		doc.text(tsDelta, y, timesheetFontSize, true, "Delta")
+		doc.line(timesheetMargin, y-4, pdfPageWidth-timesheetMargin, y-4)
+		y -= timesheetRow + 2
+	}
+	header()
+
+	for _, d := range mr.Days {
+		if y < timesheetMargin+timesheetRow {
+			doc.newPage()
+			y = pdfPageHeight - timesheetMargin
+			header()
+		}
+		date := time.Unix(d.Date, 0).In(loc)
+		doc.text(tsDate, y, timesheetFontSize, false, date.Format(holidayDate))
+		doc.text(tsDay, y, timesheetFontSize, false, date.Format("Mon"))
+		doc.text(tsDetail, y, timesheetFontSize, false, timesheetDetail(d, loc))
+		doc.text(tsWorked, y, timesheetFontSize, false, formatSeconds(d.Worked))
+		doc.text(tsExpected, y, timesheetFontSize, false, formatSeconds(d.Expected))
+		doc.text(tsDelta, y, timesheetFontSize, false, formatSeconds(d.Delta))
+		y -= timesheetRow
+	}
+
+	// the totals and signatures stay together
+	if y < timesheetMargin+8*timesheetRow {
+		doc.newPage()
+		y = pdfPageHeight - timesheetMargin
+	}
+	doc.line(timesheetMargin, y+timesheetRow-4, pdfPageWidth-timesheetMargin, y+timesheetRow-4)
+	doc.text(tsDate, y, timesheetFontSize, true, "Total")
+	doc.text(tsWorked, y, timesheetFontSize, true, formatSeconds(mr.Worked))
+	doc.text(tsExpected, y, timesheetFontSize, true, formatSeconds(mr.Expected))
+	doc.text(tsDelta, y, timesheetFontSize, true, formatSeconds(mr.Delta))
+	y -= timesheetRow
+	doc.text(tsDate, y, 7, false, "* doesn't count, it's disqualified or waiting for approval")
+	y -= 4 * timesheetRow
+
+	for _, who := range []string{"Employee", "Manager"} {
+		doc.line(tsDate, y, tsDate+200, y)
+		doc.line(tsWorked, y, pdfPageWidth-timesheetMargin, y)
+		doc.text(tsDate, y-12, 8, false, fmt.Sprintf("%s signature", who))
+		doc.text(tsWorked, y-12, 8, false, "Date")
+		y -= 4 * timesheetRow
+	}
+	return doc.write(w)
+}
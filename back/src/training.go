@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"time"
+
+	"github.com/palantir/stacktrace"
+)
+
+// Training is time in the training category, see categories.go. Training entries can have the name of
+// the course and a certificate, a PDF or a scan of it, and the yearly training report sums them up per
+// user for audits like ISO 9001's. Courses and certificates are sealed with fieldKeys, see crypt.go.
+
+// categoryTraining is the name of the category training entries are in
+const categoryTraining = "training"
+
+// maxCertificateSize is the largest certificate in bytes, certificate uploads may be larger than other
+// requests, see bodyLimitMiddleware
+const maxCertificateSize = 4 << 20
+
+// certificateType is the content type of a certificate, empty if it isn't a PDF or an image
+func certificateType(certificate []byte) string {
+	switch t := http.DetectContentType(certificate); t {
+	case "application/pdf", "image/jpeg", "image/png":
+		return t
+	}
+	return ""
+}
+
+// trainingEntrySQL selects entry ?1 if it's in the training category and, if ?2 isn't 0, user ?2's
+const trainingEntrySQL = `SELECT eid FROM entries JOIN categories USING (catid)
+	WHERE eid = ?1 AND (?2 = 0 OR uid = ?2) AND name = '` + categoryTraining + `' AND deleted_unix_s IS NULL`
+
+// setTrainingCourse sets the course of the training entry, empty to remove it. If owner isn't 0 the entry
+// has to be theirs. found is false if there's no such training entry.
+func setTrainingCourse(db *sql.DB, eid eidT, owner uidT, course string) (found bool, err error) {
+	stored, sealed, err := fieldKeys.sealBytes([]byte(course))
+	if err != nil {
+		return false, err
+	}
+	res, err := entryStore.exec(context.TODO(), db,
+		`INSERT INTO training_details (eid, course, course_sealed) SELECT eid, ?3, ?4 FROM (`+trainingEntrySQL+`) WHERE 1
+			ON CONFLICT (eid) DO UPDATE SET course = ?3, course_sealed = ?4`, eid, owner, string(stored), sealed)
+	if err != nil {
+		return false, stacktrace.Propagate(err, "failed to set course")
+	}
+	n, err := res.RowsAffected()
+	return n == 1, stacktrace.Propagate(err, "failed to get rows affected")
+}
+
+// setCertificate sets the certificate of the training entry, nil removes it. If owner isn't 0 the entry
+// has to be theirs. found is false if there's no such training entry.
+func setCertificate(db *sql.DB, eid eidT, owner uidT, certificate []byte) (found bool, err error) {
+	var typeValue interface{}
+	sealed := false
+	if certificate != nil {
+		var contentType []byte
+		contentType, sealed, err = fieldKeys.sealBytes([]byte(certificateType(certificate)))
+		if err != nil {
+			return false, err
+		}
+		typeValue = string(contentType)
+		certificate, _, err = fieldKeys.sealBytes(certificate)
+		if err != nil {
+			return false, err
+		}
+	}
+	res, err := entryStore.exec(context.TODO(), db,
+		`INSERT INTO training_details (eid, course, certificate, certificate_type, certificate_sealed)
+			SELECT eid, '', ?3, ?4, ?5 FROM (`+trainingEntrySQL+`) WHERE 1
+			ON CONFLICT (eid) DO UPDATE SET certificate = ?3, certificate_type = ?4, certificate_sealed = ?5`,
+		eid, owner, certificate, typeValue, sealed)
+	if err != nil {
+		return false, stacktrace.Propagate(err, "failed to set certificate")
+	}
+	n, err := res.RowsAffected()
+	return n == 1, stacktrace.Propagate(err, "failed to get rows affected")
+}
+
+// getCertificate returns the certificate of the training entry and its content type. If owner isn't 0
+// the entry has to be theirs. found is false if there's no such training entry or it has no certificate.
+func getCertificate(db *sql.DB, eid eidT, owner uidT) (certificate []byte, contentType string, found bool, err error) {
+	var storedType []byte
+	var sealed bool
+	err = entryStore.queryRow(context.TODO(), db,
+		`SELECT certificate, certificate_type, certificate_sealed FROM training_details
+			WHERE eid IN (`+trainingEntrySQL+`) AND certificate IS NOT NULL`, eid, owner).Scan(&certificate, &storedType, &sealed)
+	if err == sql.ErrNoRows {
+		return nil, "", false, nil
+	}
+	if err != nil {
+		return nil, "", false, stacktrace.Propagate(err, "failed to get certificate")
+	}
+
+	certificate, err = fieldKeys.openBytes(certificate, sealed)
+	if err != nil {
+		return nil, "", false, stacktrace.Propagate(err, "failed to open certificate of entry %d", eid)
+	}
+	storedType, err = fieldKeys.openBytes(storedType, sealed)
+	return certificate, string(storedType), err == nil, stacktrace.Propagate(err, "failed to open certificate of entry %d", eid)
+}
+
+// trainingSession is a training entry in the report
+type trainingSession struct {
+	EID         eidT   `json:"eid"`
+	From        int    `json:"from"`
+	To          int    `json:"to"`
+	Course      string `json:"course"`
+	Certificate bool   `json:"certificate"` // whether there is one
+}
+
+// trainingReport is a user's training in a year. Only valid entries that aren't waiting for approval
+// count, like for worked time.
+type trainingReport struct {
+	UID      uidT              `json:"uid"`
+	Email    string            `json:"email"`
+	Year     int               `json:"year"`
+	Trained  int               `json:"trained"` // seconds
+	Sessions []trainingSession `json:"sessions,omitempty"`
+}
+
+// getTrainingReport reports on the user's training in the year, starting in the user's time zone.
+// Sessions are left out unless withSessions is set.
+func getTrainingReport(db *sql.DB, u reportUser, year int, withSessions bool) (tr trainingReport, err error) {
+	from := time.Date(year, 1, 1, 0, 0, 0, 0, u.loc)
+	to := from.AddDate(1, 0, 0)
+	rows, err := entryStore.query(context.TODO(), db,
+		`SELECT eid, from_unix_s, to_unix_s, IFNULL(course, ''), IFNULL(course_sealed, 0), certificate IS NOT NULL
+			FROM entries JOIN categories USING (catid) LEFT JOIN training_details USING (eid)
+			WHERE uid = ?1 AND name = ?2 AND valid = 1 AND approved = 1 AND deleted_unix_s IS NULL
+			AND from_unix_s >= ?3 AND from_unix_s < ?4 ORDER BY from_unix_s`,
+		u.UID, categoryTraining, from.Unix(), to.Unix())
+	if err != nil {
+		return tr, stacktrace.Propagate(err, "failed to list training")
+	}
+	defer rows.Close()
+
+	tr = trainingReport{UID: u.UID, Email: u.Email, Year: year}
+	if withSessions {
+		tr.Sessions = []trainingSession{}
+	}
+	for rows.Next() {
+		var s trainingSession
+		var course []byte
+		var sealed bool
+		err = rows.Scan(&s.EID, &s.From, &s.To, &course, &sealed, &s.Certificate)
+		if err != nil {
+			return tr, stacktrace.Propagate(err, "failed to scan row")
+		}
+		tr.Trained += s.To - s.From
+		if withSessions {
+			course, err = fieldKeys.openBytes(course, sealed)
+			if err != nil {
+				return tr, stacktrace.Propagate(err, "failed to open course of entry %d", s.EID)
+			}
+			s.Course = string(course)
+			tr.Sessions = append(tr.Sessions, s)
+		}
+	}
+	return tr, nil
+}
+
+// listTrainingReports reports on everyone's training in the year, without the sessions
+func listTrainingReports(db *sql.DB, year int) (trs []trainingReport, err error) {
+	users, err := listReportUsers(db, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	trs = []trainingReport{}
+	for _, u := range users {
+		tr, err := getTrainingReport(db, u, year, false)
+		if err != nil {
+			return nil, err
+		}
+		trs = append(trs, tr)
+	}
+	return trs, nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+// courses and certificates are sealed once keys are configured, read back either way and rotated to the
+// current key
+func TestTrainingSealed(t *testing.T) {
+	loc := testLocation(t)
+	at := func(day, hour int) time.Time { return time.Date(2019, time.October, day, hour, 0, 0, 0, loc) }
+	db, done := newTestDB(t, at(31, 12))
+	defer done()
+	uid := seedUser(t, db, "a@example.com", false)
+	clear := seedEntry(t, db, uid, at(1, 8), at(1, 12), entryWork)
+	sealed := seedEntry(t, db, uid, at(2, 8), at(2, 12), entryWork)
+	_, err := db.Exec("UPDATE entries SET catid = (SELECT catid FROM categories WHERE name = ?)", categoryTraining)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := fieldKeys
+	defer func() { fieldKeys = saved }()
+	certificate := []byte("%PDF-1.4 certificate of first aid")
+
+	set := func(eid eidT, course string) {
+		t.Helper()
+		if found, err := setTrainingCourse(db, eid, uid, course); err != nil || !found {
+			t.Fatalf("setting the course got %t, %v", found, err)
+		}
+		if found, err := setCertificate(db, eid, uid, certificate); err != nil || !found {
+			t.Fatalf("setting the certificate got %t, %v", found, err)
+		}
+	}
+	check := func(when string) {
+		t.Helper()
+		users, err := listReportUsers(db, uid, 0)
+		if err != nil || len(users) != 1 {
+			t.Fatalf("got %d users, %v", len(users), err)
+		}
+		tr, err := getTrainingReport(db, users[0], 2019, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(tr.Sessions) != 2 || tr.Sessions[0].Course != "First aid" || tr.Sessions[1].Course != "Fire safety" {
+			t.Errorf("%s: got sessions %+v", when, tr.Sessions)
+		}
+		for _, eid := range []eidT{clear, sealed} {
+			got, contentType, found, err := getCertificate(db, eid, uid)
+			if err != nil || !found || !bytes.Equal(got, certificate) || contentType != "application/pdf" {
+				t.Errorf("%s: certificate of entry %d is %q, %q, %t, %v", when, eid, got, contentType, found, err)
+			}
+		}
+	}
+	// sealedWith is how many training details are sealed with the key, with every value of them
+	sealedWith := func(id string) int {
+		return countRows(t, db, `SELECT COUNT(*) FROM training_details WHERE course_sealed = 1 AND certificate_sealed = 1
+			AND course LIKE ?1 AND CAST(certificate AS TEXT) LIKE ?1 AND certificate_type LIKE ?1`, id+":%")
+	}
+
+	fieldKeys = nil
+	set(clear, "First aid")
+	oldKeys := &keyring{current: 1, keys: map[int][]byte{1: bytes.Repeat([]byte{1}, 32)}}
+	fieldKeys = oldKeys
+	set(sealed, "Fire safety")
+	if n := sealedWith("1"); n != 1 {
+		t.Errorf("%d training details sealed, want 1", n)
+	}
+	n := countRows(t, db, "SELECT COUNT(*) FROM training_details WHERE eid = ? AND (course LIKE '%safety%' OR certificate_type LIKE '%pdf%')", sealed)
+	if n != 0 {
+		t.Error("the sealed course or certificate type is in the clear")
+	}
+	check("sealed")
+
+	fieldKeys = &keyring{current: 2, keys: map[int][]byte{1: oldKeys.keys[1], 2: bytes.Repeat([]byte{2}, 32)}}
+	rotated, err := rotateTraining(db, fieldKeys)
+	if err != nil || rotated != 2 {
+		t.Fatalf("rotated %d (%v), want 2", rotated, err)
+	}
+	if n := sealedWith("2"); n != 2 {
+		t.Errorf("%d training details sealed with the current key, want 2", n)
+	}
+	check("rotated")
+	if rotated, err = rotateTraining(db, fieldKeys); err != nil || rotated != 0 {
+		t.Errorf("rotating again rotated %d (%v)", rotated, err)
+	}
+
+	// without the keys, sealed training details can't be read
+	fieldKeys = nil
+	if _, _, _, err = getCertificate(db, sealed, uid); err == nil || !strings.Contains(err.Error(), "WMS2_DATA_KEYS") {
+		t.Errorf("got %v, want an error about the keys", err)
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"crypto/rand"
 	"crypto/subtle"
 	"database/sql"
@@ -16,8 +17,12 @@ type uidT int
 type sidT string
 
 type onlineUser struct {
-	UID   uidT `json:"uid"`
-	Since int  `json:"since"`
+	UID         uidT  `json:"uid"`
+	Since       int   `json:"since"`
+	ExpectedEnd int   `json:"expectedEnd"` // 0 if unknown
+	Site        stidT `json:"site"`
+
+	MissedHeartbeat bool `json:"missedHeartbeat"`
 }
 
 func createUser(db *sql.DB, email, password string, admin bool) (uid uidT, err error) {
@@ -25,16 +30,15 @@ func createUser(db *sql.DB, email, password string, admin bool) (uid uidT, err e
 
 	tx, err := db.Begin()
 	rollback := func() {
-		err = tx.Rollback()
-		if err != nil {
-			fmt.Println(stacktrace.Propagate(err, "failed to roll back transaction"))
+		if err := tx.Rollback(); err != nil {
+			logError(stacktrace.Propagate(err, "failed to roll back transaction"))
 		}
 	}
 	if err != nil {
 		return -1, stacktrace.Propagate(err, "failed to begin a transaction")
 	}
 
-	err = db.QueryRow("SELECT 1 FROM users WHERE email = ?", email).Scan()
+	err = tx.QueryRow("SELECT 1 FROM users WHERE email = ?", email).Scan()
 	if err != sql.ErrNoRows {
 		rollback()
 		return -1, stacktrace.Propagate(err, "user already exists")
@@ -49,7 +53,7 @@ func createUser(db *sql.DB, email, password string, admin bool) (uid uidT, err e
 		adminInt = 1
 	}
 
-	_, err = db.Exec(
+	_, err = tx.Exec(
 		`INSERT INTO users (email, password_hash, password_salt, admin)
 		  VALUES (?1, ?2, ?3, ?4)`, email, hash, salt, adminInt)
 	if err != nil {
@@ -57,15 +61,15 @@ func createUser(db *sql.DB, email, password string, admin bool) (uid uidT, err e
 		return -1, stacktrace.Propagate(err, "failed to insert a row into the users table")
 	}
 
-	err = db.QueryRow(`SELECT uid FROM users WHERE email = ?`, email).Scan(&uid)
+	err = tx.QueryRow(`SELECT uid FROM users WHERE email = ?`, email).Scan(&uid)
 	if err != nil {
 		rollback()
 		return -1, stacktrace.Propagate(err, "failed to get uid")
 	}
 
-	_, err = db.Exec(
+	_, err = tx.Exec(
 		`INSERT INTO user_states (uid, state, since_unix_s)
-			VALUES (?1, ?2, ?3)`, uid, "O", time.Now().Unix())
+			VALUES (?1, ?2, ?3)`, uid, stateOut, time.Now().Unix())
 	if err != nil {
 		rollback()
 		return uid, stacktrace.Propagate(err, "failed to insert a row into the user_states table")
@@ -96,16 +100,16 @@ func checkSession(db *sql.DB, sid sidT) (ok bool) {
 }
 
 func getUserBySession(db *sql.DB, sid sidT) (uid uidT, err error) {
-	db.QueryRow("SELECT uid FROM sessions WHERE sid = ?1 AND expires_unix_s >= ?2", sid, time.Now().Unix()).Scan(&uid)
+	err = db.QueryRow("SELECT uid FROM sessions WHERE sid = ?1 AND expires_unix_s >= ?2", sid, time.Now().Unix()).Scan(&uid)
 	return uid, err
 }
 
-func createSession(db *sql.DB, uid uidT, expireAfter time.Duration) (sid sidT, err error) {
+func createSession(ex execer, uid uidT, expireAfter time.Duration) (sid sidT, err error) {
 	sidRaw := make([]byte, 18)
 	rand.Read(sidRaw)
 	sid = sidT(base64.StdEncoding.EncodeToString(sidRaw))
 	expires := time.Now().Add(expireAfter).Unix()
-	_, err = db.Exec(
+	_, err = ex.Exec(
 		`INSERT INTO sessions (sid, uid, expires_unix_s)
 			VALUES (?1, ?2, ?3)`, sid, uid, expires)
 	return sid, err
@@ -121,20 +125,36 @@ func checkAdmin(db *sql.DB, uid uidT) (admin bool, err error) {
 	return admin, err
 }
 
+// checkAuditor reports whether the user may read everything, admins always can
+func checkAuditor(db *sql.DB, uid uidT) (auditor bool, err error) {
+	err = db.QueryRow("SELECT admin = 1 OR auditor = 1 FROM users WHERE uid = ?", uid).Scan(&auditor)
+	return auditor, err
+}
+
+func setAuditor(db *sql.DB, uid uidT, auditor bool) (err error) {
+	_, err = db.Exec("UPDATE users SET auditor = ?1 WHERE uid = ?2", auditor, uid)
+	return stacktrace.Propagate(err, "failed to update auditor role")
+}
+
 func countOnlineUsers(db *sql.DB) (onlineUsers int, err error) {
-	err = db.QueryRow("SELECT COUNT(*) FROM user_states WHERE state = 'I'").Scan(&onlineUsers)
+	err = db.QueryRow("SELECT COUNT(*) FROM user_states WHERE state = ?", stateIn).Scan(&onlineUsers)
+	return onlineUsers, err
+}
+
+func countOnlineUsersAt(db *sql.DB, stid stidT) (onlineUsers int, err error) {
+	err = db.QueryRow("SELECT COUNT(*) FROM user_states WHERE state = ?1 AND stid = ?2", stateIn, stid).Scan(&onlineUsers)
 	return onlineUsers, err
 }
 
 func listOnlineUsers(db *sql.DB) (onlineUsers []onlineUser, err error) {
-	rows, err := db.Query("SELECT uid, since_unix_s FROM user_states WHERE state = 'I'")
+	rows, err := db.Query("SELECT uid, since_unix_s, IFNULL(expected_end_unix_s, 0), IFNULL(stid, 0), missed_heartbeat FROM user_states WHERE state = ?", stateIn)
 	if err != nil {
 		return onlineUsers, stacktrace.Propagate(err, "failed to get online users")
 	}
 
 	for rows.Next() {
 		var ou onlineUser
-		err = rows.Scan(&ou.UID, &ou.Since)
+		err = rows.Scan(&ou.UID, &ou.Since, &ou.ExpectedEnd, &ou.Site, &ou.MissedHeartbeat)
 		if err != nil {
 			return onlineUsers, stacktrace.Propagate(err, "failed to scan row")
 		}
@@ -153,3 +173,52 @@ func uidToEmail(db *sql.DB, uid uidT) (email string, err error) {
 	err = db.QueryRow("SELECT email FROM users WHERE uid = ?", uid).Scan(&email)
 	return email, err
 }
+
+// userLocation is the user's time zone, days and months start at midnight there.
+// It's the server's if they haven't set one, or if theirs is no longer known.
+func userLocation(ctx context.Context, db *sql.DB, uid uidT) (loc *time.Location, err error) {
+	var tz string
+	err = db.QueryRowContext(ctx, "SELECT IFNULL(timezone, '') FROM users WHERE uid = ?", uid).Scan(&tz)
+	if err == sql.ErrNoRows {
+		return time.Local, nil
+	}
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed to get time zone")
+	}
+	return timezoneLocation(uid, tz), nil
+}
+
+// timezoneLocation is the location of users.timezone, see userLocation
+func timezoneLocation(uid uidT, tz string) *time.Location {
+	if tz == "" {
+		return time.Local
+	}
+	loc, err := time.LoadLocation(tz)
+	if err != nil {
+		logError(stacktrace.Propagate(err, "unknown time zone %q of user %d", tz, uid))
+		return time.Local
+	}
+	return loc
+}
+
+// checkTimezone checks that tz is an IANA time zone name like Europe/Berlin or "" for the server's,
+// the error is meant for clients
+func checkTimezone(tz string) error {
+	if tz == "" {
+		return nil
+	}
+	if _, err := time.LoadLocation(tz); err != nil || tz == "Local" {
+		return fmt.Errorf("unknown time zone %q", tz)
+	}
+	return nil
+}
+
+// setTimezone sets the user's time zone, see checkTimezone
+func setTimezone(db *sql.DB, uid uidT, tz string) (err error) {
+	var value interface{}
+	if tz != "" {
+		value = tz
+	}
+	_, err = db.Exec("UPDATE users SET timezone = ?1 WHERE uid = ?2", value, uid)
+	return stacktrace.Propagate(err, "failed to set time zone")
+}
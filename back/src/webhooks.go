@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/palantir/stacktrace"
+)
+
+// Webhooks let other tools react to clock events. Admins register a URL with a secret, and each
+// event is POSTed to it as JSON with an X-WMS2-Signature header, "sha256=" followed by the hex
+// HMAC-SHA256 of the body keyed with the secret. Events are audited changes, see audit, and go
+// through the outbox, so they're enqueued in the change's transaction and retried if delivery fails.
+
+type whidT int
+
+// webhook events, a webhook gets all of them if it doesn't list any
+const (
+	webhookClockIn    = "clock-in"
+	webhookClockOut   = "clock-out"
+	webhookEntryEdit  = "entry-edit" // an entry was created, edited, deleted or restored
+	webhookDisqualify = "disqualify"
+)
+
+var webhookEvents = []string{webhookClockIn, webhookClockOut, webhookEntryEdit, webhookDisqualify}
+
+type webhook struct {
+	WHID    whidT    `json:"whid"`
+	URL     string   `json:"url"`
+	Secret  string   `json:"secret,omitempty"` // only sent when it's created
+	Events  []string `json:"events"`
+	Created int64    `json:"created"`
+}
+
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+func (wh webhook) validate() error {
+	if err := checkText("url", wh.URL, maxURLLength); err != nil {
+		return err
+	}
+	u, err := url.Parse(wh.URL)
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return stacktrace.NewError("url has to be an http or https URL")
+	}
+	if err := checkText("secret", wh.Secret, maxSecretLength); err != nil {
+		return err
+	}
+	for _, ev := range wh.Events {
+		known := false
+		for _, e := range webhookEvents {
+			known = known || ev == e
+		}
+		if !known {
+			return stacktrace.NewError("unknown event %q", ev)
+		}
+	}
+	return nil
+}
+
+// webhookEvent is the event an audit action is delivered as, empty if it isn't one
+func webhookEvent(action string) string {
+	switch action {
+	case auditClockIn:
+		return webhookClockIn
+	case auditClockOut:
+		return webhookClockOut
+	case auditCreate, auditEdit, auditDelete, auditRestore, auditConfirm:
+		return webhookEntryEdit
+	case auditDisqualify:
+		return webhookDisqualify
+	}
+	return ""
+}
+
+// webhookBody is what's POSTed, before and after are like the audit log's
+type webhookBody struct {
+	Event  string          `json:"event"`
+	Action string          `json:"action"` // the audit action, like edit or delete for entry-edit
+	At     int64           `json:"at"`
+	By     uidT            `json:"by"` // 0 for the server itself
+	UID    uidT            `json:"uid"`
+	EID    eidT            `json:"eid,omitempty"`
+	Before json.RawMessage `json:"before,omitempty"`
+	After  json.RawMessage `json:"after,omitempty"`
+}
+
+// webhookPayload is the outbox payload, one per webhook an event goes to
+type webhookPayload struct {
+	WHID  whidT           `json:"whid"`
+	Event string          `json:"event"`
+	Body  json.RawMessage `json:"body"`
+}
+
+// enqueueWebhooks enqueues the body for every webhook that wants its event
+func enqueueWebhooks(ex execer, body webhookBody) (err error) {
+	js, err := json.Marshal(body)
+	if err != nil {
+		return stacktrace.Propagate(err, "failed to marshal webhook body")
+	}
+	event, _ := json.Marshal(body.Event)
+
+	// the payloads are a webhookPayload each, put together from whid and the marshalled event and body
+	now := clk.Now().Unix()
+	_, err = ex.Exec(
+		`INSERT INTO outbox (kind, payload, created_unix_s, next_attempt_unix_s)
+			SELECT ?1, '{"whid":' || whid || ',"event":' || ?3 || ',"body":' || ?4 || '}', ?5, ?5 FROM webhooks
+				WHERE events = '' OR instr(',' || events || ',', ',' || ?2 || ',') > 0`,
+		outboxWebhook, body.Event, string(event), string(js), now)
+	return stacktrace.Propagate(err, "failed to enqueue webhooks")
+}
+
+func listWebhooks(db *sql.DB) (whs []webhook, err error) {
+	rows, err := db.Query("SELECT whid, url, events, created_unix_s FROM webhooks ORDER BY whid")
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed to list webhooks")
+	}
+	defer rows.Close()
+
+	whs = []webhook{}
+	for rows.Next() {
+		var wh webhook
+		var events string
+		err = rows.Scan(&wh.WHID, &wh.URL, &events, &wh.Created)
+		if err != nil {
+			return nil, stacktrace.Propagate(err, "failed to scan row")
+		}
+		wh.Events = []string{}
+		if events != "" {
+			wh.Events = strings.Split(events, ",")
+		}
+		whs = append(whs, wh)
+	}
+	return whs, nil
+}
+
+// createWebhook registers the webhook, generating a secret if it has none
+func createWebhook(db *sql.DB, wh webhook) (webhook, error) {
+	if wh.Secret == "" {
+		secretRaw := make([]byte, 24)
+		rand.Read(secretRaw)
+		wh.Secret = base64.URLEncoding.EncodeToString(secretRaw)
+	}
+	wh.Created = clk.Now().Unix()
+
+	res, err := db.Exec(
+		"INSERT INTO webhooks (url, secret, events, created_unix_s) VALUES (?1, ?2, ?3, ?4)",
+		wh.URL, wh.Secret, strings.Join(wh.Events, ","), wh.Created)
+	if err != nil {
+		return wh, stacktrace.Propagate(err, "failed to insert webhook")
+	}
+	id, err := res.LastInsertId()
+	wh.WHID = whidT(id)
+	if wh.Events == nil {
+		wh.Events = []string{}
+	}
+	return wh, stacktrace.Propagate(err, "failed to get webhook id")
+}
+
+// deleteWebhook deletes the webhook, events for it that are still pending in the outbox are dropped
+func deleteWebhook(db *sql.DB, whid whidT) (found bool, err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, stacktrace.Propagate(err, "failed to begin transaction")
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec("DELETE FROM webhooks WHERE whid = ?", whid)
+	if err != nil {
+		return false, stacktrace.Propagate(err, "failed to delete webhook")
+	}
+	n, err := res.RowsAffected()
+	if err != nil || n != 1 {
+		return false, stacktrace.Propagate(err, "failed to get rows affected")
+	}
+
+	// the payloads start with the whid, see enqueueWebhooks
+	_, err = tx.Exec(`DELETE FROM outbox WHERE kind = ?1 AND status = ?2 AND payload LIKE '{"whid":' || ?3 || ',%'`,
+		outboxWebhook, outboxPending, whid)
+	if err != nil {
+		return true, stacktrace.Propagate(err, "failed to drop pending events of webhook")
+	}
+	return true, stacktrace.Propagate(tx.Commit(), "failed to commit transaction")
+}
+
+// signWebhook is the X-WMS2-Signature of the body
+func signWebhook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookDeliverer is the outbox deliverer for webhooks
+func webhookDeliverer(db *sql.DB) deliverer {
+	return func(payload []byte) error {
+		var p webhookPayload
+		if err := json.Unmarshal(payload, &p); err != nil {
+			return stacktrace.Propagate(err, "invalid webhook payload")
+		}
+
+		var target, secret string
+		err := db.QueryRow("SELECT url, secret FROM webhooks WHERE whid = ?", p.WHID).Scan(&target, &secret)
+		if err == sql.ErrNoRows {
+			return nil // it was deleted
+		}
+		if err != nil {
+			return stacktrace.Propagate(err, "failed to get webhook")
+		}
+
+		req, err := http.NewRequest(http.MethodPost, target, bytes.NewReader(p.Body))
+		if err != nil {
+			return stacktrace.Propagate(err, "failed to create webhook request")
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-WMS2-Event", p.Event)
+		req.Header.Set("X-WMS2-Signature", signWebhook(secret, p.Body))
+		resp, err := webhookClient.Do(req)
+		if err != nil {
+			return stacktrace.Propagate(err, "failed to post webhook to "+target)
+		}
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return stacktrace.NewError("webhook %s responded %s", target, resp.Status)
+		}
+		return nil
+	}
+}
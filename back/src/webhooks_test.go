@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// deleting a webhook drops its pending events, not what was sent or what other webhooks get
+func TestDeleteWebhook(t *testing.T) {
+	db, done := newTestDB(t, time.Unix(1570000000, 0))
+	defer done()
+	var whs []webhook
+	for _, url := range []string{"https://a.example.com", "https://b.example.com"} {
+		wh, err := createWebhook(db, webhook{URL: url, Events: []string{}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		whs = append(whs, wh)
+	}
+	if err := enqueueWebhooks(db, webhookBody{Event: "entry-edit"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("UPDATE outbox SET status = ? WHERE oid = 1", outboxSent); err != nil {
+		t.Fatal(err)
+	}
+	if err := enqueueWebhooks(db, webhookBody{Event: "entry-edit"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if found, err := deleteWebhook(db, whs[0].WHID); err != nil || !found {
+		t.Fatalf("got %t, %v", found, err)
+	}
+	for _, c := range []struct {
+		status string
+		whid   whidT
+		want   int
+	}{{outboxSent, whs[0].WHID, 1}, {outboxPending, whs[0].WHID, 0}, {outboxPending, whs[1].WHID, 2}} {
+		n := countRows(t, db, `SELECT COUNT(*) FROM outbox WHERE status = ?1 AND payload LIKE '{"whid":' || ?2 || ',%'`,
+			c.status, c.whid)
+		if n != c.want {
+			t.Errorf("%d %s events of webhook %d, want %d", n, c.status, c.whid, c.want)
+		}
+	}
+	if found, err := deleteWebhook(db, whs[0].WHID); err != nil || found {
+		t.Errorf("deleting again got %t, %v", found, err)
+	}
+}
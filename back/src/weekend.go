@@ -0,0 +1,69 @@
+package main
+
+import (
+	"database/sql"
+	"os"
+	"time"
+
+	"github.com/palantir/stacktrace"
+)
+
+// weekendApproval is whether work on weekends needs an admin's approval, see weekendApprovalFromEnv.
+// Work on a weekend day that isn't approved still counts as worked, but not as overtime.
+var weekendApproval = false
+
+// weekendApprovalFromEnv reads WMS2_WEEKEND_APPROVAL, "true" to require approval of weekend work
+func weekendApprovalFromEnv() bool {
+	return os.Getenv("WMS2_WEEKEND_APPROVAL") == "true"
+}
+
+func isWeekend(date time.Time) bool {
+	return date.Weekday() == time.Saturday || date.Weekday() == time.Sunday
+}
+
+// weekendSet holds the weekend dates (like 2006-01-02) a user may work on
+type weekendSet map[string]bool
+
+func (ws weekendSet) has(date time.Time) bool {
+	return ws[date.Format(holidayDate)]
+}
+
+// getApprovedWeekends returns the approved weekend dates from the day of from up to the day of to, inclusive
+func getApprovedWeekends(db *sql.DB, uid uidT, from, to time.Time) (ws weekendSet, err error) {
+	rows, err := db.Query(
+		"SELECT date FROM weekend_approvals WHERE uid = ?1 AND date >= ?2 AND date <= ?3",
+		uid, from.Format(holidayDate), to.Format(holidayDate))
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed to get weekend approvals")
+	}
+	defer rows.Close()
+
+	ws = make(weekendSet)
+	for rows.Next() {
+		var date string
+		err = rows.Scan(&date)
+		if err != nil {
+			return nil, stacktrace.Propagate(err, "failed to scan row")
+		}
+		ws[date] = true
+	}
+	return ws, nil
+}
+
+// approveWeekend lets the user work on the weekend date, before or after the fact
+func approveWeekend(db *sql.DB, uid uidT, date time.Time, by uidT) (err error) {
+	_, err = db.Exec(
+		`INSERT OR IGNORE INTO weekend_approvals (uid, date, approved_by, approved_unix_s)
+			VALUES (?1, ?2, ?3, ?4)`,
+		uid, date.Format(holidayDate), by, clk.Now().Unix())
+	return stacktrace.Propagate(err, "failed to approve weekend")
+}
+
+func revokeWeekendApproval(db *sql.DB, uid uidT, date time.Time) (found bool, err error) {
+	res, err := db.Exec("DELETE FROM weekend_approvals WHERE uid = ?1 AND date = ?2", uid, date.Format(holidayDate))
+	if err != nil {
+		return false, stacktrace.Propagate(err, "failed to revoke weekend approval")
+	}
+	n, err := res.RowsAffected()
+	return n > 0, stacktrace.Propagate(err, "failed to get rows affected")
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/palantir/stacktrace"
+)
+
+type weeklySummary struct {
+	Email     string
+	From      time.Time
+	Days      []dayReport
+	Worked    int
+	Delta     int
+	Balance   int // monthly delta as of the last day of the summary
+	Flagged   int // invalid entries during the week
+	SiteNames map[stidT]string
+}
+
+var weeklySummaryTemplate = template.Must(template.New("weekly").Funcs(template.FuncMap{
+	"date":  func(unix int64) string { return time.Unix(unix, 0).Format("Mon Jan 2") },
+	"clock": func(unix int) string { return time.Unix(int64(unix), 0).Format("15:04") },
+	"hours": formatSeconds,
+	"sites": formatSites,
+}).Parse(`Hi {{.Email}},
+
+here's your week so far, starting {{date .From.Unix}}.
+{{range .Days}}
+{{date .Date}}: worked {{hours .Worked}}, delta {{hours .Delta}}
+{{- if gt (len .Sites) 1}} ({{sites .Sites $.SiteNames}}){{end}}
+{{- range .Entries}}
+    {{clock .From}} - {{clock .To}}{{if not .Valid}} (flagged, not clocked out){{end}}
+{{- end}}
+{{end}}
+Week total: {{hours .Worked}}, delta {{hours .Delta}}
+Balance for the month: {{hours .Balance}}
+{{- if .Flagged}}
+
+{{.Flagged}} of your entries this week were flagged because you didn't clock out.
+{{- end}}
+`))
+
+// formatSeconds formats a (possibly negative) number of seconds as e.g. "-1h05m"
+func formatSeconds(s int) string {
+	sign := ""
+	if s < 0 {
+		sign = "-"
+		s = -s
+	}
+	return fmt.Sprintf("%s%dh%02dm", sign, s/3600, s/60%60)
+}
+
+// formatSites formats the time worked per site as e.g. "Main 6h00m, Warehouse 2h00m"
+func formatSites(sites map[stidT]int, names map[stidT]string) string {
+	stids := []int{}
+	for stid := range sites {
+		stids = append(stids, int(stid))
+	}
+	sort.Ints(stids)
+
+	parts := []string{}
+	for _, stid := range stids {
+		parts = append(parts, names[stidT(stid)]+" "+formatSeconds(sites[stidT(stid)]))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// weekStart is the first day of the week for weekly summaries and the calendar, see weekStartFromEnv
+var weekStart = time.Monday
+
+// weekStartFromEnv reads WMS2_WEEK_START, the English name of a weekday like "sunday"
+func weekStartFromEnv() time.Weekday {
+	s := os.Getenv("WMS2_WEEK_START")
+	if s == "" {
+		return time.Monday
+	}
+	for d := time.Sunday; d <= time.Saturday; d++ {
+		if strings.EqualFold(s, d.String()) {
+			return d
+		}
+	}
+	logWarning(stacktrace.NewError("invalid WMS2_WEEK_START %q, using Monday", s))
+	return time.Monday
+}
+
+// startOfWeek is the start of the first day of the week of date, see weekStart
+func startOfWeek(date time.Time) time.Time {
+	offset := (int(date.Weekday()) - int(weekStart) + 7) % 7 // days since the start of the week
+	return time.Date(date.Year(), date.Month(), date.Day()-offset, 0, 0, 0, 0, date.Location())
+}
+
+// weeklySummaryDay is the day the weekly summaries go out, covering the week up to and including it
+const weeklySummaryDay = time.Friday
+
+// weeklySummaryHour is when on weeklySummaryDay they go out, in the server's time zone
+const weeklySummaryHour = 18
+
+// weeklySummaryDays is how many days of the week the summary covers, from weekStart to weeklySummaryDay
+func weeklySummaryDays() int {
+	return (int(weeklySummaryDay)-int(weekStart)+7)%7 + 1
+}
+
+// getWeeklySummary summarizes the given number of days starting on the day of from, in the user's time zone
+func getWeeklySummary(db *sql.DB, uid uidT, from time.Time, days int) (ws weeklySummary, err error) {
+	loc, err := userLocation(context.TODO(), db, uid)
+	if err != nil {
+		return ws, err
+	}
+	from = time.Date(from.Year(), from.Month(), from.Day(), 0, 0, 0, 0, loc)
+	ws.From = from
+	to := from.AddDate(0, 0, days)
+
+	ws.Email, err = uidToEmail(db, uid)
+	if err != nil {
+		return ws, stacktrace.Propagate(err, "failed to get email")
+	}
+
+	ws.Days, err = getDayReports(db, uid, from, days)
+	if err != nil {
+		return ws, err
+	}
+
+	for _, dr := range ws.Days {
+		ws.Worked += dr.Worked
+		ws.Delta += dr.Delta
+		for _, en := range dr.Entries {
+			if !en.Valid {
+				ws.Flagged++
+			}
+		}
+	}
+
+	sites, err := listSites(db)
+	if err != nil {
+		return ws, err
+	}
+	ws.SiteNames = make(map[stidT]string)
+	for _, s := range sites {
+		ws.SiteNames[s.STID] = s.Name
+	}
+
+	ws.Balance, err = getDeltaForMonth(context.TODO(), db, uid, to.AddDate(0, 0, -1), deltaToDate)
+	if err != nil {
+		return ws, stacktrace.Propagate(err, "failed to get monthly delta")
+	}
+
+	return ws, nil
+}
+
+// sendWeeklySummaries queues the summaries of the days of the week starting from for everyone who
+// hasn't opted out. It keeps going past failures for single users and returns the first,
+// affected is how many were queued.
+func sendWeeklySummaries(db *sql.DB, from time.Time, days int) (affected int, err error) {
+	rows, err := db.Query("SELECT uid FROM users WHERE weekly_summary = 1")
+	if err != nil {
+		return 0, stacktrace.Propagate(err, "failed to select users for weekly summary")
+	}
+
+	var failed error
+	fail := func(err error) {
+		logError(err)
+		if failed == nil {
+			failed = err
+		}
+	}
+
+	uids := []uidT{}
+	for rows.Next() {
+		var uid uidT
+		err = rows.Scan(&uid)
+		if err != nil {
+			fail(stacktrace.Propagate(err, "failed to scan row"))
+			continue
+		}
+		uids = append(uids, uid)
+	}
+
+	for _, uid := range uids {
+		ws, err := getWeeklySummary(db, uid, from, days)
+		if err != nil {
+			fail(stacktrace.Propagate(err, "failed to get weekly summary for "+strconv.Itoa(int(uid))))
+			continue
+		}
+
+		var body bytes.Buffer
+		err = weeklySummaryTemplate.Execute(&body, ws)
+		if err != nil {
+			fail(stacktrace.Propagate(err, "failed to render weekly summary"))
+			continue
+		}
+
+		err = enqueueEmail(db, ws.Email, "Your week starting "+from.Format("Jan 2"), body.String())
+		if err != nil {
+			fail(stacktrace.Propagate(err, "failed to queue weekly summary"))
+			continue
+		}
+		affected++
+	}
+	return affected, failed
+}
+
+// setWeeklySummary opts the user back in to the weekly summary or out of it
+func setWeeklySummary(db *sql.DB, uid uidT, enabled bool) (err error) {
+	_, err = db.Exec("UPDATE users SET weekly_summary = ?1 WHERE uid = ?2", enabled, uid)
+	return stacktrace.Propagate(err, "failed to update weekly summary setting")
+}
+
+// weeklySummarizer mails the summary of the week so far on the evening of weeklySummaryDay,
+// after most people have clocked out for the weekend
+func weeklySummarizer(db *sql.DB) {
+	for {
+		now := time.Now()
+		from := startOfWeek(now)
+		days := weeklySummaryDays()
+		next := from.AddDate(0, 0, days-1).Add(weeklySummaryHour * time.Hour)
+		if !next.After(now) {
+			from = from.AddDate(0, 0, 7)
+			next = next.AddDate(0, 0, 7)
+		}
+		if !jobSleep(time.Until(next)) {
+			return
+		}
+		err := runJob(db, jobWeeklySummaries, func() (int, error) {
+			return sendWeeklySummaries(db, from, days)
+		})
+		if err != nil {
+			logError(err, "job", jobWeeklySummaries)
+		}
+	}
+}
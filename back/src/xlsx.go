@@ -0,0 +1,205 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/palantir/stacktrace"
+)
+
+// A minimal .xlsx (Office Open XML) writer, just enough for reports: sheets of strings and numbers,
+// bold cells and column widths. It writes the parts of the zip package by hand so that it needs
+// nothing beyond the standard library.
+
+type xlsxCell struct {
+	Value interface{} // string, int or float64, nil for an empty cell
+	Bold  bool
+}
+
+type xlsxSheet struct {
+	Name   string
+	Widths []float64 // in characters, the defaults for columns past the end
+	Rows   [][]xlsxCell
+}
+
+// cell styles, the indices of cellXfs in xlsxStyles
+const (
+	xlsxPlain = iota
+	xlsxBold
+	xlsxNumber
+	xlsxBoldNumber
+)
+
+const xlsxStyles = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<styleSheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main">
+<fonts count="2"><font><sz val="11"/><name val="Calibri"/></font><font><b/><sz val="11"/><name val="Calibri"/></font></fonts>
+<fills count="2"><fill><patternFill patternType="none"/></fill><fill><patternFill patternType="gray125"/></fill></fills>
+<borders count="1"><border><left/><right/><top/><bottom/><diagonal/></border></borders>
+<cellStyleXfs count="1"><xf numFmtId="0" fontId="0" fillId="0" borderId="0"/></cellStyleXfs>
+<cellXfs count="4">
+<xf numFmtId="0" fontId="0" fillId="0" borderId="0" xfId="0"/>
+<xf numFmtId="0" fontId="1" fillId="0" borderId="0" xfId="0" applyFont="1"/>
+<xf numFmtId="2" fontId="0" fillId="0" borderId="0" xfId="0" applyNumberFormat="1"/>
+<xf numFmtId="2" fontId="1" fillId="0" borderId="0" xfId="0" applyFont="1" applyNumberFormat="1"/>
+</cellXfs>
+</styleSheet>`
+
+// xlsxColumn is the letter(s) of the zero-based column, like A or AB
+func xlsxColumn(i int) string {
+	name := ""
+	for i++; i > 0; i = (i - 1) / 26 {
+		name = string(rune('A'+(i-1)%26)) + name
+	}
+	return name
+}
+
+// xlsxSheetNames makes the names valid sheet names: at most 31 characters, none of []:*?/\ and unique
+func xlsxSheetNames(names []string) []string {
+	clean := strings.NewReplacer("[", "(", "]", ")", ":", "_", "*", "_", "?", "_", "/", "_", `\`, "_")
+	seen := map[string]bool{}
+	valid := make([]string, len(names))
+	for i, name := range names {
+		name = clean.Replace(name)
+		if name == "" {
+			name = "Sheet"
+		}
+		base := []rune(name)
+		if len(base) > 31 {
+			base = base[:31]
+		}
+		name = string(base)
+		for n := 2; seen[strings.ToLower(name)]; n++ {
+			suffix := fmt.Sprintf(" (%d)", n)
+			if len(base)+len(suffix) > 31 {
+				base = base[:31-len(suffix)]
+			}
+			name = string(base) + suffix
+		}
+		seen[strings.ToLower(name)] = true
+		valid[i] = name
+	}
+	return valid
+}
+
+func xmlEscape(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+func writeXLSXSheet(w io.Writer, sh xlsxSheet) (err error) {
+	var b strings.Builder
+	b.WriteString(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>` + "\n")
+	b.WriteString(`<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main">`)
+	if len(sh.Widths) > 0 {
+		b.WriteString("<cols>")
+		for i, width := range sh.Widths {
+			fmt.Fprintf(&b, `<col min="%d" max="%d" width="%g" customWidth="1"/>`, i+1, i+1, width)
+		}
+		b.WriteString("</cols>")
+	}
+	b.WriteString("<sheetData>")
+	for r, row := range sh.Rows {
+		fmt.Fprintf(&b, `<row r="%d">`, r+1)
+		for c, cell := range row {
+			ref := xlsxColumn(c) + strconv.Itoa(r+1)
+			style := xlsxPlain
+			if cell.Bold {
+				style = xlsxBold
+			}
+			switch v := cell.Value.(type) {
+			case nil:
+			case string:
+				fmt.Fprintf(&b, `<c r="%s" s="%d" t="inlineStr"><is><t xml:space="preserve">%s</t></is></c>`,
+					ref, style, xmlEscape(v))
+			case int:
+				fmt.Fprintf(&b, `<c r="%s" s="%d"><v>%d</v></c>`, ref, style, v)
+			case float64:
+				fmt.Fprintf(&b, `<c r="%s" s="%d"><v>%s</v></c>`, ref, style+xlsxNumber,
+					strconv.FormatFloat(v, 'f', -1, 64))
+			default:
+				return stacktrace.NewError("unsupported cell value %T", v)
+			}
+		}
+		b.WriteString("</row>")
+	}
+	b.WriteString("</sheetData></worksheet>")
+	_, err = io.WriteString(w, b.String())
+	return err
+}
+
+// writeXLSX writes a workbook with the sheets, which need at least one
+func writeXLSX(w io.Writer, sheets []xlsxSheet) (err error) {
+	if len(sheets) == 0 {
+		return stacktrace.NewError("a workbook needs a sheet")
+	}
+	names := []string{}
+	for _, sh := range sheets {
+		names = append(names, sh.Name)
+	}
+	names = xlsxSheetNames(names)
+
+	var types, workbook, rels strings.Builder
+	types.WriteString(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">
+<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>
+<Default Extension="xml" ContentType="application/xml"/>
+<Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/>
+<Override PartName="/xl/styles.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.styles+xml"/>`)
+	workbook.WriteString(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" ` +
+		`xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships"><sheets>`)
+	rels.WriteString(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">`)
+	for i := range sheets {
+		n := i + 1
+		fmt.Fprintf(&types, `<Override PartName="/xl/worksheets/sheet%d.xml" `+
+			`ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/>`, n)
+		fmt.Fprintf(&workbook, `<sheet name="%s" sheetId="%d" r:id="rId%d"/>`, xmlEscape(names[i]), n, n)
+		fmt.Fprintf(&rels, `<Relationship Id="rId%d" `+
+			`Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" `+
+			`Target="worksheets/sheet%d.xml"/>`, n, n)
+	}
+	types.WriteString("</Types>")
+	workbook.WriteString("</sheets></workbook>")
+	fmt.Fprintf(&rels, `<Relationship Id="rId%d" `+
+		`Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/styles" Target="styles.xml"/>`,
+		len(sheets)+1)
+	rels.WriteString("</Relationships>")
+
+	zw := zip.NewWriter(w)
+	parts := []struct{ name, content string }{
+		{"[Content_Types].xml", types.String()},
+		{"_rels/.rels", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+			`<Relationship Id="rId1" ` +
+			`Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" ` +
+			`Target="xl/workbook.xml"/></Relationships>`},
+		{"xl/workbook.xml", workbook.String()},
+		{"xl/_rels/workbook.xml.rels", rels.String()},
+		{"xl/styles.xml", xlsxStyles},
+	}
+	for _, p := range parts {
+		f, err := zw.Create(p.name)
+		if err != nil {
+			return stacktrace.Propagate(err, "failed to add "+p.name)
+		}
+		if _, err = io.WriteString(f, p.content); err != nil {
+			return stacktrace.Propagate(err, "failed to write "+p.name)
+		}
+	}
+	for i, sh := range sheets {
+		f, err := zw.Create(fmt.Sprintf("xl/worksheets/sheet%d.xml", i+1))
+		if err != nil {
+			return stacktrace.Propagate(err, "failed to add sheet")
+		}
+		if err = writeXLSXSheet(f, sh); err != nil {
+			return stacktrace.Propagate(err, "failed to write sheet")
+		}
+	}
+	return stacktrace.Propagate(zw.Close(), "failed to finish workbook")
+}
@@ -18,8 +18,19 @@ let cachedStatus = null;
 let cachedExpiry = 0;
 
 module.exports = {
-  async list() {
-    return req("/u/entries");
+  // from and to are optional Dates, the server defaults to the last few months
+  async list(from, to) {
+    const params = [];
+    if (from) {
+      params.push("from=" + Math.floor(from.getTime() / 1000));
+    }
+    if (to) {
+      params.push("to=" + Math.floor(to.getTime() / 1000));
+    }
+    return req("/u/entries" + (params.length ? "?" + params.join("&") : ""));
+  },
+  async listMonth(year, month) {
+    return this.list(new Date(year, month - 1, 1), new Date(year, month, 1));
   },
   getStatus() {
     if (cachedExpiry < Date.now()) {
@@ -40,6 +51,14 @@ module.exports = {
   async clockOut() {
     await req("/u/clock/out", "PUT");
     cachedExpiry = 0;
+  },
+  async breakStart() {
+    await req("/u/break/start", "PUT");
+    cachedExpiry = 0;
+  },
+  async breakEnd() {
+    await req("/u/break/end", "PUT");
+    cachedExpiry = 0;
   }
 };
 
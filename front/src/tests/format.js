@@ -24,10 +24,14 @@ tap.test("duration", test => {
 tap.test("entryList", test => {
   test.same(
     format.entryList({
-      "1571004000": [
-        { id: 105, from: 1571043673, to: 1571043674, valid: true },
-        { id: 106, from: 1571043678, to: 1571044420, valid: true }
-      ]
+      "1571004000": {
+        weekend: false,
+        expected: 28800,
+        entries: [
+          { id: 105, from: 1571043673, to: 1571043674, valid: true },
+          { id: 106, from: 1571043678, to: 1571044420, valid: true }
+        ]
+      }
     }),
     [
       {
@@ -45,10 +49,14 @@ tap.test("entryList", test => {
   );
   test.same(
     format.entryList({
-      "1571004000": [
-        { id: 105, from: 1571043673, to: 1571043674, valid: true },
-        { id: 106, from: 1571043678, to: 1571044420, valid: false }
-      ]
+      "1571004000": {
+        weekend: false,
+        expected: 28800,
+        entries: [
+          { id: 105, from: 1571043673, to: 1571043674, valid: true },
+          { id: 106, from: 1571043678, to: 1571044420, valid: false }
+        ]
+      }
     }),
     [
       {
@@ -66,9 +74,13 @@ tap.test("entryList", test => {
   );
   test.same(
     format.entryList({
-      "1571004000": [
-        { id: 105, from: 1571043673, to: 1571043674, valid: false }
-      ]
+      "1571004000": {
+        weekend: false,
+        expected: 28800,
+        entries: [
+          { id: 105, from: 1571043673, to: 1571043674, valid: false }
+        ]
+      }
     }),
     [
       {
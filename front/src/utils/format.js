@@ -25,7 +25,7 @@ function ms(x) {
 
 function entryList(l) {
   const ll = [];
-  for (const [day, ens] of Object.entries(l)) {
+  for (const [day, { entries: ens }] of Object.entries(l)) {
     const x = {};
     x.date = date(ms(day));
 
@@ -104,6 +104,14 @@ const statusClock = () => {
                   m("b", format.duration(Date.now() - status.since * 1000)),
                   m("span", ".")
                 ]
+              : statusState === "B"
+              ? [
+                  m("span", "You've been "),
+                  m("b", "on a break"),
+                  m("span", " for "),
+                  m("b", format.duration(Date.now() - status.since * 1000)),
+                  m("span", ".")
+                ]
               : [
                   m("span", "You're currently "),
                   m("b", "clocked out"),
@@ -157,7 +165,19 @@ const statusClock = () => {
       m(
         "button.btn",
         {
-          disabled: statusState !== "I",
+          disabled: statusState !== "I" && statusState !== "B",
+          onclick: e =>
+            (statusState === "B"
+              ? entries.breakEnd()
+              : entries.breakStart()
+            ).then(refresh)
+        },
+        statusState === "B" ? "End break" : "Break"
+      ),
+      m(
+        "button.btn",
+        {
+          disabled: statusState !== "I" && statusState !== "B",
           class: statusState === "I" ? "btn-primary" : "",
           onclick: e => entries.clockOut().then(refresh)
         },